@@ -19,6 +19,7 @@ import (
 	"server/internal/logger"
 	"server/internal/middleware"
 	storepkg "server/internal/store"
+	"server/internal/tenant"
 	"server/internal/web"
 	"server/internal/websocket"
 
@@ -44,6 +45,11 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Schema migrations run as a separate command: server migrate up|down|status|force
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(cfg, os.Args[2:]))
+	}
+
 	// Initialize logger
 	logger, err := logger.New(cfg.LogLevel)
 	if err != nil {
@@ -64,9 +70,9 @@ func main() {
 		_ = dataStore.Close()
 	}()
 
-	// Run database migrations
-	if err := dataStore.AutoMigrate(); err != nil {
-		logger.Fatal("Failed to run database migrations", zap.Error(err))
+	// Bring the schema up to date; a schema from a newer binary is never touched
+	if err := migrateOnStart(context.Background(), dataStore, cfg.MigrateOnStart, logger); err != nil {
+		logger.Fatal("Database schema is not usable", zap.Error(err))
 	}
 
 	// Test database connection
@@ -75,17 +81,29 @@ func main() {
 	}
 	logger.Info("Database connected successfully")
 
+	// Request handlers bind services to the request's tenant scope with WithContext; work
+	// that serves every organization, such as the MQTT broker, login provisioning and
+	// background jobs, opts out of tenant scoping with systemCtx
+	systemCtx := tenant.Bypass(context.Background())
+
 	// Initialize services
-	orgService := services.NewOrganizationService(dataStore.DB())
 	projectService := services.NewProjectService(dataStore.DB())
 	deviceService := services.NewDeviceService(dataStore.DB())
+	partitionService := services.NewPartitionService(dataStore.DB())
 	// settings & audit services
 	settingService := services.NewSettingServiceWithRepos(
 		storepkg.NewOrganizationSettingRepository(dataStore.DB()),
 		storepkg.NewSystemSettingRepository(dataStore.DB()),
-		storepkg.NewAuditLogRepository(dataStore.DB()),
 	)
-	auditService := services.NewAuditService(storepkg.NewAuditLogRepository(dataStore.DB()))
+	retentionService := services.NewAuditRetentionService(dataStore.DB(), settingService, cfg.AuditRetentionInterval, cfg.AuditPurgeBatchSize)
+	auditService := services.NewAuditService(storepkg.NewAuditLogRepository(dataStore.DB()), logger)
+	// Write audit records in the background; the queue is drained on shutdown
+	auditCtx, auditCancel := context.WithCancel(context.Background())
+	auditDone := make(chan struct{})
+	go func() {
+		defer close(auditDone)
+		auditService.Run(auditCtx)
+	}()
 
 	// Initialize Casdoor client
 	casdoorClient, err := casdoor.New(cfg)
@@ -104,9 +122,15 @@ func main() {
 	if err := enforcer.InitDefaultPolicies(); err != nil {
 		logger.Warn("Failed to initialize default policies", zap.Error(err))
 	}
+	orgService := services.NewOrganizationService(dataStore.DB(), enforcer)
+	transferService := services.NewDeviceTransferService(dataStore.DB(), enforcer, logger)
+	shareService := services.NewDeviceShareService(dataStore.DB(), enforcer, logger)
+	bindingService := services.NewDeviceBindingService(dataStore.DB(), enforcer, logger)
+	directoryService := services.NewDirectoryService(dataStore.DB(), casdoorClient)
 
 	// Initialize auth middleware
-	authMiddleware := auth.New(casdoorClient, enforcer, orgService, logger)
+	provisioningService := services.NewProvisioningService(dataStore.DB().WithContext(systemCtx), cfg.AutoProvisionOrgs)
+	authMiddleware := auth.New(casdoorClient, enforcer, provisioningService, services.NewOrgSessionService(dataStore.DB().WithContext(systemCtx)), logger)
 
 	// Initialize web handler for Flutter web app integration
 	webConfig := &web.Config{
@@ -117,14 +141,67 @@ func main() {
 	webHandler := web.NewHandler(webConfig)
 
 	// Initialize API handlers
-	deviceHandler := api.NewDeviceHandler(deviceService, orgService, enforcer, logger)
-	projectHandler := api.NewProjectHandler(projectService, orgService, enforcer, logger)
-	permissionHandler := api.NewPermissionHandler(orgService, enforcer, logger)
+	projectHandler := api.NewProjectHandler(projectService, orgService, auditService, enforcer, logger)
+	partitionHandler := api.NewPartitionHandler(partitionService, auditService, enforcer, logger)
+	transferHandler := api.NewTransferHandler(transferService, deviceService, enforcer, logger)
+	shareHandler := api.NewShareHandler(shareService, deviceService, enforcer, logger)
+	bindingHandler := api.NewBindingHandler(bindingService, deviceService, enforcer, logger)
+	permissionHandler := api.NewPermissionHandler(orgService, auditService, enforcer, logger)
 	authHandler := api.NewAuthHandler(authMiddleware, casdoorClient)
-	adminSettingsHandler := api.NewAdminSettingsHandler(settingService, enforcer, logger)
+	adminSettingsHandler := api.NewAdminSettingsHandler(settingService, retentionService, auditService, enforcer, logger)
+	directoryHandler := api.NewDirectoryHandler(directoryService, logger)
+	organizationHandler := api.NewOrganizationHandler(orgService, casdoorClient, auditService, logger)
+
+	// Sync users and groups from Casdoor in the background
+	if cfg.CasdoorSyncInterval > 0 {
+		syncCtx, syncCancel := context.WithCancel(context.Background())
+		defer syncCancel()
+		go func() {
+			ticker := time.NewTicker(cfg.CasdoorSyncInterval)
+			defer ticker.Stop()
+			for {
+				if _, err := directoryService.WithContext(tenant.Bypass(syncCtx)).SyncAll(syncCtx, services.SyncTriggerScheduled); err != nil && syncCtx.Err() == nil {
+					logger.Warn("Directory sync failed", zap.Error(err))
+				}
+				select {
+				case <-syncCtx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+		logger.Info("Directory sync scheduled", zap.Duration("interval", cfg.CasdoorSyncInterval))
+	}
+
+	// Enforce audit retention in the background
+	if cfg.AuditRetentionInterval > 0 {
+		retentionCtx, retentionCancel := context.WithCancel(context.Background())
+		defer retentionCancel()
+		go func() {
+			timer := time.NewTimer(retentionService.NextRunDelay())
+			defer timer.Stop()
+			for {
+				select {
+				case <-retentionCtx.Done():
+					return
+				case <-timer.C:
+				}
+				run, err := retentionService.Enforce(tenant.Bypass(retentionCtx), services.RetentionTriggerScheduled, 0)
+				if err != nil && retentionCtx.Err() == nil {
+					logger.Warn("Audit retention failed", zap.Error(err))
+				} else if run != nil {
+					logger.Info("Audit retention enforced",
+						zap.Int64("rows_purged", run.RowsPurged),
+						zap.Int64("duration_ms", run.DurationMs))
+				}
+				timer.Reset(cfg.AuditRetentionInterval)
+			}
+		}()
+		logger.Info("Audit retention scheduled", zap.Duration("interval", cfg.AuditRetentionInterval))
+	}
 
 	// Initialize MQTT broker
-	mqttBroker := broker.NewMQTTBroker(cfg, deviceService, auditService, logger)
+	mqttBroker := broker.NewMQTTBroker(cfg, deviceService.WithContext(systemCtx), auditService, logger)
 
 	// Start MQTT broker in background
 	mqttCtx, mqttCancel := context.WithCancel(context.Background())
@@ -154,6 +231,9 @@ func main() {
 			zap.Int("max_conn_per_user", cfg.WSMaxConnPerUser))
 	}
 
+	deviceHandler := api.NewDeviceHandler(deviceService, bindingService, orgService, mqttBroker, wsHub, auditService, enforcer, logger)
+	auditHandler := api.NewAuditHandler(auditService, deviceService, enforcer, logger)
+
 	// Set gin mode
 	if cfg.Env == "production" {
 		gin.SetMode(gin.ReleaseMode)
@@ -161,6 +241,8 @@ func main() {
 
 	// Create router
 	router := gin.New()
+	// Handlers pass *gin.Context as a context.Context; let it carry the request's tenant scope
+	router.ContextWithFallback = true
 	router.Use(gin.Recovery())
 
 	// Add security middleware (M7)
@@ -227,33 +309,17 @@ func main() {
 			})
 		})
 
-		// Organizations (public for testing)
-		v1.GET("/organizations", func(c *gin.Context) {
-			orgs, err := orgService.ListOrganizations()
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-			c.JSON(http.StatusOK, orgs)
-		})
-
-		v1.POST("/organizations", func(c *gin.Context) {
-			var req struct {
-				CasdoorOrg string `json:"casdoor_org" binding:"required"`
-				Name       string `json:"name" binding:"required"`
-			}
-			if err := c.ShouldBindJSON(&req); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
-
-			org, err := orgService.CreateOrganization(req.CasdoorOrg, req.Name)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-			c.JSON(http.StatusCreated, org)
-		})
+		// Organizations, managed by super users only
+		organizations := v1.Group("/organizations")
+		organizations.Use(authMiddleware.AuthRequired(), authMiddleware.RequireSuperUser())
+		{
+			organizations.GET("", organizationHandler.ListOrganizations)
+			organizations.POST("", organizationHandler.CreateOrganization)
+			organizations.POST("/import", organizationHandler.ImportOrganizations)
+			organizations.GET("/:id", organizationHandler.GetOrganization)
+			organizations.PUT("/:id", organizationHandler.UpdateOrganization)
+			organizations.DELETE("/:id", organizationHandler.DeleteOrganization)
+		}
 
 		// Protected endpoints requiring authentication
 		protected := v1.Group("/protected")
@@ -291,7 +357,7 @@ func main() {
 					filters["status"] = status
 				}
 
-				devices, err := deviceService.ListDevicesByOrganization(orgUUID, filters)
+				devices, err := deviceService.WithContext(c.Request.Context()).ListDevicesByOrganization(orgUUID, filters)
 				if err != nil {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 					return
@@ -315,6 +381,10 @@ func main() {
 			admin.GET("/audit/retention-days", adminSettingsHandler.GetAuditRetention)
 			admin.PUT("/audit/retention-days", adminSettingsHandler.SetAuditRetention)
 			admin.POST("/audit/purge", adminSettingsHandler.PurgeAudit)
+			admin.GET("/audit/retention/status", adminSettingsHandler.GetAuditRetentionStatus)
+			// Casdoor directory sync
+			admin.GET("/directory/sync", directoryHandler.ListSyncRuns)
+			admin.POST("/directory/sync", directoryHandler.SyncDirectory)
 		}
 
 		// WebSocket endpoint (if enabled)
@@ -344,18 +414,73 @@ func main() {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
+			var targetID *uuid.UUID
+			if device, err := deviceService.WithContext(c.Request.Context()).GetDeviceByIdentifier(req.DeviceID, services.IdentifierType(req.DeviceID)); err == nil {
+				targetID = &device.ID
+			}
+			user := auth.GetUserContext(c)
+			auditService.Record(services.Actor{UserID: user.LocalUserID, IP: c.ClientIP(), UserAgent: c.Request.UserAgent()},
+				services.AuditActionMQTTKick, "device", targetID, gin.H{"device_id": req.DeviceID})
 			c.JSON(http.StatusOK, gin.H{"status": "kicked"})
 		})
 
 		// Device API endpoints (M4)
 		devices := v1.Group("/devices")
 		devices.Use(authMiddleware.AuthRequired())
+		// Claim attempts per user, on top of the lockout of a user from a device after repeated
+		// wrong codes
+		claimLimit := middleware.KeyedRateLimitMiddleware(6*time.Second, 10, func(c *gin.Context) string {
+			return auth.GetUserContext(c).UserID
+		})
 		{
 			devices.GET("", deviceHandler.ListDevices)
+			devices.GET("/export", deviceHandler.ExportDevices)
 			devices.POST("", deviceHandler.CreateDevice)
+			devices.POST("/bind", bindingHandler.BindDevice)
+			devices.POST("/claim", claimLimit, bindingHandler.ClaimDevice)
+			devices.POST("/import", deviceHandler.ImportDevices)
 			devices.GET("/:id", deviceHandler.GetDevice)
 			devices.PATCH("/:id", deviceHandler.UpdateDevice)
 			devices.DELETE("/:id", deviceHandler.DeleteDevice)
+			devices.GET("/:id/binding", bindingHandler.GetBinding)
+			devices.POST("/:id/claim-code", deviceHandler.SetClaimCode)
+			devices.POST("/:id/credentials/rotate", deviceHandler.RotateCredentials)
+			devices.POST("/:id/transfer", transferHandler.CreateTransfer)
+			devices.GET("/:id/share", shareHandler.ListShares)
+			devices.POST("/:id/share", shareHandler.ShareDevice)
+			devices.DELETE("/:id/share/:share_id", shareHandler.UnshareDevice)
+			devices.GET("/:id/history", auditHandler.DeviceHistory)
+		}
+
+		// Audit log query and export, scoped to the caller's organization
+		audit := v1.Group("/audit")
+		audit.Use(authMiddleware.AuthRequired())
+		{
+			audit.GET("", auditHandler.ListAudit)
+			audit.GET("/export", auditHandler.ExportAudit)
+		}
+
+		// Device transfer endpoints
+		transfers := v1.Group("/transfers")
+		transfers.Use(authMiddleware.AuthRequired())
+		{
+			transfers.GET("", transferHandler.ListTransfers)
+			transfers.GET("/:id", transferHandler.GetTransfer)
+			transfers.POST("/:id/approve", transferHandler.ApproveTransfer)
+			transfers.POST("/:id/reject", transferHandler.RejectTransfer)
+			transfers.POST("/:id/cancel", transferHandler.CancelTransfer)
+		}
+
+		// User and group directory endpoints, scoped to the caller's organization
+		users := v1.Group("/users")
+		users.Use(authMiddleware.AuthRequired(), authMiddleware.RequirePermission("users", "read"))
+		{
+			users.GET("", directoryHandler.ListUsers)
+		}
+		groups := v1.Group("/groups")
+		groups.Use(authMiddleware.AuthRequired(), authMiddleware.RequirePermission("groups", "read"))
+		{
+			groups.GET("", directoryHandler.ListGroups)
 		}
 
 		// Project API endpoints (M4)
@@ -367,6 +492,17 @@ func main() {
 			projects.GET("/:id", projectHandler.GetProject)
 			projects.PATCH("/:id", projectHandler.UpdateProject)
 			projects.DELETE("/:id", projectHandler.DeleteProject)
+			projects.GET("/:id/partitions/tree", partitionHandler.GetPartitionTree)
+		}
+
+		// Partition API endpoints (M4)
+		partitions := v1.Group("/partitions")
+		partitions.Use(authMiddleware.AuthRequired())
+		{
+			partitions.POST("", partitionHandler.CreatePartition)
+			partitions.GET("/:id", partitionHandler.GetPartition)
+			partitions.PATCH("/:id", partitionHandler.UpdatePartition)
+			partitions.DELETE("/:id", partitionHandler.DeletePartition)
 		}
 
 		// Permission API endpoints (M5)
@@ -414,5 +550,9 @@ func main() {
 		logger.Fatal("Server forced to shutdown", zap.Error(err))
 	}
 
+	// Write the audit records still queued
+	auditCancel()
+	<-auditDone
+
 	logger.Info("Server exited")
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"server/internal/config"
+	storepkg "server/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const migrateUsage = `usage: server migrate <command>
+
+commands:
+  up [n]           apply all pending migrations, or the next n
+  down <n>         revert the last n migrations
+  status           show the schema version and pending migrations
+  force <version>  record version as current and clear the dirty flag, without running anything`
+
+// runMigrate runs a migrate subcommand and returns the process exit code
+func runMigrate(cfg *config.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	count := func() (int, error) {
+		if len(args) < 2 {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid count %q", args[1])
+		}
+		return n, nil
+	}
+
+	dataStore, err := storepkg.New(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer func() {
+		_ = dataStore.Close()
+	}()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up", "down":
+		n, err := count()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		var versions []uint64
+		if args[0] == "up" {
+			versions, err = dataStore.MigrateUp(ctx, n)
+		} else {
+			if n == 0 {
+				fmt.Fprintln(os.Stderr, "down needs the number of migrations to revert")
+				return 2
+			}
+			versions, err = dataStore.MigrateDown(ctx, n)
+		}
+		for _, v := range versions {
+			fmt.Printf("%s %d\n", args[0], v)
+		}
+		if errors.Is(err, storepkg.ErrNoChange) {
+			fmt.Println("no change")
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "status":
+		status, err := dataStore.MigrationStatus(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("dialect: %s\nversion: %d\ndirty:   %t\nlatest:  %d\n", status.Dialect, status.Version, status.Dirty, status.Latest)
+		for _, m := range status.Pending {
+			fmt.Printf("pending: %06d_%s\n", m.Version, m.Name)
+		}
+		if status.Version > status.Latest {
+			fmt.Println("database schema is newer than this binary")
+		}
+	case "force":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "force needs a version")
+			return 2
+		}
+		version, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid version %q\n", args[1])
+			return 2
+		}
+		if err := dataStore.ForceVersion(ctx, version); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("forced version %d\n", version)
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
+
+// migrateOnStart refuses a schema that is ahead of the binary or dirty, then applies
+// pending migrations when apply is set, or refuses to start when it is not
+func migrateOnStart(ctx context.Context, dataStore *storepkg.Store, apply bool, logger *zap.Logger) error {
+	status, err := dataStore.CheckSchema(ctx)
+	if err != nil {
+		return err
+	}
+	if len(status.Pending) == 0 {
+		logger.Info("Database schema is up to date", zap.Uint64("version", status.Version))
+		return nil
+	}
+	if !apply {
+		return fmt.Errorf("%d pending migrations; run `server migrate up`", len(status.Pending))
+	}
+
+	applied, err := dataStore.MigrateUp(ctx, 0)
+	if err != nil && !errors.Is(err, storepkg.ErrNoChange) {
+		return err
+	}
+	logger.Info("Applied database migrations",
+		zap.Uint64("from", status.Version), zap.Uint64s("versions", applied))
+	return nil
+}
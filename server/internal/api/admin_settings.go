@@ -15,13 +15,15 @@ import (
 
 // AdminSettingsHandler exposes org settings & audit config APIs
 type AdminSettingsHandler struct {
-	settings *services.SettingService
-	enforcer *casbinx.Enforcer
-	logger   *zap.Logger
+	settings  *services.SettingService
+	retention *services.AuditRetentionService
+	audit     *services.AuditService
+	enforcer  *casbinx.Enforcer
+	logger    *zap.Logger
 }
 
-func NewAdminSettingsHandler(settings *services.SettingService, enforcer *casbinx.Enforcer, logger *zap.Logger) *AdminSettingsHandler {
-	return &AdminSettingsHandler{settings: settings, enforcer: enforcer, logger: logger.With(zap.String("component", "admin_settings_handler"))}
+func NewAdminSettingsHandler(settings *services.SettingService, retention *services.AuditRetentionService, audit *services.AuditService, enforcer *casbinx.Enforcer, logger *zap.Logger) *AdminSettingsHandler {
+	return &AdminSettingsHandler{settings: settings, retention: retention, audit: audit, enforcer: enforcer, logger: logger.With(zap.String("component", "admin_settings_handler"))}
 }
 
 // GET /api/v1/admin/orgs/:id/settings
@@ -77,7 +79,9 @@ func (h *AdminSettingsHandler) UpdateOrgSettings(c *gin.Context) {
 		return
 	}
 
-	var req services.OrgSettings
+	// Fields left out keep their current value
+	before, _ := h.settings.GetOrgSettings(c, orgID)
+	req := *before
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -87,6 +91,8 @@ func (h *AdminSettingsHandler) UpdateOrgSettings(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
 		return
 	}
+	recordAudit(c, h.audit, user, services.AuditActionOrgSettingsUpdate, "organization", &orgID,
+		services.AuditChanges(services.AuditSnapshot(before), services.AuditSnapshot(req)))
 	c.JSON(http.StatusOK, gin.H{"message": "updated"})
 }
 
@@ -127,10 +133,13 @@ func (h *AdminSettingsHandler) SetAuditRetention(c *gin.Context) {
 	if payload.RetentionDays < 1 {
 		payload.RetentionDays = 1
 	}
+	before, _ := h.settings.GetAuditRetentionDays(c)
 	if err := h.settings.SetAuditRetentionDays(c, payload.RetentionDays); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention"})
 		return
 	}
+	recordAudit(c, h.audit, user, services.AuditActionAuditRetentionUpdate, "system_setting", nil,
+		services.AuditChanges(map[string]interface{}{"retention_days": before}, map[string]interface{}{"retention_days": payload.RetentionDays}))
 	c.JSON(http.StatusOK, gin.H{"message": "updated"})
 }
 
@@ -146,10 +155,40 @@ func (h *AdminSettingsHandler) PurgeAudit(c *gin.Context) {
 		return
 	}
 	days, _ := strconv.Atoi(c.DefaultQuery("days", "0"))
-	n, err := h.settings.PurgeAudit(c, days)
+	run, err := h.retention.Enforce(c.Request.Context(), services.RetentionTriggerManual, days)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge"})
+		if run == nil {
+			respondError(c, h.logger, err, "Failed to purge")
+			return
+		}
+		h.logger.Error("Audit purge failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge", "run": run})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"purged": n})
+	recordAudit(c, h.audit, user, services.AuditActionAuditPurge, "audit_log", nil,
+		gin.H{"retention_days": run.RetentionDays, "purged": run.RowsPurged})
+	c.JSON(http.StatusOK, gin.H{"purged": run.RowsPurged, "run": run})
+}
+
+// GET /api/v1/admin/audit/retention/status?limit=10
+func (h *AdminSettingsHandler) GetAuditRetentionStatus(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	if !user.IsSuperUser {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if limit < 1 || limit > 100 {
+		limit = 10
+	}
+	status, err := h.retention.Status(c.Request.Context(), limit)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get retention status")
+		return
+	}
+	c.JSON(http.StatusOK, status)
 }
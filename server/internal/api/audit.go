@@ -0,0 +1,210 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"server/internal/auth"
+	"server/internal/casbinx"
+	"server/internal/domain/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// AuditHandler handles audit log query, export and resource history endpoints
+type AuditHandler struct {
+	auditService  *services.AuditService
+	deviceService *services.DeviceService
+	enforcer      *casbinx.Enforcer
+	logger        *zap.Logger
+}
+
+// NewAuditHandler creates a new audit handler
+func NewAuditHandler(auditService *services.AuditService, deviceService *services.DeviceService, enforcer *casbinx.Enforcer, logger *zap.Logger) *AuditHandler {
+	return &AuditHandler{
+		auditService:  auditService,
+		deviceService: deviceService,
+		enforcer:      enforcer,
+		logger:        logger.With(zap.String("component", "audit_handler")),
+	}
+}
+
+// ListAudit lists audit records, newest first. Super users see every organization unless
+// org_id is given; everyone else only sees their own organization.
+// GET /api/v1/audit?org_id=&actor=&action=&target_type=&target_id=&from=&to=&page=&page_size=
+func (h *AuditHandler) ListAudit(c *gin.Context) {
+	q, ok := h.auditQuery(c)
+	if !ok {
+		return
+	}
+	page, pageSize := auditPagination(c)
+
+	logs, total, err := h.auditService.ListLogs(c.Request.Context(), q, page, pageSize)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to list audit logs")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"logs": logs,
+		"pagination": gin.H{
+			"page":      page,
+			"page_size": pageSize,
+			"total":     total,
+		},
+	})
+}
+
+// ExportAudit streams every matching audit record, oldest first, as CSV or NDJSON. It takes
+// the same filters as ListAudit.
+// GET /api/v1/audit/export?format=csv|ndjson&...
+func (h *AuditHandler) ExportAudit(c *gin.Context) {
+	q, ok := h.auditQuery(c)
+	if !ok {
+		return
+	}
+	format := c.DefaultQuery("format", services.AuditExportCSV)
+	if err := services.ValidateExportFormat(format); err != nil {
+		respondError(c, h.logger, err, "Invalid export format")
+		return
+	}
+
+	contentType := "text/csv; charset=utf-8"
+	if format == services.AuditExportNDJSON {
+		contentType = "application/x-ndjson"
+	}
+	filename := fmt.Sprintf("audit-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	// Large exports outlast the server's write timeout; the request context still ends the
+	// export if the client goes away
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		h.logger.Warn("Failed to lift write deadline for audit export", zap.Error(err))
+	}
+
+	if err := h.auditService.ExportLogs(c.Request.Context(), q, format, c.Writer); err != nil {
+		if c.Writer.Written() {
+			// The status is already sent; the client sees a truncated export
+			h.logger.Error("Audit export aborted", zap.Error(err))
+			return
+		}
+		c.Writer.Header().Del("Content-Type")
+		c.Writer.Header().Del("Content-Disposition")
+		respondError(c, h.logger, err, "Failed to export audit logs")
+	}
+}
+
+// DeviceHistory lists the audit records of one device, newest first. Anyone who can read the
+// device can read its history; non-super users only see records from the organization that
+// currently owns it.
+// GET /api/v1/devices/:id/history?by=mac|imei&action=&from=&to=&page=&page_size=
+func (h *AuditHandler) DeviceHistory(c *gin.Context) {
+	user, device, ok := loadDevice(c, h.deviceService, h.enforcer, h.logger, "read")
+	if !ok {
+		return
+	}
+
+	q := services.AuditLogQuery{
+		Action:     c.Query("action"),
+		TargetType: "device",
+		TargetID:   &device.ID,
+	}
+	if !user.IsSuperUser && device.Project != nil {
+		q.OrgID = &device.Project.OrgID
+	}
+	if !parseAuditTimeRange(c, &q) {
+		return
+	}
+	page, pageSize := auditPagination(c)
+
+	logs, total, err := h.auditService.ListLogs(c.Request.Context(), q, page, pageSize)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get device history")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"logs": logs,
+		"pagination": gin.H{
+			"page":      page,
+			"page_size": pageSize,
+			"total":     total,
+		},
+	})
+}
+
+// auditQuery parses the audit filters and resolves the organization scope, checking that
+// non-super users may read their organization's audit log
+func (h *AuditHandler) auditQuery(c *gin.Context) (services.AuditLogQuery, bool) {
+	var q services.AuditLogQuery
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return q, false
+	}
+
+	if orgID := c.Query("org_id"); orgID != "" {
+		orgUUID, err := uuid.Parse(orgID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid org_id"})
+			return q, false
+		}
+		if !user.IsSuperUser && orgUUID != user.OrgID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to organization"})
+			return q, false
+		}
+		q.OrgID = &orgUUID
+	} else if !user.IsSuperUser || user.OrgSwitched() {
+		q.OrgID = &user.OrgID
+	}
+	if q.OrgID != nil && !authorizeAny(c, h.enforcer, h.logger, user, "audit", "read", "Access denied to audit log",
+		casbinx.BuildDomain("org", q.OrgID.String())) {
+		return q, false
+	}
+
+	for param, dst := range map[string]**uuid.UUID{"actor": &q.Actor, "target_id": &q.TargetID} {
+		if value := c.Query(param); value != "" {
+			id, err := uuid.Parse(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+				return q, false
+			}
+			*dst = &id
+		}
+	}
+	q.Action = c.Query("action")
+	q.TargetType = c.Query("target_type")
+	return q, parseAuditTimeRange(c, &q)
+}
+
+// parseAuditTimeRange reads from and to as RFC 3339 timestamps
+func parseAuditTimeRange(c *gin.Context, q *services.AuditLogQuery) bool {
+	for param, dst := range map[string]**time.Time{"from": &q.From, "to": &q.To} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 timestamp"})
+				return false
+			}
+			*dst = &t
+		}
+	}
+	return true
+}
+
+func auditPagination(c *gin.Context) (int, int) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 500 {
+		pageSize = 50
+	}
+	return page, pageSize
+}
@@ -7,8 +7,10 @@ import (
 
 	"server/internal/auth"
 	"server/internal/casdoor"
+	"server/pkg/errors"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 // AuthHandler exposes minimal auth endpoints for web login flow
@@ -28,6 +30,7 @@ func (h *AuthHandler) RegisterRoutes(r *gin.RouterGroup) {
 		grp.GET("/login", h.Login)
 		grp.GET("/callback", h.Callback)
 		grp.GET("/me", h.authMW.AuthRequired(), h.Me)
+		grp.POST("/switch-org", h.authMW.AuthRequired(), h.SwitchOrg)
 		grp.POST("/logout", h.Logout)
 	}
 }
@@ -87,12 +90,42 @@ func (h *AuthHandler) Callback(c *gin.Context) {
 	c.Redirect(http.StatusFound, redirect)
 }
 
-// Me returns current user info
+// Me returns current user info, including the session's active organization (org_id) and
+// the user's own (home_org_id)
 func (h *AuthHandler) Me(c *gin.Context) {
 	user := auth.GetUserContext(c)
 	c.JSON(http.StatusOK, user)
 }
 
+// SwitchOrg makes another organization the active one for the current session. List
+// endpoints default to it and organization permissions are checked in it until the token
+// expires or the session switches again.
+// POST /api/v1/auth/switch-org { org_id }
+func (h *AuthHandler) SwitchOrg(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	var req struct {
+		OrgID string `json:"org_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	orgID, err := uuid.Parse(req.OrgID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid org_id"})
+		return
+	}
+	if _, err := h.authMW.SwitchOrganization(user, orgID); err != nil {
+		if appErr, ok := err.(*errors.AppError); ok {
+			c.JSON(appErr.HTTPStatus, gin.H{"error": appErr.Message})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to switch organization"})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
 // Logout clears cookie
 func (h *AuthHandler) Logout(c *gin.Context) {
 	c.SetCookie("dt_access_token", "", -1, "/", "", false, true)
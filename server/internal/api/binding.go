@@ -0,0 +1,189 @@
+package api
+
+import (
+	"net/http"
+
+	"server/internal/auth"
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/internal/domain/services"
+	"server/internal/tenant"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// BindingHandler handles device binding API endpoints
+type BindingHandler struct {
+	bindingService *services.DeviceBindingService
+	deviceService  *services.DeviceService
+	enforcer       *casbinx.Enforcer
+	logger         *zap.Logger
+}
+
+// NewBindingHandler creates a new binding handler
+func NewBindingHandler(bindingService *services.DeviceBindingService, deviceService *services.DeviceService, enforcer *casbinx.Enforcer, logger *zap.Logger) *BindingHandler {
+	return &BindingHandler{
+		bindingService: bindingService,
+		deviceService:  deviceService,
+		enforcer:       enforcer,
+		logger:         logger.With(zap.String("component", "binding_handler")),
+	}
+}
+
+// BindDevice claims a self-registered device for a user and places it in a project without
+// a claim code. Knowing a MAC or IMEI is no proof of possession, so only super users may,
+// for any existing user and into any project; everyone else, field staff included, claims
+// with ClaimDevice. The response carries the device's new MQTT credentials.
+// POST /api/v1/devices/bind { id, id_type: mac|imei, user_id?, project_id, partition_id? }
+func (h *BindingHandler) BindDevice(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	if !user.IsSuperUser {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Binding without a claim code is reserved to super users; use POST /api/v1/devices/claim"})
+		return
+	}
+
+	var req struct {
+		ID          string     `json:"id" binding:"required"`
+		IDType      string     `json:"id_type"`
+		UserID      *uuid.UUID `json:"user_id,omitempty"`
+		ProjectID   uuid.UUID  `json:"project_id" binding:"required"`
+		PartitionID *uuid.UUID `json:"partition_id,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.IDType == "" {
+		req.IDType = "mac"
+	}
+	if req.IDType != "mac" && req.IDType != "imei" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id_type must be 'mac' or 'imei'"})
+		return
+	}
+
+	actor, ok := requestActor(c, user)
+	if !ok {
+		return
+	}
+	bindTo := actor.UserID
+	if req.UserID != nil {
+		bindTo = *req.UserID
+	}
+
+	// Self-registered devices wait in the factory project, which may belong to another
+	// organization, until they are claimed; only unbound devices can be bound
+	device, err := h.deviceService.WithContext(tenant.Bypass(c.Request.Context())).GetDeviceByIdentifier(req.ID, req.IDType)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get device")
+		return
+	}
+
+	binding, creds, err := h.bindingService.WithContext(c.Request.Context()).BindDevice(device, actor, bindTo, req.ProjectID, req.PartitionID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to bind device")
+		return
+	}
+
+	h.logger.Info("Device bound",
+		zap.String("device_id", device.ID.String()),
+		zap.String("bound_to", bindTo.String()),
+		zap.String("project_id", req.ProjectID.String()),
+		zap.String("user_id", user.UserID))
+
+	// As with a claim, the device's new MQTT secret is shown only this once
+	c.JSON(http.StatusCreated, struct {
+		*models.DeviceBinding
+		MQTTCredentials *services.DeviceCredentials `json:"mqtt_credentials"`
+	}{binding, creds})
+}
+
+// ClaimDevice binds a self-registered device to the caller on proof of possession, its claim
+// code, and places it in one of the caller's projects. Unknown devices, wrong codes, used
+// codes and callers locked out of the device by repeated wrong codes all get the same 403.
+// POST /api/v1/devices/claim { id, id_type: mac|imei, claim_code, project_id, partition_id? }
+func (h *BindingHandler) ClaimDevice(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var req struct {
+		ID          string     `json:"id" binding:"required"`
+		IDType      string     `json:"id_type"`
+		ClaimCode   string     `json:"claim_code" binding:"required"`
+		ProjectID   uuid.UUID  `json:"project_id" binding:"required"`
+		PartitionID *uuid.UUID `json:"partition_id,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.IDType == "" {
+		req.IDType = "mac"
+	}
+	if req.IDType != "mac" && req.IDType != "imei" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id_type must be 'mac' or 'imei'"})
+		return
+	}
+
+	actor, ok := requestActor(c, user)
+	if !ok {
+		return
+	}
+	domains := []string{casbinx.BuildDomain("project", req.ProjectID.String())}
+	if req.PartitionID != nil {
+		domains = append([]string{casbinx.BuildDomain("partition", req.PartitionID.String())}, domains...)
+	}
+	if !authorizeAny(c, h.enforcer, h.logger, user, "devices", "write", "Access denied to project", domains...) {
+		return
+	}
+
+	device, err := h.deviceService.WithContext(tenant.Bypass(c.Request.Context())).GetDeviceByIdentifier(req.ID, req.IDType)
+	if err != nil {
+		if err == services.ErrDeviceNotFound {
+			err = services.ErrInvalidClaimCode
+		}
+		respondError(c, h.logger, err, "Failed to get device")
+		return
+	}
+
+	binding, creds, err := h.bindingService.WithContext(c.Request.Context()).ClaimDevice(device, actor, req.ClaimCode, req.ProjectID, req.PartitionID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to claim device")
+		return
+	}
+
+	h.logger.Info("Device claimed",
+		zap.String("device_id", device.ID.String()),
+		zap.String("project_id", req.ProjectID.String()),
+		zap.String("user_id", user.UserID))
+
+	// The new owner gets the device's MQTT secret, which is shown only this once
+	c.JSON(http.StatusCreated, struct {
+		*models.DeviceBinding
+		MQTTCredentials *services.DeviceCredentials `json:"mqtt_credentials"`
+	}{binding, creds})
+}
+
+// GetBinding returns who a device is bound to
+// GET /api/v1/devices/:id/binding?by=mac|imei
+func (h *BindingHandler) GetBinding(c *gin.Context) {
+	_, device, ok := loadDevice(c, h.deviceService, h.enforcer, h.logger, "read")
+	if !ok {
+		return
+	}
+
+	binding, err := h.bindingService.WithContext(c.Request.Context()).GetBinding(device.ID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get binding")
+		return
+	}
+	c.JSON(http.StatusOK, binding)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"server/internal/auth"
+)
+
+func TestBindDevice_SuperUsersOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := NewBindingHandler(nil, nil, nil, zap.NewNop())
+
+	// Project managers and field staff alike claim with a code; bind is refused before
+	// anything else is looked at
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	body := `{"id":"AA:BB:CC:DD:EE:FF","project_id":"` + uuid.NewString() + `"}`
+	c.Request = httptest.NewRequest("POST", "http://example.com/api/v1/devices/bind", strings.NewReader(body))
+	c.Set("user", &auth.UserContext{UserID: "staff", LocalUserID: uuid.New(), OrgID: uuid.New(), Roles: []string{"admin"}})
+
+	h.BindDevice(c)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "/api/v1/devices/claim") {
+		t.Fatalf("expected the response to point to claiming, got %s", w.Body.String())
+	}
+}
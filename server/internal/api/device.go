@@ -1,13 +1,17 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"server/internal/auth"
 	"server/internal/casbinx"
 	"server/internal/domain/models"
 	"server/internal/domain/services"
+	"server/internal/websocket"
 	"server/pkg/errors"
 
 	"github.com/gin-gonic/gin"
@@ -15,19 +19,32 @@ import (
 	"go.uber.org/zap"
 )
 
+// DeviceKicker disconnects the live MQTT client of a device
+type DeviceKicker interface {
+	Kick(deviceID string) error
+}
+
 // DeviceHandler handles device-related API endpoints
 type DeviceHandler struct {
 	deviceService       *services.DeviceService
+	bindingService      *services.DeviceBindingService
 	organizationService *services.OrganizationService
+	mqttBroker          DeviceKicker
+	wsHub               *websocket.Hub // nil when WebSocket is disabled
+	auditService        *services.AuditService
 	enforcer            *casbinx.Enforcer
 	logger              *zap.Logger
 }
 
 // NewDeviceHandler creates a new device handler
-func NewDeviceHandler(deviceService *services.DeviceService, organizationService *services.OrganizationService, enforcer *casbinx.Enforcer, logger *zap.Logger) *DeviceHandler {
+func NewDeviceHandler(deviceService *services.DeviceService, bindingService *services.DeviceBindingService, organizationService *services.OrganizationService, mqttBroker DeviceKicker, wsHub *websocket.Hub, auditService *services.AuditService, enforcer *casbinx.Enforcer, logger *zap.Logger) *DeviceHandler {
 	return &DeviceHandler{
 		deviceService:       deviceService,
+		bindingService:      bindingService,
 		organizationService: organizationService,
+		mqttBroker:          mqttBroker,
+		wsHub:               wsHub,
+		auditService:        auditService,
 		enforcer:            enforcer,
 		logger:              logger.With(zap.String("component", "device_handler")),
 	}
@@ -41,11 +58,6 @@ func (h *DeviceHandler) ListDevices(c *gin.Context) {
 		return
 	}
 
-	// Parse query parameters
-	orgID := c.Query("org_id")
-	projectID := c.Query("project_id")
-	partitionID := c.Query("partition_id")
-	status := c.Query("status")
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
 
@@ -57,6 +69,105 @@ func (h *DeviceHandler) ListDevices(c *gin.Context) {
 		pageSize = 20
 	}
 
+	orgUUID, filters, ok := deviceListFilters(c, user)
+	if !ok {
+		return
+	}
+
+	// List devices; q searches MAC, IMEI and display name, cursor continues from next_cursor
+	result, err := h.deviceService.WithContext(c.Request.Context()).ListDevicePage(orgUUID, services.DeviceListOptions{
+		Filters:  filters,
+		Search:   c.Query("q"),
+		Sort:     c.Query("sort"),
+		Page:     page,
+		PageSize: pageSize,
+		Cursor:   c.Query("cursor"),
+	})
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to list devices")
+		return
+	}
+
+	devices := result.Devices
+	if devices == nil {
+		devices = []models.Device{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"devices": devices,
+		"pagination": gin.H{
+			"page":        page,
+			"page_size":   pageSize,
+			"total":       result.Total,
+			"next_cursor": result.NextCursor,
+		},
+	})
+}
+
+// ExportDevices streams every device matching the list filters as CSV, NDJSON or XLSX, with
+// partition paths, bindings and shares. The CSV can be fed back to ImportDevices.
+// GET /api/v1/devices/export?format=csv|ndjson|xlsx&...
+func (h *DeviceHandler) ExportDevices(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	orgUUID, filters, ok := deviceListFilters(c, user)
+	if !ok {
+		return
+	}
+	format := c.DefaultQuery("format", services.DeviceExportCSV)
+	if err := services.ValidateDeviceExportFormat(format); err != nil {
+		respondError(c, h.logger, err, "Invalid export format")
+		return
+	}
+
+	contentType := "text/csv; charset=utf-8"
+	switch format {
+	case services.DeviceExportNDJSON:
+		contentType = "application/x-ndjson"
+	case services.DeviceExportXLSX:
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	filename := fmt.Sprintf("devices-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	// Large exports outlast the server's write timeout; the request context still ends the
+	// export if the client goes away
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		h.logger.Warn("Failed to lift write deadline for device export", zap.Error(err))
+	}
+
+	err := h.deviceService.WithContext(c.Request.Context()).ExportDevices(orgUUID, services.DeviceListOptions{
+		Filters: filters,
+		Search:  c.Query("q"),
+		Sort:    c.Query("sort"),
+	}, format, c.Writer)
+	if err != nil {
+		if c.Writer.Written() {
+			// The status is already sent; the client sees a truncated export
+			h.logger.Error("Device export aborted", zap.Error(err))
+			return
+		}
+		c.Writer.Header().Del("Content-Type")
+		c.Writer.Header().Del("Content-Disposition")
+		respondError(c, h.logger, err, "Failed to export devices")
+	}
+}
+
+// deviceListFilters reads the organization and filters of a device list or export from the
+// query. On failure the response is written and ok is false.
+func deviceListFilters(c *gin.Context, user *auth.UserContext) (uuid.UUID, map[string]interface{}, bool) {
+	// Parse query parameters
+	orgID := c.Query("org_id")
+	projectID := c.Query("project_id")
+	partitionID := c.Query("partition_id")
+	status := c.Query("status")
+	deviceType := c.Query("device_type")
+
 	// Use user's organization if not specified
 	if orgID == "" {
 		orgID = user.OrgID.String()
@@ -65,13 +176,13 @@ func (h *DeviceHandler) ListDevices(c *gin.Context) {
 	// Check if user can access the specified organization
 	if !user.IsSuperUser && orgID != user.OrgID.String() {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to organization"})
-		return
+		return uuid.Nil, nil, false
 	}
 
 	orgUUID, err := uuid.Parse(orgID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid org_id"})
-		return
+		return uuid.Nil, nil, false
 	}
 
 	// Build filters
@@ -79,45 +190,54 @@ func (h *DeviceHandler) ListDevices(c *gin.Context) {
 	if status != "" {
 		filters["status"] = status
 	}
+	if deviceType != "" {
+		filters["device_type"] = deviceType
+	}
 	if projectID != "" {
-		if projUUID, err := uuid.Parse(projectID); err == nil {
-			filters["project_id"] = projUUID
+		projUUID, err := uuid.Parse(projectID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project_id"})
+			return uuid.Nil, nil, false
 		}
+		filters["project_id"] = projUUID
 	}
 	if partitionID != "" {
-		if partUUID, err := uuid.Parse(partitionID); err == nil {
+		partUUID, err := uuid.Parse(partitionID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid partition_id"})
+			return uuid.Nil, nil, false
+		}
+		// recursive=true also lists devices of the partitions below it
+		if c.Query("recursive") == "true" {
+			filters[services.DeviceFilterPartitionTree] = partUUID
+		} else {
 			filters["partition_id"] = partUUID
 		}
 	}
 
-	// List devices
-	devices, err := h.deviceService.ListDevicesByOrganization(orgUUID, filters)
-	if err != nil {
-		h.logger.Error("Failed to list devices", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list devices"})
-		return
+	// Tag filters: tag=a&tag=b matches devices with any of the tags, or all of them with tag_mode=all
+	if tags := c.QueryArray("tag"); len(tags) > 0 {
+		switch c.DefaultQuery("tag_mode", "any") {
+		case "any":
+			filters[services.DeviceFilterTagsAny] = tags
+		case "all":
+			filters[services.DeviceFilterTagsAll] = tags
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "tag_mode must be 'any' or 'all'"})
+			return uuid.Nil, nil, false
+		}
 	}
-
-	// Apply pagination
-	start := (page - 1) * pageSize
-	end := start + pageSize
-	if start >= len(devices) {
-		devices = []models.Device{}
-	} else {
-		if end > len(devices) {
-			end = len(devices)
+	// Metadata filters: meta.<key>=<value> matches top-level meta values compared as text
+	meta := make(map[string]string)
+	for param, values := range c.Request.URL.Query() {
+		if key, ok := strings.CutPrefix(param, "meta."); ok && len(values) > 0 {
+			meta[key] = values[0]
 		}
-		devices = devices[start:end]
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"devices": devices,
-		"pagination": gin.H{
-			"page":      page,
-			"page_size": pageSize,
-			"total":     len(devices),
-		},
-	})
+	if len(meta) > 0 {
+		filters[services.DeviceFilterMeta] = meta
+	}
+	return orgUUID, filters, true
 }
 
 // GetDevice gets a device by ID
@@ -136,7 +256,7 @@ func (h *DeviceHandler) GetDevice(c *gin.Context) {
 		return
 	}
 
-	device, err := h.deviceService.GetDeviceByIdentifier(deviceID, deviceBy)
+	device, err := h.deviceService.WithContext(c.Request.Context()).GetDeviceByIdentifier(deviceID, deviceBy)
 	if err != nil {
 		if err == services.ErrDeviceNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
@@ -148,19 +268,11 @@ func (h *DeviceHandler) GetDevice(c *gin.Context) {
 	}
 
 	// Check permissions
-	domain := h.buildDeviceDomain(device)
-	allowed, err := h.enforcer.Enforce(user.UserID, domain, "devices", "read")
-	if err != nil {
-		h.logger.Error("Permission check failed", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Permission check failed"})
-		return
-	}
-
-	if !allowed && !user.IsSuperUser {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to device"})
+	if !authorizeAny(c, h.enforcer, h.logger, user, "devices", "read", "Access denied to device", deviceDomains(device)...) {
 		return
 	}
 
+	setETag(c, device.Version)
 	c.JSON(http.StatusOK, device)
 }
 
@@ -192,17 +304,12 @@ func (h *DeviceHandler) CreateDevice(c *gin.Context) {
 		return
 	}
 
-	// Check permissions for the project
-	domain := "project:" + req.ProjectID.String()
-	allowed, err := h.enforcer.Enforce(user.UserID, domain, "devices", "write")
-	if err != nil {
-		h.logger.Error("Permission check failed", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Permission check failed"})
-		return
+	// Check permissions for the target partition or project
+	domains := []string{casbinx.BuildDomain("project", req.ProjectID.String())}
+	if req.PartitionID != nil {
+		domains = append([]string{casbinx.BuildDomain("partition", req.PartitionID.String())}, domains...)
 	}
-
-	if !allowed && !user.IsSuperUser {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to project"})
+	if !authorizeAny(c, h.enforcer, h.logger, user, "devices", "write", "Access denied to project", domains...) {
 		return
 	}
 
@@ -217,7 +324,7 @@ func (h *DeviceHandler) CreateDevice(c *gin.Context) {
 		imeiPtr = &req.IMEI
 	}
 
-	device, err := h.deviceService.CreateDevice(primaryID, imeiPtr, req.DeviceType, req.ProjectID, req.PartitionID, req.DisplayName)
+	device, creds, err := h.deviceService.WithContext(c.Request.Context()).CreateDeviceWithCredentials(primaryID, imeiPtr, req.DeviceType, req.ProjectID, req.PartitionID, req.DisplayName)
 	if err != nil {
 		if appErr, ok := err.(*errors.AppError); ok {
 			c.JSON(appErr.HTTPStatus, gin.H{"error": appErr.Message, "details": appErr.Details})
@@ -232,11 +339,100 @@ func (h *DeviceHandler) CreateDevice(c *gin.Context) {
 		zap.String("device_id", device.ID.String()),
 		zap.String("user_id", user.UserID),
 		zap.String("mac", device.MAC))
+	recordAudit(c, h.auditService, user, services.AuditActionDeviceCreate, "device", &device.ID,
+		services.AuditChanges(nil, services.AuditSnapshot(device)))
+
+	// The MQTT secret is shown only this once
+	setETag(c, device.Version)
+	c.JSON(http.StatusCreated, struct {
+		*models.Device
+		MQTTCredentials *services.DeviceCredentials `json:"mqtt_credentials"`
+	}{device, creds})
+}
+
+// maxDeviceImportBytes bounds the body of a bulk import
+const maxDeviceImportBytes = 8 << 20
+
+// ImportDevices creates devices in bulk from CSV (with a header row) or a JSON array in the
+// user's active organization. Every row is validated first; if any fails, nothing is created
+// and the per-row errors are returned with 422. dry_run=true only validates.
+// POST /api/v1/devices/import?dry_run=&format=csv|json
+func (h *DeviceHandler) ImportDevices(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dry_run"})
+		return
+	}
+	format := c.Query("format")
+	if format == "" {
+		format = "json"
+		if strings.Contains(c.ContentType(), "csv") {
+			format = "csv"
+		}
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxDeviceImportBytes)
+	var rows []services.DeviceImportRow
+	switch format {
+	case "csv":
+		rows, err = services.ParseDeviceImportCSV(body)
+	case "json":
+		rows, err = services.ParseDeviceImportJSON(body)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be 'csv' or 'json'"})
+		return
+	}
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to read import")
+		return
+	}
+
+	allowed := make(map[uuid.UUID]bool)
+	canWrite := func(projectID uuid.UUID) bool {
+		if user.IsSuperUser {
+			return true
+		}
+		if ok, seen := allowed[projectID]; seen {
+			return ok
+		}
+		ok, err := h.enforcer.EnforceAny(user.Subjects(), "project:"+projectID.String(), "devices", "write")
+		if err != nil {
+			h.logger.Error("Permission check failed", zap.Error(err))
+		}
+		allowed[projectID] = ok && err == nil
+		return allowed[projectID]
+	}
 
-	c.JSON(http.StatusCreated, device)
+	result, err := h.deviceService.WithContext(c.Request.Context()).ImportDevices(user.OrgID, rows,
+		services.DeviceImportOptions{DryRun: dryRun, CanWrite: canWrite})
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to import devices")
+		return
+	}
+	if result.Invalid > 0 && !dryRun {
+		c.JSON(http.StatusUnprocessableEntity, result)
+		return
+	}
+	if result.Committed {
+		h.logger.Info("Devices imported",
+			zap.Int("count", result.Total),
+			zap.String("org_id", user.OrgID.String()),
+			zap.String("user_id", user.UserID))
+		recordAudit(c, h.auditService, user, services.AuditActionDeviceImport, "device", nil,
+			gin.H{"count": result.Total, "partitions_created": result.PartitionsCreated})
+		c.JSON(http.StatusCreated, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
 }
 
-// UpdateDevice updates device information
+// UpdateDevice updates device information. With If-Match, only the version the ETag names
+// is updated; otherwise 412 is returned.
 func (h *DeviceHandler) UpdateDevice(c *gin.Context) {
 	user := auth.GetUserContext(c)
 	if user == nil {
@@ -254,8 +450,8 @@ func (h *DeviceHandler) UpdateDevice(c *gin.Context) {
 
 	var req struct {
 		DisplayName string                 `json:"display_name,omitempty"`
-		Tags        []string               `json:"tags,omitempty"`
-		Meta        map[string]interface{} `json:"meta,omitempty"`
+		Tags        *[]string              `json:"tags,omitempty"` // replaces all tags; [] clears them
+		Meta        map[string]interface{} `json:"meta,omitempty"` // JSON merge patch; null removes a key
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -263,7 +459,7 @@ func (h *DeviceHandler) UpdateDevice(c *gin.Context) {
 		return
 	}
 
-	device, err := h.deviceService.GetDeviceByIdentifier(deviceID, deviceBy)
+	device, err := h.deviceService.WithContext(c.Request.Context()).GetDeviceByIdentifier(deviceID, deviceBy)
 	if err != nil {
 		if err == services.ErrDeviceNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
@@ -275,86 +471,253 @@ func (h *DeviceHandler) UpdateDevice(c *gin.Context) {
 	}
 
 	// Check permissions
-	domain := h.buildDeviceDomain(device)
-	allowed, err := h.enforcer.Enforce(user.UserID, domain, "devices", "write")
-	if err != nil {
-		h.logger.Error("Permission check failed", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Permission check failed"})
+	if !authorizeAny(c, h.enforcer, h.logger, user, "devices", "write", "Access denied to device", deviceDomains(device)...) {
 		return
 	}
-
-	if !allowed && !user.IsSuperUser {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to device"})
+	if !checkIfMatch(c, device.Version) {
 		return
 	}
+	before := services.AuditSnapshot(device)
 
 	// Update fields
 	if req.DisplayName != "" {
 		device.DisplayName = req.DisplayName
 	}
-	// TODO: Add support for tags and meta fields when they are added to the model
 
-	if err := h.deviceService.UpdateDevice(device); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device"})
+	if err := h.deviceService.WithContext(c.Request.Context()).UpdateDeviceLabels(device, req.Tags, req.Meta); err != nil {
+		respondError(c, h.logger, err, "Failed to update device")
 		return
 	}
+	recordAudit(c, h.auditService, user, services.AuditActionDeviceUpdate, "device", &device.ID,
+		services.AuditChanges(before, services.AuditSnapshot(device)))
+	setETag(c, device.Version)
 	c.JSON(http.StatusOK, device)
 }
 
-// DeleteDevice deletes/unbinds a device
+// DeleteDevice soft-deletes a device, or with ?mode=unbind returns it to the unbound pool.
+// Either way its bindings, shares, device:<id> policies, MQTT secret and claim code are
+// removed and its live MQTT and WebSocket sessions are closed. If-Match is honoured as in UpdateDevice.
+// DELETE /api/v1/devices/:id?by=mac|imei&mode=delete|unbind
 func (h *DeviceHandler) DeleteDevice(c *gin.Context) {
-	user := auth.GetUserContext(c)
-	if user == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+	mode := c.DefaultQuery("mode", "delete")
+	if mode != "delete" && mode != "unbind" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be 'delete' or 'unbind'"})
 		return
 	}
 
-	deviceID := c.Param("id")
-	deviceBy := c.DefaultQuery("by", "mac")
+	user, device, ok := loadDevice(c, h.deviceService, h.enforcer, h.logger, "manage")
+	if !ok || !checkIfMatch(c, device.Version) {
+		return
+	}
+	actor, ok := requestActor(c, user)
+	if !ok {
+		return
+	}
 
-	if deviceBy != "mac" && deviceBy != "imei" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "by parameter must be 'mac' or 'imei'"})
+	if mode == "unbind" {
+		err := h.bindingService.WithContext(c.Request.Context()).UnbindDevice(device, actor)
+		if err != nil {
+			respondError(c, h.logger, err, "Failed to unbind device")
+			return
+		}
+	} else if err := h.bindingService.WithContext(c.Request.Context()).DeleteDevice(device, actor); err != nil {
+		respondError(c, h.logger, err, "Failed to delete device")
 		return
 	}
 
-	device, err := h.deviceService.GetDeviceByIdentifier(deviceID, deviceBy)
-	if err != nil {
-		if err == services.ErrDeviceNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
-		} else {
-			h.logger.Error("Failed to get device", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get device"})
+	reason := "Device deleted"
+	if mode == "unbind" {
+		reason = "Device unbound"
+	}
+	h.closeSessions(device, reason)
+
+	h.logger.Info("Device removed",
+		zap.String("device_id", device.ID.String()),
+		zap.String("mode", mode),
+		zap.String("user_id", user.UserID))
+
+	if mode == "unbind" {
+		setETag(c, device.Version)
+		c.JSON(http.StatusOK, device)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Device deleted"})
+}
+
+// SetClaimCode gives an unbound device a new factory claim code, replacing its current one.
+// Without claim_code a random code is generated and returned; it cannot be read back later.
+// ttl_seconds limits how long the code is valid.
+// POST /api/v1/devices/:id/claim-code?by=mac|imei { claim_code?, ttl_seconds? }
+func (h *DeviceHandler) SetClaimCode(c *gin.Context) {
+	var req struct {
+		ClaimCode  string `json:"claim_code"`
+		TTLSeconds int64  `json:"ttl_seconds"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
+	}
+	if req.TTLSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds must not be negative"})
 		return
 	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
 
-	// Check permissions
-	domain := h.buildDeviceDomain(device)
-	allowed, err := h.enforcer.Enforce(user.UserID, domain, "devices", "manage")
+	user, device, ok := loadDevice(c, h.deviceService, h.enforcer, h.logger, "manage")
+	if !ok {
+		return
+	}
+
+	service := h.deviceService.WithContext(c.Request.Context())
+	code := req.ClaimCode
+	var expiresAt *time.Time
+	var err error
+	if code == "" {
+		code, expiresAt, err = service.IssueClaimCode(device, models.ClaimCodeSourceFactory, ttl)
+	} else {
+		if ttl > 0 {
+			t := time.Now().Add(ttl)
+			expiresAt = &t
+		}
+		err = service.SetClaimCode(device, code, expiresAt)
+		code = ""
+	}
 	if err != nil {
-		h.logger.Error("Permission check failed", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Permission check failed"})
+		respondError(c, h.logger, err, "Failed to set claim code")
 		return
 	}
 
-	if !allowed && !user.IsSuperUser {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to device"})
+	recordAudit(c, h.auditService, user, services.AuditActionDeviceClaimCode, "device", &device.ID,
+		map[string]interface{}{"generated": code != "", "expires_at": expiresAt})
+	resp := gin.H{"device_id": device.ID, "expires_at": expiresAt}
+	if code != "" {
+		resp["claim_code"] = code
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RotateCredentials gives a device a new MQTT secret and returns it; it cannot be read back
+// later. The old secret keeps working for grace_seconds (default a day) so the device can be
+// updated; with 0 it stops at once and the device's MQTT client is disconnected.
+// POST /api/v1/devices/:id/credentials/rotate?by=mac|imei { grace_seconds? }
+func (h *DeviceHandler) RotateCredentials(c *gin.Context) {
+	var req struct {
+		GraceSeconds *int64 `json:"grace_seconds"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	grace := services.DefaultCredentialGrace
+	if req.GraceSeconds != nil {
+		if *req.GraceSeconds < 0 || *req.GraceSeconds > int64(services.MaxCredentialGrace/time.Second) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("grace_seconds must be between 0 and %d",
+				int64(services.MaxCredentialGrace/time.Second))})
+			return
+		}
+		grace = time.Duration(*req.GraceSeconds) * time.Second
+	}
+
+	user, device, ok := loadDevice(c, h.deviceService, h.enforcer, h.logger, "manage")
+	if !ok {
+		return
+	}
+
+	creds, err := h.deviceService.WithContext(c.Request.Context()).IssueCredentials(device, grace)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to rotate device credentials")
 		return
 	}
+	if grace == 0 {
+		h.kickMQTT(device)
+	}
 
-	// TODO: Implement device deletion in service
-	// For now, just return success
-	h.logger.Info("Device deletion requested",
+	h.logger.Info("Device credentials rotated",
 		zap.String("device_id", device.ID.String()),
+		zap.Duration("grace", grace),
 		zap.String("user_id", user.UserID))
+	recordAudit(c, h.auditService, user, services.AuditActionDeviceCredentialsRotate, "device", &device.ID,
+		map[string]interface{}{"grace_seconds": int64(grace / time.Second), "previous_expires_at": creds.PreviousExpiresAt})
+
+	c.JSON(http.StatusOK, gin.H{"device_id": device.ID, "mqtt_credentials": creds})
+}
+
+// closeSessions disconnects the device's MQTT client and any WebSocket sessions on it
+func (h *DeviceHandler) closeSessions(device *models.Device, reason string) {
+	h.kickMQTT(device)
+	if h.wsHub != nil {
+		keys := []string{device.MAC}
+		if device.IMEI != nil {
+			keys = append(keys, *device.IMEI)
+		}
+		h.wsHub.CloseDeviceConnections(reason, keys...)
+	}
+}
+
+// kickMQTT disconnects the device's MQTT client, which may have authenticated with either
+// identifier
+func (h *DeviceHandler) kickMQTT(device *models.Device) {
+	if h.mqttBroker == nil {
+		return
+	}
+	keys := []string{device.MAC}
+	if device.IMEI != nil {
+		keys = append(keys, *device.IMEI)
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := h.mqttBroker.Kick(key); err != nil {
+			h.logger.Warn("Failed to disconnect MQTT client",
+				zap.String("device_id", device.ID.String()), zap.Error(err))
+			return
+		}
+	}
+}
+
+// loadDevice resolves the :id device (?by=mac|imei) and checks act on it. On failure the
+// response is written and false is returned.
+func loadDevice(c *gin.Context, deviceService *services.DeviceService, enforcer *casbinx.Enforcer, logger *zap.Logger, act string) (*auth.UserContext, *models.Device, bool) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return nil, nil, false
+	}
+
+	deviceBy := c.DefaultQuery("by", "mac")
+	if deviceBy != "mac" && deviceBy != "imei" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "by parameter must be 'mac' or 'imei'"})
+		return nil, nil, false
+	}
+
+	device, err := deviceService.WithContext(c.Request.Context()).GetDeviceByIdentifier(c.Param("id"), deviceBy)
+	if err != nil {
+		if err == services.ErrDeviceNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		} else {
+			logger.Error("Failed to get device", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get device"})
+		}
+		return nil, nil, false
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Device deletion requested (to be implemented)"})
+	if !authorizeAny(c, enforcer, logger, user, "devices", act, "Access denied to device", deviceDomains(device)...) {
+		return nil, nil, false
+	}
+	return user, device, true
 }
 
-// buildDeviceDomain constructs the permission domain for a device
-func (h *DeviceHandler) buildDeviceDomain(device *models.Device) string {
+// deviceDomains lists the permission domains that grant access to a device, most specific
+// first: the device itself (shares), its partition, then its project
+func deviceDomains(device *models.Device) []string {
+	domains := []string{casbinx.BuildDomain("device", device.ID.String())}
 	if device.PartitionID != nil {
-		return "partition:" + device.PartitionID.String()
+		domains = append(domains, casbinx.BuildDomain("partition", device.PartitionID.String()))
 	}
-	return "project:" + device.ProjectID.String()
+	return append(domains, casbinx.BuildDomain("project", device.ProjectID.String()))
 }
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"server/internal/auth"
+	"server/internal/domain/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// DirectoryHandler handles user and group listing and the Casdoor directory sync endpoints
+type DirectoryHandler struct {
+	directoryService *services.DirectoryService
+	logger           *zap.Logger
+}
+
+// NewDirectoryHandler creates a new directory handler
+func NewDirectoryHandler(directoryService *services.DirectoryService, logger *zap.Logger) *DirectoryHandler {
+	return &DirectoryHandler{
+		directoryService: directoryService,
+		logger:           logger.With(zap.String("component", "directory_handler")),
+	}
+}
+
+// ListUsers lists the users of the caller's organization
+// GET /api/v1/users?q=&page=&page_size=
+func (h *DirectoryHandler) ListUsers(c *gin.Context) {
+	orgID, page, pageSize, ok := h.listParams(c)
+	if !ok {
+		return
+	}
+
+	users, total, err := h.directoryService.WithContext(c.Request.Context()).ListUsers(orgID, c.Query("q"), page, pageSize)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to list users")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"users": users,
+		"pagination": gin.H{
+			"page":      page,
+			"page_size": pageSize,
+			"total":     total,
+		},
+	})
+}
+
+// ListGroups lists the groups of the caller's organization
+// GET /api/v1/groups?q=&page=&page_size=
+func (h *DirectoryHandler) ListGroups(c *gin.Context) {
+	orgID, page, pageSize, ok := h.listParams(c)
+	if !ok {
+		return
+	}
+
+	groups, total, err := h.directoryService.WithContext(c.Request.Context()).ListGroups(orgID, c.Query("q"), page, pageSize)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to list groups")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"groups": groups,
+		"pagination": gin.H{
+			"page":      page,
+			"page_size": pageSize,
+			"total":     total,
+		},
+	})
+}
+
+// SyncDirectory syncs users and groups from Casdoor now, for one organization or, for super
+// users without org_id who have not switched organization, for all of them
+// POST /api/v1/admin/directory/sync?org_id=
+func (h *DirectoryHandler) SyncDirectory(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	if c.Query("org_id") == "" && user.IsSuperUser && !user.OrgSwitched() {
+		runs, err := h.directoryService.WithContext(c.Request.Context()).SyncAll(c.Request.Context(), services.SyncTriggerManual)
+		if err != nil {
+			respondError(c, h.logger, err, "Directory sync failed")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"runs": runs})
+		return
+	}
+
+	orgID, ok := h.orgParam(c, user)
+	if !ok {
+		return
+	}
+	run, err := h.directoryService.WithContext(c.Request.Context()).SyncOrganization(c.Request.Context(), orgID, services.SyncTriggerManual)
+	if err != nil {
+		respondError(c, h.logger, err, "Directory sync failed")
+		return
+	}
+
+	h.logger.Info("Directory synced",
+		zap.String("org_id", orgID.String()),
+		zap.Int("users_created", run.UsersCreated),
+		zap.Int("users_deleted", run.UsersDeleted),
+		zap.String("user_id", user.UserID))
+
+	c.JSON(http.StatusOK, run)
+}
+
+// ListSyncRuns lists recent directory sync runs
+// GET /api/v1/admin/directory/sync?org_id=&limit=
+func (h *DirectoryHandler) ListSyncRuns(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	var orgFilter *uuid.UUID
+	if c.Query("org_id") != "" || !user.IsSuperUser || user.OrgSwitched() {
+		orgID, ok := h.orgParam(c, user)
+		if !ok {
+			return
+		}
+		orgFilter = &orgID
+	}
+
+	runs, err := h.directoryService.WithContext(c.Request.Context()).ListSyncRuns(orgFilter, limit)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to list sync runs")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+// listParams resolves the organization and pagination of a listing request
+func (h *DirectoryHandler) listParams(c *gin.Context) (uuid.UUID, int, int, bool) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return uuid.Nil, 0, 0, false
+	}
+	orgID, ok := h.orgParam(c, user)
+	if !ok {
+		return uuid.Nil, 0, 0, false
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	return orgID, page, pageSize, true
+}
+
+// orgParam returns org_id, defaulting to the caller's organization. Only super users may
+// name another organization.
+func (h *DirectoryHandler) orgParam(c *gin.Context, user *auth.UserContext) (uuid.UUID, bool) {
+	orgID := c.Query("org_id")
+	if orgID == "" {
+		return user.OrgID, true
+	}
+	orgUUID, err := uuid.Parse(orgID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid org_id"})
+		return uuid.Nil, false
+	}
+	if !user.IsSuperUser && orgUUID != user.OrgID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to organization"})
+		return uuid.Nil, false
+	}
+	return orgUUID, true
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"server/internal/auth"
+	"server/internal/domain/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// OrganizationHandler handles organization management. Its routes are for super users only;
+// main mounts them behind RequireSuperUser.
+type OrganizationHandler struct {
+	organizationService *services.OrganizationService
+	directory           services.OrganizationDirectory
+	auditService        *services.AuditService
+	logger              *zap.Logger
+}
+
+// NewOrganizationHandler creates a new organization handler
+func NewOrganizationHandler(organizationService *services.OrganizationService, directory services.OrganizationDirectory, auditService *services.AuditService, logger *zap.Logger) *OrganizationHandler {
+	return &OrganizationHandler{
+		organizationService: organizationService,
+		directory:           directory,
+		auditService:        auditService,
+		logger:              logger.With(zap.String("component", "organization_handler")),
+	}
+}
+
+// ListOrganizations lists all organizations
+// GET /api/v1/organizations
+func (h *OrganizationHandler) ListOrganizations(c *gin.Context) {
+	orgs, err := h.organizationService.WithContext(c.Request.Context()).ListOrganizations()
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to list organizations")
+		return
+	}
+	c.JSON(http.StatusOK, orgs)
+}
+
+// GetOrganization gets an organization by ID
+// GET /api/v1/organizations/:id
+func (h *OrganizationHandler) GetOrganization(c *gin.Context) {
+	orgID, ok := h.orgParam(c)
+	if !ok {
+		return
+	}
+	org, err := h.organizationService.WithContext(c.Request.Context()).GetOrganization(orgID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get organization")
+		return
+	}
+	c.JSON(http.StatusOK, org)
+}
+
+// CreateOrganization creates an organization for a Casdoor organization
+// POST /api/v1/organizations
+func (h *OrganizationHandler) CreateOrganization(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	var req struct {
+		CasdoorOrg string `json:"casdoor_org" binding:"required"`
+		Name       string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	org, err := h.organizationService.WithContext(c.Request.Context()).CreateOrganization(req.CasdoorOrg, req.Name)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to create organization")
+		return
+	}
+	recordAudit(c, h.auditService, user, services.AuditActionOrgCreate, "organization", &org.ID,
+		services.AuditChanges(nil, services.AuditSnapshot(org)))
+	c.JSON(http.StatusCreated, org)
+}
+
+// UpdateOrganization renames an organization
+// PUT /api/v1/organizations/:id
+func (h *OrganizationHandler) UpdateOrganization(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	orgID, ok := h.orgParam(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	service := h.organizationService.WithContext(c.Request.Context())
+	existing, err := service.GetOrganization(orgID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get organization")
+		return
+	}
+	before := services.AuditSnapshot(existing)
+
+	org, err := service.UpdateOrganization(orgID, req.Name)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to update organization")
+		return
+	}
+	recordAudit(c, h.auditService, user, services.AuditActionOrgUpdate, "organization", &org.ID,
+		services.AuditChanges(before, services.AuditSnapshot(org)))
+	c.JSON(http.StatusOK, org)
+}
+
+// DeleteOrganization deletes an organization. One that still has projects or devices is
+// refused with 409 unless cascade=true, which deletes everything it owns.
+// DELETE /api/v1/organizations/:id?cascade=
+func (h *OrganizationHandler) DeleteOrganization(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	orgID, ok := h.orgParam(c)
+	if !ok {
+		return
+	}
+	cascade, err := strconv.ParseBool(c.DefaultQuery("cascade", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cascade"})
+		return
+	}
+
+	service := h.organizationService.WithContext(c.Request.Context())
+	existing, err := service.GetOrganization(orgID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get organization")
+		return
+	}
+	if err := service.DeleteOrganization(orgID, cascade); err != nil {
+		respondError(c, h.logger, err, "Failed to delete organization")
+		return
+	}
+	detail := services.AuditChanges(services.AuditSnapshot(existing), nil)
+	detail["cascade"] = cascade
+	recordAudit(c, h.auditService, user, services.AuditActionOrgDelete, "organization", &orgID, detail)
+	c.JSON(http.StatusOK, gin.H{"message": "Organization deleted"})
+}
+
+// ImportOrganizations creates an organization for every Casdoor organization that has none
+// POST /api/v1/organizations/import
+func (h *OrganizationHandler) ImportOrganizations(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	result, err := h.organizationService.WithContext(c.Request.Context()).ImportOrganizations(c.Request.Context(), h.directory)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to import organizations")
+		return
+	}
+	if len(result.Created) > 0 {
+		created := make([]string, 0, len(result.Created))
+		for _, org := range result.Created {
+			created = append(created, org.CasdoorOrg)
+		}
+		recordAudit(c, h.auditService, user, services.AuditActionOrgImport, "organization", nil,
+			gin.H{"created": created, "failed": result.Failed})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (h *OrganizationHandler) orgParam(c *gin.Context) (uuid.UUID, bool) {
+	orgID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return uuid.Nil, false
+	}
+	return orgID, true
+}
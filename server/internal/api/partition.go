@@ -0,0 +1,261 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"server/internal/auth"
+	"server/internal/casbinx"
+	"server/internal/domain/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// PartitionHandler handles partition-related API endpoints
+type PartitionHandler struct {
+	partitionService *services.PartitionService
+	auditService     *services.AuditService
+	enforcer         *casbinx.Enforcer
+	logger           *zap.Logger
+}
+
+// NewPartitionHandler creates a new partition handler
+func NewPartitionHandler(partitionService *services.PartitionService, auditService *services.AuditService, enforcer *casbinx.Enforcer, logger *zap.Logger) *PartitionHandler {
+	return &PartitionHandler{
+		partitionService: partitionService,
+		auditService:     auditService,
+		enforcer:         enforcer,
+		logger:           logger.With(zap.String("component", "partition_handler")),
+	}
+}
+
+// GetPartitionTree returns the nested partition tree of a project
+// GET /api/v1/projects/:id/partitions/tree
+func (h *PartitionHandler) GetPartitionTree(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	projectUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid project ID"})
+		return
+	}
+
+	if !authorizeAny(c, h.enforcer, h.logger, user, "partitions", "read", "Access denied to project",
+		casbinx.BuildDomain("project", projectUUID.String())) {
+		return
+	}
+
+	tree, err := h.partitionService.WithContext(c.Request.Context()).GetTree(projectUUID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get partition tree")
+		return
+	}
+	c.JSON(http.StatusOK, tree)
+}
+
+// GetPartition returns a partition with its ancestors and the device rollup of its subtree
+// GET /api/v1/partitions/:id
+func (h *PartitionHandler) GetPartition(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	partitionUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid partition ID"})
+		return
+	}
+
+	partition, err := h.partitionService.WithContext(c.Request.Context()).GetPartition(partitionUUID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get partition")
+		return
+	}
+	if !authorizeAny(c, h.enforcer, h.logger, user, "partitions", "read", "Access denied to partition",
+		casbinx.BuildDomain("partition", partition.ID.String()),
+		casbinx.BuildDomain("project", partition.ProjectID.String())) {
+		return
+	}
+
+	detail, err := h.partitionService.WithContext(c.Request.Context()).GetPartitionDetail(partition.ID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get partition")
+		return
+	}
+	c.JSON(http.StatusOK, detail)
+}
+
+// CreatePartition creates a new partition
+// POST /api/v1/partitions
+func (h *PartitionHandler) CreatePartition(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var req struct {
+		ProjectID uuid.UUID  `json:"project_id" binding:"required"`
+		ParentID  *uuid.UUID `json:"parent_id,omitempty"`
+		Name      string     `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	domains := []string{casbinx.BuildDomain("project", req.ProjectID.String())}
+	if req.ParentID != nil {
+		domains = append([]string{casbinx.BuildDomain("partition", req.ParentID.String())}, domains...)
+	}
+	if !authorizeAny(c, h.enforcer, h.logger, user, "partitions", "write", "Access denied to project", domains...) {
+		return
+	}
+
+	partition, err := h.partitionService.WithContext(c.Request.Context()).CreatePartition(req.ProjectID, req.ParentID, req.Name)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to create partition")
+		return
+	}
+
+	h.logger.Info("Partition created",
+		zap.String("partition_id", partition.ID.String()),
+		zap.String("project_id", partition.ProjectID.String()),
+		zap.String("user_id", user.UserID))
+	recordAudit(c, h.auditService, user, services.AuditActionPartitionCreate, "partition", &partition.ID,
+		services.AuditChanges(nil, services.AuditSnapshot(partition)))
+
+	c.JSON(http.StatusCreated, partition)
+}
+
+// UpdatePartition renames and/or moves a partition
+// PATCH /api/v1/partitions/:id { name?, parent_id? } — "parent_id": null moves it to the top level
+func (h *PartitionHandler) UpdatePartition(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	partitionUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid partition ID"})
+		return
+	}
+
+	var req struct {
+		Name     string          `json:"name,omitempty"`
+		ParentID json.RawMessage `json:"parent_id,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// parent_id absent: no move; null: move to top level; uuid: move under that partition
+	move := len(req.ParentID) > 0
+	var newParentID *uuid.UUID
+	if move && string(req.ParentID) != "null" {
+		if err := json.Unmarshal(req.ParentID, &newParentID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parent_id"})
+			return
+		}
+	}
+	if req.Name == "" && !move {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name or parent_id must be provided"})
+		return
+	}
+
+	partition, err := h.partitionService.WithContext(c.Request.Context()).GetPartition(partitionUUID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get partition")
+		return
+	}
+
+	if !authorizeAny(c, h.enforcer, h.logger, user, "partitions", "write", "Access denied to partition",
+		casbinx.BuildDomain("partition", partition.ID.String()),
+		casbinx.BuildDomain("project", partition.ProjectID.String())) {
+		return
+	}
+	before := services.AuditSnapshot(partition)
+
+	if move && newParentID != nil {
+		// Moving under another partition also requires write access to the destination
+		if !authorizeAny(c, h.enforcer, h.logger, user, "partitions", "write", "Access denied to target partition",
+			casbinx.BuildDomain("partition", newParentID.String()),
+			casbinx.BuildDomain("project", partition.ProjectID.String())) {
+			return
+		}
+	} else if move {
+		// The top level belongs to the project, so only project writers move partitions there
+		if !authorizeAny(c, h.enforcer, h.logger, user, "partitions", "write", "Access denied to project",
+			casbinx.BuildDomain("project", partition.ProjectID.String())) {
+			return
+		}
+	}
+
+	partition, err = h.partitionService.WithContext(c.Request.Context()).UpdatePartition(partition.ID, req.Name, move, newParentID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to update partition")
+		return
+	}
+	if move {
+		h.logger.Info("Partition moved",
+			zap.String("partition_id", partition.ID.String()),
+			zap.String("path", partition.Path),
+			zap.String("user_id", user.UserID))
+	}
+	recordAudit(c, h.auditService, user, services.AuditActionPartitionUpdate, "partition", &partition.ID,
+		services.AuditChanges(before, services.AuditSnapshot(partition)))
+
+	c.JSON(http.StatusOK, partition)
+}
+
+// DeletePartition deletes an empty partition
+// DELETE /api/v1/partitions/:id
+func (h *PartitionHandler) DeletePartition(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	partitionUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid partition ID"})
+		return
+	}
+
+	partition, err := h.partitionService.WithContext(c.Request.Context()).GetPartition(partitionUUID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get partition")
+		return
+	}
+
+	if !authorizeAny(c, h.enforcer, h.logger, user, "partitions", "manage", "Access denied to partition",
+		casbinx.BuildDomain("partition", partition.ID.String()),
+		casbinx.BuildDomain("project", partition.ProjectID.String())) {
+		return
+	}
+
+	if err := h.partitionService.WithContext(c.Request.Context()).DeletePartition(partition.ID); err != nil {
+		respondError(c, h.logger, err, "Failed to delete partition")
+		return
+	}
+
+	h.logger.Info("Partition deleted",
+		zap.String("partition_id", partition.ID.String()),
+		zap.String("user_id", user.UserID))
+	recordAudit(c, h.auditService, user, services.AuditActionPartitionDelete, "partition", &partition.ID,
+		services.AuditChanges(services.AuditSnapshot(partition), nil))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Partition deleted"})
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"server/internal/auth"
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/internal/domain/services"
+	"server/internal/store"
+)
+
+func TestUpdatePartition_RootMoveNeedsProjectWrite(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Organization{}, &models.Project{}, &models.Partition{}, &models.Device{}, &models.CasbinRule{}); err != nil {
+		t.Fatal(err)
+	}
+	enforcer, err := casbinx.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	org := &models.Organization{BaseModel: models.BaseModel{ID: uuid.New()}, CasdoorOrg: "acme", Name: "Acme"}
+	project := &models.Project{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: org.ID, Name: "Site", CreatedBy: uuid.New()}
+	if err := db.Create(org).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(project).Error; err != nil {
+		t.Fatal(err)
+	}
+	partitions := services.NewPartitionService(db)
+	building, err := partitions.CreatePartition(project.ID, nil, "Building")
+	if err != nil {
+		t.Fatal(err)
+	}
+	floor, err := partitions.CreatePartition(project.ID, &building.ID, "Floor 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The building manager may write in the building, but not at the project's top level
+	buildingDomain := casbinx.BuildDomain("partition", building.ID.String())
+	floorDomain := casbinx.BuildDomain("partition", floor.ID.String())
+	for _, domain := range []string{buildingDomain, floorDomain} {
+		if _, err := enforcer.AddPolicy("role:partition_admin", domain, "partitions", "write"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := enforcer.AddRoleForUser("manager", "role:partition_admin", domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := NewPartitionHandler(partitions, services.NewAuditService(store.NewAuditLogRepository(db), zap.NewNop()), enforcer, zap.NewNop())
+	move := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("PATCH", "http://example.com/api/v1/partitions/"+floor.ID.String(), strings.NewReader(`{"parent_id":null}`))
+		c.Params = gin.Params{{Key: "id", Value: floor.ID.String()}}
+		c.Set("user", &auth.UserContext{UserID: "manager", LocalUserID: uuid.New(), OrgID: org.ID})
+		h.UpdatePartition(c)
+		return w
+	}
+
+	if w := move(); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a top-level move without project write, got %d: %s", w.Code, w.Body.String())
+	}
+
+	projectDomain := casbinx.BuildDomain("project", project.ID.String())
+	if _, err := enforcer.AddPolicy("role:project_admin", projectDomain, "partitions", "write"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enforcer.AddRoleForUser("manager", "role:project_admin", projectDomain); err != nil {
+		t.Fatal(err)
+	}
+	if w := move(); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with project write, got %d: %s", w.Code, w.Body.String())
+	}
+}
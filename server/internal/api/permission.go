@@ -2,26 +2,30 @@ package api
 
 import (
 	"net/http"
+	"strings"
 
 	"server/internal/auth"
 	"server/internal/casbinx"
 	"server/internal/domain/services"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
 // PermissionHandler handles permission-related API endpoints
 type PermissionHandler struct {
 	organizationService *services.OrganizationService
+	auditService        *services.AuditService
 	enforcer            *casbinx.Enforcer
 	logger              *zap.Logger
 }
 
 // NewPermissionHandler creates a new permission handler
-func NewPermissionHandler(organizationService *services.OrganizationService, enforcer *casbinx.Enforcer, logger *zap.Logger) *PermissionHandler {
+func NewPermissionHandler(organizationService *services.OrganizationService, auditService *services.AuditService, enforcer *casbinx.Enforcer, logger *zap.Logger) *PermissionHandler {
 	return &PermissionHandler{
 		organizationService: organizationService,
+		auditService:        auditService,
 		enforcer:            enforcer,
 		logger:              logger.With(zap.String("component", "permission_handler")),
 	}
@@ -201,6 +205,9 @@ func (h *PermissionHandler) GrantPermission(c *gin.Context) {
 		zap.String("subject", req.Subject),
 		zap.String("role", req.Role),
 		zap.String("granted_by", user.UserID))
+	targetType, targetID := domainTarget(req.Domain)
+	recordAudit(c, h.auditService, user, services.AuditActionPermissionGrant, targetType, targetID,
+		gin.H{"domain": req.Domain, "subject": req.Subject, "role": req.Role})
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Permission granted successfully",
@@ -260,6 +267,9 @@ func (h *PermissionHandler) RevokePermission(c *gin.Context) {
 		zap.String("subject", req.Subject),
 		zap.String("role", req.Role),
 		zap.String("revoked_by", user.UserID))
+	targetType, targetID := domainTarget(req.Domain)
+	recordAudit(c, h.auditService, user, services.AuditActionPermissionRevoke, targetType, targetID,
+		gin.H{"domain": req.Domain, "subject": req.Subject, "role": req.Role})
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Permission revoked successfully",
@@ -318,3 +328,23 @@ func (h *PermissionHandler) CheckPermission(c *gin.Context) {
 		"has_permission": hasPermission,
 	})
 }
+
+// domainTarget maps a Casbin domain such as project:<id> to the audit target it governs, so
+// permission changes show up in that resource's history. Other domains map to "permission".
+func domainTarget(domain string) (string, *uuid.UUID) {
+	kind, id, ok := strings.Cut(domain, ":")
+	if !ok {
+		return "permission", nil
+	}
+	targetID, err := uuid.Parse(id)
+	if err != nil {
+		return "permission", nil
+	}
+	switch kind {
+	case "org":
+		return "organization", &targetID
+	case "project", "partition", "device":
+		return kind, &targetID
+	}
+	return "permission", nil
+}
@@ -16,15 +16,17 @@ import (
 type ProjectHandler struct {
 	projectService      *services.ProjectService
 	organizationService *services.OrganizationService
+	auditService        *services.AuditService
 	enforcer            *casbinx.Enforcer
 	logger              *zap.Logger
 }
 
 // NewProjectHandler creates a new project handler
-func NewProjectHandler(projectService *services.ProjectService, organizationService *services.OrganizationService, enforcer *casbinx.Enforcer, logger *zap.Logger) *ProjectHandler {
+func NewProjectHandler(projectService *services.ProjectService, organizationService *services.OrganizationService, auditService *services.AuditService, enforcer *casbinx.Enforcer, logger *zap.Logger) *ProjectHandler {
 	return &ProjectHandler{
 		projectService:      projectService,
 		organizationService: organizationService,
+		auditService:        auditService,
 		enforcer:            enforcer,
 		logger:              logger.With(zap.String("component", "project_handler")),
 	}
@@ -58,7 +60,7 @@ func (h *ProjectHandler) ListProjects(c *gin.Context) {
 		return
 	}
 
-	projects, err := h.projectService.ListProjectsByOrg(orgUUID)
+	projects, err := h.projectService.WithContext(c.Request.Context()).ListProjectsByOrg(orgUUID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list projects"})
 		return
@@ -95,11 +97,12 @@ func (h *ProjectHandler) GetProject(c *gin.Context) {
 		return
 	}
 
-	project, err := h.projectService.GetProject(projectUUID)
+	project, err := h.projectService.WithContext(c.Request.Context()).GetProject(projectUUID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
 		return
 	}
+	setETag(c, project.Version)
 	c.JSON(http.StatusOK, project)
 }
 
@@ -135,15 +138,19 @@ func (h *ProjectHandler) CreateProject(c *gin.Context) {
 		return
 	}
 
-	project, err := h.projectService.CreateProject(user.OrgID, req.Name, req.Remark, uuid.MustParse(user.UserID))
+	project, err := h.projectService.WithContext(c.Request.Context()).CreateProject(user.OrgID, req.Name, req.Remark, user.LocalUserID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create project"})
 		return
 	}
+	recordAudit(c, h.auditService, user, services.AuditActionProjectCreate, "project", &project.ID,
+		services.AuditChanges(nil, services.AuditSnapshot(project)))
+	setETag(c, project.Version)
 	c.JSON(http.StatusCreated, project)
 }
 
-// UpdateProject updates a project
+// UpdateProject updates a project. With If-Match, only the version the ETag names is
+// updated; otherwise 412 is returned.
 func (h *ProjectHandler) UpdateProject(c *gin.Context) {
 	user := auth.GetUserContext(c)
 	if user == nil {
@@ -182,15 +189,28 @@ func (h *ProjectHandler) UpdateProject(c *gin.Context) {
 		return
 	}
 
-	project, err := h.projectService.UpdateProject(projectUUID, req.Name, req.Remark)
+	existing, err := h.projectService.WithContext(c.Request.Context()).GetProject(projectUUID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update project"})
+		respondError(c, h.logger, err, "Failed to get project")
 		return
 	}
+	if !checkIfMatch(c, existing.Version) {
+		return
+	}
+	before := services.AuditSnapshot(existing)
+
+	project, err := h.projectService.WithContext(c.Request.Context()).UpdateProject(projectUUID, existing.Version, req.Name, req.Remark)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to update project")
+		return
+	}
+	recordAudit(c, h.auditService, user, services.AuditActionProjectUpdate, "project", &project.ID,
+		services.AuditChanges(before, services.AuditSnapshot(project)))
+	setETag(c, project.Version)
 	c.JSON(http.StatusOK, project)
 }
 
-// DeleteProject deletes a project
+// DeleteProject deletes a project, honouring If-Match as UpdateProject does
 func (h *ProjectHandler) DeleteProject(c *gin.Context) {
 	user := auth.GetUserContext(c)
 	if user == nil {
@@ -219,9 +239,20 @@ func (h *ProjectHandler) DeleteProject(c *gin.Context) {
 		return
 	}
 
-	if err := h.projectService.DeleteProject(projectUUID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete project"})
+	existing, err := h.projectService.WithContext(c.Request.Context()).GetProject(projectUUID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get project")
+		return
+	}
+	if !checkIfMatch(c, existing.Version) {
+		return
+	}
+
+	if err := h.projectService.WithContext(c.Request.Context()).DeleteProject(projectUUID, existing.Version); err != nil {
+		respondError(c, h.logger, err, "Failed to delete project")
 		return
 	}
+	recordAudit(c, h.auditService, user, services.AuditActionProjectDelete, "project", &projectUUID,
+		services.AuditChanges(services.AuditSnapshot(existing), nil))
 	c.JSON(http.StatusOK, gin.H{"message": "Project deleted"})
 }
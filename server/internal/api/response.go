@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"server/internal/auth"
+	"server/internal/casbinx"
+	"server/internal/domain/services"
+	"server/pkg/errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// respondError writes an AppError with its HTTP status, or a 500 with fallback message for other errors
+func respondError(c *gin.Context, logger *zap.Logger, err error, fallback string) {
+	if appErr, ok := err.(*errors.AppError); ok {
+		c.JSON(appErr.HTTPStatus, gin.H{"error": appErr.Message, "details": appErr.Details})
+		return
+	}
+	logger.Error(fallback, zap.Error(err))
+	c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+}
+
+// authorizeAny checks obj/act against each domain in order and succeeds on the first match.
+// The user's groups are checked as well. Super users are always allowed. On failure the
+// response is written and false is returned.
+func authorizeAny(c *gin.Context, enforcer *casbinx.Enforcer, logger *zap.Logger, user *auth.UserContext, obj, act, deniedMsg string, domains ...string) bool {
+	if user.IsSuperUser {
+		return true
+	}
+	subjects := user.Subjects()
+	for _, domain := range domains {
+		allowed, err := enforcer.EnforceAny(subjects, domain, obj, act)
+		if err != nil {
+			logger.Error("Permission check failed", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Permission check failed"})
+			return false
+		}
+		if allowed {
+			return true
+		}
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": deniedMsg})
+	return false
+}
+
+// requestActor builds the audit actor for the current request from the provisioned local
+// user. Contexts built without provisioning have no local user and get a 401.
+func requestActor(c *gin.Context, user *auth.UserContext) (services.Actor, bool) {
+	if user.LocalUserID == uuid.Nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not provisioned"})
+		return services.Actor{}, false
+	}
+	return services.Actor{UserID: user.LocalUserID, IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}, true
+}
+
+// recordAudit queues an audit record of a completed mutation by the current user. It does not
+// wait for the write, so a slow database never holds up the response.
+func recordAudit(c *gin.Context, audit *services.AuditService, user *auth.UserContext, action, targetType string, targetID *uuid.UUID, detail interface{}) {
+	if audit == nil {
+		return
+	}
+	actor := services.Actor{UserID: user.LocalUserID, IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+	audit.Record(actor, action, targetType, targetID, detail)
+}
+
+// setETag sets the ETag of a versioned resource, which is its version in quotes
+func setETag(c *gin.Context, version int64) {
+	c.Header("ETag", strconv.Quote(strconv.FormatInt(version, 10)))
+}
+
+// checkIfMatch checks the request's If-Match header against the current version of a
+// resource. No header, "*" or a list holding the current ETag passes; weak tags are
+// compared by value. Otherwise 412 is written with the current ETag and false returned.
+func checkIfMatch(c *gin.Context, version int64) bool {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return true
+	}
+	current := strconv.FormatInt(version, 10)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if strings.Trim(tag, `"`) == current {
+			return true
+		}
+	}
+	setETag(c, version)
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Resource was modified; reload it and retry"})
+	return false
+}
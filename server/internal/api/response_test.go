@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckIfMatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for header, want := range map[string]bool{
+		"":              true,
+		"*":             true,
+		`"3"`:           true,
+		`W/"3"`:         true,
+		`"1", "3"`:      true,
+		`"2"`:           false,
+		`"1", W/"2"`:    false,
+		`"33"`:          false,
+		`"3-something"`: false,
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("PATCH", "http://example.com/api/v1/projects/x", nil)
+		if header != "" {
+			c.Request.Header.Set("If-Match", header)
+		}
+
+		if got := checkIfMatch(c, 3); got != want {
+			t.Fatalf("If-Match %q: expected %v, got %v", header, want, got)
+		}
+		if want {
+			continue
+		}
+		if w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("If-Match %q: expected 412, got %d", header, w.Code)
+		}
+		if etag := w.Header().Get("ETag"); etag != `"3"` {
+			t.Fatalf("If-Match %q: expected current ETag, got %q", header, etag)
+		}
+	}
+}
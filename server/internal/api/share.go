@@ -0,0 +1,116 @@
+package api
+
+import (
+	"net/http"
+
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/internal/domain/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// ShareHandler handles device sharing API endpoints
+type ShareHandler struct {
+	shareService  *services.DeviceShareService
+	deviceService *services.DeviceService
+	enforcer      *casbinx.Enforcer
+	logger        *zap.Logger
+}
+
+// NewShareHandler creates a new share handler
+func NewShareHandler(shareService *services.DeviceShareService, deviceService *services.DeviceService, enforcer *casbinx.Enforcer, logger *zap.Logger) *ShareHandler {
+	return &ShareHandler{
+		shareService:  shareService,
+		deviceService: deviceService,
+		enforcer:      enforcer,
+		logger:        logger.With(zap.String("component", "share_handler")),
+	}
+}
+
+// ListShares lists the users and groups a device is shared with
+// GET /api/v1/devices/:id/share?by=mac|imei
+func (h *ShareHandler) ListShares(c *gin.Context) {
+	_, device, ok := loadDevice(c, h.deviceService, h.enforcer, h.logger, "read")
+	if !ok {
+		return
+	}
+
+	shares, err := h.shareService.WithContext(c.Request.Context()).ListShares(device.ID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to list shares")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"shares": shares})
+}
+
+// ShareDevice shares a device with a user or group
+// POST /api/v1/devices/:id/share?by=mac|imei { subject_type, subject_id, role }
+func (h *ShareHandler) ShareDevice(c *gin.Context) {
+	var req struct {
+		SubjectType models.SubjectType `json:"subject_type" binding:"required"`
+		SubjectID   uuid.UUID          `json:"subject_id" binding:"required"`
+		Role        models.DeviceRole  `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, device, ok := loadDevice(c, h.deviceService, h.enforcer, h.logger, "manage")
+	if !ok {
+		return
+	}
+	actor, ok := requestActor(c, user)
+	if !ok {
+		return
+	}
+
+	share, err := h.shareService.WithContext(c.Request.Context()).ShareDevice(device, actor, req.SubjectType, req.SubjectID, req.Role)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to share device")
+		return
+	}
+
+	h.logger.Info("Device shared",
+		zap.String("device_id", device.ID.String()),
+		zap.String("subject_type", string(share.SubjectType)),
+		zap.String("subject_id", share.SubjectID.String()),
+		zap.String("role", string(share.Role)),
+		zap.String("user_id", user.UserID))
+
+	c.JSON(http.StatusCreated, share)
+}
+
+// UnshareDevice revokes a device share
+// DELETE /api/v1/devices/:id/share/:share_id?by=mac|imei
+func (h *ShareHandler) UnshareDevice(c *gin.Context) {
+	shareUUID, err := uuid.Parse(c.Param("share_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid share ID"})
+		return
+	}
+
+	user, device, ok := loadDevice(c, h.deviceService, h.enforcer, h.logger, "manage")
+	if !ok {
+		return
+	}
+	actor, ok := requestActor(c, user)
+	if !ok {
+		return
+	}
+
+	if err := h.shareService.WithContext(c.Request.Context()).UnshareDevice(device, actor, shareUUID); err != nil {
+		respondError(c, h.logger, err, "Failed to remove share")
+		return
+	}
+
+	h.logger.Info("Device share removed",
+		zap.String("device_id", device.ID.String()),
+		zap.String("share_id", shareUUID.String()),
+		zap.String("user_id", user.UserID))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share removed"})
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"net/http"
+
+	"server/internal/auth"
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/internal/domain/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// TransferHandler handles device transfer API endpoints
+type TransferHandler struct {
+	transferService *services.DeviceTransferService
+	deviceService   *services.DeviceService
+	enforcer        *casbinx.Enforcer
+	logger          *zap.Logger
+}
+
+// NewTransferHandler creates a new transfer handler
+func NewTransferHandler(transferService *services.DeviceTransferService, deviceService *services.DeviceService, enforcer *casbinx.Enforcer, logger *zap.Logger) *TransferHandler {
+	return &TransferHandler{
+		transferService: transferService,
+		deviceService:   deviceService,
+		enforcer:        enforcer,
+		logger:          logger.With(zap.String("component", "transfer_handler")),
+	}
+}
+
+// CreateTransfer requests a transfer of a device to another user
+// POST /api/v1/devices/:id/transfer?by=mac|imei { to_user_id }
+func (h *TransferHandler) CreateTransfer(c *gin.Context) {
+	var req struct {
+		ToUserID uuid.UUID `json:"to_user_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, device, ok := loadDevice(c, h.deviceService, h.enforcer, h.logger, "manage")
+	if !ok {
+		return
+	}
+	actor, ok := requestActor(c, user)
+	if !ok {
+		return
+	}
+
+	transfer, err := h.transferService.WithContext(c.Request.Context()).RequestTransfer(device, actor, req.ToUserID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to create transfer")
+		return
+	}
+
+	h.logger.Info("Device transfer requested",
+		zap.String("transfer_id", transfer.ID.String()),
+		zap.String("device_id", device.ID.String()),
+		zap.String("to_user_id", req.ToUserID.String()),
+		zap.String("user_id", user.UserID))
+
+	c.JSON(http.StatusCreated, transfer)
+}
+
+// ListTransfers lists the caller's incoming or outgoing transfers
+// GET /api/v1/transfers?direction=incoming|outgoing&status=pending
+func (h *TransferHandler) ListTransfers(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	direction := c.DefaultQuery("direction", "incoming")
+	if direction != "incoming" && direction != "outgoing" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "direction must be 'incoming' or 'outgoing'"})
+		return
+	}
+	status := models.TransferStatus(c.Query("status"))
+	switch status {
+	case "", models.TransferStatusPending, models.TransferStatusApproved,
+		models.TransferStatusRejected, models.TransferStatusCancelled:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+
+	actor, ok := requestActor(c, user)
+	if !ok {
+		return
+	}
+
+	transfers, err := h.transferService.WithContext(c.Request.Context()).ListTransfers(actor.UserID, direction == "outgoing", status)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to list transfers")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"transfers": transfers})
+}
+
+// GetTransfer returns a transfer visible to its sender or recipient
+// GET /api/v1/transfers/:id
+func (h *TransferHandler) GetTransfer(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	transferUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transfer ID"})
+		return
+	}
+
+	transfer, err := h.transferService.WithContext(c.Request.Context()).GetTransfer(transferUUID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to get transfer")
+		return
+	}
+
+	if !user.IsSuperUser && user.LocalUserID != transfer.FromSubjectID && user.LocalUserID != transfer.ToSubjectID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to transfer"})
+		return
+	}
+	c.JSON(http.StatusOK, transfer)
+}
+
+// ApproveTransfer accepts a transfer and moves the device into the recipient's project.
+// A device edited while the approval runs answers 412; approving again retries.
+// POST /api/v1/transfers/:id/approve { project_id, partition_id? }
+func (h *TransferHandler) ApproveTransfer(c *gin.Context) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	transferUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transfer ID"})
+		return
+	}
+
+	var req struct {
+		ProjectID   uuid.UUID  `json:"project_id" binding:"required"`
+		PartitionID *uuid.UUID `json:"partition_id,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The recipient must be able to place devices in the chosen project or partition
+	domains := []string{casbinx.BuildDomain("project", req.ProjectID.String())}
+	if req.PartitionID != nil {
+		domains = append([]string{casbinx.BuildDomain("partition", req.PartitionID.String())}, domains...)
+	}
+	if !authorizeAny(c, h.enforcer, h.logger, user, "devices", "write", "Access denied to target project", domains...) {
+		return
+	}
+
+	actor, ok := requestActor(c, user)
+	if !ok {
+		return
+	}
+
+	transfer, err := h.transferService.WithContext(c.Request.Context()).ApproveTransfer(transferUUID, actor, req.ProjectID, req.PartitionID)
+	if err != nil {
+		respondError(c, h.logger, err, "Failed to approve transfer")
+		return
+	}
+
+	h.logger.Info("Device transfer approved",
+		zap.String("transfer_id", transfer.ID.String()),
+		zap.String("device_id", transfer.DeviceID.String()),
+		zap.String("project_id", req.ProjectID.String()),
+		zap.String("user_id", user.UserID))
+
+	c.JSON(http.StatusOK, transfer)
+}
+
+// RejectTransfer declines a transfer as its recipient
+// POST /api/v1/transfers/:id/reject
+func (h *TransferHandler) RejectTransfer(c *gin.Context) {
+	h.closeTransfer(c, h.transferService.WithContext(c.Request.Context()).RejectTransfer, "Failed to reject transfer", "Device transfer rejected")
+}
+
+// CancelTransfer withdraws a transfer as its sender
+// POST /api/v1/transfers/:id/cancel
+func (h *TransferHandler) CancelTransfer(c *gin.Context) {
+	h.closeTransfer(c, h.transferService.WithContext(c.Request.Context()).CancelTransfer, "Failed to cancel transfer", "Device transfer cancelled")
+}
+
+func (h *TransferHandler) closeTransfer(c *gin.Context, fn func(uuid.UUID, services.Actor) (*models.DeviceTransfer, error), failMsg, logMsg string) {
+	user := auth.GetUserContext(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	transferUUID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transfer ID"})
+		return
+	}
+
+	actor, ok := requestActor(c, user)
+	if !ok {
+		return
+	}
+
+	transfer, err := fn(transferUUID, actor)
+	if err != nil {
+		respondError(c, h.logger, err, failMsg)
+		return
+	}
+
+	h.logger.Info(logMsg,
+		zap.String("transfer_id", transfer.ID.String()),
+		zap.String("device_id", transfer.DeviceID.String()),
+		zap.String("user_id", user.UserID))
+
+	c.JSON(http.StatusOK, transfer)
+}
@@ -1,12 +1,18 @@
 package auth
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
 	"strings"
+	"time"
 
 	"server/internal/casbinx"
 	"server/internal/casdoor"
+	"server/internal/domain/models"
 	"server/internal/domain/services"
+	"server/internal/tenant"
 	"server/pkg/errors"
 
 	"github.com/gin-gonic/gin"
@@ -16,21 +22,55 @@ import (
 
 // UserContext represents the current user context
 type UserContext struct {
-	UserID       string    `json:"user_id"`
+	UserID       string    `json:"user_id"`       // Casdoor user ID
+	LocalUserID  uuid.UUID `json:"local_user_id"` // models.User ID, recorded as the actor
 	Username     string    `json:"username"`
 	Email        string    `json:"email"`
-	Organization string    `json:"organization"`
-	OrgID        uuid.UUID `json:"org_id"`
+	Organization string    `json:"organization"` // Casdoor organization of the token
+	OrgID        uuid.UUID `json:"org_id"`       // active organization, see POST /auth/switch-org
+	HomeOrgID    uuid.UUID `json:"home_org_id"`  // local organization of the token
 	Roles        []string  `json:"roles"`
 	Groups       []string  `json:"groups"`
 	IsSuperUser  bool      `json:"is_super_user"`
+
+	session   string    // hash of the access token, keying the session's active organization
+	expiresAt time.Time // expiry of the access token
+}
+
+// OrgSwitched reports whether the session works in another organization than its own
+func (u *UserContext) OrgSwitched() bool {
+	return u.OrgID != u.HomeOrgID
+}
+
+// Subjects returns the Casbin subjects a request is checked as: the Casdoor user ID, the
+// local user ID that device shares and transfers are granted to, and the user's groups
+func (u *UserContext) Subjects() []string {
+	subjects := make([]string, 0, len(u.Groups)+2)
+	subjects = append(subjects, u.UserID)
+	if u.LocalUserID != uuid.Nil && u.LocalUserID.String() != u.UserID {
+		subjects = append(subjects, u.LocalUserID.String())
+	}
+	for _, group := range u.Groups {
+		subjects = append(subjects, casbinx.GroupSubject(group))
+	}
+	return subjects
+}
+
+// TenantContext scopes ctx to the user's active organization. Super users see every
+// organization until they switch to one, and only that one while switched.
+func (u *UserContext) TenantContext(ctx context.Context) context.Context {
+	if u.IsSuperUser && !u.OrgSwitched() {
+		return tenant.Bypass(ctx)
+	}
+	return tenant.WithOrg(ctx, u.OrgID)
 }
 
 // Middleware provides authentication and authorization middleware
 type Middleware struct {
 	casdoorClient *casdoor.Client
 	enforcer      *casbinx.Enforcer
-	orgService    *services.OrganizationService
+	provisioner   *services.ProvisioningService
+	sessions      *services.OrgSessionService
 	logger        *zap.Logger
 }
 
@@ -41,13 +81,15 @@ type Service = Middleware
 func New(
 	casdoorClient *casdoor.Client,
 	enforcer *casbinx.Enforcer,
-	orgService *services.OrganizationService,
+	provisioner *services.ProvisioningService,
+	sessions *services.OrgSessionService,
 	logger *zap.Logger,
 ) *Middleware {
 	return &Middleware{
 		casdoorClient: casdoorClient,
 		enforcer:      enforcer,
-		orgService:    orgService,
+		provisioner:   provisioner,
+		sessions:      sessions,
 		logger:        logger,
 	}
 }
@@ -92,35 +134,26 @@ func (m *Middleware) AuthRequired() gin.HandlerFunc {
 			return
 		}
 
-		// Get organization info
-		org, err := m.orgService.GetOrganizationByCasdoor(userInfo.Organization)
+		// Provision the local organization and user on first sight
+		userCtx, err := m.buildUserContext(userInfo, token)
 		if err != nil {
-			m.logger.Warn("Organization not found", zap.String("org", userInfo.Organization))
-			c.JSON(http.StatusForbidden, gin.H{
-				"error": "Organization not found or not authorized",
-			})
+			m.logger.Warn("User provisioning failed",
+				zap.String("org", userInfo.Organization),
+				zap.String("user", userInfo.ID),
+				zap.Error(err))
+			if appErr, ok := err.(*errors.AppError); ok {
+				c.JSON(appErr.HTTPStatus, gin.H{"error": appErr.Message})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to provision user"})
+			}
 			c.Abort()
 			return
 		}
 
-		// Check if user is super user
-		isSuperUser := m.casdoorClient.IsSuperOrganization(userInfo.Organization) ||
-			m.enforcer.IsSuperUser(userInfo.ID)
-
-		// Build user context
-		userCtx := &UserContext{
-			UserID:       userInfo.ID,
-			Username:     userInfo.Username,
-			Email:        userInfo.Email,
-			Organization: userInfo.Organization,
-			OrgID:        org.ID,
-			Roles:        userInfo.Roles,
-			Groups:       userInfo.Groups,
-			IsSuperUser:  isSuperUser,
-		}
-
-		// Store user context in gin context
+		// Store user context in gin context and scope the request's queries to the user's
+		// organization
 		c.Set("user", userCtx)
+		c.Request = c.Request.WithContext(userCtx.TenantContext(c.Request.Context()))
 		c.Next()
 	}
 }
@@ -141,11 +174,11 @@ func (m *Middleware) RequirePermission(resource, action string) gin.HandlerFunc
 			return
 		}
 
-		// Build domain based on organization
+		// Build domain based on the session's active organization
 		domain := casbinx.BuildDomain("org", userCtx.OrgID.String())
 
 		// Check permission
-		allowed, err := m.enforcer.Enforce(userCtx.UserID, domain, resource, action)
+		allowed, err := m.enforcer.EnforceAny(userCtx.Subjects(), domain, resource, action)
 		if err != nil {
 			m.logger.Error("Permission check failed", zap.Error(err))
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Permission check failed"})
@@ -201,7 +234,7 @@ func (m *Middleware) RequireResourcePermission(resourceType, action string) gin.
 		domain := casbinx.BuildDomain(resourceType, resourceID)
 
 		// Check permission
-		allowed, err := m.enforcer.Enforce(userCtx.UserID, domain, resourceType, action)
+		allowed, err := m.enforcer.EnforceAny(userCtx.Subjects(), domain, resourceType, action)
 		if err != nil {
 			m.logger.Error("Permission check failed", zap.Error(err))
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Permission check failed"})
@@ -212,7 +245,7 @@ func (m *Middleware) RequireResourcePermission(resourceType, action string) gin.
 		if !allowed {
 			// Also try organization-level permission
 			orgDomain := casbinx.BuildDomain("org", userCtx.OrgID.String())
-			allowed, err = m.enforcer.Enforce(userCtx.UserID, orgDomain, resourceType, action)
+			allowed, err = m.enforcer.EnforceAny(userCtx.Subjects(), orgDomain, resourceType, action)
 			if err != nil {
 				m.logger.Error("Permission check failed", zap.Error(err))
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Permission check failed"})
@@ -241,6 +274,26 @@ func GetUserContext(c *gin.Context) *UserContext {
 	return nil
 }
 
+// RequireSuperUser allows only users of the super organization
+func (m *Middleware) RequireSuperUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userCtx := GetUserContext(c)
+		if userCtx == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+
+		if !userCtx.IsSuperUser {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Super admin required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
 // RequireOrganization ensures user belongs to specified organization
 func (m *Middleware) RequireOrganization(orgID string) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -275,8 +328,13 @@ func (m *Middleware) ValidateToken(token string) (*UserContext, error) {
 		return nil, err
 	}
 
-	// Get organization info
-	org, err := m.orgService.GetOrganizationByCasdoor(userInfo.Organization)
+	return m.buildUserContext(userInfo, token)
+}
+
+// buildUserContext provisions the local organization and user for a verified token and
+// builds the request's user context, working in the organization the session switched to
+func (m *Middleware) buildUserContext(userInfo *casdoor.UserInfo, token string) (*UserContext, error) {
+	org, user, err := m.provisioner.ProvisionUser(userInfo)
 	if err != nil {
 		return nil, err
 	}
@@ -285,17 +343,66 @@ func (m *Middleware) ValidateToken(token string) (*UserContext, error) {
 	isSuperUser := m.casdoorClient.IsSuperOrganization(userInfo.Organization) ||
 		m.enforcer.IsSuperUser(userInfo.ID)
 
-	// Build user context
 	userCtx := &UserContext{
 		UserID:       userInfo.ID,
+		LocalUserID:  user.ID,
 		Username:     userInfo.Username,
 		Email:        userInfo.Email,
 		Organization: userInfo.Organization,
 		OrgID:        org.ID,
+		HomeOrgID:    org.ID,
 		Roles:        userInfo.Roles,
 		Groups:       userInfo.Groups,
 		IsSuperUser:  isSuperUser,
+		session:      sessionKey(token),
+		expiresAt:    userInfo.ExpiresAt,
+	}
+	if m.sessions != nil {
+		if orgID, ok := m.sessions.ActiveOrg(userCtx.session, user.ID); ok && m.canUseOrg(userCtx, orgID) {
+			userCtx.OrgID = orgID
+		}
 	}
-
 	return userCtx, nil
 }
+
+// SwitchOrganization makes orgID the active organization of the user's session. Users may
+// switch to their own organization and to any organization they hold a role in; super users
+// may switch anywhere.
+func (m *Middleware) SwitchOrganization(userCtx *UserContext, orgID uuid.UUID) (*models.Organization, error) {
+	if m.sessions == nil {
+		return nil, errors.NewInternalError("Organization switching is not available")
+	}
+	if !m.canUseOrg(userCtx, orgID) {
+		return nil, errors.NewForbiddenError("Not a member of the organization")
+	}
+	org, err := m.sessions.Switch(userCtx.session, userCtx.LocalUserID, orgID, userCtx.expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	userCtx.OrgID = org.ID
+	return org, nil
+}
+
+// canUseOrg reports whether the user may work in orgID: their own organization, one where
+// they or one of their groups hold a role, or any for super users
+func (m *Middleware) canUseOrg(userCtx *UserContext, orgID uuid.UUID) bool {
+	if userCtx.IsSuperUser || orgID == userCtx.HomeOrgID {
+		return true
+	}
+	domain := casbinx.BuildDomain("org", orgID.String())
+	for _, subject := range userCtx.Subjects() {
+		if len(m.enforcer.GetRolesForUser(subject, domain)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionKey identifies the login session of token without keeping the token itself
+func sessionKey(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
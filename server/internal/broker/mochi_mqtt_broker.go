@@ -2,10 +2,13 @@ package broker
 
 import (
 	"context"
+	"encoding/json"
+	"net"
 	"regexp"
 	"strings"
 	"sync"
 
+	"github.com/google/uuid"
 	mqtt "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/listeners"
 	"github.com/mochi-mqtt/server/v2/packets"
@@ -14,6 +17,7 @@ import (
 	"server/internal/config"
 	"server/internal/domain/models"
 	"server/internal/domain/services"
+	"server/pkg/errors"
 )
 
 // MochiBroker implements MQTT using mochi-mqtt/server v2
@@ -27,10 +31,10 @@ type MochiBroker struct {
 	running bool
 	mu      sync.RWMutex
 
-	// clientID -> normalized device ID (from password)
+	// clientID -> deviceIdentity
 	clientDevice sync.Map
 
-	// deviceID -> WS handler
+	// normalized MAC or IMEI -> WS handler
 	handlers   map[string]func(topic string, payload []byte)
 	handlersMu sync.RWMutex
 }
@@ -105,7 +109,9 @@ func (b *MochiBroker) Stop() error {
 	return nil
 }
 
-// PublishToDevice publishes data to devices/<id>/down
+// PublishToDevice publishes data to devices/<id>/down, where id is the device's MAC or IMEI.
+// A connected device may have subscribed under either, so the data goes out under each
+// identifier its client is known by.
 func (b *MochiBroker) PublishToDevice(deviceID, deviceBy string, payload []byte) error {
 	b.mu.RLock()
 	running := b.running
@@ -114,11 +120,16 @@ func (b *MochiBroker) PublishToDevice(deviceID, deviceBy string, payload []byte)
 	if !running || srv == nil {
 		return ErrBrokerNotRunning
 	}
-	topic := "devices/" + normalizeDeviceKey(deviceID) + "/down"
-	return srv.Publish(topic, payload, false, 1)
+	for _, key := range b.topicKeys(deviceID) {
+		if err := srv.Publish("devices/"+key+"/down", payload, false, 1); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// SubscribeToDevice registers WS handler for device uplinks
+// SubscribeToDevice registers WS handler for device uplinks. OnPublished delivers them, under
+// whichever of its identifiers the device publishes.
 func (b *MochiBroker) SubscribeToDevice(deviceID, deviceBy string, handler func(topic string, payload []byte)) error {
 	b.mu.RLock()
 	running := b.running
@@ -127,23 +138,9 @@ func (b *MochiBroker) SubscribeToDevice(deviceID, deviceBy string, handler func(
 	if !running || srv == nil {
 		return ErrBrokerNotRunning
 	}
-	id := normalizeDeviceKey(deviceID)
-	// store handler
 	b.handlersMu.Lock()
-	b.handlers[id] = handler
+	b.handlers[normalizeDeviceKey(deviceID)] = handler
 	b.handlersMu.Unlock()
-
-	// Inline subscribe to all uplink topics for this device
-	cb := func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
-		// deliver to handler
-		payload := make([]byte, len(pk.Payload))
-		copy(payload, pk.Payload)
-		handler(pk.TopicName, payload)
-	}
-	// Subscribe to up/status/register
-	_ = srv.Subscribe("devices/"+id+"/up", 1, cb)
-	_ = srv.Subscribe("devices/"+id+"/status", 1, cb)
-	_ = srv.Subscribe("devices/"+id+"/register", 1, cb)
 	return nil
 }
 
@@ -163,7 +160,7 @@ func (b *MochiBroker) GetStats() map[string]interface{} {
 	}
 }
 
-// Kick disconnects client by device id (MAC)
+// Kick disconnects client by device id (MAC or IMEI)
 func (b *MochiBroker) Kick(deviceID string) error {
 	b.mu.RLock()
 	srv := b.srv
@@ -174,15 +171,122 @@ func (b *MochiBroker) Kick(deviceID string) error {
 	target := normalizeDeviceKey(deviceID)
 	// Iterate clients from server and disconnect matches
 	for id, cl := range srv.Clients.GetAll() {
-		if v, ok := b.clientDevice.Load(id); ok {
-			if equalsDeviceID(toString(v), target) {
-				_ = srv.DisconnectClient(cl, packets.CodeSuccess)
-			}
+		if ident, ok := b.identity(id); ok && ident.owns(target) {
+			_ = srv.DisconnectClient(cl, packets.CodeSuccess)
 		}
 	}
 	return nil
 }
 
+// deviceIdentity is what an MQTT client authenticated as: the MAC or IMEI in its credentials
+// and, when it authenticated with the device's secret, both identifiers of the device. Its
+// topics may use either of them.
+type deviceIdentity struct {
+	id     string // normalized identifier from the credentials
+	by     string // "mac" or "imei"
+	secret bool   // authenticated with the device's secret rather than a legacy password
+	mac    string
+	imei   string
+}
+
+// withDevice returns the identity with the identifiers of dev. A legacy password proves
+// nothing beyond the identifier it names, so a legacy client keeps just that one.
+func (d deviceIdentity) withDevice(dev *models.Device) deviceIdentity {
+	if !d.secret {
+		return d
+	}
+	d.mac, d.imei = dev.MAC, ""
+	if dev.IMEI != nil {
+		d.imei = *dev.IMEI
+	}
+	return d
+}
+
+// keys returns the distinct identifiers of the client, the one from the credentials first
+func (d deviceIdentity) keys() []string {
+	keys := []string{d.id}
+	for _, key := range []string{d.mac, d.imei} {
+		if key != "" && key != d.id {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// owns reports whether key, a normalized MAC or IMEI, identifies the client
+func (d deviceIdentity) owns(key string) bool {
+	return key != "" && (key == d.id || key == d.mac || key == d.imei)
+}
+
+// identity returns the identity of a connected device client; the broker's own inline
+// client has none
+func (b *MochiBroker) identity(clientID string) (deviceIdentity, bool) {
+	v, ok := b.clientDevice.Load(clientID)
+	if !ok {
+		return deviceIdentity{}, false
+	}
+	ident, ok := v.(deviceIdentity)
+	return ident, ok
+}
+
+// updateIdentity records the identifiers of dev for a client, unless it has disconnected or
+// its identity changed meanwhile
+func (b *MochiBroker) updateIdentity(clientID string, ident deviceIdentity, dev *models.Device) deviceIdentity {
+	next := ident.withDevice(dev)
+	if next != ident && !b.clientDevice.CompareAndSwap(clientID, ident, next) {
+		return ident
+	}
+	return next
+}
+
+// refreshIdentity looks the device of a client authenticated by secret up again, as it may
+// have been given its other identifier since the client connected
+func (b *MochiBroker) refreshIdentity(clientID string, ident deviceIdentity) deviceIdentity {
+	if !ident.secret {
+		return ident
+	}
+	dev, err := b.deviceService.GetDeviceByIdentifier(ident.id, ident.by)
+	if err != nil || dev == nil {
+		return ident
+	}
+	return b.updateIdentity(clientID, ident, dev)
+}
+
+// topicKeys returns the identifiers to address a device by on its topics: those of its
+// connected client, or just deviceID when it is not connected
+func (b *MochiBroker) topicKeys(deviceID string) []string {
+	key := normalizeDeviceKey(deviceID)
+	keys := []string{key}
+	b.clientDevice.Range(func(_, v interface{}) bool {
+		if ident, ok := v.(deviceIdentity); ok && ident.owns(key) {
+			keys = ident.keys()
+			return false
+		}
+		return true
+	})
+	return keys
+}
+
+// audit queues an audit record of a broker event. Devices act without a user, so the actor
+// is nil and the client's address is recorded instead.
+func (b *MochiBroker) audit(remote, action, targetType string, targetID *uuid.UUID, detail map[string]interface{}) {
+	if b.auditService == nil {
+		return
+	}
+	b.auditService.Record(services.Actor{IP: remote}, action, targetType, targetID, detail)
+}
+
+// remoteIP returns the client's IP address without the port
+func remoteIP(cl *mqtt.Client) string {
+	if cl == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(cl.Net.Remote); err == nil {
+		return host
+	}
+	return cl.Net.Remote
+}
+
 // mochiHook implements fine-grained auth and ACL via hooks
 type mochiHook struct {
 	mqtt.HookBase
@@ -193,101 +297,149 @@ func (h *mochiHook) ID() string { return "dalitoolkit-auth-acl" }
 
 func (h *mochiHook) Provides(b byte) bool { return true }
 
-// OnConnectAuthenticate validates username/password
+// OnConnectAuthenticate validates username/password. The username is the device's MAC or,
+// for cellular gateways, its IMEI, and the password its secret. Legacy firmware uses the
+// shared device username with the MAC or IMEI as password, while its organization allows it.
 func (h *mochiHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 	username := string(pk.Connect.Username)
 	password := string(pk.Connect.Password)
-	if username != h.b.cfg.MQTTDeviceUsername {
-		h.b.logger.Warn("MQTT auth failed: username mismatch", zap.String("username", username))
-		return false
-	}
-	mac, err := services.NormalizeMAC(password)
-	if err != nil {
-		h.b.logger.Warn("MQTT auth failed: invalid MAC password", zap.String("password", password))
-		return false
+
+	var (
+		ident deviceIdentity
+		dev   *models.Device
+		auth  string
+	)
+	if username == h.b.cfg.MQTTDeviceUsername {
+		// Legacy firmware: the shared username with the MAC or IMEI as password
+		id := normalizeDeviceKey(password)
+		by := services.IdentifierType(id)
+		if by == "" {
+			h.b.logger.Warn("MQTT auth failed: invalid MAC or IMEI password", zap.String("client_id", cl.ID))
+			h.authFailed(cl, username, "invalid MAC or IMEI password")
+			return false
+		}
+		ident, auth = deviceIdentity{id: id, by: by}, "legacy"
+		// Unknown devices may still connect to register
+		if found, derr := h.b.deviceService.GetDeviceByIdentifier(id, by); derr == nil && found != nil {
+			allowed, aerr := h.b.deviceService.LegacyPasswordAllowed(found)
+			if aerr != nil {
+				h.b.logger.Error("MQTT auth failed: legacy password setting", zap.String("device_"+by, id), zap.Error(aerr))
+				return false
+			}
+			if !allowed {
+				h.b.logger.Warn("MQTT auth failed: legacy password disabled", zap.String("device_"+by, id))
+				h.authFailed(cl, username, "legacy password disabled")
+				return false
+			}
+			dev = found
+		}
+	} else {
+		// The device's MAC or IMEI with its own secret
+		id := normalizeDeviceKey(username)
+		by := services.IdentifierType(id)
+		if by == "" {
+			h.b.logger.Warn("MQTT auth failed: username mismatch", zap.String("username", username))
+			h.authFailed(cl, username, "username mismatch")
+			return false
+		}
+		found, aerr := h.b.deviceService.AuthenticateDevice(by, id, password)
+		if aerr != nil {
+			h.b.logger.Warn("MQTT auth failed: invalid device secret", zap.String("device_"+by, id), zap.Error(aerr))
+			h.authFailed(cl, username, "invalid device secret")
+			return false
+		}
+		ident, dev, auth = deviceIdentity{id: id, by: by, secret: true}, found, "secret"
 	}
-	h.b.clientDevice.Store(cl.ID, mac)
 
 	// Mark device online if exists
-	if dev, derr := h.b.deviceService.GetDeviceByIdentifier(mac, "mac"); derr == nil && dev != nil {
-		_ = h.b.deviceService.UpdateDeviceStatus(dev.ID, models.DeviceStatusOnline)
+	var deviceID *uuid.UUID
+	if dev != nil {
+		ident = ident.withDevice(dev)
+		_ = h.b.deviceService.ReportPresence(dev.ID, models.DeviceStatusOnline)
+		deviceID = &dev.ID
 	}
-	h.b.logger.Info("MQTT client connected", zap.String("client_id", cl.ID), zap.String("device_mac", mac))
+	h.b.clientDevice.Store(cl.ID, ident)
+	h.b.audit(remoteIP(cl), services.AuditActionMQTTConnect, "device", deviceID, map[string]interface{}{
+		"client_id": cl.ID, ident.by: ident.id, "auth": auth,
+	})
+	h.b.logger.Info("MQTT client connected", zap.String("client_id", cl.ID), zap.String("device_"+ident.by, ident.id))
 	return true
 }
 
+// authFailed audits a rejected connection
+func (h *mochiHook) authFailed(cl *mqtt.Client, username, reason string) {
+	h.b.audit(remoteIP(cl), services.AuditActionMQTTAuthFailed, "mqtt_client", nil, map[string]interface{}{
+		"client_id": cl.ID, "username": username, "reason": reason,
+	})
+}
+
 // OnDisconnect marks offline
 func (h *mochiHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
 	if v, ok := h.b.clientDevice.LoadAndDelete(cl.ID); ok {
-		if dev, derr := h.b.deviceService.GetDeviceByIdentifier(toString(v), "mac"); derr == nil && dev != nil {
-			_ = h.b.deviceService.UpdateDeviceStatus(dev.ID, models.DeviceStatusOffline)
+		ident, _ := v.(deviceIdentity)
+		if dev, derr := h.b.deviceService.GetDeviceByIdentifier(ident.id, ident.by); derr == nil && dev != nil {
+			_ = h.b.deviceService.ReportPresence(dev.ID, models.DeviceStatusOffline)
 		}
 		h.b.logger.Info("MQTT client disconnected", zap.String("client_id", cl.ID), zap.Error(err))
 	}
 }
 
-// OnACLCheck allow per-topic rules
+// OnACLCheck allow per-topic rules. <id> may be either the MAC or the IMEI of the client's
+// device.
 func (h *mochiHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
-	// lookup device id from connect
-	v, _ := h.b.clientDevice.Load(cl.ID)
-	did := toString(v)
-	if did == "" {
+	// lookup device identity from connect
+	ident, ok := h.b.identity(cl.ID)
+	if !ok {
+		return false
+	}
+	id, kind := parseDeviceTopic(topic)
+	if id == "" {
 		return false
 	}
 	if write {
 		// publish allowed only to devices/<id>/(up|status|register)
-		id, kind := parseDeviceTopic(topic)
-		if id == "" {
-			return false
-		}
-		if !equalsDeviceID(did, id) {
+		if kind != "up" && kind != "status" && kind != "register" {
 			return false
 		}
-		if kind == "up" || kind == "status" || kind == "register" {
-			return true
-		}
+	} else if kind != "down" || topic != "devices/"+id+"/down" {
+		// subscribe: only to devices/<id>/down, with <id> normalized as the server publishes it
 		return false
 	}
-	// subscribe: only to devices/<id>/down
-	expected := "devices/" + normalizeDeviceKey(did) + "/down"
-	return topic == expected
+	return ident.owns(id) || h.b.refreshIdentity(cl.ID, ident).owns(id)
 }
 
 // OnPublished fanout to WS and device lifecycle handling
 func (h *mochiHook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
-	// only handle publish from clients (not inline) on device topics
-	id, kind := parseDeviceTopic(pk.TopicName)
-	if id == "" {
+	// only handle publish from device clients (not inline) on device topics
+	ident, ok := h.b.identity(cl.ID)
+	if !ok {
 		return
 	}
+	_, kind := parseDeviceTopic(pk.TopicName)
+	if kind == "" {
+		return
+	}
+	payload := make([]byte, len(pk.Payload))
+	copy(payload, pk.Payload)
 
 	// Update lifecycle
-	go h.b.handleDeviceLifecycleOnPublish(id, kind, pk.Payload)
+	go h.b.handleDeviceLifecycleOnPublish(cl.ID, ident, kind, payload, remoteIP(cl))
 
-	// deliver to handler if exists
+	// deliver to the handlers of WS sessions opened by either identifier of the device
 	h.b.handlersMu.RLock()
-	handler := h.b.handlers[id]
-	h.b.handlersMu.RUnlock()
-	if handler != nil {
-		payload := make([]byte, len(pk.Payload))
-		copy(payload, pk.Payload)
-		go handler(pk.TopicName, payload)
+	defer h.b.handlersMu.RUnlock()
+	for _, key := range ident.keys() {
+		if handler := h.b.handlers[key]; handler != nil {
+			go handler(pk.TopicName, payload)
+		}
 	}
 }
 
 // helpers from old gmqtt implementation (adapted)
-func toString(v interface{}) string {
-	if v == nil {
-		return ""
-	}
-	if s, ok := v.(string); ok {
-		return s
-	}
-	return ""
-}
-
 var macRegex = regexp.MustCompile(`^[0-9A-F]{12}$`)
 
+// normalizeDeviceKey drops the separators of a MAC and upper-cases it. Anything else, such
+// as an IMEI, which is digits only, is returned unchanged.
 func normalizeDeviceKey(id string) string {
 	up := strings.ToUpper(strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(id, ":", ""), "-", ""), ".", ""))
 	if macRegex.MatchString(up) {
@@ -316,32 +468,107 @@ type BrokerError struct{ msg string }
 
 func (e *BrokerError) Error() string { return e.msg }
 
-// device lifecycle
-func (b *MochiBroker) handleDeviceLifecycleOnPublish(deviceID, kind string, payload []byte) {
-	dev, err := b.deviceService.GetDeviceByIdentifier(deviceID, "mac")
-	if err == nil && dev != nil {
-		switch kind {
-		case "status":
-			text := strings.TrimSpace(strings.ToLower(string(payload)))
-			status := models.DeviceStatusOnline
-			if strings.Contains(text, "offline") {
-				status = models.DeviceStatusOffline
+// device lifecycle of a publish by a client, looked up by the identifier it authenticated with
+func (b *MochiBroker) handleDeviceLifecycleOnPublish(clientID string, ident deviceIdentity, kind string, payload []byte, remote string) {
+	if kind == "register" {
+		b.handleRegister(clientID, ident, payload, remote)
+		return
+	}
+	dev, err := b.deviceService.GetDeviceByIdentifier(ident.id, ident.by)
+	if err != nil || dev == nil {
+		return
+	}
+	b.updateIdentity(clientID, ident, dev)
+	status := models.DeviceStatusOnline
+	if kind == "status" && strings.Contains(strings.ToLower(string(payload)), "offline") {
+		status = models.DeviceStatusOffline
+	}
+	_ = b.deviceService.ReportPresence(dev.ID, status)
+}
+
+// handleRegister handles a registration, see services.DeviceRegistration. Unknown devices
+// are created when factory registration is allowed. The device is sent the result on its
+// down topic, followed by a claim code when it gets one; a rejected registration is audited.
+// Anyone may use a legacy password, so once a device has a secret only clients with it get
+// a code; until then the code goes to the legacy client whose identifiers just checked out.
+func (b *MochiBroker) handleRegister(clientID string, ident deviceIdentity, payload []byte, remote string) {
+	reg, err := services.ParseDeviceRegistration(payload)
+	var dev *models.Device
+	var created bool
+	if err == nil {
+		dev, created, err = b.deviceService.RegisterDevice(ident.by, ident.id, ident.secret, reg, b.cfg.FactoryDefaultProjectID, b.cfg.FactoryAllowRegistration)
+	}
+	if err != nil {
+		b.sendRegistrationResult(ident.id, nil, false, err)
+		if appErr, ok := err.(*errors.AppError); ok && (appErr.Code == errors.ErrCodeValidation || appErr.Code == errors.ErrCodeConflict) {
+			var deviceID *uuid.UUID
+			if known, derr := b.deviceService.GetDeviceByIdentifier(ident.id, ident.by); derr == nil && known != nil {
+				deviceID = &known.ID
 			}
-			_ = b.deviceService.UpdateDeviceStatus(dev.ID, status)
-		default:
-			_ = b.deviceService.UpdateDeviceStatus(dev.ID, models.DeviceStatusOnline)
+			b.audit(remote, services.AuditActionDeviceRegisterRejected, "device", deviceID, map[string]interface{}{
+				"client_id": clientID, ident.by: ident.id, "error": appErr,
+			})
 		}
+		b.logger.Warn("Device registration rejected", zap.String(ident.by, ident.id), zap.Error(err))
 		return
 	}
 
-	// best-effort: for unknown devices and register topic, auto-register if enabled
-	if kind == "register" && b.cfg.FactoryAllowRegistration {
-		// minimal fields handled server-side already (full parsing in domain service)
-		if dev2, created, e := b.deviceService.FindOrCreateForRegistration(deviceID, nil, "", models.DeviceTypeOther, b.cfg.FactoryDefaultProjectID, true); e == nil && dev2 != nil {
-			_ = b.deviceService.UpdateDeviceStatus(dev2.ID, models.DeviceStatusOnline)
-			if created {
-				b.logger.Info("Device auto-registered via MQTT", zap.String("mac", deviceID), zap.String("device_id", dev2.ID.String()))
-			}
+	ident = b.updateIdentity(clientID, ident, dev)
+	_ = b.deviceService.ReportPresence(dev.ID, models.DeviceStatusOnline)
+	if created {
+		b.logger.Info("Device auto-registered via MQTT", zap.String(ident.by, ident.id), zap.String("device_id", dev.ID.String()))
+		b.audit(remote, services.AuditActionDeviceRegister, "device", &dev.ID, map[string]interface{}{
+			"mac": dev.MAC, "imei": dev.IMEI, "project_id": dev.ProjectID,
+		})
+	}
+	b.sendRegistrationResult(ident.id, dev, created, nil)
+	if ident.secret {
+		b.sendClaimCode(dev, ident.id)
+		return
+	}
+	hasSecret, err := b.deviceService.HasCredentials(dev)
+	if err != nil {
+		b.logger.Warn("Failed to check device credentials", zap.String("device_id", dev.ID.String()), zap.Error(err))
+		return
+	}
+	if !hasSecret {
+		b.sendClaimCode(dev, ident.id)
+	}
+}
+
+// sendRegistrationResult sends the result of a registration on devices/<key>/down:
+// {"type":"register_result","ok":true,"device_id":...,"created":...,"status":...} or
+// {"type":"register_result","ok":false,"error":{"code":...,"message":...,"details":...}}
+func (b *MochiBroker) sendRegistrationResult(key string, dev *models.Device, created bool, err error) {
+	result := map[string]interface{}{"type": "register_result", "ok": err == nil}
+	if err != nil {
+		appErr, ok := err.(*errors.AppError)
+		if !ok {
+			appErr = errors.NewInternalError("Registration failed")
 		}
+		result["error"] = appErr
+	} else {
+		result["device_id"], result["created"], result["status"] = dev.ID, created, dev.Status
+	}
+	payload, _ := json.Marshal(result)
+	if perr := b.PublishToDevice(key, "", payload); perr != nil {
+		b.logger.Warn("Failed to send registration result", zap.String("device_key", key), zap.Error(perr))
+	}
+}
+
+// sendClaimCode issues a claim code to an unbound device and sends it on devices/<key>/down
+// as {"type":"claim_code","claim_code":...,"expires_at":...}, for the device to show
+func (b *MochiBroker) sendClaimCode(dev *models.Device, key string) {
+	code, expiresAt, err := b.deviceService.IssueRegistrationClaimCode(dev, b.cfg.ClaimCodeTTL)
+	if err != nil {
+		b.logger.Warn("Failed to issue claim code", zap.String("device_id", dev.ID.String()), zap.Error(err))
+		return
+	}
+	if code == "" {
+		return
+	}
+	payload, _ := json.Marshal(map[string]interface{}{"type": "claim_code", "claim_code": code, "expires_at": expiresAt})
+	if err := b.PublishToDevice(key, "", payload); err != nil {
+		b.logger.Warn("Failed to send claim code", zap.String("device_id", dev.ID.String()), zap.Error(err))
 	}
 }
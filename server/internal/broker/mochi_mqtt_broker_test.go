@@ -1,6 +1,22 @@
 package broker
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"server/internal/casbinx"
+	"server/internal/config"
+	"server/internal/domain/models"
+	"server/internal/domain/services"
+)
 
 func TestNormalizeDeviceKey(t *testing.T) {
 	cases := []struct {
@@ -11,6 +27,7 @@ func TestNormalizeDeviceKey(t *testing.T) {
 		{"aa-bb-cc-dd-ee-ff", "AABBCCDDEEFF"},
 		{"aabb.ccdd.eeff", "AABBCCDDEEFF"},
 		{"AABBCCDDEEFF", "AABBCCDDEEFF"},
+		{"861234567890123", "861234567890123"},
 		{"notamac", "notamac"},
 	}
 	for _, c := range cases {
@@ -45,3 +62,313 @@ func TestParseDeviceTopic(t *testing.T) {
 		t.Fatalf("expected empty results for invalid topic, got id=%q kind=%q", id, kind)
 	}
 }
+
+func TestDeviceIdentity(t *testing.T) {
+	ident := deviceIdentity{id: "861234567890123", by: "imei", secret: true}
+	if keys := ident.keys(); len(keys) != 1 || keys[0] != "861234567890123" {
+		t.Fatalf("unexpected keys before the device is known: %v", keys)
+	}
+	imei := "861234567890123"
+	device := &models.Device{MAC: "AABBCCDDEEFF", IMEI: &imei}
+	if legacy := (deviceIdentity{id: imei, by: "imei"}).withDevice(device); len(legacy.keys()) != 1 {
+		t.Fatalf("unexpected keys of a legacy identity: %v", legacy.keys())
+	}
+	ident = ident.withDevice(device)
+	keys := ident.keys()
+	if len(keys) != 2 || keys[0] != "861234567890123" || keys[1] != "AABBCCDDEEFF" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if !ident.owns("AABBCCDDEEFF") || !ident.owns("861234567890123") {
+		t.Fatal("expected the identity to own both identifiers")
+	}
+	if ident.owns("") || ident.owns("112233445566") {
+		t.Fatal("expected the identity to own no other identifier")
+	}
+}
+
+func TestMochiHook_IMEIClients(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Organization{}, &models.Project{}, &models.Partition{}, &models.Device{},
+		&models.DeviceCredential{}, &models.OrganizationSetting{}); err != nil {
+		t.Fatal(err)
+	}
+	project := &models.Project{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: uuid.New(), Name: "Factory", CreatedBy: uuid.New()}
+	if err := db.Create(project).Error; err != nil {
+		t.Fatal(err)
+	}
+	deviceService := services.NewDeviceService(db)
+	imei := "861234567890123"
+	device, err := deviceService.CreateDevice("aa:bb:cc:dd:ee:01", &imei, models.DeviceTypeLTE, project.ID, nil, "Gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := deviceService.IssueCredentials(device, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{MQTTDeviceUsername: "device"}
+	b := NewMQTTBroker(cfg, deviceService, nil, zap.NewNop())
+	h := &mochiHook{b: b}
+	connectAs := func(id, username, password string) *mqtt.Client {
+		cl := &mqtt.Client{ID: id}
+		pk := packets.Packet{Connect: packets.ConnectParams{Username: []byte(username), Password: []byte(password)}}
+		if !h.OnConnectAuthenticate(cl, pk) {
+			t.Fatalf("expected %q to authenticate", username)
+		}
+		return cl
+	}
+	connect := func(id, password string) *mqtt.Client { return connectAs(id, "device", password) }
+
+	if h.OnConnectAuthenticate(&mqtt.Client{ID: "bad"}, packets.Packet{Connect: packets.ConnectParams{
+		Username: []byte("device"), Password: []byte("1234567890123"),
+	}}) {
+		t.Fatal("expected a password that is neither MAC nor IMEI to be rejected")
+	}
+
+	gw := connectAs("gw", imei, creds.Password)
+	for topic, want := range map[string]bool{
+		"devices/861234567890123/up":     true,
+		"devices/AABBCCDDEE01/status":    true,
+		"devices/aa:bb:cc:dd:ee:01/up":   true,
+		"devices/861234567890123/down":   false,
+		"devices/861234567890124/up":     false,
+		"devices/AABBCCDDEE02/register":  false,
+		"devices/861234567890123/up/sub": false,
+	} {
+		if got := h.OnACLCheck(gw, topic, true); got != want {
+			t.Fatalf("publish to %q: expected %v, got %v", topic, want, got)
+		}
+	}
+	for topic, want := range map[string]bool{
+		"devices/861234567890123/down":   true,
+		"devices/AABBCCDDEE01/down":      true,
+		"devices/aa:bb:cc:dd:ee:01/down": false,
+		"devices/861234567890123/up":     false,
+	} {
+		if got := h.OnACLCheck(gw, topic, false); got != want {
+			t.Fatalf("subscribe to %q: expected %v, got %v", topic, want, got)
+		}
+	}
+	if keys := b.topicKeys("AA:BB:CC:DD:EE:01"); len(keys) != 2 || keys[0] != imei {
+		t.Fatalf("unexpected topic keys: %v", keys)
+	}
+
+	// A WebSocket session opened by MAC receives uplinks published under the IMEI
+	received := make(chan string, 1)
+	b.handlers["AABBCCDDEE01"] = func(topic string, payload []byte) { received <- topic + " " + string(payload) }
+	h.OnPublished(gw, packets.Packet{TopicName: "devices/861234567890123/up", Payload: []byte("hello")})
+	select {
+	case got := <-received:
+		if got != "devices/861234567890123/up hello" {
+			t.Fatalf("unexpected uplink %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the uplink to reach the MAC session")
+	}
+
+	// A legacy password proves only the identifier it names, even once the device is known
+	legacy := connect("legacy", imei)
+	if !h.OnACLCheck(legacy, "devices/861234567890123/up", true) || h.OnACLCheck(legacy, "devices/AABBCCDDEE01/up", true) {
+		t.Fatal("expected a legacy client to be limited to its own IMEI")
+	}
+	late := connect("late", "861234567890124")
+	lateIMEI := "861234567890124"
+	if _, err := deviceService.CreateDevice("AABBCCDDEE02", &lateIMEI, models.DeviceTypeLTE, project.ID, nil, "Late"); err != nil {
+		t.Fatal(err)
+	}
+	if h.OnACLCheck(late, "devices/AABBCCDDEE02/up", true) {
+		t.Fatal("expected the MAC of a device registered later to stay off limits")
+	}
+
+	// The IMEI of a device given one after its client connected by secret is learned on first use
+	other, err := deviceService.CreateDevice("AABBCCDDEE03", nil, models.DeviceTypeLTE, project.ID, nil, "Other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCreds, err := deviceService.IssueCredentials(other, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := connectAs("secret", otherCreds.Username, otherCreds.Password)
+	if h.OnACLCheck(secret, "devices/861234567890125/up", true) {
+		t.Fatal("expected an unknown IMEI to be rejected")
+	}
+	if err := db.Model(&models.Device{}).Where("id = ?", other.ID).Update("imei", "861234567890125").Error; err != nil {
+		t.Fatal(err)
+	}
+	if !h.OnACLCheck(secret, "devices/861234567890125/up", true) {
+		t.Fatal("expected the IMEI of the device to be allowed")
+	}
+
+	h.OnDisconnect(gw, nil, false)
+	if _, ok := b.identity("gw"); ok {
+		t.Fatal("expected the identity to be dropped on disconnect")
+	}
+}
+
+func TestMochiHook_DeviceSecrets(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Organization{}, &models.Project{}, &models.Partition{}, &models.Device{},
+		&models.DeviceCredential{}, &models.OrganizationSetting{}); err != nil {
+		t.Fatal(err)
+	}
+	project := &models.Project{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: uuid.New(), Name: "Site", CreatedBy: uuid.New()}
+	if err := db.Create(project).Error; err != nil {
+		t.Fatal(err)
+	}
+	deviceService := services.NewDeviceService(db)
+	imei := "861234567890140"
+	device, err := deviceService.CreateDevice("AA:BB:CC:DD:EE:10", &imei, models.DeviceTypeLTE, project.ID, nil, "Gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := deviceService.IssueCredentials(device, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := deviceService.IssueCredentials(device, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewMQTTBroker(&config.Config{MQTTDeviceUsername: "device"}, deviceService, nil, zap.NewNop())
+	h := &mochiHook{b: b}
+	authenticate := func(id, username, password string) bool {
+		return h.OnConnectAuthenticate(&mqtt.Client{ID: id}, packets.Packet{Connect: packets.ConnectParams{
+			Username: []byte(username), Password: []byte(password),
+		}})
+	}
+
+	for _, c := range []struct {
+		username, password string
+		want               bool
+	}{
+		{creds.Username, creds.Password, true},
+		{"aa:bb:cc:dd:ee:10", creds.Password, true},
+		{imei, creds.Password, true},
+		{creds.Username, old.Password, true},
+		{creds.Username, "wrong", false},
+		{"AABBCCDDEE11", creds.Password, false},
+		{"someone", creds.Password, false},
+		{"device", "AA:BB:CC:DD:EE:10", true},
+	} {
+		if got := authenticate("c", c.username, c.password); got != c.want {
+			t.Fatalf("%q/%q: expected %v, got %v", c.username, c.password, c.want, got)
+		}
+	}
+	if !authenticate("c", creds.Username, creds.Password) || !h.OnACLCheck(&mqtt.Client{ID: "c"}, "devices/861234567890140/up", true) {
+		t.Fatal("expected a client authenticated by secret to publish under its IMEI")
+	}
+
+	// Once the organization turns legacy passwords off only secrets work; unknown devices
+	// may still connect to register
+	setting := &models.OrganizationSetting{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: project.OrgID}
+	if err := db.Create(setting).Error; err != nil {
+		t.Fatal(err)
+	}
+	if authenticate("legacy", "device", "AABBCCDDEE10") {
+		t.Fatal("expected the legacy password to be rejected")
+	}
+	if !authenticate("secret", creds.Username, creds.Password) {
+		t.Fatal("expected the secret to keep working")
+	}
+	if !authenticate("new", "device", "AABBCCDDEE12") {
+		t.Fatal("expected an unknown device to connect with its MAC")
+	}
+}
+
+func TestMochiHook_RegisterAndClaim(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Organization{}, &models.User{}, &models.Project{}, &models.Partition{}, &models.Device{},
+		&models.DeviceBinding{}, &models.DeviceShare{}, &models.DeviceClaimCode{}, &models.DeviceClaimAttempt{}, &models.DeviceCredential{},
+		&models.CasbinRule{}, &models.AuditLog{}, &models.OrganizationSetting{}); err != nil {
+		t.Fatal(err)
+	}
+	factory := &models.Project{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: uuid.New(), Name: "Factory", CreatedBy: uuid.New()}
+	site := &models.Project{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: uuid.New(), Name: "Site", CreatedBy: uuid.New()}
+	if err := db.Create([]*models.Project{factory, site}).Error; err != nil {
+		t.Fatal(err)
+	}
+	enforcer, err := casbinx.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceService := services.NewDeviceService(db)
+
+	cfg := &config.Config{MQTTDeviceUsername: "device", FactoryAllowRegistration: true, FactoryDefaultProjectID: factory.ID.String()}
+	b := NewMQTTBroker(cfg, deviceService, nil, zap.NewNop())
+	srv := mqtt.New(&mqtt.Options{InlineClient: true})
+	if err := srv.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	b.srv, b.running = srv, true
+	down := make(chan map[string]interface{}, 4)
+	if err := srv.Subscribe("devices/AABBCCDDEE60/down", 1, func(_ *mqtt.Client, _ packets.Subscription, pk packets.Packet) {
+		var msg map[string]interface{}
+		_ = json.Unmarshal(pk.Payload, &msg)
+		down <- msg
+	}); err != nil {
+		t.Fatal(err)
+	}
+	receive := func(kind string) map[string]interface{} {
+		select {
+		case msg := <-down:
+			if msg["type"] != kind {
+				t.Fatalf("expected %s, got %v", kind, msg)
+			}
+			return msg
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s", kind)
+		}
+		return nil
+	}
+
+	// A new device on the legacy path registers and is sent its first claim code
+	h := &mochiHook{b: b}
+	cl := &mqtt.Client{ID: "new"}
+	if !h.OnConnectAuthenticate(cl, packets.Packet{Connect: packets.ConnectParams{Username: []byte("device"), Password: []byte("AA:BB:CC:DD:EE:60")}}) {
+		t.Fatal("expected an unknown device to connect with its MAC")
+	}
+	ident, _ := b.identity(cl.ID)
+	b.handleRegister(cl.ID, ident, []byte(`{"name":"Gateway"}`), "")
+	if ok, _ := receive("register_result")["ok"].(bool); !ok {
+		t.Fatal("expected the registration to succeed")
+	}
+	code, _ := receive("claim_code")["claim_code"].(string)
+	if code == "" {
+		t.Fatal("expected a claim code")
+	}
+
+	// The installer claims the device with the code it shows
+	device, err := deviceService.GetDeviceByIdentifier("AABBCCDDEE60", "mac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	customer := services.Actor{UserID: uuid.New()}
+	if _, creds, err := services.NewDeviceBindingService(db, enforcer, zap.NewNop()).ClaimDevice(device, customer, code, site.ID, nil); err != nil || creds == nil {
+		t.Fatalf("expected the claim to succeed with credentials, got %v", err)
+	}
+
+	// The device now has a secret, so legacy clients get no further codes, bound or not
+	if err := db.Model(&models.Device{}).Where("id = ?", device.ID).Update("status", models.DeviceStatusUnbound).Error; err != nil {
+		t.Fatal(err)
+	}
+	b.handleRegister(cl.ID, ident, nil, "")
+	receive("register_result")
+	select {
+	case msg := <-down:
+		t.Fatalf("expected no further message, got %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
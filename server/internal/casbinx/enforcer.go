@@ -1,6 +1,8 @@
 package casbinx
 
 import (
+	"strings"
+
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/model"
 	gormadapter "github.com/casbin/gorm-adapter/v3"
@@ -67,6 +69,17 @@ func (e *Enforcer) Enforce(sub, dom, obj, act string) (bool, error) {
 	return e.enforcer.Enforce(sub, dom, obj, act)
 }
 
+// EnforceAny checks whether any of the subjects is allowed obj/act in dom
+func (e *Enforcer) EnforceAny(subjects []string, dom, obj, act string) (bool, error) {
+	for _, sub := range subjects {
+		allowed, err := e.enforcer.Enforce(sub, dom, obj, act)
+		if err != nil || allowed {
+			return allowed, err
+		}
+	}
+	return false, nil
+}
+
 // AddPolicy adds a policy
 func (e *Enforcer) AddPolicy(sub, dom, obj, act string) (bool, error) {
 	return e.enforcer.AddPolicy(sub, dom, obj, act)
@@ -147,9 +160,58 @@ func (e *Enforcer) InitDefaultPolicies() error {
 		}
 	}
 
+	// Domains are compared exactly, so device:<id> domains granted before their role
+	// policies were written per device get them now
+	groupings, err := e.enforcer.GetGroupingPolicy()
+	if err != nil {
+		return err
+	}
+	for _, g := range groupings {
+		if len(g) == 3 && strings.HasPrefix(g[2], "device:") && g[2] != "device:*" {
+			if err := e.AddDeviceRolePolicies(g[2]); err != nil {
+				return err
+			}
+		}
+	}
+
 	return e.SavePolicy()
 }
 
+// deviceRolePolicies lists what each device role may do in its device:<id> domain
+var deviceRolePolicies = [][]string{
+	{"role:device_owner", "devices", "manage"},
+	{"role:device_owner", "devices", "write"},
+	{"role:device_owner", "devices", "read"},
+	{"role:device_editor", "devices", "write"},
+	{"role:device_editor", "devices", "read"},
+	{"role:device_viewer", "devices", "read"},
+}
+
+// AddDeviceRolePolicies writes the device role policies into a device:<id> domain. Call it
+// before adding a grouping in that domain; policies already present are left as they are.
+func (e *Enforcer) AddDeviceRolePolicies(domain string) error {
+	for _, p := range deviceRolePolicies {
+		if _, err := e.enforcer.AddPolicy(p[0], domain, p[1], p[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveDeviceRolePolicies removes the device role policies of a device:<id> domain
+func (e *Enforcer) RemoveDeviceRolePolicies(domain string) (bool, error) {
+	return e.enforcer.RemoveFilteredPolicy(1, domain)
+}
+
+// RemoveDomain removes every policy and grouping of a domain
+func (e *Enforcer) RemoveDomain(domain string) error {
+	if _, err := e.enforcer.RemoveFilteredPolicy(1, domain); err != nil {
+		return err
+	}
+	_, err := e.enforcer.RemoveFilteredGroupingPolicy(2, domain)
+	return err
+}
+
 // BuildDomain builds domain string from resource type and ID
 func BuildDomain(resourceType, resourceID string) string {
 	return resourceType + ":" + resourceID
@@ -185,6 +247,22 @@ func (e *Enforcer) RemoveGroupingPolicy(subject, role, domain string) (bool, err
 	return e.enforcer.RemoveGroupingPolicy(subject, role, domain)
 }
 
+// RemoveFilteredGroupingPolicy removes grouping policies matching the field filter
+func (e *Enforcer) RemoveFilteredGroupingPolicy(fieldIndex int, fieldValues ...string) (bool, error) {
+	return e.enforcer.RemoveFilteredGroupingPolicy(fieldIndex, fieldValues...)
+}
+
+// DeviceRoleName returns the Casbin role for a device share role (owner, editor, viewer)
+func DeviceRoleName(role string) string {
+	return "role:device_" + role
+}
+
+// GroupSubject returns the Casbin subject for a Casdoor group. Requests are checked against
+// the user and each group in their token, so a group grant reaches every member.
+func GroupSubject(casdoorGroupID string) string {
+	return "group:" + casdoorGroupID
+}
+
 // GetFilteredGroupingPolicy gets filtered grouping policies
 func (e *Enforcer) GetFilteredGroupingPolicy(fieldIndex int, fieldValue string) [][]string {
 	policies, err := e.enforcer.GetFilteredGroupingPolicy(fieldIndex, fieldValue)
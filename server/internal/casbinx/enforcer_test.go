@@ -1,6 +1,7 @@
 package casbinx
 
 import (
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -97,6 +98,82 @@ func TestEnforcer_DomainIsolation(t *testing.T) {
 	assert.False(t, allowed)
 }
 
+func TestEnforcer_DeviceShareDomain(t *testing.T) {
+	enforcer := setupTestEnforcer(t)
+
+	require.NoError(t, enforcer.AddDeviceRolePolicies("device:abc"))
+	_, err := enforcer.AddGroupingPolicy(GroupSubject("acme/contractors"), DeviceRoleName("viewer"), "device:abc")
+	assert.NoError(t, err)
+	_, err = enforcer.AddGroupingPolicy(GroupSubject("acme/contractors"), DeviceRoleName("viewer"), "device:def")
+	assert.NoError(t, err)
+
+	// Role policies apply to the device domains that carry them only
+	allowed, err := enforcer.Enforce(GroupSubject("acme/contractors"), "device:abc", "devices", "read")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = enforcer.Enforce(GroupSubject("acme/contractors"), "device:def", "devices", "read")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	allowed, err = enforcer.Enforce(GroupSubject("acme/contractors"), "device:abc", "devices", "write")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	_, err = enforcer.RemoveDeviceRolePolicies("device:abc")
+	assert.NoError(t, err)
+	allowed, err = enforcer.Enforce(GroupSubject("acme/contractors"), "device:abc", "devices", "read")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestEnforcer_DomainsMatchExactly(t *testing.T) {
+	enforcer := setupTestEnforcer(t)
+
+	// Wildcard domains in policies are not patterns; a grant reaches its own domain only
+	_, err := enforcer.AddPolicy("role:project_viewer", "project:*", "devices", "read")
+	assert.NoError(t, err)
+	_, err = enforcer.AddPolicy("role:project_admin", "project:abc", "devices", "write")
+	assert.NoError(t, err)
+	_, err = enforcer.AddRoleForUser("alice", "role:project_viewer", "project:abc")
+	assert.NoError(t, err)
+	_, err = enforcer.AddRoleForUser("alice", "role:project_admin", "project:abc")
+	assert.NoError(t, err)
+
+	allowed, err := enforcer.Enforce("alice", "project:abc", "devices", "read")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	allowed, err = enforcer.Enforce("alice", "project:abc", "devices", "write")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = enforcer.Enforce("alice", "project:abcd", "devices", "write")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestEnforcer_InitDefaultPoliciesBackfillsDevices(t *testing.T) {
+	// InitDefaultPolicies saves in a transaction, which needs a database every connection sees
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "casbin.db")), &gorm.Config{})
+	require.NoError(t, err)
+	enforcer, err := New(db)
+	require.NoError(t, err)
+
+	// A grouping written before device domains carried their own role policies
+	_, err = enforcer.AddGroupingPolicy("alice", DeviceRoleName("owner"), "device:abc")
+	require.NoError(t, err)
+	require.NoError(t, enforcer.InitDefaultPolicies())
+
+	allowed, err := enforcer.Enforce("alice", "device:abc", "devices", "manage")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = enforcer.Enforce("alice", "device:def", "devices", "read")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+}
+
 func TestBuildDomain(t *testing.T) {
 	domain := BuildDomain("org", "123")
 	assert.Equal(t, "org:123", domain)
@@ -26,6 +26,8 @@ type UserInfo struct {
 	Organization string   `json:"organization"`
 	Roles        []string `json:"roles"`
 	Groups       []string `json:"groups"`
+
+	ExpiresAt time.Time `json:"-"` // expiry of the verified token, zero when it has none
 }
 
 // New creates a new Casdoor client
@@ -71,6 +73,9 @@ func (c *Client) VerifyToken(tokenString string) (*UserInfo, error) {
 		Organization: claims.Owner,
 		Groups:       claims.Groups,
 	}
+	if claims.ExpiresAt != nil {
+		userInfo.ExpiresAt = claims.ExpiresAt.Time
+	}
 	// Roles mapping if available via permissions/roles
 	if claims.Roles != nil {
 		names := make([]string, 0, len(claims.Roles))
@@ -100,36 +105,109 @@ func (c *Client) ParseClaims(accessToken string) (*casdoorsdk.Claims, error) {
 	return c.client.ParseJwtToken(accessToken)
 }
 
-// GetUsers fetches users from Casdoor organization
+// GroupInfo represents group information from Casdoor
+type GroupInfo struct {
+	ID          string `json:"id"` // owner/name, as carried in the groups claim of user tokens
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	ParentID    string `json:"parent_id"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// GetUsers fetches users from Casdoor organization. Users deleted upstream are omitted.
 func (c *Client) GetUsers(ctx context.Context, orgName string) ([]UserInfo, error) {
 	// Use SDK to get users
-	users, err := c.client.GetUsers()
+	users, err := c.orgClient(orgName).GetUsers()
 	if err != nil {
 		return nil, errors.NewInternalError("Failed to fetch users from Casdoor")
 	}
 
-	result := make([]UserInfo, len(users))
-	for i, user := range users {
-		result[i] = UserInfo{
+	result := make([]UserInfo, 0, len(users))
+	for _, user := range users {
+		if user == nil || user.IsDeleted {
+			continue
+		}
+		result = append(result, UserInfo{
 			ID:           user.Id,
-			Name:         user.Name,
+			Name:         user.DisplayName,
 			Username:     user.Name, // Casdoor uses Name as username
 			Email:        user.Email,
 			Organization: user.Owner,
-		}
+			Groups:       user.Groups,
+		})
 	}
 
 	return result, nil
 }
 
 // GetGroups fetches groups from Casdoor organization
-func (c *Client) GetGroups(ctx context.Context, orgName string) ([]*casdoorsdk.Group, error) {
-	groups, err := c.client.GetGroups()
+func (c *Client) GetGroups(ctx context.Context, orgName string) ([]GroupInfo, error) {
+	groups, err := c.orgClient(orgName).GetGroups()
 	if err != nil {
 		return nil, errors.NewInternalError("Failed to fetch groups from Casdoor")
 	}
 
-	return groups, nil
+	result := make([]GroupInfo, 0, len(groups))
+	for _, group := range groups {
+		if group == nil {
+			continue
+		}
+		result = append(result, GroupInfo{
+			ID:          GroupID(group.Owner, group.Name),
+			Name:        group.Name,
+			DisplayName: group.DisplayName,
+			ParentID:    group.ParentId,
+			Enabled:     group.IsEnabled,
+		})
+	}
+
+	return result, nil
+}
+
+// OrganizationInfo represents an organization in Casdoor
+type OrganizationInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// GetOrganizations fetches every Casdoor organization. Organizations are owned by "admin", so
+// they are listed as that owner; the application needs global admin rights in Casdoor.
+func (c *Client) GetOrganizations(ctx context.Context) ([]OrganizationInfo, error) {
+	orgs, err := c.orgClient("admin").GetOrganizations()
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to fetch organizations from Casdoor")
+	}
+
+	result := make([]OrganizationInfo, 0, len(orgs))
+	for _, org := range orgs {
+		if org == nil {
+			continue
+		}
+		result = append(result, OrganizationInfo{Name: org.Name, DisplayName: org.DisplayName})
+	}
+
+	return result, nil
+}
+
+// GroupID builds the owner/name identifier Casdoor uses for groups in user records and tokens
+func GroupID(owner, name string) string {
+	return owner + "/" + name
+}
+
+// orgClient returns an SDK client scoped to orgName; the configured client is reused for
+// the configured organization
+func (c *Client) orgClient(orgName string) *casdoorsdk.Client {
+	if orgName == "" || orgName == c.config.CasdoorOrg {
+		return c.client
+	}
+	return casdoorsdk.NewClient(
+		c.config.CasdoorServerURL,
+		c.config.CasdoorClientID,
+		c.config.CasdoorClientSecret,
+		c.config.CasdoorCertificate,
+		orgName,
+		c.config.CasdoorApp,
+	)
 }
 
 // SyncPolicies synchronizes authorization policies from Casdoor
@@ -29,6 +29,7 @@ type User struct {
 	Username      string    `gorm:"not null" json:"username"`
 	OrgID         uuid.UUID `gorm:"type:uuid;not null;index" json:"org_id"`
 	Email         string    `json:"email"`
+	DisplayName   string    `json:"display_name"`
 
 	// Relationships
 	Organization *Organization `gorm:"foreignKey:OrgID" json:"organization,omitempty"`
@@ -37,14 +38,38 @@ type User struct {
 // Group represents a user group
 type Group struct {
 	BaseModel
-	CasdoorGroupID string    `gorm:"uniqueIndex;not null" json:"casdoor_group_id"`
+	CasdoorGroupID string    `gorm:"uniqueIndex;not null" json:"casdoor_group_id"` // owner/name
 	Name           string    `gorm:"not null" json:"name"`
+	DisplayName    string    `json:"display_name"`
 	OrgID          uuid.UUID `gorm:"type:uuid;not null;index" json:"org_id"`
 
 	// Relationships
 	Organization *Organization `gorm:"foreignKey:OrgID" json:"organization,omitempty"`
 }
 
+// UserGroup records that a user is a member of a group, as synced from Casdoor
+type UserGroup struct {
+	UserID  uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	GroupID uuid.UUID `gorm:"type:uuid;primaryKey;index" json:"group_id"`
+}
+
+// DirectorySyncRun records one synchronisation of an organization's users and groups from Casdoor
+type DirectorySyncRun struct {
+	BaseModel
+	OrgID         uuid.UUID  `gorm:"type:uuid;not null;index" json:"org_id"`
+	Trigger       string     `gorm:"not null" json:"trigger"` // scheduled or manual
+	StartedAt     time.Time  `gorm:"not null" json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at"`
+	UsersCreated  int        `json:"users_created"`
+	UsersUpdated  int        `json:"users_updated"`
+	UsersDeleted  int        `json:"users_deleted"`
+	GroupsCreated int        `json:"groups_created"`
+	GroupsUpdated int        `json:"groups_updated"`
+	GroupsDeleted int        `json:"groups_deleted"`
+	Memberships   int        `json:"memberships"`
+	Error         string     `json:"error,omitempty"`
+}
+
 // Project represents a project within an organization
 type Project struct {
 	BaseModel
@@ -52,6 +77,7 @@ type Project struct {
 	Name      string    `gorm:"not null" json:"name"`
 	Remark    string    `json:"remark"`
 	CreatedBy uuid.UUID `gorm:"type:uuid;not null" json:"created_by"`
+	Version   int64     `gorm:"not null;default:1" json:"version"` // bumped by every edit; the ETag of the project
 
 	// Relationships
 	Organization *Organization `gorm:"foreignKey:OrgID" json:"organization,omitempty"`
@@ -66,7 +92,7 @@ type Partition struct {
 	ProjectID uuid.UUID  `gorm:"type:uuid;not null;index" json:"project_id"`
 	ParentID  *uuid.UUID `gorm:"type:uuid;index" json:"parent_id"`
 	Name      string     `gorm:"not null" json:"name"`
-	Path      string     `gorm:"type:text;index" json:"path"` // Use text for SQLite compatibility, ltree for PostgreSQL
+	Path      string     `gorm:"type:text;index" json:"path"` // ltree on PostgreSQL (see store migrations), text on SQLite
 	Depth     int        `gorm:"not null" json:"depth"`
 
 	// Relationships
@@ -98,15 +124,18 @@ const (
 // Device represents a physical device
 type Device struct {
 	BaseModel
-	MAC         string       `gorm:"size:12;uniqueIndex;not null" json:"mac"` // 12 char uppercase hex
-	IMEI        *string      `gorm:"size:16;uniqueIndex" json:"imei"`         // 14-16 digit string
-	DeviceType  DeviceType   `gorm:"not null" json:"device_type"`
-	ProjectID   uuid.UUID    `gorm:"type:uuid;not null;index" json:"project_id"`
-	PartitionID *uuid.UUID   `gorm:"type:uuid;index" json:"partition_id"`
-	DisplayName string       `json:"display_name"`
-	Status      DeviceStatus `gorm:"default:'unbound'" json:"status"`
-	LastSeenAt  *time.Time   `json:"last_seen_at"`
-	Meta        string       `gorm:"type:jsonb" json:"meta"` // JSON metadata
+	MAC             string       `gorm:"size:12;uniqueIndex;not null" json:"mac"` // 12 char uppercase hex
+	IMEI            *string      `gorm:"size:16;uniqueIndex" json:"imei"`         // 14-16 digit string
+	DeviceType      DeviceType   `gorm:"not null" json:"device_type"`
+	ProjectID       uuid.UUID    `gorm:"type:uuid;not null;index" json:"project_id"`
+	PartitionID     *uuid.UUID   `gorm:"type:uuid;index" json:"partition_id"`
+	DisplayName     string       `json:"display_name"`
+	FirmwareVersion string       `json:"firmware_version"` // as last reported by the device at registration
+	Status          DeviceStatus `gorm:"default:'unbound'" json:"status"`
+	LastSeenAt      *time.Time   `json:"last_seen_at"`
+	Tags            StringList   `gorm:"type:jsonb" json:"tags"`            // free-form labels, e.g. circuit or installer
+	Meta            JSONMap      `gorm:"type:jsonb" json:"meta"`            // JSON metadata, updated with merge-patch
+	Version         int64        `gorm:"not null;default:1" json:"version"` // bumped by every edit; the ETag of the device
 
 	// Relationships
 	Project   *Project         `gorm:"foreignKey:ProjectID" json:"project,omitempty"`
@@ -130,6 +159,51 @@ type DeviceBinding struct {
 	Binder *User   `gorm:"foreignKey:BoundBy" json:"binder,omitempty"`
 }
 
+// ClaimCodeSource tells how a claim code reached the device's owner
+type ClaimCodeSource string
+
+const (
+	ClaimCodeSourceDevice  ClaimCodeSource = "device"  // sent to the device when it registers
+	ClaimCodeSourceFactory ClaimCodeSource = "factory" // imported or issued through the API, e.g. for a label
+)
+
+// DeviceClaimCode is the proof of possession that lets a customer claim an unbound device.
+// Only a hash of the code is kept. A code is used once and may expire.
+type DeviceClaimCode struct {
+	DeviceID  uuid.UUID       `gorm:"type:uuid;primaryKey" json:"device_id"`
+	CodeHash  string          `gorm:"size:64;not null" json:"-"`
+	Source    ClaimCodeSource `gorm:"size:16;not null" json:"source"`
+	ExpiresAt *time.Time      `json:"expires_at"`
+	UsedAt    *time.Time      `json:"used_at"`
+	UsedBy    *uuid.UUID      `gorm:"type:uuid" json:"used_by"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// DeviceClaimAttempt counts the wrong claim codes one user sent for a device. Repeated
+// wrong guesses lock that user out of claiming the device for a while; other users, the
+// device's real owner among them, are not affected.
+type DeviceClaimAttempt struct {
+	DeviceID       uuid.UUID  `gorm:"type:uuid;primaryKey" json:"device_id"`
+	UserID         uuid.UUID  `gorm:"type:uuid;primaryKey" json:"user_id"`
+	FailedAttempts int        `gorm:"not null;default:0" json:"failed_attempts"`
+	LockedUntil    *time.Time `json:"locked_until"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// DeviceCredential holds the MQTT secret of a device; only hashes are kept. After a rotation
+// the previous secret keeps working until PreviousExpiresAt.
+type DeviceCredential struct {
+	DeviceID          uuid.UUID  `gorm:"type:uuid;primaryKey" json:"device_id"`
+	SecretHash        string     `gorm:"size:64;not null" json:"-"`
+	PreviousHash      string     `gorm:"size:64" json:"-"`
+	PreviousExpiresAt *time.Time `json:"previous_expires_at"`
+	RotatedAt         time.Time  `gorm:"not null" json:"rotated_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
 // SubjectType represents the type of subject (user or group)
 type SubjectType string
 
@@ -207,6 +281,7 @@ func (CasbinRule) TableName() string {
 // AuditLog represents audit trail for actions
 type AuditLog struct {
 	BaseModel
+	OrgID      *uuid.UUID `gorm:"type:uuid;index" json:"org_id"`
 	Actor      uuid.UUID  `gorm:"type:uuid;not null;index" json:"actor"`
 	Action     string     `gorm:"not null;index" json:"action"`
 	TargetType string     `gorm:"not null;index" json:"target_type"`
@@ -219,12 +294,31 @@ type AuditLog struct {
 	User *User `gorm:"foreignKey:Actor" json:"user,omitempty"`
 }
 
+// AuditPurgeRun records one enforcement of the audit retention period
+type AuditPurgeRun struct {
+	BaseModel
+	Trigger       string     `gorm:"not null" json:"trigger"` // scheduled or manual
+	RetentionDays int        `json:"retention_days"`
+	Cutoff        time.Time  `json:"cutoff"`
+	StartedAt     time.Time  `gorm:"not null;index" json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at"`
+	RowsPurged    int64      `json:"rows_purged"`
+	Batches       int        `json:"batches"`
+	DurationMs    int64      `json:"duration_ms"`
+	Error         string     `json:"error,omitempty"`
+}
+
 // OrganizationSetting stores per-organization configuration
 type OrganizationSetting struct {
 	BaseModel
+	// The booleans default to true in the migrations only: with a default in the tag GORM
+	// would insert true for false.
 	OrgID                    uuid.UUID  `gorm:"type:uuid;uniqueIndex" json:"org_id"`
-	FactoryAllowRegistration bool       `gorm:"not null;default:true" json:"factory_allow_registration"`
+	FactoryAllowRegistration bool       `gorm:"not null" json:"factory_allow_registration"`
 	FactoryDefaultProjectID  *uuid.UUID `gorm:"type:uuid" json:"factory_default_project_id"`
+	// MQTTLegacyPasswords lets devices still authenticate with their MAC or IMEI as password,
+	// for firmware without per-device secrets
+	MQTTLegacyPasswords bool `gorm:"column:mqtt_legacy_passwords;not null" json:"mqtt_legacy_passwords"`
 }
 
 // SystemSetting provides simple key-value settings for the whole deployment
@@ -232,3 +326,13 @@ type SystemSetting struct {
 	Key   string `gorm:"primaryKey;size:128" json:"key"`
 	Value string `gorm:"type:text" json:"value"`
 }
+
+// OrgSession records the organization a login session works in when it is not the user's
+// own. Sessions are keyed by a hash of their access token and end when the token expires.
+type OrgSession struct {
+	TokenHash string    `gorm:"primaryKey;size:64" json:"-"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+	OrgID     uuid.UUID `gorm:"type:uuid;not null" json:"org_id"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
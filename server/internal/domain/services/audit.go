@@ -0,0 +1,320 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/internal/tenant"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// AuditLogQuery filters audit log listings and exports
+type AuditLogQuery = store.AuditLogQuery
+
+// Audit log export formats
+const (
+	AuditExportCSV    = "csv"
+	AuditExportNDJSON = "ndjson"
+)
+
+// auditExportFlushEvery is how many records an export writes between flushes
+const auditExportFlushEvery = 500
+
+// auditCSVHeader is the column order of CSV exports
+var auditCSVHeader = []string{"id", "created_at", "org_id", "actor", "action", "target_type", "target_id", "ip", "user_agent", "detail"}
+
+// Audit actions recorded by the API handlers and the MQTT broker
+const (
+	AuditActionDeviceCreate            = "device.create"
+	AuditActionDeviceUpdate            = "device.update"
+	AuditActionDeviceRegister          = "device.register"
+	AuditActionDeviceRegisterRejected  = "device.register_rejected"
+	AuditActionDeviceImport            = "device.import"
+	AuditActionDeviceClaimCode         = "device.claim_code"
+	AuditActionDeviceCredentialsRotate = "device.credentials_rotate"
+	AuditActionOrgCreate               = "organization.create"
+	AuditActionOrgUpdate               = "organization.update"
+	AuditActionOrgDelete               = "organization.delete"
+	AuditActionOrgImport               = "organization.import"
+	AuditActionProjectCreate           = "project.create"
+	AuditActionProjectUpdate           = "project.update"
+	AuditActionProjectDelete           = "project.delete"
+	AuditActionPartitionCreate         = "partition.create"
+	AuditActionPartitionUpdate         = "partition.update"
+	AuditActionPartitionDelete         = "partition.delete"
+	AuditActionPermissionGrant         = "permission.grant"
+	AuditActionPermissionRevoke        = "permission.revoke"
+	AuditActionOrgSettingsUpdate       = "settings.org.update"
+	AuditActionAuditRetentionUpdate    = "settings.audit_retention.update"
+	AuditActionAuditPurge              = "audit.purge"
+	AuditActionMQTTConnect             = "mqtt.connect"
+	AuditActionMQTTAuthFailed          = "mqtt.auth_failed"
+	AuditActionMQTTKick                = "mqtt.kick"
+)
+
+const (
+	// auditQueueSize bounds the records waiting for the background writer
+	auditQueueSize = 1024
+	// auditWriteTimeout bounds one background write
+	auditWriteTimeout = 5 * time.Second
+)
+
+// auditIgnoredFields are left out of audit snapshots: timestamps that change on every write
+// and preloaded relations
+var auditIgnoredFields = map[string]bool{
+	"updated_at": true, "deleted_at": true, "organization": true, "project": true, "partition": true,
+	"parent": true, "children": true, "partitions": true, "devices": true, "user": true,
+}
+
+// Audit logging. Log writes synchronously; Record queues for the writer started by Run.
+type AuditService struct {
+	repo   *store.AuditLogRepository
+	logger *zap.Logger
+	queue  chan *models.AuditLog
+}
+
+func NewAuditService(repo *store.AuditLogRepository, logger *zap.Logger) *AuditService {
+	return &AuditService{
+		repo:   repo,
+		logger: logger.With(zap.String("component", "audit")),
+		queue:  make(chan *models.AuditLog, auditQueueSize),
+	}
+}
+
+// Actor identifies who performs an operation and from where, for audit records
+type Actor struct {
+	UserID    uuid.UUID
+	IP        string
+	UserAgent string
+}
+
+func (a *AuditService) Log(ctx context.Context, actor uuid.UUID, action, targetType string, targetID *uuid.UUID, detail interface{}, ip, ua string) error {
+	return a.repo.Insert(ctx, newAuditLog(Actor{UserID: actor, IP: ip, UserAgent: ua}, action, targetType, targetID, detail))
+}
+
+// Record queues an audit record and returns at once, so a slow database never delays the
+// caller. When the queue is full the record is dropped and logged instead.
+func (a *AuditService) Record(actor Actor, action, targetType string, targetID *uuid.UUID, detail interface{}) {
+	rec := newAuditLog(actor, action, targetType, targetID, detail)
+	select {
+	case a.queue <- rec:
+	default:
+		a.logger.Warn("Audit queue full, record dropped",
+			zap.String("action", action),
+			zap.String("target_type", targetType),
+			zap.String("actor", actor.UserID.String()))
+	}
+}
+
+// Run writes queued records until ctx is cancelled, then writes whatever is still queued
+func (a *AuditService) Run(ctx context.Context) {
+	for {
+		select {
+		case rec := <-a.queue:
+			a.write(rec)
+		case <-ctx.Done():
+			for {
+				select {
+				case rec := <-a.queue:
+					a.write(rec)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *AuditService) write(rec *models.AuditLog) {
+	// Queued records come from every organization and are scoped by their own target
+	ctx, cancel := context.WithTimeout(tenant.Bypass(context.Background()), auditWriteTimeout)
+	defer cancel()
+	if err := a.repo.Insert(ctx, rec); err != nil {
+		a.logger.Error("Failed to write audit record", zap.String("action", rec.Action), zap.Error(err))
+	}
+}
+
+// AuditSnapshot captures the JSON fields of v for AuditChanges. Take it before mutating v.
+func AuditSnapshot(v interface{}) map[string]interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return nil
+	}
+	for field := range snapshot {
+		if auditIgnoredFields[field] {
+			delete(snapshot, field)
+		}
+	}
+	return snapshot
+}
+
+// AuditChanges returns {"before": ..., "after": ...} holding the fields that differ between
+// two snapshots. For a creation or deletion, where one side is nil, the other is kept whole.
+func AuditChanges(before, after map[string]interface{}) map[string]interface{} {
+	if before == nil || after == nil {
+		return map[string]interface{}{"before": before, "after": after}
+	}
+	changedBefore, changedAfter := map[string]interface{}{}, map[string]interface{}{}
+	for field, value := range after {
+		if old, ok := before[field]; !ok || !reflect.DeepEqual(old, value) {
+			changedBefore[field], changedAfter[field] = before[field], value
+		}
+	}
+	for field, value := range before {
+		if _, ok := after[field]; !ok {
+			changedBefore[field], changedAfter[field] = value, nil
+		}
+	}
+	return map[string]interface{}{"before": changedBefore, "after": changedAfter}
+}
+
+// ListLogs pages through the audit records matching q, newest first
+func (a *AuditService) ListLogs(ctx context.Context, q AuditLogQuery, page, pageSize int) ([]models.AuditLog, int64, error) {
+	if err := validateAuditQuery(q); err != nil {
+		return nil, 0, err
+	}
+	q.Offset, q.Limit = (page-1)*pageSize, pageSize
+	logs, total, err := a.repo.List(ctx, q)
+	if err != nil {
+		return nil, 0, errors.NewInternalError("Failed to list audit logs")
+	}
+	return logs, total, nil
+}
+
+// ValidateExportFormat checks an export format before any output is written
+func ValidateExportFormat(format string) error {
+	if format != AuditExportCSV && format != AuditExportNDJSON {
+		return errors.NewValidationError("Invalid export format", map[string]interface{}{
+			"format": "format must be 'csv' or 'ndjson'",
+		})
+	}
+	return nil
+}
+
+// ExportLogs streams every audit record matching q to w, oldest first, as CSV or NDJSON.
+// Output is flushed periodically when w supports it, so large exports start arriving at
+// once; an error after the first write leaves the output truncated.
+func (a *AuditService) ExportLogs(ctx context.Context, q AuditLogQuery, format string, w io.Writer) error {
+	if err := ValidateExportFormat(format); err != nil {
+		return err
+	}
+	if err := validateAuditQuery(q); err != nil {
+		return err
+	}
+	flusher, _ := w.(interface{ Flush() })
+
+	var write func(*models.AuditLog) error
+	var flush func() error
+	switch format {
+	case AuditExportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(auditCSVHeader); err != nil {
+			return err
+		}
+		write = func(rec *models.AuditLog) error { return cw.Write(auditCSVRecord(rec)) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		enc := json.NewEncoder(w)
+		write = func(rec *models.AuditLog) error { return enc.Encode(rec) }
+		flush = func() error { return nil }
+	}
+
+	count := 0
+	err := a.repo.Each(ctx, q, func(rec *models.AuditLog) error {
+		if err := write(rec); err != nil {
+			return err
+		}
+		if count++; count%auditExportFlushEvery == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func validateAuditQuery(q AuditLogQuery) error {
+	if q.From != nil && q.To != nil && !q.From.Before(*q.To) {
+		return errors.NewValidationError("Invalid time range", map[string]interface{}{
+			"from": "from must be before to",
+		})
+	}
+	return nil
+}
+
+func auditCSVRecord(rec *models.AuditLog) []string {
+	optional := func(id *uuid.UUID) string {
+		if id == nil {
+			return ""
+		}
+		return id.String()
+	}
+	return []string{
+		rec.ID.String(),
+		rec.CreatedAt.UTC().Format(time.RFC3339Nano),
+		optional(rec.OrgID),
+		rec.Actor.String(),
+		csvSafe(rec.Action),
+		csvSafe(rec.TargetType),
+		optional(rec.TargetID),
+		csvSafe(rec.IP),
+		csvSafe(rec.UserAgent),
+		csvSafe(rec.Detail),
+	}
+}
+
+// csvSafe stops spreadsheet applications from evaluating a value as a formula
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func newAuditLog(actor Actor, action, targetType string, targetID *uuid.UUID, detail interface{}) *models.AuditLog {
+	var detailStr string
+	if detail != nil {
+		b, _ := json.Marshal(detail)
+		detailStr = string(b)
+	}
+	return &models.AuditLog{
+		BaseModel:  models.BaseModel{ID: uuid.New()},
+		Actor:      actor.UserID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Detail:     detailStr,
+		IP:         actor.IP,
+		UserAgent:  actor.UserAgent,
+	}
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAuditService_QueryAndExport(t *testing.T) {
+	db := setupTestDB(t)
+	service := NewAuditService(store.NewAuditLogRepository(db), zap.NewNop())
+	ctx := context.Background()
+
+	project := setupTestProject(t, db)
+	device, err := NewDeviceService(db).CreateDevice("AA:BB:CC:DD:EE:20", nil, models.DeviceTypeWiFi, project.ID, nil, "Gateway")
+	require.NoError(t, err)
+	other := setupTestProject(t, db)
+
+	alice := &models.User{BaseModel: models.BaseModel{ID: uuid.New()}, CasdoorUserID: "u-alice", Username: "alice", OrgID: other.OrgID}
+	require.NoError(t, db.Create(alice).Error)
+
+	// Records are scoped to the organization owning the target, else to the actor's
+	require.NoError(t, service.Log(ctx, alice.ID, AuditActionDeviceShare, "device", &device.ID, map[string]interface{}{"role": "viewer"}, "10.0.0.1", "curl"))
+	require.NoError(t, writeDeviceAudit(db, Actor{UserID: alice.ID}, AuditActionDeviceUnshare, device.ID, nil))
+	require.NoError(t, service.Log(ctx, alice.ID, "project.update", "project", &other.ID, nil, "", ""))
+	require.NoError(t, service.Log(ctx, alice.ID, "login", "session", nil, nil, "", "=HYPERLINK(\"x\")"))
+	require.NoError(t, service.Log(ctx, uuid.Nil, "mqtt.connect", "client", nil, nil, "", ""))
+
+	logs, total, err := service.ListLogs(ctx, AuditLogQuery{OrgID: &project.OrgID}, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+	assert.Equal(t, AuditActionDeviceUnshare, logs[0].Action, "newest first")
+
+	_, total, err = service.ListLogs(ctx, AuditLogQuery{OrgID: &other.OrgID}, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+
+	_, total, err = service.ListLogs(ctx, AuditLogQuery{Action: "device.*"}, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+	_, total, err = service.ListLogs(ctx, AuditLogQuery{Actor: &alice.ID, TargetType: "device", TargetID: &device.ID}, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	_, total, err = service.ListLogs(ctx, AuditLogQuery{From: &future}, 1, 10)
+	require.NoError(t, err)
+	assert.Zero(t, total)
+	_, total, err = service.ListLogs(ctx, AuditLogQuery{From: &past, To: &future}, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), total)
+	_, _, err = service.ListLogs(ctx, AuditLogQuery{From: &future, To: &past}, 1, 10)
+	assert.Error(t, err)
+
+	// CSV exports are oldest first and neutralise formulas
+	var buf bytes.Buffer
+	require.NoError(t, service.ExportLogs(ctx, AuditLogQuery{OrgID: &other.OrgID}, AuditExportCSV, &buf))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, auditCSVHeader, rows[0])
+	assert.Equal(t, "project.update", rows[1][4])
+	assert.Equal(t, `'=HYPERLINK("x")`, rows[2][8])
+
+	buf.Reset()
+	require.NoError(t, service.ExportLogs(ctx, AuditLogQuery{OrgID: &project.OrgID}, AuditExportNDJSON, &buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var first models.AuditLog
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, AuditActionDeviceShare, first.Action)
+	assert.Equal(t, "10.0.0.1", first.IP)
+
+	assert.Error(t, service.ExportLogs(ctx, AuditLogQuery{}, "xml", &buf))
+}
+
+func TestAuditService_Record(t *testing.T) {
+	db := setupTestDB(t)
+	service := NewAuditService(store.NewAuditLogRepository(db), zap.NewNop())
+	project := setupTestProject(t, db)
+
+	before := AuditSnapshot(project)
+	project.Name, project.Remark = "Renamed", "moved to site B"
+	changes := AuditChanges(before, AuditSnapshot(project))
+	assert.Equal(t, map[string]interface{}{"name": "Test Project", "remark": ""}, changes["before"])
+	assert.Equal(t, map[string]interface{}{"name": "Renamed", "remark": "moved to site B"}, changes["after"])
+
+	// Records queue without a writer and are written once Run drains the queue
+	actor := Actor{UserID: uuid.New(), IP: "192.0.2.7", UserAgent: "cli"}
+	service.Record(actor, AuditActionProjectUpdate, "project", &project.ID, changes)
+	service.Record(actor, AuditActionProjectDelete, "project", &project.ID, AuditChanges(AuditSnapshot(project), nil))
+	var count int64
+	require.NoError(t, db.Model(&models.AuditLog{}).Count(&count).Error)
+	assert.Zero(t, count)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	service.Run(ctx)
+
+	_, total, err := service.ListLogs(context.Background(), AuditLogQuery{TargetID: &project.ID}, 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+	logs, _, err := service.ListLogs(context.Background(), AuditLogQuery{Action: AuditActionProjectUpdate}, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	assert.Equal(t, project.OrgID, *logs[0].OrgID)
+	assert.Equal(t, "192.0.2.7", logs[0].IP)
+	var detail map[string]map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(logs[0].Detail), &detail))
+	assert.Equal(t, "Renamed", detail["after"]["name"])
+	assert.NotContains(t, detail["after"], "updated_at")
+}
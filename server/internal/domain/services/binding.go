@@ -0,0 +1,279 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/internal/tenant"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Audit actions written by device binding
+const (
+	AuditActionDeviceBind   = "device.bind"
+	AuditActionDeviceUnbind = "device.unbind"
+	AuditActionDeviceDelete = "device.delete"
+)
+
+// DeviceBindingService claims self-registered devices for users and releases them again
+type DeviceBindingService struct {
+	db          *gorm.DB
+	deviceRepo  *store.DeviceRepository
+	bindingRepo *store.DeviceBindingRepository
+	enforcer    *casbinx.Enforcer
+	logger      *zap.Logger
+}
+
+// NewDeviceBindingService creates a new device binding service
+func NewDeviceBindingService(db *gorm.DB, enforcer *casbinx.Enforcer, logger *zap.Logger) *DeviceBindingService {
+	return &DeviceBindingService{
+		db:          db,
+		deviceRepo:  store.NewDeviceRepository(db),
+		bindingRepo: store.NewDeviceBindingRepository(db),
+		enforcer:    enforcer,
+		logger:      logger,
+	}
+}
+
+// WithContext returns the service bound to ctx, so its queries run in the tenant scope of ctx
+func (s *DeviceBindingService) WithContext(ctx context.Context) *DeviceBindingService {
+	return NewDeviceBindingService(s.db.WithContext(ctx), s.enforcer, s.logger)
+}
+
+// BindDevice claims an unbound device for userID and places it in projectID/partitionID.
+// The binding is recorded, the device leaves the unbound status and userID becomes its owner.
+// A bound device starts offline; its next presence report marks it online. Binding for
+// someone else needs userID to be an existing user the service's scope can see. The device
+// gets new MQTT credentials, returned for the owner to provision; any secret it had before
+// stops working.
+func (s *DeviceBindingService) BindDevice(device *models.Device, actor Actor, userID uuid.UUID, projectID uuid.UUID, partitionID *uuid.UUID) (*models.DeviceBinding, *DeviceCredentials, error) {
+	if userID != uuid.Nil && userID != actor.UserID {
+		if _, err := store.NewUserRepository(s.db).GetByID(userID); err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, nil, errors.NewNotFoundError("User not found")
+			}
+			return nil, nil, errors.NewInternalError("Failed to get user")
+		}
+	}
+	return s.bind(device, actor, userID, projectID, partitionID, AuditActionDeviceBind, nil)
+}
+
+// bind is BindDevice with the audit action to record and, if set, a step run first in the
+// claiming transaction; the device stays unbound if that step fails
+func (s *DeviceBindingService) bind(device *models.Device, actor Actor, userID uuid.UUID, projectID uuid.UUID, partitionID *uuid.UUID, action string, within func(tx *gorm.DB) error) (*models.DeviceBinding, *DeviceCredentials, error) {
+	if userID == uuid.Nil {
+		return nil, nil, errors.NewValidationError("Invalid user", map[string]interface{}{"user_id": "required"})
+	}
+	if device.Status != models.DeviceStatusUnbound {
+		return nil, nil, errors.NewConflictError("Device is already bound")
+	}
+	if err := validatePlacement(s.db, projectID, partitionID); err != nil {
+		return nil, nil, err
+	}
+
+	// Grouping first, rows second; see DeviceTransferService.ApproveTransfer
+	domain := casbinx.BuildDomain("device", device.ID.String())
+	owner := casbinx.DeviceRoleName(string(models.DeviceRoleOwner))
+	if err := s.enforcer.AddDeviceRolePolicies(domain); err != nil {
+		return nil, nil, errors.NewInternalError("Failed to update device permissions")
+	}
+	added, err := s.enforcer.AddGroupingPolicy(userID.String(), owner, domain)
+	if err != nil {
+		return nil, nil, errors.NewInternalError("Failed to update device permissions")
+	}
+
+	now := time.Now()
+	binding := &models.DeviceBinding{
+		BaseModel: models.BaseModel{ID: uuid.New()},
+		DeviceID:  device.ID,
+		UserID:    userID,
+		BoundAt:   now,
+		BoundBy:   actor.UserID,
+	}
+	// The device sits in the factory project, outside the caller's organization, until it
+	// is claimed; the placement above was checked in the caller's scope
+	claim := s.db.WithContext(tenant.Bypass(s.db.Statement.Context))
+	var creds *DeviceCredentials
+	err = claim.Transaction(func(tx *gorm.DB) error {
+		if within != nil {
+			if err := within(tx); err != nil {
+				return err
+			}
+		}
+		claimed, err := store.NewDeviceRepository(tx).ClaimUnbound(device.ID, projectID, partitionID, models.DeviceStatusOffline)
+		if err != nil {
+			return errors.NewInternalError("Failed to bind device")
+		}
+		if !claimed {
+			return errors.NewConflictError("Device is already bound")
+		}
+		if err := store.NewDeviceBindingRepository(tx).Create(binding); err != nil {
+			return errors.NewInternalError("Failed to bind device")
+		}
+
+		shareRepo := store.NewDeviceShareRepository(tx)
+		if err := shareRepo.DeleteByDeviceAndRole(device.ID, models.DeviceRoleOwner); err != nil {
+			return errors.NewInternalError("Failed to bind device")
+		}
+		if err := shareRepo.Create(&models.DeviceShare{
+			BaseModel:   models.BaseModel{ID: uuid.New()},
+			DeviceID:    device.ID,
+			SubjectType: models.SubjectTypeUser,
+			SubjectID:   userID,
+			Role:        models.DeviceRoleOwner,
+			GrantedBy:   actor.UserID,
+			GrantedAt:   now,
+		}); err != nil {
+			return errors.NewInternalError("Failed to bind device")
+		}
+
+		if creds, err = issueCredentials(tx, device, 0); err != nil {
+			return err
+		}
+		return writeDeviceAudit(tx, actor, action, device.ID, map[string]interface{}{
+			"binding_id":   binding.ID,
+			"user_id":      userID,
+			"project_id":   projectID,
+			"partition_id": partitionID,
+		})
+	})
+	if err != nil {
+		if added {
+			_, rerr := s.enforcer.RemoveGroupingPolicy(userID.String(), owner, domain)
+			logRevertFailure(s.logger, rerr, "remove", userID.String(), owner, domain)
+		}
+		return nil, nil, err
+	}
+
+	device.ProjectID = projectID
+	device.PartitionID = partitionID
+	device.Status = models.DeviceStatusOffline
+	device.Version++
+	binding.Device = device
+	return binding, creds, nil
+}
+
+// GetBinding returns the current binding of a device
+func (s *DeviceBindingService) GetBinding(deviceID uuid.UUID) (*models.DeviceBinding, error) {
+	binding, err := s.bindingRepo.GetByDevice(deviceID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.NewNotFoundError("Device is not bound")
+		}
+		return nil, errors.NewInternalError("Failed to get binding")
+	}
+	return binding, nil
+}
+
+// UnbindDevice releases a device back to the unbound pool. The binding ends, every share
+// and device:<id> grouping is removed, pending transfers are cancelled and its MQTT secret
+// and claim code are dropped, so the next claimant starts from a clean device and nobody
+// keeps a way in. The device keeps its identity and can re-register for a new claim code.
+func (s *DeviceBindingService) UnbindDevice(device *models.Device, actor Actor) error {
+	if device.Status == models.DeviceStatusUnbound {
+		return errors.NewConflictError("Device is not bound")
+	}
+	err := s.release(device, actor, AuditActionDeviceUnbind, func(tx *gorm.DB) error {
+		return store.NewDeviceRepository(tx).UpdateStatus(device.ID, device.Version, models.DeviceStatusUnbound)
+	})
+	if err != nil {
+		return err
+	}
+	device.Status = models.DeviceStatusUnbound
+	device.Version++
+	return nil
+}
+
+// DeleteDevice soft-deletes a device after the same cleanup as UnbindDevice
+func (s *DeviceBindingService) DeleteDevice(device *models.Device, actor Actor) error {
+	return s.release(device, actor, AuditActionDeviceDelete, func(tx *gorm.DB) error {
+		return store.NewDeviceRepository(tx).DeleteVersion(device.ID, device.Version)
+	})
+}
+
+// release drops the device:<id> groupings and role policies, then in one transaction ends bindings, removes
+// shares, cancels pending transfers, removes the MQTT secret and claim code, applies
+// finalize and writes the audit entry. The
+// groupings are restored if the transaction fails. finalize is conditioned on the version
+// of device, so a device changed since it was read is left alone with 412.
+func (s *DeviceBindingService) release(device *models.Device, actor Actor, action string, finalize func(tx *gorm.DB) error) error {
+	domain := casbinx.BuildDomain("device", device.ID.String())
+	previous := s.enforcer.GetFilteredGroupingPolicy(2, domain)
+	if len(previous) > 0 {
+		if _, err := s.enforcer.RemoveFilteredGroupingPolicy(2, domain); err != nil {
+			return errors.NewInternalError("Failed to update device permissions")
+		}
+	}
+	if _, err := s.enforcer.RemoveDeviceRolePolicies(domain); err != nil {
+		s.restoreGroupings(domain, previous)
+		return errors.NewInternalError("Failed to update device permissions")
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := store.NewDeviceBindingRepository(tx).DeleteByDevice(device.ID); err != nil {
+			return errors.NewInternalError("Failed to release device")
+		}
+		if err := store.NewDeviceShareRepository(tx).DeleteByDevice(device.ID); err != nil {
+			return errors.NewInternalError("Failed to release device")
+		}
+		if err := store.NewDeviceTransferRepository(tx).CancelPendingByDevice(device.ID); err != nil {
+			return errors.NewInternalError("Failed to release device")
+		}
+		if err := store.NewDeviceCredentialRepository(tx).DeleteByDevice(device.ID); err != nil {
+			return errors.NewInternalError("Failed to release device")
+		}
+		if err := store.NewDeviceClaimCodeRepository(tx).DeleteByDevice(device.ID); err != nil {
+			return errors.NewInternalError("Failed to release device")
+		}
+		if err := finalize(tx); err != nil {
+			if err == store.ErrVersionConflict {
+				return errors.NewPreconditionFailedError("Device was modified concurrently")
+			}
+			return errors.NewInternalError("Failed to release device")
+		}
+		return writeDeviceAudit(tx, actor, action, device.ID, map[string]interface{}{
+			"mac":             device.MAC,
+			"imei":            device.IMEI,
+			"previous_status": device.Status,
+			"project_id":      device.ProjectID,
+		})
+	})
+	if err != nil {
+		s.restoreGroupings(domain, previous)
+		return err
+	}
+	return nil
+}
+
+// restoreGroupings puts back the role policies and groupings release removed from domain
+func (s *DeviceBindingService) restoreGroupings(domain string, groupings [][]string) {
+	if len(groupings) == 0 {
+		return
+	}
+	logRevertFailure(s.logger, s.enforcer.AddDeviceRolePolicies(domain), "add_policies", "", "", domain)
+	for _, g := range groupings {
+		_, err := s.enforcer.AddGroupingPolicy(g[0], g[1], g[2])
+		logRevertFailure(s.logger, err, "add", g[0], g[1], domain)
+	}
+}
+
+// logRevertFailure logs a Casbin change that could not be undone after the write it went
+// with failed, leaving the device's permissions out of step with its rows until fixed by hand
+func logRevertFailure(logger *zap.Logger, err error, op, subject, role, domain string) {
+	if err == nil {
+		return
+	}
+	logger.Error("Failed to revert device permissions",
+		zap.String("op", op),
+		zap.String("domain", domain),
+		zap.String("subject", subject),
+		zap.String("role", role),
+		zap.Error(err))
+}
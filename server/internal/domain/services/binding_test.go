@@ -0,0 +1,140 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDeviceBindingService_BindUnbind(t *testing.T) {
+	db := setupTestDB(t)
+	enforcer, err := casbinx.New(db)
+	require.NoError(t, err)
+	service := NewDeviceBindingService(db, enforcer, zap.NewNop())
+	deviceService := NewDeviceService(db)
+
+	factory := setupTestProject(t, db)
+	site := setupTestProject(t, db)
+
+	// Self-registered devices stay unbound while reporting presence
+	device, created, err := deviceService.FindOrCreateForRegistration("AA:BB:CC:DD:EE:20", nil, "", models.DeviceTypeWiFi, factory.ID.String(), true)
+	require.NoError(t, err)
+	require.True(t, created)
+	require.NoError(t, deviceService.ReportPresence(device.ID, models.DeviceStatusOnline))
+	device, err = deviceService.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.DeviceStatusUnbound, device.Status)
+	assert.NotNil(t, device.LastSeenAt)
+
+	staff := Actor{UserID: uuid.New()}
+	// Devices can only be bound for users that exist
+	_, _, err = service.BindDevice(device, staff, uuid.New(), site.ID, nil)
+	appErr, ok := err.(*errors.AppError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, appErr.HTTPStatus)
+
+	binding, creds, err := service.BindDevice(device, staff, staff.UserID, site.ID, nil)
+	require.NoError(t, err)
+	assert.Equal(t, staff.UserID, binding.UserID)
+	assert.Equal(t, staff.UserID, binding.BoundBy)
+	require.NotNil(t, creds)
+	authenticated, err := deviceService.AuthenticateDevice("mac", creds.Username, creds.Password)
+	require.NoError(t, err)
+	assert.Equal(t, device.ID, authenticated.ID)
+
+	bound, err := deviceService.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, site.ID, bound.ProjectID)
+	assert.Equal(t, models.DeviceStatusOffline, bound.Status)
+
+	domain := casbinx.BuildDomain("device", device.ID.String())
+	owner := casbinx.DeviceRoleName(string(models.DeviceRoleOwner))
+	assert.Equal(t, []string{staff.UserID.String()}, enforcer.GetUsersForRole(owner, domain))
+
+	// A bound device cannot be claimed again, even from a stale copy
+	_, _, err = service.BindDevice(device, Actor{UserID: uuid.New()}, setupTestUser(t, db, site.OrgID).UserID, site.ID, nil)
+	assert.Error(t, err)
+	assert.Equal(t, []string{staff.UserID.String()}, enforcer.GetUsersForRole(owner, domain))
+
+	// Presence now moves the status
+	require.NoError(t, deviceService.ReportPresence(device.ID, models.DeviceStatusOnline))
+	bound, err = deviceService.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.DeviceStatusOnline, bound.Status)
+
+	current, err := service.GetBinding(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, binding.ID, current.ID)
+
+	require.NoError(t, service.UnbindDevice(bound, staff))
+	released, err := deviceService.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.DeviceStatusUnbound, released.Status)
+	assert.Empty(t, enforcer.GetFilteredGroupingPolicy(2, domain))
+	_, err = service.GetBinding(device.ID)
+	assert.Error(t, err)
+
+	var shares int64
+	require.NoError(t, db.Model(&models.DeviceShare{}).Where("device_id = ?", device.ID).Count(&shares).Error)
+	assert.Zero(t, shares)
+
+	// The previous owner's MQTT secret no longer works
+	_, err = deviceService.AuthenticateDevice("mac", creds.Username, creds.Password)
+	assert.Equal(t, ErrInvalidDeviceCredentials, err)
+	hasSecret, err := deviceService.HasCredentials(released)
+	require.NoError(t, err)
+	assert.False(t, hasSecret)
+
+	// Unbinding an unbound device is a conflict
+	assert.Error(t, service.UnbindDevice(released, staff))
+}
+
+func TestDeviceBindingService_DeleteDevice(t *testing.T) {
+	db := setupTestDB(t)
+	enforcer, err := casbinx.New(db)
+	require.NoError(t, err)
+	service := NewDeviceBindingService(db, enforcer, zap.NewNop())
+	deviceService := NewDeviceService(db)
+
+	project := setupTestProject(t, db)
+	device, _, err := deviceService.CreateDeviceWithCredentials("AA:BB:CC:DD:EE:21", nil, models.DeviceTypeWiFi, project.ID, nil, "Gateway")
+	require.NoError(t, err)
+	require.NoError(t, deviceService.SetClaimCode(device, "FACT0021", nil))
+
+	owner := Actor{UserID: uuid.New()}
+	_, _, err = service.BindDevice(device, owner, owner.UserID, project.ID, nil)
+	require.NoError(t, err)
+	_, err = NewDeviceTransferService(db, enforcer, zap.NewNop()).RequestTransfer(device, owner, setupTestUser(t, db, project.OrgID).UserID)
+	require.NoError(t, err)
+
+	require.NoError(t, service.DeleteDevice(device, owner))
+
+	_, err = deviceService.GetDevice(device.ID)
+	assert.Error(t, err)
+	var deleted models.Device
+	require.NoError(t, db.Unscoped().First(&deleted, "id = ?", device.ID).Error)
+	assert.True(t, deleted.DeletedAt.Valid)
+
+	assert.Empty(t, enforcer.GetFilteredGroupingPolicy(2, casbinx.BuildDomain("device", device.ID.String())))
+
+	var pending int64
+	require.NoError(t, db.Model(&models.DeviceTransfer{}).
+		Where("device_id = ? AND status = ?", device.ID, models.TransferStatusPending).Count(&pending).Error)
+	assert.Zero(t, pending)
+	var secrets, codes int64
+	require.NoError(t, db.Model(&models.DeviceCredential{}).Where("device_id = ?", device.ID).Count(&secrets).Error)
+	require.NoError(t, db.Model(&models.DeviceClaimCode{}).Where("device_id = ?", device.ID).Count(&codes).Error)
+	assert.Zero(t, secrets+codes)
+
+	var audit models.AuditLog
+	require.NoError(t, db.Where("target_id = ? AND action = ?", device.ID, AuditActionDeviceDelete).First(&audit).Error)
+	assert.Equal(t, owner.UserID, audit.Actor)
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/internal/tenant"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Audit actions written by device claiming
+const (
+	AuditActionDeviceClaim       = "device.claim"
+	AuditActionDeviceClaimFailed = "device.claim_failed"
+)
+
+const (
+	// claimCodeAlphabet leaves out 0/O and 1/I, which are easily confused on a label
+	claimCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	// claimCodeLength is the number of characters of a generated code, 60 random bits
+	claimCodeLength = 12
+	// MaxClaimAttempts is how many wrong codes lock a user out of claiming a device
+	MaxClaimAttempts = 5
+	// ClaimLockout is how long a user stays locked out of claiming a device
+	ClaimLockout = 15 * time.Minute
+)
+
+// ErrInvalidClaimCode is returned for a wrong, used or missing claim code and a locked out
+// caller alike, so a failed claim tells nothing about the device
+var ErrInvalidClaimCode = errors.NewForbiddenError("Invalid device or claim code")
+
+// GenerateClaimCode returns a random claim code formatted as XXXX-XXXX-XXXX
+func GenerateClaimCode() (string, error) {
+	buf := make([]byte, claimCodeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i, c := range buf {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteByte(claimCodeAlphabet[int(c)%len(claimCodeAlphabet)])
+	}
+	return b.String(), nil
+}
+
+// NormalizeClaimCode upper-cases a claim code and drops dashes and spaces. Factory codes
+// may use any letters and digits, 6 to 64 of them.
+func NormalizeClaimCode(code string) (string, error) {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		switch {
+		case r == '-' || r == ' ':
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			b.WriteRune(r)
+		default:
+			return "", fmt.Errorf("claim code may only contain letters, digits and dashes")
+		}
+	}
+	if b.Len() < 6 || b.Len() > 64 {
+		return "", fmt.Errorf("claim code must have 6 to 64 letters and digits")
+	}
+	return b.String(), nil
+}
+
+// hashClaimCode hashes a normalized code with the device ID, so equal codes of two devices
+// differ at rest
+func hashClaimCode(deviceID uuid.UUID, code string) string {
+	sum := sha256.Sum256([]byte(deviceID.String() + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetClaimCode sets a factory claim code of an unbound device, replacing any previous one.
+// The code expires at expiresAt when set. Only its hash is stored.
+func (s *DeviceService) SetClaimCode(device *models.Device, code string, expiresAt *time.Time) error {
+	normalized, err := NormalizeClaimCode(code)
+	if err != nil {
+		return errors.NewValidationError("Invalid claim code", map[string]interface{}{"claim_code": err.Error()})
+	}
+	return s.saveClaimCode(device, newClaimCode(device.ID, normalized, models.ClaimCodeSourceFactory, expiresAt))
+}
+
+// IssueClaimCode generates a claim code from source for an unbound device, replacing any
+// previous one, and returns it; it cannot be read back later. A positive ttl limits how long
+// it is valid.
+func (s *DeviceService) IssueClaimCode(device *models.Device, source models.ClaimCodeSource, ttl time.Duration) (string, *time.Time, error) {
+	code, err := GenerateClaimCode()
+	if err != nil {
+		return "", nil, errors.NewInternalError("Failed to generate claim code")
+	}
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := time.Now().Add(ttl)
+		expiresAt = &t
+	}
+	normalized, _ := NormalizeClaimCode(code)
+	if err := s.saveClaimCode(device, newClaimCode(device.ID, normalized, source, expiresAt)); err != nil {
+		return "", nil, err
+	}
+	return code, expiresAt, nil
+}
+
+// IssueRegistrationClaimCode issues a claim code for an unbound device registering over MQTT,
+// for the device to show to whoever installs it. A code that can still be used, from the
+// factory or sent at an earlier registration, is kept, so registering again cannot take the
+// code away from an installer who already read it; then, as for bound devices, "" is
+// returned. A device that missed its code gets a new one once it expires.
+func (s *DeviceService) IssueRegistrationClaimCode(device *models.Device, ttl time.Duration) (string, *time.Time, error) {
+	if device.Status != models.DeviceStatusUnbound {
+		return "", nil, nil
+	}
+	current, err := store.NewDeviceClaimCodeRepository(s.db).GetByDevice(device.ID)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return "", nil, errors.NewInternalError("Failed to get claim code")
+	}
+	if err == nil && current.UsedAt == nil && (current.ExpiresAt == nil || current.ExpiresAt.After(time.Now())) {
+		return "", nil, nil
+	}
+	return s.IssueClaimCode(device, models.ClaimCodeSourceDevice, ttl)
+}
+
+func (s *DeviceService) saveClaimCode(device *models.Device, code *models.DeviceClaimCode) error {
+	if device.Status != models.DeviceStatusUnbound {
+		return errors.NewConflictError("Device is already bound")
+	}
+	if err := store.NewDeviceClaimCodeRepository(s.db).Save(code); err != nil {
+		return errors.NewInternalError("Failed to save claim code")
+	}
+	return nil
+}
+
+func newClaimCode(deviceID uuid.UUID, normalized string, source models.ClaimCodeSource, expiresAt *time.Time) *models.DeviceClaimCode {
+	return &models.DeviceClaimCode{
+		DeviceID:  deviceID,
+		CodeHash:  hashClaimCode(deviceID, normalized),
+		Source:    source,
+		ExpiresAt: expiresAt,
+	}
+}
+
+// ClaimDevice binds an unbound device to the actor and places it in projectID/partitionID,
+// like BindDevice, on proof of possession: the device's claim code. The code is used up by
+// a successful claim. Every wrong code counts towards MaxClaimAttempts of the actor, after
+// which the actor cannot claim the device for ClaimLockout; other users still can, so
+// guessing cannot keep the real owner out. As with BindDevice, the new owner gets the
+// device's new MQTT credentials.
+func (s *DeviceBindingService) ClaimDevice(device *models.Device, actor Actor, code string, projectID uuid.UUID, partitionID *uuid.UUID) (*models.DeviceBinding, *DeviceCredentials, error) {
+	normalized, err := NormalizeClaimCode(code)
+	if err != nil {
+		return nil, nil, ErrInvalidClaimCode
+	}
+	// Claim codes belong to devices in the factory project, outside the caller's organization
+	unscoped := s.db.WithContext(tenant.Bypass(s.db.Statement.Context))
+	codes := store.NewDeviceClaimCodeRepository(unscoped)
+	now := time.Now()
+	failed := 0
+	if attempt, err := codes.GetAttempt(device.ID, actor.UserID); err == nil {
+		if attempt.LockedUntil != nil && attempt.LockedUntil.After(now) {
+			return nil, nil, ErrInvalidClaimCode
+		}
+		failed = attempt.FailedAttempts
+	} else if err != gorm.ErrRecordNotFound {
+		return nil, nil, errors.NewInternalError("Failed to get claim attempts")
+	}
+	current, err := codes.GetByDevice(device.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, ErrInvalidClaimCode
+		}
+		return nil, nil, errors.NewInternalError("Failed to get claim code")
+	}
+
+	hash := hashClaimCode(device.ID, normalized)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(current.CodeHash)) != 1 {
+		if err := codes.RecordFailure(device.ID, actor.UserID, MaxClaimAttempts, now, ClaimLockout); err != nil {
+			return nil, nil, errors.NewInternalError("Failed to check claim code")
+		}
+		detail := map[string]interface{}{"failed_attempts": failed + 1, "locked": failed+1 >= MaxClaimAttempts}
+		if err := writeDeviceAudit(unscoped, actor, AuditActionDeviceClaimFailed, device.ID, detail); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrInvalidClaimCode
+	}
+	if current.UsedAt != nil {
+		return nil, nil, ErrInvalidClaimCode
+	}
+	if current.ExpiresAt != nil && !current.ExpiresAt.After(now) {
+		return nil, nil, errors.NewForbiddenError("Claim code has expired")
+	}
+
+	return s.bind(device, actor, actor.UserID, projectID, partitionID, AuditActionDeviceClaim, func(tx *gorm.DB) error {
+		used, err := store.NewDeviceClaimCodeRepository(tx).Use(device.ID, hash, actor.UserID, now)
+		if err != nil {
+			return errors.NewInternalError("Failed to claim device")
+		}
+		if !used {
+			return ErrInvalidClaimCode
+		}
+		return nil
+	})
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNormalizeClaimCode(t *testing.T) {
+	code, err := GenerateClaimCode()
+	require.NoError(t, err)
+	assert.Regexp(t, `^[A-HJ-NP-Z2-9]{4}-[A-HJ-NP-Z2-9]{4}-[A-HJ-NP-Z2-9]{4}$`, code)
+
+	normalized, err := NormalizeClaimCode(" ab12-cd34 ef ")
+	require.NoError(t, err)
+	assert.Equal(t, "AB12CD34EF", normalized)
+	for _, invalid := range []string{"", "ab-12", "AB12CD34_EF", "äb12cd34"} {
+		_, err := NormalizeClaimCode(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestDeviceBindingService_ClaimDevice(t *testing.T) {
+	db := setupTestDB(t)
+	enforcer, err := casbinx.New(db)
+	require.NoError(t, err)
+	service := NewDeviceBindingService(db, enforcer, zap.NewNop())
+	deviceService := NewDeviceService(db)
+
+	factory := setupTestProject(t, db)
+	site := setupTestProject(t, db)
+	register := func(mac string) *models.Device {
+		device, created, err := deviceService.FindOrCreateForRegistration(mac, nil, "", models.DeviceTypeWiFi, factory.ID.String(), true)
+		require.NoError(t, err)
+		require.True(t, created)
+		return device
+	}
+	status := func(err error) int {
+		appErr, ok := err.(*errors.AppError)
+		require.True(t, ok, "expected an AppError, got %v", err)
+		return appErr.HTTPStatus
+	}
+	customer := Actor{UserID: uuid.New()}
+
+	t.Run("claim with the code sent at registration", func(t *testing.T) {
+		device := register("AA:BB:CC:DD:EE:30")
+		first, _, err := deviceService.IssueRegistrationClaimCode(device, time.Hour)
+		require.NoError(t, err)
+		require.NotEmpty(t, first)
+		// Registering again keeps the code the device was sent until it expires
+		again, _, err := deviceService.IssueRegistrationClaimCode(device, time.Hour)
+		require.NoError(t, err)
+		assert.Empty(t, again)
+		require.NoError(t, db.Model(&models.DeviceClaimCode{}).Where("device_id = ?", device.ID).
+			Update("expires_at", time.Now().Add(-time.Second)).Error)
+		code, _, err := deviceService.IssueRegistrationClaimCode(device, 0)
+		require.NoError(t, err)
+		require.NotEmpty(t, code)
+		require.NotEqual(t, first, code)
+
+		var stored models.DeviceClaimCode
+		require.NoError(t, db.First(&stored, "device_id = ?", device.ID).Error)
+		assert.NotContains(t, stored.CodeHash, code)
+
+		_, _, err = service.ClaimDevice(device, customer, first, site.ID, nil)
+		assert.Equal(t, http.StatusForbidden, status(err))
+
+		binding, creds, err := service.ClaimDevice(device, customer, code, site.ID, nil)
+		require.NoError(t, err)
+		assert.Equal(t, customer.UserID, binding.UserID)
+		require.NotNil(t, creds)
+		authenticated, err := deviceService.AuthenticateDevice("mac", creds.Username, creds.Password)
+		require.NoError(t, err)
+		assert.Equal(t, device.ID, authenticated.ID)
+		claimed, err := deviceService.GetDevice(device.ID)
+		require.NoError(t, err)
+		assert.Equal(t, site.ID, claimed.ProjectID)
+		assert.Equal(t, models.DeviceStatusOffline, claimed.Status)
+		owner := casbinx.DeviceRoleName(string(models.DeviceRoleOwner))
+		assert.Equal(t, []string{customer.UserID.String()}, enforcer.GetUsersForRole(owner, casbinx.BuildDomain("device", device.ID.String())))
+
+		var audits int64
+		require.NoError(t, db.Model(&models.AuditLog{}).Where("action = ? AND target_id = ?", AuditActionDeviceClaim, device.ID).Count(&audits).Error)
+		assert.Equal(t, int64(1), audits)
+		require.NoError(t, db.Model(&models.AuditLog{}).Where("action = ? AND target_id = ?", AuditActionDeviceClaimFailed, device.ID).Count(&audits).Error)
+		assert.Equal(t, int64(1), audits)
+
+		// Codes are single-use, also once the device is released again
+		require.NoError(t, service.UnbindDevice(claimed, customer))
+		_, _, err = service.ClaimDevice(claimed, Actor{UserID: uuid.New()}, code, site.ID, nil)
+		assert.Equal(t, http.StatusForbidden, status(err))
+	})
+
+	t.Run("factory codes survive registration and may expire", func(t *testing.T) {
+		device := register("AA:BB:CC:DD:EE:31")
+		require.NoError(t, deviceService.SetClaimCode(device, "fact-0001", nil))
+		code, _, err := deviceService.IssueRegistrationClaimCode(device, time.Hour)
+		require.NoError(t, err)
+		assert.Empty(t, code)
+
+		past := time.Now().Add(-time.Minute)
+		require.NoError(t, deviceService.SetClaimCode(device, "FACT0002", &past))
+		_, _, err = service.ClaimDevice(device, customer, "FACT0002", site.ID, nil)
+		assert.Equal(t, http.StatusForbidden, status(err))
+		assert.Contains(t, err.Error(), "expired")
+
+		// An expired factory code gives way to one sent to the device
+		code, expiresAt, err := deviceService.IssueRegistrationClaimCode(device, time.Hour)
+		require.NoError(t, err)
+		assert.NotEmpty(t, code)
+		require.NotNil(t, expiresAt)
+	})
+
+	t.Run("wrong codes lock out the guesser only", func(t *testing.T) {
+		device := register("AA:BB:CC:DD:EE:32")
+		code, _, err := deviceService.IssueRegistrationClaimCode(device, 0)
+		require.NoError(t, err)
+
+		guesser := Actor{UserID: uuid.New()}
+		for i := 0; i < MaxClaimAttempts; i++ {
+			_, _, err = service.ClaimDevice(device, guesser, "WRONG-CODE", site.ID, nil)
+			assert.Equal(t, http.StatusForbidden, status(err))
+		}
+		// A locked out caller gets the same answer as for a wrong code, even with the right one
+		_, _, err = service.ClaimDevice(device, guesser, code, site.ID, nil)
+		assert.Equal(t, ErrInvalidClaimCode, err)
+		var attempt models.DeviceClaimAttempt
+		require.NoError(t, db.First(&attempt, "device_id = ? AND user_id = ?", device.ID, guesser.UserID).Error)
+		require.NotNil(t, attempt.LockedUntil)
+
+		// The device's holder is not kept out
+		_, _, err = service.ClaimDevice(device, customer, code, site.ID, nil)
+		require.NoError(t, err)
+	})
+
+	t.Run("bound devices get no codes", func(t *testing.T) {
+		device := register("AA:BB:CC:DD:EE:33")
+		_, _, err := service.BindDevice(device, customer, customer.UserID, site.ID, nil)
+		require.NoError(t, err)
+		code, _, err := deviceService.IssueRegistrationClaimCode(device, 0)
+		require.NoError(t, err)
+		assert.Empty(t, code)
+		assert.Equal(t, http.StatusConflict, status(deviceService.SetClaimCode(device, "FACT0003", nil)))
+	})
+}
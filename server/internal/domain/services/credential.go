@@ -0,0 +1,189 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// deviceSecretBytes is the size of a generated MQTT secret, 192 random bits
+	deviceSecretBytes = 24
+	// DefaultCredentialGrace is how long the previous secret keeps working after a rotation
+	DefaultCredentialGrace = 24 * time.Hour
+	// MaxCredentialGrace bounds the grace window of a rotation
+	MaxCredentialGrace = 30 * 24 * time.Hour
+)
+
+// ErrInvalidDeviceCredentials is returned for an unknown device, a device without a secret
+// and a wrong secret alike
+var ErrInvalidDeviceCredentials = errors.NewUnauthorizedError("Invalid device credentials")
+
+// DeviceCredentials are the MQTT username and password of a device. They are returned once,
+// when issued; only a hash of the password is kept.
+type DeviceCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// PreviousExpiresAt is when the secret this one replaced stops working, if it still does
+	PreviousExpiresAt *time.Time `json:"previous_expires_at"`
+}
+
+// GenerateDeviceSecret returns a random MQTT secret, URL-safe base64 without padding
+func GenerateDeviceSecret() (string, error) {
+	buf := make([]byte, deviceSecretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashDeviceSecret hashes a secret with the device ID, so equal secrets of two devices differ
+// at rest. Secrets are random, so a plain hash cannot be reversed by guessing.
+func hashDeviceSecret(deviceID uuid.UUID, secret string) string {
+	sum := sha256.Sum256([]byte(deviceID.String() + ":" + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// MQTTUsername returns the username a device authenticates with: its MAC, or its IMEI when
+// it has no MAC. The other identifier is accepted as well.
+func MQTTUsername(device *models.Device) string {
+	if device.MAC == "" && device.IMEI != nil {
+		return *device.IMEI
+	}
+	return device.MAC
+}
+
+// CreateDeviceWithCredentials creates a device like CreateDevice and issues its MQTT secret
+// in the same transaction, so no device is left without one when issuing fails
+func (s *DeviceService) CreateDeviceWithCredentials(mac string, imei *string, deviceType models.DeviceType, projectID uuid.UUID, partitionID *uuid.UUID, displayName string) (*models.Device, *DeviceCredentials, error) {
+	var (
+		device *models.Device
+		creds  *DeviceCredentials
+	)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if device, err = NewDeviceService(tx).CreateDevice(mac, imei, deviceType, projectID, partitionID, displayName); err != nil {
+			return err
+		}
+		creds, err = issueCredentials(tx, device, 0)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return device, creds, nil
+}
+
+// IssueCredentials gives a device a new MQTT secret and returns it; it cannot be read back
+// later. The secret it replaces keeps working for grace, if positive.
+func (s *DeviceService) IssueCredentials(device *models.Device, grace time.Duration) (*DeviceCredentials, error) {
+	return issueCredentials(s.db, device, grace)
+}
+
+func issueCredentials(db *gorm.DB, device *models.Device, grace time.Duration) (*DeviceCredentials, error) {
+	repo := store.NewDeviceCredentialRepository(db)
+	current, err := repo.GetByDevice(device.ID)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errors.NewInternalError("Failed to get device credentials")
+	}
+
+	cred, creds, err := newDeviceCredential(device)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && grace > 0 {
+		expiresAt := cred.RotatedAt.Add(grace)
+		cred.PreviousHash, cred.PreviousExpiresAt = current.SecretHash, &expiresAt
+		creds.PreviousExpiresAt = &expiresAt
+	}
+	if err := repo.Save(cred); err != nil {
+		return nil, errors.NewInternalError("Failed to save device credentials")
+	}
+	return creds, nil
+}
+
+// newDeviceCredential generates a secret for a device: the row to store and the credentials
+// to hand out
+func newDeviceCredential(device *models.Device) (*models.DeviceCredential, *DeviceCredentials, error) {
+	secret, err := GenerateDeviceSecret()
+	if err != nil {
+		return nil, nil, errors.NewInternalError("Failed to generate device secret")
+	}
+	cred := &models.DeviceCredential{
+		DeviceID:   device.ID,
+		SecretHash: hashDeviceSecret(device.ID, secret),
+		RotatedAt:  time.Now(),
+	}
+	return cred, &DeviceCredentials{Username: MQTTUsername(device), Password: secret}, nil
+}
+
+// HasCredentials reports whether a device has been given an MQTT secret
+func (s *DeviceService) HasCredentials(device *models.Device) (bool, error) {
+	if _, err := store.NewDeviceCredentialRepository(s.db).GetByDevice(device.ID); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return false, nil
+		}
+		return false, errors.NewInternalError("Failed to get device credentials")
+	}
+	return true, nil
+}
+
+// AuthenticateDevice checks the MQTT secret of the device with identifier, a MAC or IMEI as
+// by says, and returns the device. The previous secret is accepted until its grace ends.
+func (s *DeviceService) AuthenticateDevice(by, identifier, secret string) (*models.Device, error) {
+	device, err := s.GetDeviceByIdentifier(identifier, by)
+	if err != nil {
+		if appErr, ok := err.(*errors.AppError); ok && appErr.HTTPStatus < 500 {
+			return nil, ErrInvalidDeviceCredentials
+		}
+		return nil, err
+	}
+	cred, err := store.NewDeviceCredentialRepository(s.db).GetByDevice(device.ID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidDeviceCredentials
+		}
+		return nil, errors.NewInternalError("Failed to get device credentials")
+	}
+
+	hash := []byte(hashDeviceSecret(device.ID, secret))
+	if subtle.ConstantTimeCompare(hash, []byte(cred.SecretHash)) == 1 {
+		return device, nil
+	}
+	if cred.PreviousHash != "" && cred.PreviousExpiresAt != nil && cred.PreviousExpiresAt.After(time.Now()) &&
+		subtle.ConstantTimeCompare(hash, []byte(cred.PreviousHash)) == 1 {
+		return device, nil
+	}
+	return nil, ErrInvalidDeviceCredentials
+}
+
+// LegacyPasswordAllowed reports whether a device may authenticate over MQTT with its MAC or
+// IMEI as password, like firmware without a secret does. Its organization decides, see
+// OrgSettings.MQTTLegacyPasswords.
+func (s *DeviceService) LegacyPasswordAllowed(device *models.Device) (bool, error) {
+	project := device.Project
+	if project == nil {
+		var err error
+		if project, err = store.NewProjectRepository(s.db).GetByID(device.ProjectID); err != nil {
+			return false, errors.NewInternalError("Failed to get project")
+		}
+	}
+	setting, err := store.NewOrganizationSettingRepository(s.db).Get(s.db.Statement.Context, project.OrgID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return true, nil
+		}
+		return false, errors.NewInternalError("Failed to get organization settings")
+	}
+	return setting.MQTTLegacyPasswords, nil
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceService_Credentials(t *testing.T) {
+	db := setupTestDB(t)
+	service := NewDeviceService(db)
+	project := setupTestProject(t, db)
+	imei := "861234567890130"
+	device, err := service.CreateDevice("AA:BB:CC:DD:EE:60", &imei, models.DeviceTypeLTE, project.ID, nil, "Gateway")
+	require.NoError(t, err)
+
+	_, err = service.AuthenticateDevice("mac", device.MAC, "anything")
+	assert.Equal(t, ErrInvalidDeviceCredentials, err)
+
+	first, err := service.IssueCredentials(device, DefaultCredentialGrace)
+	require.NoError(t, err)
+	assert.Equal(t, "AABBCCDDEE60", first.Username)
+	assert.Nil(t, first.PreviousExpiresAt)
+
+	var stored models.DeviceCredential
+	require.NoError(t, db.First(&stored, "device_id = ?", device.ID).Error)
+	assert.NotContains(t, stored.SecretHash, first.Password)
+
+	authenticated, err := service.AuthenticateDevice("imei", imei, first.Password)
+	require.NoError(t, err)
+	assert.Equal(t, device.ID, authenticated.ID)
+	_, err = service.AuthenticateDevice("mac", device.MAC, first.Password+"x")
+	assert.Equal(t, ErrInvalidDeviceCredentials, err)
+	_, err = service.AuthenticateDevice("mac", "AABBCCDDEE61", first.Password)
+	assert.Equal(t, ErrInvalidDeviceCredentials, err)
+
+	t.Run("old secret works during the grace window", func(t *testing.T) {
+		second, err := service.IssueCredentials(device, time.Hour)
+		require.NoError(t, err)
+		require.NotNil(t, second.PreviousExpiresAt)
+		assert.NotEqual(t, first.Password, second.Password)
+		for _, secret := range []string{first.Password, second.Password} {
+			_, err := service.AuthenticateDevice("mac", device.MAC, secret)
+			assert.NoError(t, err)
+		}
+
+		expired := time.Now().Add(-time.Minute)
+		require.NoError(t, db.Model(&models.DeviceCredential{}).Where("device_id = ?", device.ID).
+			Update("previous_expires_at", expired).Error)
+		_, err = service.AuthenticateDevice("mac", device.MAC, first.Password)
+		assert.Equal(t, ErrInvalidDeviceCredentials, err)
+
+		// Without a grace window the old secret stops at once
+		third, err := service.IssueCredentials(device, 0)
+		require.NoError(t, err)
+		assert.Nil(t, third.PreviousExpiresAt)
+		_, err = service.AuthenticateDevice("mac", device.MAC, second.Password)
+		assert.Equal(t, ErrInvalidDeviceCredentials, err)
+		_, err = service.AuthenticateDevice("mac", device.MAC, third.Password)
+		assert.NoError(t, err)
+	})
+
+	t.Run("legacy passwords follow the organization setting", func(t *testing.T) {
+		allowed, err := service.LegacyPasswordAllowed(device)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+
+		settings := NewSettingServiceWithRepos(store.NewOrganizationSettingRepository(db), store.NewSystemSettingRepository(db))
+		ctx := context.Background()
+		current, err := settings.GetOrgSettings(ctx, project.OrgID)
+		require.NoError(t, err)
+		assert.True(t, current.MQTTLegacyPasswords)
+		current.MQTTLegacyPasswords = false
+		require.NoError(t, settings.SetOrgSettings(ctx, project.OrgID, *current))
+
+		allowed, err = service.LegacyPasswordAllowed(device)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+		current, err = settings.GetOrgSettings(ctx, project.OrgID)
+		require.NoError(t, err)
+		assert.False(t, current.MQTTLegacyPasswords)
+		assert.True(t, current.FactoryAllowRegistration)
+	})
+}
@@ -1,6 +1,9 @@
 package services
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -15,6 +18,7 @@ import (
 
 // DeviceService handles device business logic
 type DeviceService struct {
+	db         *gorm.DB
 	deviceRepo *store.DeviceRepository
 }
 
@@ -26,10 +30,16 @@ var (
 // NewDeviceService creates a new device service
 func NewDeviceService(db *gorm.DB) *DeviceService {
 	return &DeviceService{
+		db:         db,
 		deviceRepo: store.NewDeviceRepository(db),
 	}
 }
 
+// WithContext returns the service bound to ctx, so its queries run in the tenant scope of ctx
+func (s *DeviceService) WithContext(ctx context.Context) *DeviceService {
+	return NewDeviceService(s.db.WithContext(ctx))
+}
+
 // NormalizeMAC normalizes MAC address to uppercase 12-character hex string
 func NormalizeMAC(mac string) (string, error) {
 	// Remove common separators
@@ -87,6 +97,121 @@ func ValidateMAC(mac string) bool {
 	return err == nil
 }
 
+// IdentifierType returns "mac" or "imei" for an identifier that is valid as one, or "" for
+// neither. A MAC has 12 characters and an IMEI 14 to 16 digits, so none is valid as both.
+func IdentifierType(identifier string) string {
+	switch {
+	case ValidateMAC(identifier):
+		return "mac"
+	case ValidateIMEI(identifier):
+		return "imei"
+	}
+	return ""
+}
+
+// Device list filter keys for tag and metadata matching, see store.FilterTagsAny and friends
+const (
+	DeviceFilterTagsAny = store.FilterTagsAny
+	DeviceFilterTagsAll = store.FilterTagsAll
+	DeviceFilterMeta    = store.FilterMeta
+	// DeviceFilterPartitionTree matches devices anywhere under a partition
+	DeviceFilterPartitionTree = store.FilterPartitionTree
+)
+
+// Limits on device tags and metadata keys
+const (
+	MaxDeviceTags    = 32
+	MaxTagLength     = 64
+	MaxMetaKeyLength = 64
+)
+
+// NormalizeTags trims tags, drops empty ones and duplicates and enforces the tag limits.
+// The first occurrence of a tag keeps its position.
+func NormalizeTags(tags []string) (models.StringList, error) {
+	out := models.StringList{}
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > MaxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, MaxTagLength)
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	if len(out) > MaxDeviceTags {
+		return nil, fmt.Errorf("a device can have at most %d tags, got %d", MaxDeviceTags, len(out))
+	}
+	return out, nil
+}
+
+// ValidateMetaKey checks a top-level metadata key: 1-64 letters, digits, '_', '-' or '.'.
+// Keys are restricted so they can be used in list filters on every database.
+func ValidateMetaKey(key string) error {
+	if key == "" || len(key) > MaxMetaKeyLength {
+		return fmt.Errorf("meta key must be 1-%d characters", MaxMetaKeyLength)
+	}
+	for _, char := range key {
+		if (char < 'a' || char > 'z') && (char < 'A' || char > 'Z') && (char < '0' || char > '9') &&
+			char != '_' && char != '-' && char != '.' {
+			return fmt.Errorf("meta key %q contains invalid character: %c", key, char)
+		}
+	}
+	return nil
+}
+
+// MergePatchMeta applies a JSON merge patch (RFC 7386) to device metadata: null removes a
+// key, objects are merged recursively and any other value replaces the existing one
+func MergePatchMeta(meta models.JSONMap, patch map[string]interface{}) (models.JSONMap, error) {
+	for key := range patch {
+		if err := ValidateMetaKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return models.JSONMap(mergePatch(meta, patch)), nil
+}
+
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(target)+len(patch))
+	for key, value := range target {
+		out[key] = value
+	}
+	for key, value := range patch {
+		switch v := value.(type) {
+		case nil:
+			delete(out, key)
+		case map[string]interface{}:
+			existing, _ := out[key].(map[string]interface{})
+			out[key] = mergePatch(existing, v)
+		default:
+			out[key] = v
+		}
+	}
+	return out
+}
+
+// UpdateDeviceLabels replaces the tags of a device when tags is non-nil and merge-patches its
+// metadata when metaPatch is non-nil, then persists the device
+func (s *DeviceService) UpdateDeviceLabels(device *models.Device, tags *[]string, metaPatch map[string]interface{}) error {
+	if tags != nil {
+		normalized, err := NormalizeTags(*tags)
+		if err != nil {
+			return errors.NewValidationError("Invalid tags", map[string]interface{}{"tags": err.Error()})
+		}
+		device.Tags = normalized
+	}
+	if metaPatch != nil {
+		merged, err := MergePatchMeta(device.Meta, metaPatch)
+		if err != nil {
+			return errors.NewValidationError("Invalid meta", map[string]interface{}{"meta": err.Error()})
+		}
+		device.Meta = merged
+	}
+	return s.UpdateDevice(device)
+}
+
 // CreateDevice creates a new device
 func (s *DeviceService) CreateDevice(mac string, imei *string, deviceType models.DeviceType, projectID uuid.UUID, partitionID *uuid.UUID, displayName string) (*models.Device, error) {
 	var normalizedMAC string
@@ -199,25 +324,29 @@ func (s *DeviceService) GetDeviceByID(identifier string, idType string) (*models
 
 // UpdateDeviceStatus updates device status and last seen time
 func (s *DeviceService) UpdateDeviceStatus(deviceID uuid.UUID, status models.DeviceStatus) error {
-	device, err := s.GetDevice(deviceID)
-	if err != nil {
-		return err
+	if err := s.deviceRepo.UpdatePresence(deviceID, status, time.Now()); err != nil {
+		return errors.NewInternalError("Failed to update device status")
 	}
+	return nil
+}
 
-	device.Status = status
-	now := time.Now()
-	device.LastSeenAt = &now
-
-	if err := s.deviceRepo.Update(device); err != nil {
+// ReportPresence records an online/offline report from the MQTT broker. Unbound devices keep
+// their status and only refresh the last seen time, so they stay claimable by BindDevice.
+// Only the status and last seen columns are written, so a concurrent edit is never lost.
+func (s *DeviceService) ReportPresence(deviceID uuid.UUID, status models.DeviceStatus) error {
+	if err := s.deviceRepo.ReportPresence(deviceID, status, time.Now()); err != nil {
 		return errors.NewInternalError("Failed to update device status")
 	}
-
 	return nil
 }
 
-// UpdateDevice persists device changes
+// UpdateDevice persists device changes. It fails with 412 Precondition Failed when the
+// device was changed since it was read, that is when its version moved on.
 func (s *DeviceService) UpdateDevice(device *models.Device) error {
 	if err := s.deviceRepo.Update(device); err != nil {
+		if err == store.ErrVersionConflict {
+			return errors.NewPreconditionFailedError("Device was modified concurrently")
+		}
 		return errors.NewInternalError("Failed to update device")
 	}
 	return nil
@@ -252,22 +381,15 @@ func (s *DeviceService) FindOrCreateForRegistration(macRaw string, imeiRaw *stri
 	// Try by MAC first
 	if mac != "" {
 		if dev, err := s.deviceRepo.GetByMAC(mac); err == nil && dev != nil {
-			// Update optional fields if empty
-			changed := false
+			// Fill optional fields that are still empty
+			backfill := map[string]interface{}{}
 			if dev.IMEI == nil && imei != nil {
-				dev.IMEI = imei
-				changed = true
+				backfill["imei"] = *imei
 			}
 			if dev.DisplayName == "" && displayName != "" {
-				dev.DisplayName = displayName
-				changed = true
+				backfill["display_name"] = displayName
 			}
-			if changed {
-				if uerr := s.deviceRepo.Update(dev); uerr != nil {
-					return nil, false, errors.NewInternalError("Failed to update device")
-				}
-			}
-			return dev, false, nil
+			return s.backfill(dev, backfill)
 		}
 	}
 
@@ -275,13 +397,11 @@ func (s *DeviceService) FindOrCreateForRegistration(macRaw string, imeiRaw *stri
 	if imei != nil {
 		if dev, err := s.deviceRepo.GetByIMEI(*imei); err == nil && dev != nil {
 			// Backfill MAC if missing
+			backfill := map[string]interface{}{}
 			if dev.MAC == "" && mac != "" {
-				dev.MAC = mac
-				if uerr := s.deviceRepo.Update(dev); uerr != nil {
-					return nil, false, errors.NewInternalError("Failed to update device")
-				}
+				backfill["mac"] = mac
 			}
-			return dev, false, nil
+			return s.backfill(dev, backfill)
 		}
 	}
 
@@ -310,6 +430,25 @@ func (s *DeviceService) FindOrCreateForRegistration(macRaw string, imeiRaw *stri
 	return device, true, nil
 }
 
+// backfill fills the given columns of a registering device where they are still empty and
+// returns the device as stored. Each column is written on its own, so an edit made since
+// the device was read is kept.
+func (s *DeviceService) backfill(device *models.Device, columns map[string]interface{}) (*models.Device, bool, error) {
+	if len(columns) == 0 {
+		return device, false, nil
+	}
+	for column, value := range columns {
+		if _, err := s.deviceRepo.FillEmpty(device.ID, column, value); err != nil {
+			return nil, false, errors.NewInternalError("Failed to update device")
+		}
+	}
+	device, err := s.deviceRepo.GetByID(device.ID)
+	if err != nil {
+		return nil, false, errors.NewInternalError("Failed to get device")
+	}
+	return device, false, nil
+}
+
 func chooseDisplayName(name, mac string, imei *string) string {
 	if name != "" {
 		return name
@@ -323,8 +462,136 @@ func chooseDisplayName(name, mac string, imei *string) string {
 	return "device"
 }
 
+// DefaultDeviceSort is the device list order when none is requested
+const DefaultDeviceSort = "display_name"
+
+// DeviceListOptions selects a page of devices. Cursor, when set, continues after the page it
+// was returned with and takes precedence over Page.
+type DeviceListOptions struct {
+	Filters  map[string]interface{}
+	Search   string
+	Sort     string // e.g. "last_seen_at,-display_name"
+	Page     int
+	PageSize int
+	Cursor   string
+}
+
+// DevicePage is one page of a device list
+type DevicePage struct {
+	Devices    []models.Device
+	Total      int64
+	NextCursor string // empty on the last page
+}
+
+// ListDevicePage lists one page of an organization's devices, filtered, searched and sorted
+// in the database
+func (s *DeviceService) ListDevicePage(orgID uuid.UUID, opts DeviceListOptions) (*DevicePage, error) {
+	if err := validateDeviceFilters(opts.Filters); err != nil {
+		return nil, err
+	}
+	if opts.Sort == "" {
+		opts.Sort = DefaultDeviceSort
+	}
+	if opts.PageSize < 1 {
+		opts.PageSize = 20
+	}
+	sort, err := store.ParseDeviceSort(opts.Sort)
+	if err != nil {
+		return nil, errors.NewValidationError("Invalid sort", map[string]interface{}{"sort": err.Error()})
+	}
+
+	q := store.DeviceListQuery{
+		Filters: opts.Filters,
+		Search:  strings.TrimSpace(opts.Search),
+		Sort:    sort,
+		Limit:   opts.PageSize + 1, // one extra row tells whether there is a next page
+	}
+	if opts.Cursor != "" {
+		if q.After, err = decodeDeviceCursor(opts.Cursor, opts.Sort, sort); err != nil {
+			return nil, errors.NewValidationError("Invalid cursor", map[string]interface{}{"cursor": err.Error()})
+		}
+	} else if opts.Page > 1 {
+		q.Offset = (opts.Page - 1) * opts.PageSize
+	}
+
+	devices, total, err := s.deviceRepo.ListPage(orgID, q)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to list devices")
+	}
+	page := &DevicePage{Devices: devices, Total: total}
+	if len(devices) > opts.PageSize {
+		page.Devices = devices[:opts.PageSize]
+		last := page.Devices[len(page.Devices)-1]
+		page.NextCursor = encodeDeviceCursor(opts.Sort, s.deviceRepo.CursorFor(&last, sort))
+	}
+	return page, nil
+}
+
+// deviceCursor is the wire form of a store.DeviceCursor. It records the sort it was made
+// for, so it cannot be replayed against a different order.
+type deviceCursor struct {
+	Sort   string    `json:"s"`
+	Values []*string `json:"v"`
+	ID     uuid.UUID `json:"id"`
+}
+
+func encodeDeviceCursor(sortSpec string, cursor *store.DeviceCursor) string {
+	wire := deviceCursor{Sort: sortSpec, ID: cursor.ID}
+	for _, value := range cursor.Values {
+		var text *string
+		switch v := value.(type) {
+		case string:
+			text = &v
+		case time.Time:
+			formatted := v.Format(time.RFC3339Nano)
+			text = &formatted
+		}
+		wire.Values = append(wire.Values, text)
+	}
+	b, _ := json.Marshal(wire)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeDeviceCursor(encoded, sortSpec string, sort []store.DeviceSort) (*store.DeviceCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	var wire deviceCursor
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	if wire.Sort != sortSpec || len(wire.Values) != len(sort) {
+		return nil, fmt.Errorf("cursor was issued for a different sort order")
+	}
+
+	cursor := &store.DeviceCursor{ID: wire.ID}
+	for i, text := range wire.Values {
+		var value interface{}
+		switch {
+		case text == nil:
+			if sort[i].Field != "last_seen_at" {
+				return nil, fmt.Errorf("malformed cursor")
+			}
+		case strings.HasSuffix(sort[i].Field, "_at"):
+			t, err := time.Parse(time.RFC3339Nano, *text)
+			if err != nil {
+				return nil, fmt.Errorf("malformed cursor")
+			}
+			value = t
+		default:
+			value = *text
+		}
+		cursor.Values = append(cursor.Values, value)
+	}
+	return cursor, nil
+}
+
 // ListDevicesByOrganization lists devices by organization with filtering
 func (s *DeviceService) ListDevicesByOrganization(orgID uuid.UUID, filters map[string]interface{}) ([]models.Device, error) {
+	if err := validateDeviceFilters(filters); err != nil {
+		return nil, err
+	}
 	devices, err := s.deviceRepo.ListByOrg(orgID, filters)
 	if err != nil {
 		return nil, errors.NewInternalError("Failed to list devices")
@@ -334,9 +601,23 @@ func (s *DeviceService) ListDevicesByOrganization(orgID uuid.UUID, filters map[s
 
 // ListDevicesByProject lists devices by project with filtering
 func (s *DeviceService) ListDevicesByProject(projectID uuid.UUID, filters map[string]interface{}) ([]models.Device, error) {
+	if err := validateDeviceFilters(filters); err != nil {
+		return nil, err
+	}
 	devices, err := s.deviceRepo.ListByProject(projectID, filters)
 	if err != nil {
 		return nil, errors.NewInternalError("Failed to list devices")
 	}
 	return devices, nil
 }
+
+// validateDeviceFilters rejects meta filter keys that could not be matched safely
+func validateDeviceFilters(filters map[string]interface{}) error {
+	meta, _ := filters[store.FilterMeta].(map[string]string)
+	for key := range meta {
+		if err := ValidateMetaKey(key); err != nil {
+			return errors.NewValidationError("Invalid meta filter", map[string]interface{}{"meta": err.Error()})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/internal/xlsx"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+)
+
+// Device export formats
+const (
+	DeviceExportCSV    = "csv"
+	DeviceExportNDJSON = "ndjson"
+	DeviceExportXLSX   = "xlsx"
+)
+
+// deviceExportBatchSize is how many devices an export reads, and writes between flushes, at a time
+const deviceExportBatchSize = 500
+
+// deviceExportColumns follow the import columns in CSV and XLSX exports. The importer
+// ignores them, so an export can be imported again as is.
+var deviceExportColumns = []string{"id", "project_name", "partition_id", "status", "last_seen_at", "created_at", "meta", "bound_user_id", "bound_at", "shares"}
+
+// deviceExportRecord is one NDJSON export line
+type deviceExportRecord struct {
+	ID            uuid.UUID            `json:"id"`
+	MAC           string               `json:"mac"`
+	IMEI          *string              `json:"imei"`
+	DeviceType    models.DeviceType    `json:"device_type"`
+	ProjectID     uuid.UUID            `json:"project_id"`
+	ProjectName   string               `json:"project_name"`
+	PartitionID   *uuid.UUID           `json:"partition_id"`
+	PartitionPath string               `json:"partition_path"`
+	DisplayName   string               `json:"display_name"`
+	Status        models.DeviceStatus  `json:"status"`
+	LastSeenAt    *time.Time           `json:"last_seen_at"`
+	CreatedAt     time.Time            `json:"created_at"`
+	Tags          models.StringList    `json:"tags"`
+	Meta          models.JSONMap       `json:"meta"`
+	Binding       *deviceExportBinding `json:"binding"`
+	Shares        []deviceExportShare  `json:"shares"`
+}
+
+type deviceExportBinding struct {
+	UserID  uuid.UUID `json:"user_id"`
+	BoundAt time.Time `json:"bound_at"`
+}
+
+type deviceExportShare struct {
+	SubjectType models.SubjectType `json:"subject_type"`
+	SubjectID   uuid.UUID          `json:"subject_id"`
+	Role        models.DeviceRole  `json:"role"`
+	GrantedAt   time.Time          `json:"granted_at"`
+}
+
+// ValidateDeviceExportFormat checks an export format before any output is written
+func ValidateDeviceExportFormat(format string) error {
+	if format != DeviceExportCSV && format != DeviceExportNDJSON && format != DeviceExportXLSX {
+		return errors.NewValidationError("Invalid export format", map[string]interface{}{
+			"format": "format must be 'csv', 'ndjson' or 'xlsx'",
+		})
+	}
+	return nil
+}
+
+// ExportDevices streams every device of the organization matching the filters, search and
+// sort of opts to w, with its partition path, binding and shares. Page and cursor are ignored.
+// Output is flushed after every batch when w supports it; an error after the first write
+// leaves the output truncated.
+func (s *DeviceService) ExportDevices(orgID uuid.UUID, opts DeviceListOptions, format string, w io.Writer) error {
+	if err := ValidateDeviceExportFormat(format); err != nil {
+		return err
+	}
+	if err := validateDeviceFilters(opts.Filters); err != nil {
+		return err
+	}
+	if opts.Sort == "" {
+		opts.Sort = DefaultDeviceSort
+	}
+	sort, err := store.ParseDeviceSort(opts.Sort)
+	if err != nil {
+		return errors.NewValidationError("Invalid sort", map[string]interface{}{"sort": err.Error()})
+	}
+	flusher, _ := w.(interface{ Flush() })
+
+	header := append(append([]string{}, deviceImportColumns...), deviceExportColumns...)
+	var write func(*deviceExportRecord) error
+	var flush func() error
+	var finish func() error
+	switch format {
+	case DeviceExportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+		write = func(rec *deviceExportRecord) error {
+			cells := deviceExportCells(rec)
+			for i := range cells {
+				cells[i] = csvSafe(cells[i])
+			}
+			return cw.Write(cells)
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+		finish = flush
+	case DeviceExportXLSX:
+		xw, err := xlsx.NewWriter(w, "Devices")
+		if err != nil {
+			return err
+		}
+		if err := xw.WriteRow(header); err != nil {
+			return err
+		}
+		write = func(rec *deviceExportRecord) error { return xw.WriteRow(deviceExportCells(rec)) }
+		flush = xw.Flush
+		finish = xw.Close
+	default:
+		enc := json.NewEncoder(w)
+		write = func(rec *deviceExportRecord) error { return enc.Encode(rec) }
+		flush = func() error { return nil }
+		finish = flush
+	}
+
+	paths := newPartitionPaths(store.NewPartitionRepository(s.db))
+	bindingRepo := store.NewDeviceBindingRepository(s.db)
+	shareRepo := store.NewDeviceShareRepository(s.db)
+	q := store.DeviceListQuery{Filters: opts.Filters, Search: strings.TrimSpace(opts.Search), Sort: sort}
+	err = s.deviceRepo.EachBatch(orgID, q, deviceExportBatchSize, func(devices []models.Device) error {
+		ids := make([]uuid.UUID, len(devices))
+		for i := range devices {
+			ids[i] = devices[i].ID
+		}
+		bindings, err := bindingRepo.ListByDevices(ids)
+		if err != nil {
+			return err
+		}
+		bound := make(map[uuid.UUID]*deviceExportBinding, len(bindings))
+		for _, binding := range bindings {
+			bound[binding.DeviceID] = &deviceExportBinding{UserID: binding.UserID, BoundAt: binding.BoundAt}
+		}
+		shares, err := shareRepo.ListByDevices(ids)
+		if err != nil {
+			return err
+		}
+		shared := make(map[uuid.UUID][]deviceExportShare)
+		for _, share := range shares {
+			shared[share.DeviceID] = append(shared[share.DeviceID], deviceExportShare{
+				SubjectType: share.SubjectType,
+				SubjectID:   share.SubjectID,
+				Role:        share.Role,
+				GrantedAt:   share.GrantedAt,
+			})
+		}
+
+		for i := range devices {
+			device := &devices[i]
+			rec := &deviceExportRecord{
+				ID:          device.ID,
+				MAC:         device.MAC,
+				IMEI:        device.IMEI,
+				DeviceType:  device.DeviceType,
+				ProjectID:   device.ProjectID,
+				PartitionID: device.PartitionID,
+				DisplayName: device.DisplayName,
+				Status:      device.Status,
+				LastSeenAt:  device.LastSeenAt,
+				CreatedAt:   device.CreatedAt,
+				Tags:        device.Tags,
+				Meta:        device.Meta,
+				Binding:     bound[device.ID],
+				Shares:      shared[device.ID],
+			}
+			if device.Project != nil {
+				rec.ProjectName = device.Project.Name
+			}
+			if device.PartitionID != nil {
+				if rec.PartitionPath, err = paths.path(device.ProjectID, *device.PartitionID); err != nil {
+					return err
+				}
+			}
+			if rec.Tags == nil {
+				rec.Tags = models.StringList{}
+			}
+			if rec.Meta == nil {
+				rec.Meta = models.JSONMap{}
+			}
+			if rec.Shares == nil {
+				rec.Shares = []deviceExportShare{}
+			}
+			if err := write(rec); err != nil {
+				return err
+			}
+		}
+
+		if err := flush(); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := finish(); err != nil {
+		return err
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// deviceExportCells is the CSV and XLSX row of a record, in import then export column order
+func deviceExportCells(rec *deviceExportRecord) []string {
+	optionalTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	imei, partitionID := "", ""
+	if rec.IMEI != nil {
+		imei = *rec.IMEI
+	}
+	if rec.PartitionID != nil {
+		partitionID = rec.PartitionID.String()
+	}
+	meta, _ := json.Marshal(rec.Meta)
+	boundUser, boundAt := "", ""
+	if rec.Binding != nil {
+		boundUser = rec.Binding.UserID.String()
+		boundAt = optionalTime(&rec.Binding.BoundAt)
+	}
+	shares := make([]string, len(rec.Shares))
+	for i, share := range rec.Shares {
+		shares[i] = string(share.SubjectType) + ":" + share.SubjectID.String() + ":" + string(share.Role)
+	}
+	return []string{
+		rec.MAC,
+		imei,
+		string(rec.DeviceType),
+		rec.ProjectID.String(),
+		rec.PartitionPath,
+		rec.DisplayName,
+		strings.Join(rec.Tags, ";"),
+		"", // claim codes are kept as hashes only
+		rec.ID.String(),
+		rec.ProjectName,
+		partitionID,
+		string(rec.Status),
+		optionalTime(rec.LastSeenAt),
+		optionalTime(&rec.CreatedAt),
+		string(meta),
+		boundUser,
+		boundAt,
+		strings.Join(shares, ";"),
+	}
+}
+
+// partitionPaths resolves partition IDs to their name paths ("Hall A/Line 1"), reading the
+// partitions of each project once
+type partitionPaths struct {
+	repo     *store.PartitionRepository
+	projects map[uuid.UUID]bool
+	byID     map[uuid.UUID]*models.Partition
+	paths    map[uuid.UUID]string
+}
+
+func newPartitionPaths(repo *store.PartitionRepository) *partitionPaths {
+	return &partitionPaths{
+		repo:     repo,
+		projects: make(map[uuid.UUID]bool),
+		byID:     make(map[uuid.UUID]*models.Partition),
+		paths:    make(map[uuid.UUID]string),
+	}
+}
+
+func (p *partitionPaths) path(projectID, partitionID uuid.UUID) (string, error) {
+	if path, ok := p.paths[partitionID]; ok {
+		return path, nil
+	}
+	if !p.projects[projectID] {
+		partitions, err := p.repo.ListByProject(projectID)
+		if err != nil {
+			return "", err
+		}
+		for i := range partitions {
+			p.byID[partitions[i].ID] = &partitions[i]
+		}
+		p.projects[projectID] = true
+	}
+
+	var names []string
+	for id := &partitionID; id != nil && len(names) < len(p.byID); {
+		partition, ok := p.byID[*id]
+		if !ok {
+			break
+		}
+		names = append([]string{partition.Name}, names...)
+		id = partition.ParentID
+	}
+	path := strings.Join(names, "/")
+	p.paths[partitionID] = path
+	return path, nil
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceService_ExportDevices(t *testing.T) {
+	db := setupTestDB(t)
+	org, err := NewOrganizationService(db, setupTestEnforcer(t, db)).CreateOrganization("test-org", "Test Organization")
+	require.NoError(t, err)
+	project := &models.Project{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: org.ID, Name: "Plant", CreatedBy: uuid.New()}
+	require.NoError(t, db.Create(project).Error)
+
+	service := NewDeviceService(db)
+	rows := []DeviceImportRow{
+		{MAC: "A1B2C3D4E5F6", IMEI: "123456789012345", DeviceType: "lte_nr", Project: project.ID.String(), PartitionPath: "Hall A/Line 1", DisplayName: "=Gate", Tags: []string{"roof", "-east"}},
+		{MAC: "A1B2C3D4E5F7", DeviceType: "wifi_eth", Project: project.ID.String(), DisplayName: "Fence"},
+	}
+	imported, err := service.ImportDevices(org.ID, rows, DeviceImportOptions{})
+	require.NoError(t, err)
+	require.True(t, imported.Committed)
+	gate := *imported.Rows[0].DeviceID
+
+	owner := uuid.New()
+	now := time.Now()
+	require.NoError(t, db.Create(&models.DeviceBinding{BaseModel: models.BaseModel{ID: uuid.New()}, DeviceID: gate, UserID: owner, BoundAt: now, BoundBy: owner}).Error)
+	require.NoError(t, db.Create(&models.DeviceShare{BaseModel: models.BaseModel{ID: uuid.New()}, DeviceID: gate, SubjectType: models.SubjectTypeUser, SubjectID: uuid.New(), Role: models.DeviceRoleViewer, GrantedBy: owner, GrantedAt: now}).Error)
+
+	opts := DeviceListOptions{Sort: "mac"}
+
+	t.Run("csv round-trips into the importer", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, service.ExportDevices(org.ID, opts, DeviceExportCSV, &buf))
+		assert.Contains(t, buf.String(), "'=Gate")
+
+		parsed, err := ParseDeviceImportCSV(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, rows, parsed)
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, service.ExportDevices(org.ID, opts, DeviceExportNDJSON, &buf))
+		scanner := bufio.NewScanner(&buf)
+		var records []deviceExportRecord
+		for scanner.Scan() {
+			var rec deviceExportRecord
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+			records = append(records, rec)
+		}
+		require.Len(t, records, 2)
+		assert.Equal(t, gate, records[0].ID)
+		assert.Equal(t, "Plant", records[0].ProjectName)
+		assert.Equal(t, "Hall A/Line 1", records[0].PartitionPath)
+		require.NotNil(t, records[0].Binding)
+		assert.Equal(t, owner, records[0].Binding.UserID)
+		require.Len(t, records[0].Shares, 1)
+		assert.Equal(t, models.DeviceRoleViewer, records[0].Shares[0].Role)
+		assert.Nil(t, records[1].Binding)
+		assert.Empty(t, records[1].Shares)
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		var buf bytes.Buffer
+		filtered := DeviceListOptions{Filters: map[string]interface{}{DeviceFilterTagsAny: []string{"roof"}}}
+		require.NoError(t, service.ExportDevices(org.ID, filtered, DeviceExportNDJSON, &buf))
+		assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("\n")))
+	})
+
+	t.Run("xlsx", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, service.ExportDevices(org.ID, opts, DeviceExportXLSX, &buf))
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+		names := make([]string, 0, len(zr.File))
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		assert.Contains(t, names, "xl/worksheets/sheet1.xml")
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.Error(t, service.ExportDevices(org.ID, opts, "pdf", &buf))
+		assert.Zero(t, buf.Len())
+	})
+}
@@ -0,0 +1,498 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/internal/tenant"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MaxDeviceImportRows bounds one bulk import
+const MaxDeviceImportRows = 5000
+
+// Device import error codes
+const (
+	ImportErrorInvalid   = "invalid"
+	ImportErrorConflict  = "conflict"
+	ImportErrorNotFound  = "not_found"
+	ImportErrorForbidden = "forbidden"
+)
+
+// deviceImportColumns are the columns of a CSV import, matched case-insensitively. Tags are
+// separated by ';' within their cell. The extra columns of a CSV export are accepted and
+// ignored.
+var deviceImportColumns = []string{"mac", "imei", "device_type", "project", "partition_path", "display_name", "tags", "claim_code"}
+
+// DeviceImportRow is one device to import. Project is a project ID or the name of a project
+// in the organization; PartitionPath names partitions from the project root down, separated
+// by '/'. ClaimCode, when set, is the factory claim code of the device (see ClaimDevice).
+type DeviceImportRow struct {
+	MAC           string   `json:"mac"`
+	IMEI          string   `json:"imei"`
+	DeviceType    string   `json:"device_type"`
+	Project       string   `json:"project"`
+	PartitionPath string   `json:"partition_path"`
+	DisplayName   string   `json:"display_name"`
+	Tags          []string `json:"tags"`
+	ClaimCode     string   `json:"claim_code,omitempty"`
+}
+
+// DeviceImportError is a problem with one field of a row
+type DeviceImportError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// DeviceImportRowResult reports one row: the normalized device it describes and its errors,
+// or, once committed, the created device ID and its MQTT credentials, returned only this once
+type DeviceImportRowResult struct {
+	Row             int                 `json:"row"` // 1-based position among the data rows
+	MAC             string              `json:"mac,omitempty"`
+	IMEI            string              `json:"imei,omitempty"`
+	ProjectID       *uuid.UUID          `json:"project_id,omitempty"`
+	PartitionPath   string              `json:"partition_path,omitempty"`
+	DeviceID        *uuid.UUID          `json:"device_id,omitempty"`
+	MQTTCredentials *DeviceCredentials  `json:"mqtt_credentials,omitempty"`
+	Errors          []DeviceImportError `json:"errors,omitempty"`
+}
+
+// DeviceImportResult is the outcome of ImportDevices. Nothing is written unless every row
+// is valid; Committed tells whether the devices were created.
+type DeviceImportResult struct {
+	DryRun    bool                    `json:"dry_run"`
+	Committed bool                    `json:"committed"`
+	Total     int                     `json:"total"`
+	Invalid   int                     `json:"invalid"`
+	Rows      []DeviceImportRowResult `json:"rows"`
+	// PartitionsCreated lists the partitions created from missing path segments, or that
+	// would be created on a dry run, as "<project ID>:<path>"
+	PartitionsCreated []string `json:"partitions_created"`
+}
+
+// DeviceImportOptions controls ImportDevices. CanWrite reports whether the caller may add
+// devices to a project; rows for other projects fail with ImportErrorForbidden.
+type DeviceImportOptions struct {
+	DryRun   bool
+	CanWrite func(projectID uuid.UUID) bool
+}
+
+// ParseDeviceImportCSV reads import rows from CSV with a header line naming the columns
+func ParseDeviceImportCSV(r io.Reader) ([]DeviceImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.NewBadRequestError("CSV is empty")
+	}
+	if err != nil {
+		return nil, errors.NewBadRequestError("Invalid CSV: " + err.Error())
+	}
+
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		known := false
+		for _, column := range deviceImportColumns {
+			known = known || column == name
+		}
+		if known {
+			index[name] = i
+			continue
+		}
+		for _, column := range deviceExportColumns {
+			known = known || column == name
+		}
+		if !known {
+			return nil, errors.NewBadRequestError(fmt.Sprintf("Unknown CSV column %q", name))
+		}
+	}
+	cell := func(record []string, column string) string {
+		if i, ok := index[column]; ok && i < len(record) {
+			// Undo the quoting csvSafe adds to exported values
+			value := record[i]
+			if rest, quoted := strings.CutPrefix(value, "'"); quoted && rest != "" && csvSafe(rest) != rest {
+				value = rest
+			}
+			return strings.TrimSpace(value)
+		}
+		return ""
+	}
+
+	rows := []DeviceImportRow{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.NewBadRequestError("Invalid CSV: " + err.Error())
+		}
+		if len(rows) == MaxDeviceImportRows {
+			return nil, errors.NewBadRequestError(fmt.Sprintf("At most %d rows can be imported at once", MaxDeviceImportRows))
+		}
+		row := DeviceImportRow{
+			MAC:           cell(record, "mac"),
+			IMEI:          cell(record, "imei"),
+			DeviceType:    cell(record, "device_type"),
+			Project:       cell(record, "project"),
+			PartitionPath: cell(record, "partition_path"),
+			DisplayName:   cell(record, "display_name"),
+			ClaimCode:     cell(record, "claim_code"),
+		}
+		if tags := cell(record, "tags"); tags != "" {
+			for _, tag := range strings.Split(tags, ";") {
+				row.Tags = append(row.Tags, strings.TrimSpace(tag))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ParseDeviceImportJSON reads import rows from a JSON array of objects
+func ParseDeviceImportJSON(r io.Reader) ([]DeviceImportRow, error) {
+	var rows []DeviceImportRow
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rows); err != nil {
+		return nil, errors.NewBadRequestError("Invalid JSON: " + err.Error())
+	}
+	if len(rows) > MaxDeviceImportRows {
+		return nil, errors.NewBadRequestError(fmt.Sprintf("At most %d rows can be imported at once", MaxDeviceImportRows))
+	}
+	return rows, nil
+}
+
+// importDevice is a validated row ready to be created
+type importDevice struct {
+	result    *DeviceImportRowResult
+	device    models.Device
+	projectID uuid.UUID
+	path      []string
+	claimCode string // normalized
+}
+
+// ImportDevices validates rows for the organization and, unless opts.DryRun is set and only
+// when every row is valid, creates all devices, their MQTT secrets and any missing
+// partitions in one transaction.
+// MACs and IMEIs are checked against every registered device, not only the organization's.
+func (s *DeviceService) ImportDevices(orgID uuid.UUID, rows []DeviceImportRow, opts DeviceImportOptions) (*DeviceImportResult, error) {
+	if len(rows) == 0 {
+		return nil, errors.NewBadRequestError("No rows to import")
+	}
+	if len(rows) > MaxDeviceImportRows {
+		return nil, errors.NewBadRequestError(fmt.Sprintf("At most %d rows can be imported at once", MaxDeviceImportRows))
+	}
+
+	projects, err := store.NewProjectRepository(s.db).ListByOrg(orgID)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to list projects")
+	}
+	projectsByID := make(map[uuid.UUID]*models.Project, len(projects))
+	projectsByName := make(map[string][]*models.Project, len(projects))
+	for i := range projects {
+		projectsByID[projects[i].ID] = &projects[i]
+		projectsByName[projects[i].Name] = append(projectsByName[projects[i].Name], &projects[i])
+	}
+
+	result := &DeviceImportResult{DryRun: opts.DryRun, Total: len(rows), Rows: make([]DeviceImportRowResult, len(rows)), PartitionsCreated: []string{}}
+	devices := make([]*importDevice, 0, len(rows))
+	macRows := make(map[string]int)
+	imeiRows := make(map[string]int)
+	for i, row := range rows {
+		res := &result.Rows[i]
+		res.Row = i + 1
+		fail := func(field, code, message string) {
+			res.Errors = append(res.Errors, DeviceImportError{Field: field, Code: code, Message: message})
+		}
+		item := &importDevice{result: res}
+
+		if row.MAC == "" {
+			fail("mac", ImportErrorInvalid, "MAC address is required")
+		} else if mac, err := NormalizeMAC(row.MAC); err != nil {
+			fail("mac", ImportErrorInvalid, err.Error())
+		} else if first, seen := macRows[mac]; seen {
+			res.MAC = mac
+			fail("mac", ImportErrorConflict, fmt.Sprintf("MAC repeats row %d", first))
+		} else {
+			res.MAC = mac
+			macRows[mac] = res.Row
+		}
+		if row.IMEI != "" {
+			if imei, err := NormalizeIMEI(strings.TrimSpace(row.IMEI)); err != nil {
+				fail("imei", ImportErrorInvalid, err.Error())
+			} else if first, seen := imeiRows[imei]; seen {
+				res.IMEI = imei
+				fail("imei", ImportErrorConflict, fmt.Sprintf("IMEI repeats row %d", first))
+			} else {
+				res.IMEI = imei
+				imeiRows[imei] = res.Row
+			}
+		}
+
+		deviceType := models.DeviceType(strings.TrimSpace(row.DeviceType))
+		switch deviceType {
+		case models.DeviceTypeLTE, models.DeviceTypeWiFi, models.DeviceTypeOther:
+		default:
+			fail("device_type", ImportErrorInvalid, fmt.Sprintf("device_type must be %s, %s or %s",
+				models.DeviceTypeLTE, models.DeviceTypeWiFi, models.DeviceTypeOther))
+		}
+
+		project := strings.TrimSpace(row.Project)
+		if project == "" {
+			fail("project", ImportErrorInvalid, "project is required")
+		} else if id, err := uuid.Parse(project); err == nil && projectsByID[id] != nil {
+			item.projectID = id
+		} else if matches := projectsByName[project]; len(matches) == 1 {
+			item.projectID = matches[0].ID
+		} else if len(matches) > 1 {
+			fail("project", ImportErrorInvalid, fmt.Sprintf("%d projects are named %q; use the project ID", len(matches), project))
+		} else {
+			fail("project", ImportErrorNotFound, fmt.Sprintf("project %q not found in the organization", project))
+		}
+		if item.projectID != uuid.Nil {
+			res.ProjectID = &item.projectID
+			if opts.CanWrite != nil && !opts.CanWrite(item.projectID) {
+				fail("project", ImportErrorForbidden, "access denied to project")
+			}
+		}
+
+		for _, name := range strings.Split(row.PartitionPath, "/") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if len(name) > 128 {
+				fail("partition_path", ImportErrorInvalid, "partition names must be at most 128 characters")
+				break
+			}
+			item.path = append(item.path, name)
+		}
+		res.PartitionPath = strings.Join(item.path, "/")
+
+		tags, err := NormalizeTags(row.Tags)
+		if err != nil {
+			fail("tags", ImportErrorInvalid, err.Error())
+		}
+
+		if code := strings.TrimSpace(row.ClaimCode); code != "" {
+			if item.claimCode, err = NormalizeClaimCode(code); err != nil {
+				fail("claim_code", ImportErrorInvalid, err.Error())
+			}
+		}
+
+		var imei *string
+		if res.IMEI != "" {
+			imei = &res.IMEI
+		}
+		item.device = models.Device{
+			BaseModel:   models.BaseModel{ID: uuid.New()},
+			MAC:         res.MAC,
+			IMEI:        imei,
+			DeviceType:  deviceType,
+			ProjectID:   item.projectID,
+			DisplayName: chooseDisplayName(strings.TrimSpace(row.DisplayName), res.MAC, imei),
+			Status:      models.DeviceStatusUnbound,
+			Tags:        tags,
+			Meta:        models.JSONMap{},
+		}
+		devices = append(devices, item)
+	}
+
+	// Registered devices are looked up across organizations: the identifiers are unique over
+	// every row, so a device of another tenant conflicts as well
+	registered, err := store.NewDeviceRepository(s.db.WithContext(tenant.Bypass(s.db.Statement.Context))).
+		ListByIdentifiers(mapKeys(macRows), mapKeys(imeiRows))
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to check existing devices")
+	}
+	for _, device := range registered {
+		if row, ok := macRows[device.MAC]; ok {
+			res := &result.Rows[row-1]
+			res.Errors = append(res.Errors, DeviceImportError{Field: "mac", Code: ImportErrorConflict, Message: "a device with this MAC is already registered"})
+		}
+		if device.IMEI != nil {
+			if row, ok := imeiRows[*device.IMEI]; ok {
+				res := &result.Rows[row-1]
+				res.Errors = append(res.Errors, DeviceImportError{Field: "imei", Code: ImportErrorConflict, Message: "a device with this IMEI is already registered"})
+			}
+		}
+	}
+	for i := range result.Rows {
+		if len(result.Rows[i].Errors) > 0 {
+			result.Invalid++
+		}
+	}
+
+	if result.Invalid > 0 {
+		return result, nil
+	}
+
+	commit := func(tx *gorm.DB) error {
+		partitions := newImportPartitions(store.NewPartitionRepository(tx), !opts.DryRun)
+		for _, item := range devices {
+			partitionID, err := partitions.resolve(item.projectID, item.path)
+			if err != nil {
+				return err
+			}
+			item.device.PartitionID = partitionID
+		}
+		result.PartitionsCreated = partitions.created
+		if opts.DryRun {
+			return nil
+		}
+
+		batch := make([]models.Device, len(devices))
+		for i, item := range devices {
+			batch[i] = item.device
+		}
+		if err := store.NewDeviceRepository(tx).CreateBatch(batch); err != nil {
+			return err
+		}
+		var codes []models.DeviceClaimCode
+		for _, item := range devices {
+			if item.claimCode != "" {
+				codes = append(codes, *newClaimCode(item.device.ID, item.claimCode, models.ClaimCodeSourceFactory, nil))
+			}
+		}
+		if err := store.NewDeviceClaimCodeRepository(tx).CreateBatch(codes); err != nil {
+			return err
+		}
+		creds := make([]models.DeviceCredential, len(devices))
+		issued := make([]*DeviceCredentials, len(devices))
+		for i, item := range devices {
+			cred, c, err := newDeviceCredential(&item.device)
+			if err != nil {
+				return err
+			}
+			creds[i], issued[i] = *cred, c
+		}
+		if err := store.NewDeviceCredentialRepository(tx).CreateBatch(creds); err != nil {
+			return err
+		}
+		for i, item := range devices {
+			id := item.device.ID
+			item.result.DeviceID, item.result.MQTTCredentials = &id, issued[i]
+		}
+		return nil
+	}
+
+	if opts.DryRun {
+		if err := commit(s.db); err != nil {
+			return nil, errors.NewInternalError("Failed to resolve partitions")
+		}
+		return result, nil
+	}
+	if err := s.db.Transaction(commit); err != nil {
+		if appErr, ok := err.(*errors.AppError); ok {
+			return nil, appErr
+		}
+		return nil, errors.NewInternalError("Failed to import devices")
+	}
+	result.Committed = true
+	return result, nil
+}
+
+// importPartitions resolves partition paths of an import, creating missing partitions when
+// create is set and only recording them otherwise
+type importPartitions struct {
+	repo     *store.PartitionRepository
+	create   bool
+	projects map[uuid.UUID]map[string]*models.Partition // project -> parent ID + "/" + name
+	created  []string
+}
+
+func newImportPartitions(repo *store.PartitionRepository, create bool) *importPartitions {
+	return &importPartitions{repo: repo, create: create, projects: make(map[uuid.UUID]map[string]*models.Partition), created: []string{}}
+}
+
+// resolve returns the partition at path in the project, nil for an empty path. Missing
+// partitions get an ID, and are created unless this is a dry run.
+func (p *importPartitions) resolve(projectID uuid.UUID, path []string) (*uuid.UUID, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	tree, err := p.load(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var parent *models.Partition
+	for i, name := range path {
+		parentKey := ""
+		if parent != nil {
+			parentKey = parent.ID.String()
+		}
+		key := parentKey + "/" + name
+		partition, ok := tree[key]
+		if !ok {
+			partition = &models.Partition{
+				BaseModel: models.BaseModel{ID: uuid.New()},
+				ProjectID: projectID,
+				Name:      name,
+				Depth:     1,
+			}
+			partition.Path = store.PartitionLabel(partition.ID)
+			if parent != nil {
+				partition.ParentID = &parent.ID
+				partition.Path = parent.Path + "." + partition.Path
+				partition.Depth = parent.Depth + 1
+			}
+			if p.create {
+				if err := p.repo.Create(partition); err != nil {
+					return nil, err
+				}
+			}
+			tree[key] = partition
+			p.created = append(p.created, projectID.String()+":"+strings.Join(path[:i+1], "/"))
+		}
+		parent = partition
+	}
+	return &parent.ID, nil
+}
+
+// load reads the project's partitions once. When creating, the project tree is locked first
+// so concurrent restructurings cannot interleave with the import.
+func (p *importPartitions) load(projectID uuid.UUID) (map[string]*models.Partition, error) {
+	if tree, ok := p.projects[projectID]; ok {
+		return tree, nil
+	}
+	if p.create {
+		if err := p.repo.LockProjectTree(projectID); err != nil {
+			return nil, err
+		}
+	}
+	partitions, err := p.repo.ListByProject(projectID)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]*models.Partition, len(partitions))
+	for i := range partitions {
+		parentKey := ""
+		if partitions[i].ParentID != nil {
+			parentKey = partitions[i].ParentID.String()
+		}
+		tree[parentKey+"/"+partitions[i].Name] = &partitions[i]
+	}
+	p.projects[projectID] = tree
+	return tree, nil
+}
+
+func mapKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
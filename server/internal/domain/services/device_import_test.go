@@ -0,0 +1,127 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeviceImportCSV(t *testing.T) {
+	rows, err := ParseDeviceImportCSV(strings.NewReader(
+		"MAC,imei,device_type,project,partition_path,tags\n" +
+			"a1:b2:c3:d4:e5:f6,,wifi_eth,Plant,Hall A/Line 1,roof; east\n"))
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, DeviceImportRow{
+		MAC:           "a1:b2:c3:d4:e5:f6",
+		DeviceType:    "wifi_eth",
+		Project:       "Plant",
+		PartitionPath: "Hall A/Line 1",
+		Tags:          []string{"roof", "east"},
+	}, rows[0])
+
+	_, err = ParseDeviceImportCSV(strings.NewReader("mac,serial\nA1B2C3D4E5F6,1\n"))
+	assert.Error(t, err)
+}
+
+func TestDeviceService_ImportDevices(t *testing.T) {
+	db := setupTestDB(t)
+	org, err := NewOrganizationService(db, setupTestEnforcer(t, db)).CreateOrganization("test-org", "Test Organization")
+	require.NoError(t, err)
+	project := &models.Project{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: org.ID, Name: "Plant", CreatedBy: uuid.New()}
+	require.NoError(t, db.Create(project).Error)
+	locked := &models.Project{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: org.ID, Name: "Locked", CreatedBy: uuid.New()}
+	require.NoError(t, db.Create(locked).Error)
+
+	service := NewDeviceService(db)
+	_, err = service.CreateDevice("AABBCCDDEEFF", nil, models.DeviceTypeWiFi, project.ID, nil, "Existing")
+	require.NoError(t, err)
+
+	opts := DeviceImportOptions{CanWrite: func(id uuid.UUID) bool { return id != locked.ID }}
+	rows := []DeviceImportRow{
+		{MAC: "a1-b2-c3-d4-e5-f6", IMEI: "123456789012345", DeviceType: "lte_nr", Project: "Plant", PartitionPath: "Hall A/Line 1", Tags: []string{"roof"}},
+		{MAC: "A1B2C3D4E5F7", DeviceType: "wifi_eth", Project: project.ID.String(), PartitionPath: "Hall A", DisplayName: "Gate", ClaimCode: "gate-2024-0001"},
+	}
+
+	t.Run("row errors", func(t *testing.T) {
+		bad := append(rows[:2:2],
+			DeviceImportRow{MAC: "aa:bb:cc:dd:ee:ff", DeviceType: "wifi_eth", Project: "Plant"},
+			DeviceImportRow{MAC: "A1B2C3D4E5F6", DeviceType: "toaster", Project: "Nowhere", ClaimCode: "x"},
+			DeviceImportRow{MAC: "A1B2C3D4E5F8", DeviceType: "other", Project: "Locked"},
+		)
+		result, err := service.ImportDevices(org.ID, bad, opts)
+		require.NoError(t, err)
+		assert.False(t, result.Committed)
+		assert.Equal(t, 3, result.Invalid)
+		assert.Empty(t, result.Rows[0].Errors)
+		assert.Equal(t, []DeviceImportError{{Field: "mac", Code: ImportErrorConflict, Message: "a device with this MAC is already registered"}}, result.Rows[2].Errors)
+		codes := map[string]string{}
+		for _, e := range result.Rows[3].Errors {
+			codes[e.Field] = e.Code
+		}
+		assert.Equal(t, map[string]string{"mac": ImportErrorConflict, "device_type": ImportErrorInvalid, "project": ImportErrorNotFound, "claim_code": ImportErrorInvalid}, codes)
+		assert.Equal(t, ImportErrorForbidden, result.Rows[4].Errors[0].Code)
+
+		var count int64
+		require.NoError(t, db.Model(&models.Device{}).Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		result, err := service.ImportDevices(org.ID, rows, DeviceImportOptions{DryRun: true, CanWrite: opts.CanWrite})
+		require.NoError(t, err)
+		assert.False(t, result.Committed)
+		assert.Zero(t, result.Invalid)
+		assert.Equal(t, []string{project.ID.String() + ":Hall A", project.ID.String() + ":Hall A/Line 1"}, result.PartitionsCreated)
+
+		var count int64
+		require.NoError(t, db.Model(&models.Partition{}).Count(&count).Error)
+		assert.Zero(t, count)
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		result, err := service.ImportDevices(org.ID, rows, opts)
+		require.NoError(t, err)
+		assert.True(t, result.Committed)
+		require.NotNil(t, result.Rows[0].DeviceID)
+		assert.Len(t, result.PartitionsCreated, 2)
+
+		device, err := service.GetDevice(*result.Rows[0].DeviceID)
+		require.NoError(t, err)
+		assert.Equal(t, "A1B2C3D4E5F6", device.MAC)
+		assert.Equal(t, "A1B2C3D4E5F6", device.DisplayName)
+		assert.Equal(t, models.StringList{"roof"}, device.Tags)
+		// Imported devices get their MQTT secret, so they keep working without legacy passwords
+		creds := result.Rows[0].MQTTCredentials
+		require.NotNil(t, creds)
+		authenticated, err := service.AuthenticateDevice("mac", creds.Username, creds.Password)
+		require.NoError(t, err)
+		assert.Equal(t, device.ID, authenticated.ID)
+		require.NotNil(t, device.PartitionID)
+		var line models.Partition
+		require.NoError(t, db.First(&line, "id = ?", *device.PartitionID).Error)
+		assert.Equal(t, "Line 1", line.Name)
+		assert.Equal(t, 2, line.Depth)
+
+		gate, err := service.GetDevice(*result.Rows[1].DeviceID)
+		require.NoError(t, err)
+		assert.Equal(t, "Gate", gate.DisplayName)
+		assert.Equal(t, line.ParentID, gate.PartitionID)
+		var code models.DeviceClaimCode
+		require.NoError(t, db.First(&code, "device_id = ?", gate.ID).Error)
+		assert.Equal(t, models.ClaimCodeSourceFactory, code.Source)
+		assert.Equal(t, hashClaimCode(gate.ID, "GATE20240001"), code.CodeHash)
+		require.Error(t, db.First(&code, "device_id = ?", device.ID).Error)
+
+		// The same file again conflicts on every row and changes nothing
+		again, err := service.ImportDevices(org.ID, rows, opts)
+		require.NoError(t, err)
+		assert.False(t, again.Committed)
+		assert.Equal(t, 2, again.Invalid)
+	})
+}
@@ -0,0 +1,216 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/pkg/errors"
+)
+
+// Limits on the register payload of a device
+const (
+	MaxRegistrationPayload   = 16 << 10
+	MaxRegistrationName      = 128
+	MaxFirmwareVersionLength = 64
+)
+
+// RegistrationCapabilitiesKey is the metadata key holding the capabilities a device reported
+// at registration
+const RegistrationCapabilitiesKey = "cap"
+
+// registrationAttempts bounds how often a registration is retried against concurrent edits
+const registrationAttempts = 3
+
+// DeviceRegistration is the JSON payload a device publishes on devices/<id>/register.
+// Every field is optional.
+type DeviceRegistration struct {
+	IMEI         string                 `json:"imei"`
+	MAC          string                 `json:"mac"`
+	DeviceType   models.DeviceType      `json:"device_type"`
+	Name         string                 `json:"name"`
+	Firmware     string                 `json:"firmware"`
+	Capabilities map[string]interface{} `json:"cap"`
+}
+
+// ParseDeviceRegistration parses and validates a register payload and normalizes its
+// identifiers. An empty payload, from devices that report nothing about themselves, is an
+// empty registration.
+func ParseDeviceRegistration(payload []byte) (*DeviceRegistration, error) {
+	reg := &DeviceRegistration{}
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return reg, nil
+	}
+	if len(payload) > MaxRegistrationPayload {
+		return nil, errors.NewValidationError("Invalid registration", map[string]interface{}{
+			"payload": fmt.Sprintf("payload must be at most %d bytes", MaxRegistrationPayload),
+		})
+	}
+	if err := json.Unmarshal(payload, reg); err != nil {
+		return nil, errors.NewValidationError("Invalid registration", map[string]interface{}{
+			"payload": "payload must be a JSON object: " + err.Error(),
+		})
+	}
+
+	details := map[string]interface{}{}
+	if reg.IMEI = strings.TrimSpace(reg.IMEI); reg.IMEI != "" {
+		imei, err := NormalizeIMEI(reg.IMEI)
+		if err != nil {
+			details["imei"] = err.Error()
+		}
+		reg.IMEI = imei
+	}
+	if reg.MAC = strings.TrimSpace(reg.MAC); reg.MAC != "" {
+		mac, err := NormalizeMAC(reg.MAC)
+		if err != nil {
+			details["mac"] = err.Error()
+		}
+		reg.MAC = mac
+	}
+	switch reg.DeviceType {
+	case "", models.DeviceTypeLTE, models.DeviceTypeWiFi, models.DeviceTypeOther:
+	default:
+		details["device_type"] = fmt.Sprintf("device_type must be %s, %s or %s",
+			models.DeviceTypeLTE, models.DeviceTypeWiFi, models.DeviceTypeOther)
+	}
+	if reg.Name = strings.TrimSpace(reg.Name); len(reg.Name) > MaxRegistrationName {
+		details["name"] = fmt.Sprintf("name must be at most %d characters", MaxRegistrationName)
+	}
+	if reg.Firmware = strings.TrimSpace(reg.Firmware); len(reg.Firmware) > MaxFirmwareVersionLength {
+		details["firmware"] = fmt.Sprintf("firmware must be at most %d characters", MaxFirmwareVersionLength)
+	}
+	if len(details) > 0 {
+		return nil, errors.NewValidationError("Invalid registration", details)
+	}
+	return reg, nil
+}
+
+// RegisterDevice handles the registration of a device that authenticated over MQTT with
+// identifier, a MAC or IMEI as by says, and, when secret, the device's secret. The
+// registration may not name another identifier of that kind, nor join the MAC of one device
+// to the IMEI of another, and only a client with the secret may add the other identifier to
+// an existing device. The device is found
+// by its MAC or IMEI, or created in defaultProjectID when allowCreate, and what it reports
+// is recorded: a missing MAC or IMEI, a device type still "other", a display name still
+// empty or defaulting to an identifier, its firmware version and, under
+// RegistrationCapabilitiesKey in Meta, its capabilities. Returns whether it was created.
+func (s *DeviceService) RegisterDevice(by, identifier string, secret bool, reg *DeviceRegistration, defaultProjectID string, allowCreate bool) (*models.Device, bool, error) {
+	var own *string
+	switch by {
+	case "mac":
+		own = &reg.MAC
+	case "imei":
+		own = &reg.IMEI
+	default:
+		return nil, false, errors.NewBadRequestError("Invalid identifier type. Must be 'mac' or 'imei'")
+	}
+	if *own == "" {
+		*own = identifier
+	} else if *own != identifier {
+		return nil, false, errors.NewValidationError("Invalid registration", map[string]interface{}{
+			by: fmt.Sprintf("%s does not match the one the device authenticated with", by),
+		})
+	}
+	if err := s.checkRegistrationIdentifiers(by, secret, reg); err != nil {
+		return nil, false, err
+	}
+
+	// Devices with an IMEI are cellular unless they say otherwise
+	deviceType := reg.DeviceType
+	if deviceType == "" && reg.IMEI != "" {
+		deviceType = models.DeviceTypeLTE
+	}
+	createType := deviceType
+	if createType == "" {
+		createType = models.DeviceTypeOther
+	}
+	var imei *string
+	if reg.IMEI != "" {
+		imei = &reg.IMEI
+	}
+	device, created, err := s.FindOrCreateForRegistration(reg.MAC, imei, reg.Name, createType, defaultProjectID, allowCreate)
+	if err != nil {
+		return nil, false, err
+	}
+	if device, err = s.applyRegistration(device, reg, deviceType); err != nil {
+		return nil, false, err
+	}
+	return device, created, nil
+}
+
+// checkRegistrationIdentifiers rejects a registration whose MAC and IMEI are already
+// recorded for different devices, or that would record one of them on an existing device
+// the client did not prove to be with its secret: anyone may use a legacy password, and a
+// device known only by the identifier it did not authenticate with is not the client's
+func (s *DeviceService) checkRegistrationIdentifiers(by string, secret bool, reg *DeviceRegistration) error {
+	if reg.MAC == "" || reg.IMEI == "" {
+		return nil
+	}
+	byMAC, macErr := s.deviceRepo.GetByMAC(reg.MAC)
+	byIMEI, imeiErr := s.deviceRepo.GetByIMEI(reg.IMEI)
+	switch {
+	case macErr == nil && imeiErr == nil && byMAC.ID != byIMEI.ID:
+		return errors.NewConflictError("MAC and IMEI belong to different devices")
+	case macErr == nil && byMAC.IMEI != nil && *byMAC.IMEI != reg.IMEI:
+		return errors.NewConflictError("Device with this MAC has another IMEI")
+	case imeiErr == nil && byIMEI.MAC != "" && byIMEI.MAC != reg.MAC:
+		return errors.NewConflictError("Device with this IMEI has another MAC")
+	case macErr == nil && imeiErr != nil && (by != "mac" || !secret):
+		return errors.NewConflictError("Only the device can add an IMEI to its MAC, with its secret")
+	case imeiErr == nil && macErr != nil && (by != "imei" || !secret):
+		return errors.NewConflictError("Only the device can add a MAC to its IMEI, with its secret")
+	}
+	return nil
+}
+
+// applyRegistration records the details of a registration on device and returns the device
+// as stored. A concurrent edit makes it start over from the stored device, so the edit is
+// kept.
+func (s *DeviceService) applyRegistration(device *models.Device, reg *DeviceRegistration, deviceType models.DeviceType) (*models.Device, error) {
+	for attempt := 1; ; attempt++ {
+		if !registrationChanges(device, reg, deviceType) {
+			return device, nil
+		}
+		err := s.deviceRepo.Update(device)
+		if err == nil {
+			return device, nil
+		}
+		if err != store.ErrVersionConflict || attempt == registrationAttempts {
+			return nil, errors.NewInternalError("Failed to update device")
+		}
+		if device, err = s.deviceRepo.GetByID(device.ID); err != nil {
+			return nil, errors.NewInternalError("Failed to get device")
+		}
+	}
+}
+
+// registrationChanges applies the details of a registration to device and reports whether
+// that changed it
+func registrationChanges(device *models.Device, reg *DeviceRegistration, deviceType models.DeviceType) bool {
+	changed := false
+	if deviceType != "" && deviceType != models.DeviceTypeOther && device.DeviceType == models.DeviceTypeOther {
+		device.DeviceType, changed = deviceType, true
+	}
+	defaultName := device.DisplayName == "" || device.DisplayName == device.MAC ||
+		(device.IMEI != nil && device.DisplayName == *device.IMEI)
+	if reg.Name != "" && defaultName && device.DisplayName != reg.Name {
+		device.DisplayName, changed = reg.Name, true
+	}
+	if reg.Firmware != "" && device.FirmwareVersion != reg.Firmware {
+		device.FirmwareVersion, changed = reg.Firmware, true
+	}
+	current, _ := device.Meta[RegistrationCapabilitiesKey].(map[string]interface{})
+	if reg.Capabilities != nil && (current == nil || !reflect.DeepEqual(current, reg.Capabilities)) {
+		meta := make(models.JSONMap, len(device.Meta)+1)
+		for key, value := range device.Meta {
+			meta[key] = value
+		}
+		meta[RegistrationCapabilitiesKey] = reg.Capabilities
+		device.Meta, changed = meta, true
+	}
+	return changed
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"server/internal/domain/models"
+	"server/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeviceRegistration(t *testing.T) {
+	reg, err := ParseDeviceRegistration([]byte(" \n"))
+	require.NoError(t, err)
+	assert.Equal(t, &DeviceRegistration{}, reg)
+
+	reg, err = ParseDeviceRegistration([]byte(`{"imei":"861234567890123","mac":"a1:b2:c3:d4:e5:f6","device_type":"lte_nr",
+		"name":" Gateway 7 ","firmware":"2.1.0","cap":{"rs485":2,"dali":true},"extra":"ignored"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "861234567890123", reg.IMEI)
+	assert.Equal(t, "A1B2C3D4E5F6", reg.MAC)
+	assert.Equal(t, models.DeviceTypeLTE, reg.DeviceType)
+	assert.Equal(t, "Gateway 7", reg.Name)
+	assert.Equal(t, "2.1.0", reg.Firmware)
+	assert.Equal(t, map[string]interface{}{"rs485": float64(2), "dali": true}, reg.Capabilities)
+
+	for payload, field := range map[string]string{
+		`not json`:                 "payload",
+		`["a"]`:                    "payload",
+		`{"cap":"all"}`:            "payload",
+		`{"imei":"86123"}`:         "imei",
+		`{"mac":"zz"}`:             "mac",
+		`{"device_type":"zigbee"}`: "device_type",
+		`{"firmware":"` + strings.Repeat("1", MaxFirmwareVersionLength+1) + `"}`: "firmware",
+		`{"name":"` + strings.Repeat("n", MaxRegistrationName+1) + `"}`:          "name",
+	} {
+		_, err := ParseDeviceRegistration([]byte(payload))
+		appErr, ok := err.(*errors.AppError)
+		require.True(t, ok, payload)
+		assert.Equal(t, errors.ErrCodeValidation, appErr.Code, payload)
+		assert.Contains(t, appErr.Details, field, payload)
+	}
+}
+
+func TestDeviceService_RegisterDevice(t *testing.T) {
+	db := setupTestDB(t)
+	service := NewDeviceService(db)
+	factory := setupTestProject(t, db)
+	projectID := factory.ID.String()
+	status := func(err error) int {
+		appErr, ok := err.(*errors.AppError)
+		require.True(t, ok, "expected an AppError, got %v", err)
+		return appErr.HTTPStatus
+	}
+	parse := func(payload string) *DeviceRegistration {
+		reg, err := ParseDeviceRegistration([]byte(payload))
+		require.NoError(t, err)
+		return reg
+	}
+
+	t.Run("creates a device from its payload", func(t *testing.T) {
+		device, created, err := service.RegisterDevice("imei", "861234567890120", false, parse(`{"mac":"AA:BB:CC:DD:EE:50","name":"Pump house",
+			"firmware":"1.0.0","cap":{"channels":4}}`), projectID, true)
+		require.NoError(t, err)
+		assert.True(t, created)
+		assert.Equal(t, "AABBCCDDEE50", device.MAC)
+		require.NotNil(t, device.IMEI)
+		assert.Equal(t, "861234567890120", *device.IMEI)
+		assert.Equal(t, models.DeviceTypeLTE, device.DeviceType)
+		assert.Equal(t, "Pump house", device.DisplayName)
+		assert.Equal(t, "1.0.0", device.FirmwareVersion)
+		assert.Equal(t, map[string]interface{}{"channels": float64(4)}, device.Meta[RegistrationCapabilitiesKey])
+
+		stored, err := service.GetDevice(device.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "1.0.0", stored.FirmwareVersion)
+		assert.Equal(t, map[string]interface{}{"channels": float64(4)}, stored.Meta[RegistrationCapabilitiesKey])
+	})
+
+	t.Run("back-fills an existing device", func(t *testing.T) {
+		existing, created, err := service.FindOrCreateForRegistration("AA:BB:CC:DD:EE:51", nil, "", models.DeviceTypeOther, projectID, true)
+		require.NoError(t, err)
+		require.True(t, created)
+		require.Equal(t, "AABBCCDDEE51", existing.DisplayName)
+		existing.Meta = models.JSONMap{"site": "north"}
+		require.NoError(t, service.UpdateDevice(existing))
+
+		// Adding the IMEI takes the device's secret
+		payload := `{"imei":"861234567890121","device_type":"lte_nr","name":"Boiler","firmware":"3.2","cap":{"relays":2}}`
+		_, _, err = service.RegisterDevice("mac", "AABBCCDDEE51", false, parse(payload), projectID, false)
+		assert.Equal(t, http.StatusConflict, status(err))
+
+		device, created, err := service.RegisterDevice("mac", "AABBCCDDEE51", true, parse(payload), projectID, false)
+		require.NoError(t, err)
+		assert.False(t, created)
+		assert.Equal(t, existing.ID, device.ID)
+		require.NotNil(t, device.IMEI)
+		assert.Equal(t, "861234567890121", *device.IMEI)
+		assert.Equal(t, models.DeviceTypeLTE, device.DeviceType)
+		assert.Equal(t, "Boiler", device.DisplayName)
+		assert.Equal(t, "3.2", device.FirmwareVersion)
+		assert.Equal(t, "north", device.Meta["site"])
+		assert.Greater(t, device.Version, existing.Version)
+
+		// Names given by people are kept, firmware follows the device
+		device.DisplayName = "Boiler room"
+		require.NoError(t, service.UpdateDevice(device))
+		device, _, err = service.RegisterDevice("mac", "AABBCCDDEE51", false, parse(`{"name":"Boiler","firmware":"3.3"}`), projectID, false)
+		require.NoError(t, err)
+		assert.Equal(t, "Boiler room", device.DisplayName)
+		assert.Equal(t, "3.3", device.FirmwareVersion)
+		assert.Equal(t, map[string]interface{}{"relays": float64(2)}, device.Meta[RegistrationCapabilitiesKey])
+	})
+
+	t.Run("rejects foreign identifiers", func(t *testing.T) {
+		_, _, err := service.RegisterDevice("mac", "AABBCCDDEE52", false, parse(`{"mac":"AABBCCDDEE53"}`), projectID, true)
+		assert.Equal(t, http.StatusBadRequest, status(err))
+
+		// The IMEI of the first device cannot be joined to another MAC
+		_, _, err = service.RegisterDevice("mac", "AABBCCDDEE51", true, parse(`{"imei":"861234567890120"}`), projectID, true)
+		assert.Equal(t, http.StatusConflict, status(err))
+		_, _, err = service.RegisterDevice("imei", "861234567890120", true, parse(`{"mac":"AABBCCDDEE54"}`), projectID, true)
+		assert.Equal(t, http.StatusConflict, status(err))
+
+		// An unknown IMEI cannot attach itself to the MAC of an existing device
+		victim, err := service.CreateDevice("AABBCCDDEE56", nil, models.DeviceTypeWiFi, factory.ID, nil, "Victim")
+		require.NoError(t, err)
+		_, _, err = service.RegisterDevice("imei", "861234567890122", false, parse(`{"mac":"AABBCCDDEE56"}`), projectID, true)
+		assert.Equal(t, http.StatusConflict, status(err))
+		victim, err = service.GetDevice(victim.ID)
+		require.NoError(t, err)
+		assert.Nil(t, victim.IMEI)
+
+		_, _, err = service.RegisterDevice("mac", "AABBCCDDEE55", false, parse(``), projectID, false)
+		assert.Equal(t, ErrDeviceNotFound, err)
+	})
+}
@@ -0,0 +1,316 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"server/internal/casdoor"
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Directory sync triggers recorded on DirectorySyncRun
+const (
+	SyncTriggerScheduled = "scheduled"
+	SyncTriggerManual    = "manual"
+)
+
+// Directory is the identity provider users and groups are synced from; *casdoor.Client
+// implements it
+type Directory interface {
+	GetUsers(ctx context.Context, orgName string) ([]casdoor.UserInfo, error)
+	GetGroups(ctx context.Context, orgName string) ([]casdoor.GroupInfo, error)
+}
+
+// DirectoryService mirrors Casdoor users, groups and memberships into the local tables and
+// serves the user and group listings
+type DirectoryService struct {
+	db        *gorm.DB
+	directory Directory
+	orgRepo   *store.OrganizationRepository
+	userRepo  *store.UserRepository
+	groupRepo *store.GroupRepository
+	runRepo   *store.DirectorySyncRunRepository
+	running   *sync.Mutex // shared by the copies WithContext makes
+}
+
+// NewDirectoryService creates a new directory service
+func NewDirectoryService(db *gorm.DB, directory Directory) *DirectoryService {
+	return &DirectoryService{
+		db:        db,
+		directory: directory,
+		orgRepo:   store.NewOrganizationRepository(db),
+		userRepo:  store.NewUserRepository(db),
+		groupRepo: store.NewGroupRepository(db),
+		runRepo:   store.NewDirectorySyncRunRepository(db),
+		running:   &sync.Mutex{},
+	}
+}
+
+// WithContext returns the service bound to ctx, so its queries run in the tenant scope of ctx
+func (s *DirectoryService) WithContext(ctx context.Context) *DirectoryService {
+	scoped := NewDirectoryService(s.db.WithContext(ctx), s.directory)
+	scoped.running = s.running
+	return scoped
+}
+
+// SyncAll syncs every organization. A failing organization is recorded on its run and does
+// not stop the others; the first failure is returned alongside all runs.
+func (s *DirectoryService) SyncAll(ctx context.Context, trigger string) ([]models.DirectorySyncRun, error) {
+	if !s.running.TryLock() {
+		return nil, errors.NewConflictError("Directory sync already running")
+	}
+	defer s.running.Unlock()
+
+	orgs, err := s.orgRepo.List()
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to list organizations")
+	}
+	runs := make([]models.DirectorySyncRun, 0, len(orgs))
+	var firstErr error
+	for i := range orgs {
+		if ctx.Err() != nil {
+			return runs, ctx.Err()
+		}
+		run, err := s.syncOrganization(ctx, &orgs[i], trigger)
+		if run != nil {
+			runs = append(runs, *run)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return runs, firstErr
+}
+
+// SyncOrganization syncs one organization
+func (s *DirectoryService) SyncOrganization(ctx context.Context, orgID uuid.UUID, trigger string) (*models.DirectorySyncRun, error) {
+	org, err := s.orgRepo.GetByID(orgID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.NewNotFoundError("Organization not found")
+		}
+		return nil, errors.NewInternalError("Failed to get organization")
+	}
+	if !s.running.TryLock() {
+		return nil, errors.NewConflictError("Directory sync already running")
+	}
+	defer s.running.Unlock()
+	return s.syncOrganization(ctx, org, trigger)
+}
+
+// ListSyncRuns lists recent sync runs, optionally for one organization
+func (s *DirectoryService) ListSyncRuns(orgID *uuid.UUID, limit int) ([]models.DirectorySyncRun, error) {
+	runs, err := s.runRepo.ListRecent(orgID, limit)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to list sync runs")
+	}
+	return runs, nil
+}
+
+// ListUsers pages through an organization's users matching q
+func (s *DirectoryService) ListUsers(orgID uuid.UUID, q string, page, pageSize int) ([]models.User, int64, error) {
+	users, total, err := s.userRepo.Search(orgID, strings.TrimSpace(q), (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, 0, errors.NewInternalError("Failed to list users")
+	}
+	return users, total, nil
+}
+
+// ListGroups pages through an organization's groups matching q
+func (s *DirectoryService) ListGroups(orgID uuid.UUID, q string, page, pageSize int) ([]models.Group, int64, error) {
+	groups, total, err := s.groupRepo.Search(orgID, strings.TrimSpace(q), (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, 0, errors.NewInternalError("Failed to list groups")
+	}
+	return groups, total, nil
+}
+
+// syncOrganization fetches the organization's directory and applies it in one transaction.
+// The run is saved when it starts and again with its statistics or error when it ends.
+func (s *DirectoryService) syncOrganization(ctx context.Context, org *models.Organization, trigger string) (*models.DirectorySyncRun, error) {
+	run := &models.DirectorySyncRun{
+		BaseModel: models.BaseModel{ID: uuid.New()},
+		OrgID:     org.ID,
+		Trigger:   trigger,
+		StartedAt: time.Now(),
+	}
+	if err := s.runRepo.Save(run); err != nil {
+		return nil, errors.NewInternalError("Failed to record sync run")
+	}
+
+	err := s.fetchAndApply(ctx, org, run)
+	finished := time.Now()
+	run.FinishedAt = &finished
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if saveErr := s.runRepo.Save(run); saveErr != nil && err == nil {
+		err = errors.NewInternalError("Failed to record sync run")
+	}
+	return run, err
+}
+
+func (s *DirectoryService) fetchAndApply(ctx context.Context, org *models.Organization, run *models.DirectorySyncRun) error {
+	groups, err := s.directory.GetGroups(ctx, org.CasdoorOrg)
+	if err != nil {
+		return err
+	}
+	users, err := s.directory.GetUsers(ctx, org.CasdoorOrg)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		groupIDs, err := applyGroups(store.NewGroupRepository(tx), org, groups, run)
+		if err != nil {
+			return errors.NewInternalError("Failed to sync groups")
+		}
+		if err := applyUsers(store.NewUserRepository(tx), org, users, groupIDs, run); err != nil {
+			return errors.NewInternalError("Failed to sync users")
+		}
+		return nil
+	})
+}
+
+// applyGroups upserts the upstream groups, restoring soft-deleted ones, and soft-deletes
+// groups missing upstream. It returns the local ID of every upstream group by Casdoor ID.
+func applyGroups(repo *store.GroupRepository, org *models.Organization, upstream []casdoor.GroupInfo, run *models.DirectorySyncRun) (map[string]uuid.UUID, error) {
+	existing, err := repo.ListByOrg(org.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	byCasdoorID := make(map[string]*models.Group, len(existing))
+	for i := range existing {
+		byCasdoorID[existing[i].CasdoorGroupID] = &existing[i]
+	}
+
+	ids := make(map[string]uuid.UUID, len(upstream))
+	for _, info := range upstream {
+		group, ok := byCasdoorID[info.ID]
+		if !ok {
+			group = &models.Group{
+				BaseModel:      models.BaseModel{ID: uuid.New()},
+				CasdoorGroupID: info.ID,
+				Name:           info.Name,
+				DisplayName:    info.DisplayName,
+				OrgID:          org.ID,
+			}
+			if err := repo.Create(group); err != nil {
+				return nil, err
+			}
+			run.GroupsCreated++
+		} else if group.DeletedAt.Valid || group.Name != info.Name || group.DisplayName != info.DisplayName {
+			group.Name = info.Name
+			group.DisplayName = info.DisplayName
+			group.DeletedAt = gorm.DeletedAt{}
+			if err := repo.Save(group); err != nil {
+				return nil, err
+			}
+			run.GroupsUpdated++
+		}
+		ids[info.ID] = group.ID
+	}
+
+	for _, group := range existing {
+		if _, ok := ids[group.CasdoorGroupID]; ok || group.DeletedAt.Valid {
+			continue
+		}
+		if err := repo.Delete(group.ID); err != nil {
+			return nil, err
+		}
+		run.GroupsDeleted++
+	}
+	return ids, nil
+}
+
+// applyUsers upserts the upstream users, restoring soft-deleted ones and adopting users that
+// moved from another organization, soft-deletes users missing upstream and replaces the
+// organization's memberships
+func applyUsers(repo *store.UserRepository, org *models.Organization, upstream []casdoor.UserInfo, groupIDs map[string]uuid.UUID, run *models.DirectorySyncRun) error {
+	existing, err := repo.ListByOrg(org.ID, true)
+	if err != nil {
+		return err
+	}
+	byCasdoorID := make(map[string]*models.User, len(existing))
+	for i := range existing {
+		byCasdoorID[existing[i].CasdoorUserID] = &existing[i]
+	}
+
+	seen := make(map[string]bool, len(upstream))
+	var memberships []models.UserGroup
+	for _, info := range upstream {
+		if info.ID == "" || seen[info.ID] {
+			continue
+		}
+		seen[info.ID] = true
+
+		user, ok := byCasdoorID[info.ID]
+		if !ok {
+			moved, err := repo.GetByCasdoorUserID(info.ID)
+			if err != nil && err != gorm.ErrRecordNotFound {
+				return err
+			}
+			user = moved
+		}
+		if user == nil {
+			user = &models.User{
+				BaseModel:     models.BaseModel{ID: LocalUserID(info.ID)},
+				CasdoorUserID: info.ID,
+				Username:      info.Username,
+				Email:         info.Email,
+				DisplayName:   info.Name,
+				OrgID:         org.ID,
+			}
+			if err := repo.Create(user); err != nil {
+				return err
+			}
+			run.UsersCreated++
+		} else if user.DeletedAt.Valid || user.OrgID != org.ID || user.Username != info.Username ||
+			user.Email != info.Email || user.DisplayName != info.Name {
+			user.Username = info.Username
+			user.Email = info.Email
+			user.DisplayName = info.Name
+			user.OrgID = org.ID
+			user.DeletedAt = gorm.DeletedAt{}
+			if err := repo.Save(user); err != nil {
+				return err
+			}
+			run.UsersUpdated++
+		}
+
+		joined := make(map[uuid.UUID]bool)
+		for _, name := range info.Groups {
+			// Casdoor lists groups as owner/name; accept bare names from the same organization
+			if !strings.Contains(name, "/") {
+				name = casdoor.GroupID(org.CasdoorOrg, name)
+			}
+			if groupID, ok := groupIDs[name]; ok && !joined[groupID] {
+				joined[groupID] = true
+				memberships = append(memberships, models.UserGroup{UserID: user.ID, GroupID: groupID})
+			}
+		}
+	}
+
+	for _, user := range existing {
+		if seen[user.CasdoorUserID] || user.DeletedAt.Valid {
+			continue
+		}
+		if err := repo.Delete(user.ID); err != nil {
+			return err
+		}
+		run.UsersDeleted++
+	}
+
+	if err := repo.ReplaceOrgMemberships(org.ID, memberships); err != nil {
+		return err
+	}
+	run.Memberships = len(memberships)
+	return nil
+}
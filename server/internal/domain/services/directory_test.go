@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"server/internal/casdoor"
+	"server/internal/config"
+	"server/internal/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCasdoor serves get-users and get-groups for one organization the way Casdoor does
+type fakeCasdoor struct {
+	mu     sync.Mutex
+	users  []map[string]interface{}
+	groups []map[string]interface{}
+	fail   bool
+}
+
+func (f *fakeCasdoor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var data interface{}
+	switch r.URL.Path {
+	case "/api/get-users":
+		data = f.users
+	case "/api/get-groups":
+		data = f.groups
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "msg": "", "data": data})
+}
+
+func (f *fakeCasdoor) set(users, groups []map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users, f.groups = users, groups
+}
+
+func casdoorUser(id, name, displayName string, groups ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"owner": "acme", "name": name, "id": id, "displayName": displayName,
+		"email": name + "@acme.test", "groups": groups,
+	}
+}
+
+func casdoorGroup(name, displayName string) map[string]interface{} {
+	return map[string]interface{}{"owner": "acme", "name": name, "displayName": displayName, "isEnabled": true}
+}
+
+func TestDirectoryService_Sync(t *testing.T) {
+	db := setupTestDB(t)
+	fake := &fakeCasdoor{}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := casdoor.New(&config.Config{CasdoorServerURL: server.URL, CasdoorOrg: "acme"})
+	require.NoError(t, err)
+	service := NewDirectoryService(db, client)
+
+	org, err := NewOrganizationService(db, setupTestEnforcer(t, db)).CreateOrganization("acme", "Acme")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	fake.set([]map[string]interface{}{
+		casdoorUser("u-alice", "alice", "Alice", "acme/ops", "acme/eng"),
+		casdoorUser("u-bob", "bob", "Bob", "ops"),
+	}, []map[string]interface{}{
+		casdoorGroup("ops", "Operations"),
+		casdoorGroup("eng", "Engineering"),
+	})
+	run, err := service.SyncOrganization(ctx, org.ID, SyncTriggerManual)
+	require.NoError(t, err)
+	assert.Equal(t, 2, run.UsersCreated)
+	assert.Equal(t, 2, run.GroupsCreated)
+	assert.Equal(t, 3, run.Memberships)
+	assert.NotNil(t, run.FinishedAt)
+	assert.Empty(t, run.Error)
+
+	userRepo := store.NewUserRepository(db)
+	bob, err := userRepo.GetByCasdoorUserID("u-bob")
+	require.NoError(t, err)
+	assert.Equal(t, org.ID, bob.OrgID)
+	assert.Equal(t, "Bob", bob.DisplayName)
+	groupIDs, err := userRepo.ListGroupIDs(bob.ID)
+	require.NoError(t, err)
+	assert.Len(t, groupIDs, 1)
+
+	// Bob and the eng group leave, Alice is renamed and Carol joins
+	fake.set([]map[string]interface{}{
+		casdoorUser("u-alice", "alice", "Alice Smith", "acme/ops", "acme/eng"),
+		casdoorUser("u-carol", "carol", "Carol"),
+	}, []map[string]interface{}{
+		casdoorGroup("ops", "Operations"),
+	})
+	run, err = service.SyncOrganization(ctx, org.ID, SyncTriggerScheduled)
+	require.NoError(t, err)
+	assert.Equal(t, 1, run.UsersCreated)
+	assert.Equal(t, 1, run.UsersUpdated)
+	assert.Equal(t, 1, run.UsersDeleted)
+	assert.Equal(t, 1, run.GroupsDeleted)
+	assert.Equal(t, 1, run.Memberships)
+
+	users, total, err := service.ListUsers(org.ID, "", 1, 20)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+	assert.Equal(t, "alice", users[0].Username)
+	assert.Equal(t, "Alice Smith", users[0].DisplayName)
+	_, total, err = service.ListUsers(org.ID, "CAROL", 1, 20)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+	groups, total, err := service.ListGroups(org.ID, "oper", 1, 20)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+	assert.Equal(t, "acme/ops", groups[0].CasdoorGroupID)
+
+	// A returning user is restored with the same local ID
+	fake.set([]map[string]interface{}{
+		casdoorUser("u-alice", "alice", "Alice Smith", "acme/ops"),
+		casdoorUser("u-bob", "bob", "Bob"),
+		casdoorUser("u-carol", "carol", "Carol"),
+	}, []map[string]interface{}{
+		casdoorGroup("ops", "Operations"),
+	})
+	_, err = service.SyncAll(ctx, SyncTriggerManual)
+	require.NoError(t, err)
+	restored, err := userRepo.GetByCasdoorUserID("u-bob")
+	require.NoError(t, err)
+	assert.Equal(t, bob.ID, restored.ID)
+	assert.False(t, restored.DeletedAt.Valid)
+
+	// Upstream failures are recorded on the run and leave local data alone
+	fake.mu.Lock()
+	fake.fail = true
+	fake.mu.Unlock()
+	run, err = service.SyncOrganization(ctx, org.ID, SyncTriggerManual)
+	assert.Error(t, err)
+	require.NotNil(t, run)
+	assert.NotEmpty(t, run.Error)
+	_, total, err = service.ListUsers(org.ID, "", 1, 20)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), total)
+
+	runs, err := service.ListSyncRuns(&org.ID, 10)
+	require.NoError(t, err)
+	assert.Len(t, runs, 4)
+	assert.NotEmpty(t, runs[0].Error, "most recent run first")
+}
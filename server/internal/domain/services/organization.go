@@ -1,6 +1,10 @@
 package services
 
 import (
+	"context"
+
+	"server/internal/casbinx"
+	"server/internal/casdoor"
 	"server/internal/domain/models"
 	"server/internal/store"
 	"server/pkg/errors"
@@ -11,28 +15,44 @@ import (
 
 // OrganizationService handles organization business logic
 type OrganizationService struct {
-	orgRepo *store.OrganizationRepository
+	db       *gorm.DB
+	orgRepo  *store.OrganizationRepository
+	enforcer *casbinx.Enforcer
 }
 
 // NewOrganizationService creates a new organization service
-func NewOrganizationService(db *gorm.DB) *OrganizationService {
+func NewOrganizationService(db *gorm.DB, enforcer *casbinx.Enforcer) *OrganizationService {
 	return &OrganizationService{
-		orgRepo: store.NewOrganizationRepository(db),
+		db:       db,
+		orgRepo:  store.NewOrganizationRepository(db),
+		enforcer: enforcer,
 	}
 }
 
+// WithContext returns the service bound to ctx, so its queries run in the tenant scope of ctx
+func (s *OrganizationService) WithContext(ctx context.Context) *OrganizationService {
+	return NewOrganizationService(s.db.WithContext(ctx), s.enforcer)
+}
+
 // ProjectService handles project business logic
 type ProjectService struct {
+	db       *gorm.DB
 	projRepo *store.ProjectRepository
 }
 
 // NewProjectService creates a new project service
 func NewProjectService(db *gorm.DB) *ProjectService {
 	return &ProjectService{
+		db:       db,
 		projRepo: store.NewProjectRepository(db),
 	}
 }
 
+// WithContext returns the service bound to ctx, so its queries run in the tenant scope of ctx
+func (s *ProjectService) WithContext(ctx context.Context) *ProjectService {
+	return NewProjectService(s.db.WithContext(ctx))
+}
+
 // CreateProject creates a new project in org
 func (s *ProjectService) CreateProject(orgID uuid.UUID, name, remark string, createdBy uuid.UUID) (*models.Project, error) {
 	project := &models.Project{
@@ -69,12 +89,16 @@ func (s *ProjectService) ListProjectsByOrg(orgID uuid.UUID) ([]models.Project, e
 	return projects, nil
 }
 
-// UpdateProject updates name/remark
-func (s *ProjectService) UpdateProject(id uuid.UUID, name, remark string) (*models.Project, error) {
+// UpdateProject updates name/remark of the project at version, the version the caller read.
+// A project changed since then fails with 412 Precondition Failed.
+func (s *ProjectService) UpdateProject(id uuid.UUID, version int64, name, remark string) (*models.Project, error) {
 	proj, err := s.GetProject(id)
 	if err != nil {
 		return nil, err
 	}
+	if proj.Version != version {
+		return nil, errors.NewPreconditionFailedError("Project was modified concurrently")
+	}
 	if name != "" {
 		proj.Name = name
 	}
@@ -82,18 +106,25 @@ func (s *ProjectService) UpdateProject(id uuid.UUID, name, remark string) (*mode
 		proj.Remark = remark
 	}
 	if err := s.projRepo.Update(proj); err != nil {
+		if err == store.ErrVersionConflict {
+			return nil, errors.NewPreconditionFailedError("Project was modified concurrently")
+		}
 		return nil, errors.NewInternalError("Failed to update project")
 	}
 	return proj, nil
 }
 
-// DeleteProject deletes a project
-func (s *ProjectService) DeleteProject(id uuid.UUID) error {
+// DeleteProject deletes the project at version, the version the caller read. A project
+// changed since then fails with 412 Precondition Failed.
+func (s *ProjectService) DeleteProject(id uuid.UUID, version int64) error {
 	// Ensure exists
 	if _, err := s.GetProject(id); err != nil {
 		return err
 	}
-	if err := s.projRepo.Delete(id); err != nil {
+	if err := s.projRepo.DeleteVersion(id, version); err != nil {
+		if err == store.ErrVersionConflict {
+			return errors.NewPreconditionFailedError("Project was modified concurrently")
+		}
 		return errors.NewInternalError("Failed to delete project")
 	}
 	return nil
@@ -168,15 +199,119 @@ func (s *OrganizationService) UpdateOrganization(id uuid.UUID, name string) (*mo
 	return org, nil
 }
 
-// DeleteOrganization deletes an organization
-func (s *OrganizationService) DeleteOrganization(id uuid.UUID) error {
+// DeleteOrganization deletes an organization. An organization that still has projects or
+// devices is refused unless cascade is set, which deletes everything it owns along with it.
+// The Casbin policies and groupings of the organization's org:, project:, partition: and
+// device: domains are removed once the rows are gone.
+func (s *OrganizationService) DeleteOrganization(id uuid.UUID, cascade bool) error {
 	if _, err := s.GetOrganization(id); err != nil {
 		return err
 	}
+	domains, err := s.domains(id)
+	if err != nil {
+		return errors.NewInternalError("Failed to delete organization")
+	}
 
-	if err := s.orgRepo.Delete(id); err != nil {
+	if !cascade {
+		projects, devices, err := s.orgRepo.CountContents(id)
+		if err != nil {
+			return errors.NewInternalError("Failed to delete organization")
+		}
+		if projects > 0 || devices > 0 {
+			conflict := errors.NewConflictError("Organization still has projects or devices")
+			conflict.Details = map[string]interface{}{"projects": projects, "devices": devices}
+			return conflict
+		}
+		if err := s.orgRepo.Delete(id); err != nil {
+			return errors.NewInternalError("Failed to delete organization")
+		}
+		return s.removeDomains(domains)
+	}
+
+	if err := s.orgRepo.DeleteCascade(id); err != nil {
 		return errors.NewInternalError("Failed to delete organization")
 	}
+	return s.removeDomains(domains)
+}
+
+// domains lists the Casbin domains of an organization and of everything it owns
+func (s *OrganizationService) domains(id uuid.UUID) ([]string, error) {
+	projects, partitions, devices, err := s.orgRepo.ContentIDs(id)
+	if err != nil {
+		return nil, err
+	}
+	domains := make([]string, 0, 1+len(projects)+len(partitions)+len(devices))
+	domains = append(domains, casbinx.BuildDomain("org", id.String()))
+	for _, group := range []struct {
+		kind string
+		ids  []uuid.UUID
+	}{{"project", projects}, {"partition", partitions}, {"device", devices}} {
+		for _, resourceID := range group.ids {
+			domains = append(domains, casbinx.BuildDomain(group.kind, resourceID.String()))
+		}
+	}
+	return domains, nil
+}
 
+// removeDomains drops the Casbin rules of a deleted organization's domains. The adapter
+// writes outside the delete's transaction, so a failure leaves the rows deleted; the rules
+// left behind name IDs that no longer exist.
+func (s *OrganizationService) removeDomains(domains []string) error {
+	for _, domain := range domains {
+		if err := s.enforcer.RemoveDomain(domain); err != nil {
+			return errors.NewInternalError("Organization deleted, but removing its permissions failed")
+		}
+	}
 	return nil
 }
+
+// OrganizationDirectory lists the organizations of the identity provider; *casdoor.Client
+// implements it
+type OrganizationDirectory interface {
+	GetOrganizations(ctx context.Context) ([]casdoor.OrganizationInfo, error)
+}
+
+// OrganizationImport is the outcome of ImportOrganizations
+type OrganizationImport struct {
+	Created  []models.Organization `json:"created"`
+	Existing []string              `json:"existing"`
+	Failed   map[string]string     `json:"failed,omitempty"`
+}
+
+// ImportOrganizations creates a local organization for every Casdoor organization that has
+// none yet, named after its display name. Existing organizations are left untouched, and an
+// organization that cannot be created does not stop the others.
+func (s *OrganizationService) ImportOrganizations(ctx context.Context, directory OrganizationDirectory) (*OrganizationImport, error) {
+	upstream, err := directory.GetOrganizations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &OrganizationImport{Created: []models.Organization{}, Existing: []string{}}
+	for _, info := range upstream {
+		if info.Name == "" {
+			continue
+		}
+		if _, err := s.orgRepo.GetByCasdoorOrg(info.Name); err == nil {
+			result.Existing = append(result.Existing, info.Name)
+			continue
+		}
+		org := &models.Organization{
+			BaseModel:  models.BaseModel{ID: uuid.New()},
+			CasdoorOrg: info.Name,
+			Name:       info.DisplayName,
+		}
+		if org.Name == "" {
+			org.Name = info.Name
+		}
+		if err := s.orgRepo.Create(org); err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]string)
+			}
+			result.Failed[info.Name] = "Failed to create organization"
+			continue
+		}
+		result.Created = append(result.Created, *org)
+	}
+	return result, nil
+}
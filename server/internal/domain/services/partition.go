@@ -0,0 +1,394 @@
+package services
+
+import (
+	"context"
+	"strings"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// PartitionService handles partition tree business logic
+type PartitionService struct {
+	db       *gorm.DB
+	partRepo *store.PartitionRepository
+	projRepo *store.ProjectRepository
+}
+
+// NewPartitionService creates a new partition service
+func NewPartitionService(db *gorm.DB) *PartitionService {
+	return &PartitionService{
+		db:       db,
+		partRepo: store.NewPartitionRepository(db),
+		projRepo: store.NewProjectRepository(db),
+	}
+}
+
+// WithContext returns the service bound to ctx, so its queries run in the tenant scope of ctx
+func (s *PartitionService) WithContext(ctx context.Context) *PartitionService {
+	return NewPartitionService(s.db.WithContext(ctx))
+}
+
+// DeviceRollup summarizes device counts for a partition subtree
+type DeviceRollup struct {
+	Total   int64 `json:"total"`
+	Online  int64 `json:"online"`
+	Offline int64 `json:"offline"`
+}
+
+func (r *DeviceRollup) add(other DeviceRollup) {
+	r.Total += other.Total
+	r.Online += other.Online
+	r.Offline += other.Offline
+}
+
+// PartitionNode is a partition with its nested children and device counts
+type PartitionNode struct {
+	ID       uuid.UUID        `json:"id"`
+	ParentID *uuid.UUID       `json:"parent_id"`
+	Name     string           `json:"name"`
+	Path     string           `json:"path"`
+	Depth    int              `json:"depth"`
+	Devices  DeviceRollup     `json:"devices"`  // devices attached directly to this partition
+	Rollup   DeviceRollup     `json:"rollup"`   // devices in this partition and all descendants
+	Children []*PartitionNode `json:"children"` // always non-nil for stable JSON
+}
+
+// PartitionTree is the nested partition tree of a project
+type PartitionTree struct {
+	ProjectID  uuid.UUID        `json:"project_id"`
+	Partitions []*PartitionNode `json:"partitions"`
+	Unassigned DeviceRollup     `json:"unassigned"` // devices without a partition
+	Rollup     DeviceRollup     `json:"rollup"`     // all devices in the project
+}
+
+// PartitionDetail is a partition with its ancestors and the devices of its subtree
+type PartitionDetail struct {
+	*models.Partition
+	Ancestors   []models.Partition `json:"ancestors"`   // root first, empty for a top-level partition
+	Descendants int                `json:"descendants"` // partitions below it at any depth
+	Rollup      DeviceRollup       `json:"rollup"`      // devices in this partition and all descendants
+}
+
+// CreatePartition creates a partition under parentID (nil for a top-level partition)
+func (s *PartitionService) CreatePartition(projectID uuid.UUID, parentID *uuid.UUID, name string) (*models.Partition, error) {
+	name = strings.TrimSpace(name)
+	if err := validatePartitionName(name); err != nil {
+		return nil, err
+	}
+	if _, err := s.projRepo.GetByID(projectID); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.NewNotFoundError("Project not found")
+		}
+		return nil, errors.NewInternalError("Failed to get project")
+	}
+
+	partition := &models.Partition{
+		BaseModel: models.BaseModel{ID: uuid.New()},
+		ProjectID: projectID,
+		ParentID:  parentID,
+		Name:      name,
+	}
+
+	if parentID != nil {
+		parent, err := s.GetPartition(*parentID)
+		if err != nil {
+			return nil, err
+		}
+		if parent.ProjectID != projectID {
+			return nil, errors.NewBadRequestError("Parent partition belongs to another project")
+		}
+		partition.Path = parent.Path + "." + store.PartitionLabel(partition.ID)
+		partition.Depth = parent.Depth + 1
+	} else {
+		partition.Path = store.PartitionLabel(partition.ID)
+		partition.Depth = 1
+	}
+
+	if exists, err := s.partRepo.ExistsSibling(projectID, parentID, name, nil); err != nil {
+		return nil, errors.NewInternalError("Failed to create partition")
+	} else if exists {
+		return nil, errors.NewConflictError("Partition with this name already exists")
+	}
+
+	if err := s.partRepo.Create(partition); err != nil {
+		return nil, errors.NewInternalError("Failed to create partition")
+	}
+	return partition, nil
+}
+
+// GetPartition returns a partition by ID
+func (s *PartitionService) GetPartition(id uuid.UUID) (*models.Partition, error) {
+	partition, err := s.partRepo.GetByID(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.NewNotFoundError("Partition not found")
+		}
+		return nil, errors.NewInternalError("Failed to get partition")
+	}
+	return partition, nil
+}
+
+// GetPartitionDetail returns a partition with its ancestors, the number of partitions
+// below it and the device rollup of its whole subtree
+func (s *PartitionService) GetPartitionDetail(id uuid.UUID) (*PartitionDetail, error) {
+	partition, err := s.GetPartition(id)
+	if err != nil {
+		return nil, err
+	}
+	ancestors, err := s.partRepo.ListAncestors(partition)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to get partition ancestors")
+	}
+	descendants, err := s.partRepo.ListDescendants(partition)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to get partition descendants")
+	}
+	counts, err := s.partRepo.CountSubtreeDevices(partition)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to count devices")
+	}
+
+	detail := &PartitionDetail{Partition: partition, Ancestors: ancestors, Descendants: len(descendants)}
+	for _, c := range counts {
+		detail.Rollup.add(rollupFor(c.Status, c.Count))
+	}
+	return detail, nil
+}
+
+// RenamePartition changes the name of a partition
+func (s *PartitionService) RenamePartition(id uuid.UUID, name string) (*models.Partition, error) {
+	return s.UpdatePartition(id, name, false, nil)
+}
+
+// MovePartition re-parents a partition (nil newParentID moves it to the top level).
+// The paths and depths of the whole subtree are rewritten in one transaction; partition
+// IDs do not change, so attached devices and partition:<id> policies stay valid.
+func (s *PartitionService) MovePartition(id uuid.UUID, newParentID *uuid.UUID) (*models.Partition, error) {
+	return s.UpdatePartition(id, "", true, newParentID)
+}
+
+// UpdatePartition renames a partition unless name is empty and, when move is set, re-parents
+// it as MovePartition does. Both happen in one transaction, so a rename is not kept when the
+// move fails; the new name must be free under the new parent.
+func (s *PartitionService) UpdatePartition(id uuid.UUID, name string, move bool, newParentID *uuid.UUID) (*models.Partition, error) {
+	if name != "" {
+		name = strings.TrimSpace(name)
+		if err := validatePartitionName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	var updated *models.Partition
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		repo := store.NewPartitionRepository(tx)
+
+		partition, err := repo.GetByID(id)
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return errors.NewNotFoundError("Partition not found")
+			}
+			return errors.NewInternalError("Failed to get partition")
+		}
+		move = move && !sameParent(partition.ParentID, newParentID)
+		rename := name != "" && name != partition.Name
+		if !move && !rename {
+			updated = partition
+			return nil
+		}
+		if move {
+			if err := repo.LockProjectTree(partition.ProjectID); err != nil {
+				return errors.NewInternalError("Failed to move partition")
+			}
+			// Re-read under the lock so the cycle check sees committed paths
+			if partition, err = repo.GetByID(id); err != nil {
+				return errors.NewInternalError("Failed to get partition")
+			}
+		}
+
+		parentID := partition.ParentID
+		newPath, newDepth := partition.Path, partition.Depth
+		if move {
+			parentID = newParentID
+			newPath, newDepth = store.PartitionLabel(partition.ID), 1
+			if newParentID != nil {
+				parent, err := repo.GetByID(*newParentID)
+				if err != nil {
+					if err == gorm.ErrRecordNotFound {
+						return errors.NewNotFoundError("Parent partition not found")
+					}
+					return errors.NewInternalError("Failed to get partition")
+				}
+				if parent.ProjectID != partition.ProjectID {
+					return errors.NewBadRequestError("Cannot move a partition to another project")
+				}
+				if parent.ID == partition.ID || strings.HasPrefix(parent.Path, partition.Path+".") {
+					return errors.NewBadRequestError("Cannot move a partition under itself or its descendants")
+				}
+				newPath = parent.Path + "." + newPath
+				newDepth = parent.Depth + 1
+			}
+		}
+
+		newName := partition.Name
+		if rename {
+			newName = name
+		}
+		exists, err := repo.ExistsSibling(partition.ProjectID, parentID, newName, &partition.ID)
+		if err != nil {
+			return errors.NewInternalError("Failed to update partition")
+		}
+		if exists {
+			return errors.NewConflictError("Partition with this name already exists")
+		}
+
+		if move {
+			if err := repo.MoveSubtree(partition, newParentID, newPath, newDepth); err != nil {
+				return errors.NewInternalError("Failed to move partition")
+			}
+		}
+		if rename {
+			partition.Name = newName
+			if err := repo.Update(partition); err != nil {
+				return errors.NewInternalError("Failed to update partition")
+			}
+		}
+		updated = partition
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func sameParent(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// DeletePartition deletes an empty partition; partitions with children or devices are refused
+func (s *PartitionService) DeletePartition(id uuid.UUID) error {
+	if _, err := s.GetPartition(id); err != nil {
+		return err
+	}
+	children, err := s.partRepo.CountChildren(id)
+	if err != nil {
+		return errors.NewInternalError("Failed to delete partition")
+	}
+	if children > 0 {
+		return errors.NewConflictError("Partition has child partitions")
+	}
+	devices, err := s.partRepo.CountDevices(id)
+	if err != nil {
+		return errors.NewInternalError("Failed to delete partition")
+	}
+	if devices > 0 {
+		return errors.NewConflictError("Partition still has devices")
+	}
+	if err := s.partRepo.Delete(id); err != nil {
+		return errors.NewInternalError("Failed to delete partition")
+	}
+	return nil
+}
+
+// GetTree builds the nested partition tree of a project with device rollups
+func (s *PartitionService) GetTree(projectID uuid.UUID) (*PartitionTree, error) {
+	if _, err := s.projRepo.GetByID(projectID); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.NewNotFoundError("Project not found")
+		}
+		return nil, errors.NewInternalError("Failed to get project")
+	}
+	partitions, err := s.partRepo.ListByProject(projectID)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to list partitions")
+	}
+	counts, err := s.partRepo.CountDevicesByPartition(projectID)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to count devices")
+	}
+
+	tree := &PartitionTree{ProjectID: projectID, Partitions: []*PartitionNode{}}
+	nodes := make(map[uuid.UUID]*PartitionNode, len(partitions))
+	for _, p := range partitions {
+		nodes[p.ID] = &PartitionNode{
+			ID:       p.ID,
+			ParentID: p.ParentID,
+			Name:     p.Name,
+			Path:     p.Path,
+			Depth:    p.Depth,
+			Children: []*PartitionNode{},
+		}
+	}
+
+	for _, c := range counts {
+		var target *DeviceRollup
+		if c.PartitionID != nil {
+			if node, ok := nodes[*c.PartitionID]; ok {
+				target = &node.Devices
+			}
+		}
+		if target == nil {
+			target = &tree.Unassigned
+		}
+		target.add(rollupFor(c.Status, c.Count))
+	}
+
+	// Partitions are ordered by depth, so parents are linked before their children
+	for _, p := range partitions {
+		node := nodes[p.ID]
+		if p.ParentID != nil {
+			if parent, ok := nodes[*p.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		tree.Partitions = append(tree.Partitions, node)
+	}
+
+	tree.Rollup = tree.Unassigned
+	for _, root := range tree.Partitions {
+		tree.Rollup.add(computeRollup(root))
+	}
+	return tree, nil
+}
+
+func computeRollup(node *PartitionNode) DeviceRollup {
+	node.Rollup = node.Devices
+	for _, child := range node.Children {
+		node.Rollup.add(computeRollup(child))
+	}
+	return node.Rollup
+}
+
+func rollupFor(status models.DeviceStatus, n int64) DeviceRollup {
+	r := DeviceRollup{Total: n}
+	switch status {
+	case models.DeviceStatusOnline:
+		r.Online = n
+	case models.DeviceStatusOffline:
+		r.Offline = n
+	}
+	return r
+}
+
+func validatePartitionName(name string) error {
+	if name == "" {
+		return errors.NewValidationError("Invalid partition name", map[string]interface{}{
+			"name": "name must not be empty",
+		})
+	}
+	if len(name) > 128 {
+		return errors.NewValidationError("Invalid partition name", map[string]interface{}{
+			"name": "name must be at most 128 characters",
+		})
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func setupTestProject(t *testing.T, db *gorm.DB) *models.Project {
+	org, err := NewOrganizationService(db, setupTestEnforcer(t, db)).CreateOrganization("org-"+uuid.NewString(), "Test Organization")
+	require.NoError(t, err)
+
+	project := &models.Project{
+		BaseModel: models.BaseModel{ID: uuid.New()},
+		OrgID:     org.ID,
+		Name:      "Test Project",
+		CreatedBy: uuid.New(),
+	}
+	require.NoError(t, db.Create(project).Error)
+	return project
+}
+
+func TestPartitionService_CRUD(t *testing.T) {
+	db := setupTestDB(t)
+	project := setupTestProject(t, db)
+	service := NewPartitionService(db)
+
+	floor, err := service.CreatePartition(project.ID, nil, "Floor 1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, floor.Depth)
+	assert.Nil(t, floor.ParentID)
+
+	room, err := service.CreatePartition(project.ID, &floor.ID, "Room 101")
+	require.NoError(t, err)
+	assert.Equal(t, 2, room.Depth)
+	assert.True(t, strings.HasPrefix(room.Path, floor.Path+"."))
+
+	// Duplicate sibling names are rejected
+	_, err = service.CreatePartition(project.ID, &floor.ID, "Room 101")
+	assert.Error(t, err)
+
+	// Empty names are rejected
+	_, err = service.CreatePartition(project.ID, nil, "  ")
+	assert.Error(t, err)
+
+	// Parent from another project is rejected
+	other := setupTestProject(t, db)
+	_, err = service.CreatePartition(other.ID, &floor.ID, "Room X")
+	assert.Error(t, err)
+
+	renamed, err := service.RenamePartition(room.ID, "Room 102")
+	require.NoError(t, err)
+	assert.Equal(t, "Room 102", renamed.Name)
+
+	// Non-empty partitions cannot be deleted
+	assert.Error(t, service.DeletePartition(floor.ID))
+
+	require.NoError(t, service.DeletePartition(room.ID))
+	require.NoError(t, service.DeletePartition(floor.ID))
+	_, err = service.GetPartition(floor.ID)
+	assert.Error(t, err)
+}
+
+func TestPartitionService_TreeRollup(t *testing.T) {
+	db := setupTestDB(t)
+	project := setupTestProject(t, db)
+	service := NewPartitionService(db)
+	deviceService := NewDeviceService(db)
+
+	floor, err := service.CreatePartition(project.ID, nil, "Floor 1")
+	require.NoError(t, err)
+	room, err := service.CreatePartition(project.ID, &floor.ID, "Room 101")
+	require.NoError(t, err)
+	_, err = service.CreatePartition(project.ID, nil, "Floor 2")
+	require.NoError(t, err)
+
+	create := func(mac string, partitionID *uuid.UUID, status models.DeviceStatus) {
+		dev, err := deviceService.CreateDevice(mac, nil, models.DeviceTypeWiFi, project.ID, partitionID, mac)
+		require.NoError(t, err)
+		require.NoError(t, deviceService.UpdateDeviceStatus(dev.ID, status))
+	}
+	create("AABBCCDDEE01", &floor.ID, models.DeviceStatusOnline)
+	create("AABBCCDDEE02", &room.ID, models.DeviceStatusOnline)
+	create("AABBCCDDEE03", &room.ID, models.DeviceStatusOffline)
+	create("AABBCCDDEE04", nil, models.DeviceStatusOffline)
+
+	tree, err := service.GetTree(project.ID)
+	require.NoError(t, err)
+	require.Len(t, tree.Partitions, 2)
+
+	floorNode := tree.Partitions[0]
+	assert.Equal(t, "Floor 1", floorNode.Name)
+	assert.Equal(t, DeviceRollup{Total: 1, Online: 1}, floorNode.Devices)
+	assert.Equal(t, DeviceRollup{Total: 3, Online: 2, Offline: 1}, floorNode.Rollup)
+	require.Len(t, floorNode.Children, 1)
+	assert.Equal(t, DeviceRollup{Total: 2, Online: 1, Offline: 1}, floorNode.Children[0].Rollup)
+
+	assert.Empty(t, tree.Partitions[1].Children)
+	assert.Equal(t, DeviceRollup{}, tree.Partitions[1].Rollup)
+
+	assert.Equal(t, DeviceRollup{Total: 1, Offline: 1}, tree.Unassigned)
+	assert.Equal(t, DeviceRollup{Total: 4, Online: 2, Offline: 2}, tree.Rollup)
+}
+
+func TestPartitionService_MoveSubtree(t *testing.T) {
+	db := setupTestDB(t)
+	project := setupTestProject(t, db)
+	service := NewPartitionService(db)
+	deviceService := NewDeviceService(db)
+
+	building, err := service.CreatePartition(project.ID, nil, "Building A")
+	require.NoError(t, err)
+	floor, err := service.CreatePartition(project.ID, &building.ID, "Floor 1")
+	require.NoError(t, err)
+	room, err := service.CreatePartition(project.ID, &floor.ID, "Room 101")
+	require.NoError(t, err)
+	annex, err := service.CreatePartition(project.ID, nil, "Annex")
+	require.NoError(t, err)
+
+	dev, err := deviceService.CreateDevice("AABBCCDDEE11", nil, models.DeviceTypeWiFi, project.ID, &room.ID, "Gateway")
+	require.NoError(t, err)
+
+	// Cycles are rejected
+	_, err = service.MovePartition(building.ID, &room.ID)
+	assert.Error(t, err)
+	_, err = service.MovePartition(floor.ID, &floor.ID)
+	assert.Error(t, err)
+
+	// Moves across projects are rejected
+	other := setupTestProject(t, db)
+	foreign, err := service.CreatePartition(other.ID, nil, "Foreign")
+	require.NoError(t, err)
+	_, err = service.MovePartition(floor.ID, &foreign.ID)
+	assert.Error(t, err)
+
+	// A rename is not kept when the move in the same update fails
+	_, err = service.UpdatePartition(floor.ID, "Floor 2", true, &room.ID)
+	assert.Error(t, err)
+	unchanged, err := service.GetPartition(floor.ID)
+	require.NoError(t, err)
+	assert.Equal(t, floor.Name, unchanged.Name)
+	assert.Equal(t, floor.Path, unchanged.Path)
+
+	// Move Floor 1 (with Room 101) under Annex
+	moved, err := service.MovePartition(floor.ID, &annex.ID)
+	require.NoError(t, err)
+	assert.Equal(t, annex.ID, *moved.ParentID)
+	assert.Equal(t, 2, moved.Depth)
+	assert.True(t, strings.HasPrefix(moved.Path, annex.Path+"."))
+
+	reloadedRoom, err := service.GetPartition(room.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 3, reloadedRoom.Depth)
+	assert.Equal(t, moved.Path+"."+strings.ReplaceAll(room.ID.String(), "-", ""), reloadedRoom.Path)
+
+	// Building A is untouched
+	reloadedBuilding, err := service.GetPartition(building.ID)
+	require.NoError(t, err)
+	assert.Equal(t, building.Path, reloadedBuilding.Path)
+
+	// Devices stay attached to their partition
+	reloadedDev, err := deviceService.GetDevice(dev.ID)
+	require.NoError(t, err)
+	assert.Equal(t, room.ID, *reloadedDev.PartitionID)
+
+	// Move Floor 1 back to the top level
+	moved, err = service.MovePartition(floor.ID, nil)
+	require.NoError(t, err)
+	assert.Nil(t, moved.ParentID)
+	assert.Equal(t, 1, moved.Depth)
+	reloadedRoom, err = service.GetPartition(room.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, reloadedRoom.Depth)
+	assert.True(t, strings.HasPrefix(reloadedRoom.Path, moved.Path+"."))
+}
+
+func TestPartitionService_SubtreeQueries(t *testing.T) {
+	db := setupTestDB(t)
+	project := setupTestProject(t, db)
+	service := NewPartitionService(db)
+	deviceService := NewDeviceService(db)
+
+	building, err := service.CreatePartition(project.ID, nil, "Building A")
+	require.NoError(t, err)
+	floor, err := service.CreatePartition(project.ID, &building.ID, "Floor 1")
+	require.NoError(t, err)
+	room, err := service.CreatePartition(project.ID, &floor.ID, "Room 101")
+	require.NoError(t, err)
+	annex, err := service.CreatePartition(project.ID, nil, "Annex")
+	require.NoError(t, err)
+
+	for i, partitionID := range []uuid.UUID{building.ID, floor.ID, room.ID, room.ID, annex.ID} {
+		mac := "AABBCCDDEE3" + string(rune('0'+i))
+		device, err := deviceService.CreateDevice(mac, nil, models.DeviceTypeWiFi, project.ID, &partitionID, "Device "+mac)
+		require.NoError(t, err)
+		if i == 2 {
+			require.NoError(t, db.Model(device).Update("status", models.DeviceStatusOnline).Error)
+		}
+	}
+
+	detail, err := service.GetPartitionDetail(room.ID)
+	require.NoError(t, err)
+	require.Len(t, detail.Ancestors, 2)
+	assert.Equal(t, building.ID, detail.Ancestors[0].ID, "root first")
+	assert.Equal(t, floor.ID, detail.Ancestors[1].ID)
+	assert.Zero(t, detail.Descendants)
+	assert.Equal(t, DeviceRollup{Total: 2, Online: 1}, detail.Rollup)
+
+	detail, err = service.GetPartitionDetail(building.ID)
+	require.NoError(t, err)
+	assert.Empty(t, detail.Ancestors)
+	assert.Equal(t, 2, detail.Descendants)
+	assert.Equal(t, DeviceRollup{Total: 4, Online: 1}, detail.Rollup)
+
+	// The device list filter covers the whole subtree, the plain one only the partition
+	devices, err := deviceService.ListDevicesByProject(project.ID, map[string]interface{}{DeviceFilterPartitionTree: floor.ID})
+	require.NoError(t, err)
+	assert.Len(t, devices, 3)
+	devices, err = deviceService.ListDevicesByProject(project.ID, map[string]interface{}{"partition_id": floor.ID})
+	require.NoError(t, err)
+	assert.Len(t, devices, 1)
+	devices, err = deviceService.ListDevicesByProject(project.ID, map[string]interface{}{DeviceFilterPartitionTree: uuid.New()})
+	require.NoError(t, err)
+	assert.Empty(t, devices)
+
+	// Subtree queries follow a move
+	_, err = service.MovePartition(floor.ID, &annex.ID)
+	require.NoError(t, err)
+	detail, err = service.GetPartitionDetail(annex.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, detail.Descendants)
+	assert.Equal(t, int64(4), detail.Rollup.Total)
+	detail, err = service.GetPartitionDetail(room.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{annex.ID, floor.ID}, []uuid.UUID{detail.Ancestors[0].ID, detail.Ancestors[1].ID})
+}
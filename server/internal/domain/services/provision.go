@@ -0,0 +1,124 @@
+package services
+
+import (
+	"server/internal/casdoor"
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// localUserNamespace derives local user IDs from Casdoor user IDs
+var localUserNamespace = uuid.MustParse("6f1c2d8e-3b7a-5c49-9e0d-2a4b6c8e0f13")
+
+// LocalUserID returns the stable local UUID for a Casdoor user. Just-in-time provisioning and
+// the directory sync both use it, so a user gets the same ID whichever path creates them.
+func LocalUserID(casdoorUserID string) uuid.UUID {
+	return uuid.NewSHA1(localUserNamespace, []byte(casdoorUserID))
+}
+
+// ProvisioningService creates local user and organization records for authenticated Casdoor
+// users on their first request
+type ProvisioningService struct {
+	db       *gorm.DB
+	orgRepo  *store.OrganizationRepository
+	userRepo *store.UserRepository
+	autoOrgs map[string]bool
+}
+
+// NewProvisioningService creates a new provisioning service. Unknown organizations are only
+// created when listed in autoProvisionOrgs; "*" allows any organization.
+func NewProvisioningService(db *gorm.DB, autoProvisionOrgs []string) *ProvisioningService {
+	autoOrgs := make(map[string]bool, len(autoProvisionOrgs))
+	for _, name := range autoProvisionOrgs {
+		if name != "" {
+			autoOrgs[name] = true
+		}
+	}
+	return &ProvisioningService{
+		db:       db,
+		orgRepo:  store.NewOrganizationRepository(db),
+		userRepo: store.NewUserRepository(db),
+		autoOrgs: autoOrgs,
+	}
+}
+
+// ProvisionUser returns the local organization and user for a verified Casdoor identity,
+// creating them if needed and refreshing the profile fields from the token. Users removed
+// by the directory sync are refused.
+func (s *ProvisioningService) ProvisionUser(info *casdoor.UserInfo) (*models.Organization, *models.User, error) {
+	if info.ID == "" {
+		return nil, nil, errors.NewUnauthorizedError("Token has no user ID")
+	}
+	org, err := s.provisionOrg(info.Organization)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := s.userRepo.GetByCasdoorUserID(info.ID)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, nil, errors.NewInternalError("Failed to get user")
+	}
+	if user == nil {
+		user = &models.User{
+			BaseModel:     models.BaseModel{ID: LocalUserID(info.ID)},
+			CasdoorUserID: info.ID,
+			Username:      info.Username,
+			Email:         info.Email,
+			DisplayName:   info.Name,
+			OrgID:         org.ID,
+		}
+		if err := s.userRepo.Create(user); err != nil {
+			// A concurrent first request may have created the user already
+			existing, getErr := s.userRepo.GetByCasdoorUserID(info.ID)
+			if getErr != nil {
+				return nil, nil, errors.NewInternalError("Failed to provision user")
+			}
+			user = existing
+		}
+	}
+	if user.DeletedAt.Valid {
+		return nil, nil, errors.NewForbiddenError("User account has been removed")
+	}
+
+	if user.OrgID != org.ID || user.Username != info.Username || user.Email != info.Email || user.DisplayName != info.Name {
+		user.OrgID = org.ID
+		user.Username = info.Username
+		user.Email = info.Email
+		user.DisplayName = info.Name
+		if err := s.userRepo.Save(user); err != nil {
+			return nil, nil, errors.NewInternalError("Failed to update user")
+		}
+	}
+	return org, user, nil
+}
+
+func (s *ProvisioningService) provisionOrg(casdoorOrg string) (*models.Organization, error) {
+	org, err := s.orgRepo.GetByCasdoorOrg(casdoorOrg)
+	if err == nil {
+		return org, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, errors.NewInternalError("Failed to get organization")
+	}
+	if casdoorOrg == "" || !(s.autoOrgs["*"] || s.autoOrgs[casdoorOrg]) {
+		return nil, errors.NewForbiddenError("Organization not found or not authorized")
+	}
+
+	org = &models.Organization{
+		BaseModel:  models.BaseModel{ID: uuid.New()},
+		CasdoorOrg: casdoorOrg,
+		Name:       casdoorOrg,
+	}
+	if err := s.orgRepo.Create(org); err != nil {
+		// A concurrent first request may have created the organization already
+		existing, getErr := s.orgRepo.GetByCasdoorOrg(casdoorOrg)
+		if getErr != nil {
+			return nil, errors.NewInternalError("Failed to provision organization")
+		}
+		return existing, nil
+	}
+	return org, nil
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"testing"
+
+	"server/internal/casdoor"
+	"server/internal/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisioningService_ProvisionUser(t *testing.T) {
+	db := setupTestDB(t)
+	service := NewProvisioningService(db, []string{"acme"})
+
+	// First login from an allowed tenant creates the organization and the user
+	info := &casdoor.UserInfo{ID: "c-alice", Username: "alice", Name: "Alice", Email: "alice@acme.test", Organization: "acme"}
+	org, user, err := service.ProvisionUser(info)
+	require.NoError(t, err)
+	assert.Equal(t, "acme", org.CasdoorOrg)
+	assert.Equal(t, LocalUserID("c-alice"), user.ID)
+	assert.Equal(t, org.ID, user.OrgID)
+
+	// Later logins reuse both and pick up profile changes
+	info.Email = "alice@example.test"
+	org2, user2, err := service.ProvisionUser(info)
+	require.NoError(t, err)
+	assert.Equal(t, org.ID, org2.ID)
+	assert.Equal(t, user.ID, user2.ID)
+	stored, err := store.NewUserRepository(db).GetByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.test", stored.Email)
+
+	// Unknown tenants are refused unless allowed
+	_, _, err = service.ProvisionUser(&casdoor.UserInfo{ID: "c-mallory", Organization: "other"})
+	assert.Error(t, err)
+	_, _, err = NewProvisioningService(db, []string{"*"}).ProvisionUser(&casdoor.UserInfo{ID: "c-mallory", Organization: "other"})
+	assert.NoError(t, err)
+
+	// Users removed by the directory sync stay out
+	require.NoError(t, store.NewUserRepository(db).Delete(user.ID))
+	_, _, err = service.ProvisionUser(info)
+	assert.Error(t, err)
+}
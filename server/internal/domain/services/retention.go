@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Audit retention triggers recorded on AuditPurgeRun
+const (
+	RetentionTriggerScheduled = "scheduled"
+	RetentionTriggerManual    = "manual"
+)
+
+// auditPurgePause is how long a purge waits between batches so other writers get the table
+const auditPurgePause = 50 * time.Millisecond
+
+// AuditRetentionStatus reports the retention policy and its recent runs
+type AuditRetentionStatus struct {
+	RetentionDays int                    `json:"retention_days"`
+	Interval      string                 `json:"interval"` // empty when the scheduled purge is off
+	BatchSize     int                    `json:"batch_size"`
+	Running       bool                   `json:"running"`
+	LastRun       *models.AuditPurgeRun  `json:"last_run"`
+	NextRunAt     *time.Time             `json:"next_run_at,omitempty"`
+	RecentRuns    []models.AuditPurgeRun `json:"recent_runs"`
+}
+
+// AuditRetentionService deletes audit records older than the retention period, in batches,
+// and records each run
+type AuditRetentionService struct {
+	settings  *SettingService
+	auditRepo *store.AuditLogRepository
+	runRepo   *store.AuditPurgeRunRepository
+	interval  time.Duration
+	batchSize int
+	running   sync.Mutex
+}
+
+// NewAuditRetentionService creates a new audit retention service. interval is how often the
+// server enforces retention; 0 means only manual purges run.
+func NewAuditRetentionService(db *gorm.DB, settings *SettingService, interval time.Duration, batchSize int) *AuditRetentionService {
+	if batchSize < 1 {
+		batchSize = 5000
+	}
+	return &AuditRetentionService{
+		settings:  settings,
+		auditRepo: store.NewAuditLogRepository(db),
+		runRepo:   store.NewAuditPurgeRunRepository(db),
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Enforce deletes audit records older than days, or than the configured retention when days
+// is 0. The run is saved when it starts, after every batch and with its result at the end, so
+// a cancelled or failed run keeps what it already deleted on record.
+func (s *AuditRetentionService) Enforce(ctx context.Context, trigger string, days int) (*models.AuditPurgeRun, error) {
+	if !s.running.TryLock() {
+		return nil, errors.NewConflictError("Audit purge already running")
+	}
+	defer s.running.Unlock()
+
+	if days <= 0 {
+		days, _ = s.settings.GetAuditRetentionDays(ctx)
+	}
+	started := time.Now()
+	run := &models.AuditPurgeRun{
+		BaseModel:     models.BaseModel{ID: uuid.New()},
+		Trigger:       trigger,
+		RetentionDays: days,
+		Cutoff:        started.AddDate(0, 0, -days),
+		StartedAt:     started,
+	}
+	if err := s.runRepo.Save(run); err != nil {
+		return nil, errors.NewInternalError("Failed to record purge run")
+	}
+
+	err := s.purge(ctx, run)
+	finished := time.Now()
+	run.FinishedAt = &finished
+	run.DurationMs = finished.Sub(started).Milliseconds()
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if saveErr := s.runRepo.Save(run); saveErr != nil && err == nil {
+		err = errors.NewInternalError("Failed to record purge run")
+	}
+	return run, err
+}
+
+func (s *AuditRetentionService) purge(ctx context.Context, run *models.AuditPurgeRun) error {
+	for {
+		n, err := s.auditRepo.PurgeBatch(ctx, run.Cutoff, s.batchSize)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		run.RowsPurged += n
+		run.Batches++
+		run.DurationMs = time.Since(run.StartedAt).Milliseconds()
+		_ = s.runRepo.Save(run)
+		if n < int64(s.batchSize) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(auditPurgePause):
+		}
+	}
+}
+
+// NextRunDelay returns how long until the next scheduled run is due: one interval after the
+// last scheduled run started, so restarts do not purge more often than the interval
+func (s *AuditRetentionService) NextRunDelay() time.Duration {
+	last, err := s.runRepo.Latest(RetentionTriggerScheduled)
+	if err != nil {
+		return 0
+	}
+	if delay := time.Until(last.StartedAt.Add(s.interval)); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// Status reports the retention policy, whether a purge is running and the recent runs
+func (s *AuditRetentionService) Status(ctx context.Context, limit int) (*AuditRetentionStatus, error) {
+	runs, err := s.runRepo.ListRecent(limit)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to list purge runs")
+	}
+	days, _ := s.settings.GetAuditRetentionDays(ctx)
+	status := &AuditRetentionStatus{
+		RetentionDays: days,
+		BatchSize:     s.batchSize,
+		Running:       !s.running.TryLock(),
+		RecentRuns:    runs,
+	}
+	if !status.Running {
+		s.running.Unlock()
+	}
+	if len(runs) > 0 {
+		status.LastRun = &runs[0]
+	}
+	if s.interval > 0 {
+		status.Interval = s.interval.String()
+		next := time.Now().Add(s.NextRunDelay())
+		status.NextRunAt = &next
+	}
+	return status, nil
+}
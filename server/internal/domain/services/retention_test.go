@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditRetentionService_Enforce(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, db.AutoMigrate(&models.SystemSetting{}))
+	settings := NewSettingServiceWithRepos(store.NewOrganizationSettingRepository(db), store.NewSystemSettingRepository(db))
+	service := NewAuditRetentionService(db, settings, 24*time.Hour, 2)
+	ctx := context.Background()
+	require.NoError(t, settings.SetAuditRetentionDays(ctx, 30))
+
+	// Five records past retention, one soft-deleted by the old purge, and two recent ones
+	for i, age := range []int{90, 60, 45, 40, 31, 10, 0} {
+		rec := newAuditLog(Actor{}, "device.update", "device", nil, nil)
+		rec.CreatedAt = time.Now().AddDate(0, 0, -age)
+		require.NoError(t, db.Create(rec).Error)
+		if i == 0 {
+			require.NoError(t, db.Delete(rec).Error)
+		}
+	}
+
+	assert.Zero(t, service.NextRunDelay(), "first scheduled run is due at once")
+
+	run, err := service.Enforce(ctx, RetentionTriggerScheduled, 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), run.RowsPurged)
+	assert.Equal(t, 3, run.Batches)
+	assert.Equal(t, 30, run.RetentionDays)
+	assert.NotNil(t, run.FinishedAt)
+	assert.Empty(t, run.Error)
+
+	var remaining int64
+	require.NoError(t, db.Unscoped().Model(&models.AuditLog{}).Count(&remaining).Error)
+	assert.Equal(t, int64(2), remaining)
+
+	// An explicit period overrides the setting
+	run, err = service.Enforce(ctx, RetentionTriggerManual, 5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), run.RowsPurged)
+
+	delay := service.NextRunDelay()
+	assert.InDelta(t, (24 * time.Hour).Seconds(), delay.Seconds(), 60, "manual runs do not move the schedule")
+
+	status, err := service.Status(ctx, 10)
+	require.NoError(t, err)
+	assert.False(t, status.Running)
+	assert.Equal(t, "24h0m0s", status.Interval)
+	require.Len(t, status.RecentRuns, 2)
+	assert.Equal(t, run.ID, status.LastRun.ID)
+
+	// Only one purge runs at a time
+	service.running.Lock()
+	_, err = service.Enforce(ctx, RetentionTriggerManual, 0)
+	assert.Error(t, err)
+	status, err = service.Status(ctx, 10)
+	require.NoError(t, err)
+	assert.True(t, status.Running)
+	service.running.Unlock()
+}
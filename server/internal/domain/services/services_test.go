@@ -1,9 +1,17 @@
 package services
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
+	"server/internal/casbinx"
+	"server/internal/casdoor"
 	"server/internal/domain/models"
+	"server/pkg/errors"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -21,23 +29,36 @@ func setupTestDB(t *testing.T) *gorm.DB {
 		&models.Organization{},
 		&models.User{},
 		&models.Group{},
+		&models.UserGroup{},
+		&models.DirectorySyncRun{},
 		&models.Project{},
 		&models.Partition{},
 		&models.Device{},
 		&models.DeviceBinding{},
 		&models.DeviceShare{},
+		&models.DeviceClaimCode{},
+		&models.DeviceClaimAttempt{},
+		&models.DeviceCredential{},
 		&models.DeviceTransfer{},
 		&models.CasbinRule{},
 		&models.AuditLog{},
+		&models.AuditPurgeRun{},
+		&models.OrganizationSetting{},
 	)
 	require.NoError(t, err)
 
 	return db
 }
 
+func setupTestEnforcer(t *testing.T, db *gorm.DB) *casbinx.Enforcer {
+	enforcer, err := casbinx.New(db)
+	require.NoError(t, err)
+	return enforcer
+}
+
 func TestOrganizationService_CRUD(t *testing.T) {
 	db := setupTestDB(t)
-	service := NewOrganizationService(db)
+	service := NewOrganizationService(db, setupTestEnforcer(t, db))
 
 	// Create
 	org, err := service.CreateOrganization("test-org", "Test Organization")
@@ -70,7 +91,7 @@ func TestOrganizationService_CRUD(t *testing.T) {
 	assert.Len(t, orgs, 1)
 
 	// Delete
-	err = service.DeleteOrganization(org.ID)
+	err = service.DeleteOrganization(org.ID, false)
 	assert.NoError(t, err)
 
 	// Verify deletion
@@ -78,6 +99,137 @@ func TestOrganizationService_CRUD(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestOrganizationService_DeleteCascade(t *testing.T) {
+	db := setupTestDB(t)
+	enforcer := setupTestEnforcer(t, db)
+	service := NewOrganizationService(db, enforcer)
+	org, err := service.CreateOrganization("acme", "Acme")
+	require.NoError(t, err)
+	other, err := service.CreateOrganization("other", "Other")
+	require.NoError(t, err)
+
+	seed := func(orgID uuid.UUID, mac string) (*models.Project, *models.Device) {
+		project, err := NewProjectService(db).CreateProject(orgID, "p-"+mac, "", uuid.New())
+		require.NoError(t, err)
+		device := &models.Device{
+			BaseModel:   models.BaseModel{ID: uuid.New()},
+			MAC:         mac,
+			DeviceType:  models.DeviceTypeLTE,
+			ProjectID:   project.ID,
+			DisplayName: mac,
+			Status:      models.DeviceStatusOffline,
+		}
+		require.NoError(t, db.Create(device).Error)
+		require.NoError(t, db.Create(&models.DeviceShare{
+			BaseModel:   models.BaseModel{ID: uuid.New()},
+			DeviceID:    device.ID,
+			SubjectType: models.SubjectTypeUser,
+			SubjectID:   uuid.New(),
+			Role:        models.DeviceRoleOwner,
+			GrantedBy:   uuid.New(),
+			GrantedAt:   time.Now(),
+		}).Error)
+		return project, device
+	}
+	project, device := seed(org.ID, "A1B2C3D4E5F6")
+	otherProject, otherDevice := seed(other.ID, "0A0B0C0D0E0F")
+
+	// A soft-deleted device still owns its secret
+	retired := &models.Device{BaseModel: models.BaseModel{ID: uuid.New()}, MAC: "A1B2C3D4E5F7", DeviceType: models.DeviceTypeLTE, ProjectID: project.ID, Status: models.DeviceStatusOffline}
+	require.NoError(t, db.Create(retired).Error)
+	require.NoError(t, db.Create(&models.DeviceCredential{DeviceID: retired.ID, SecretHash: "x", RotatedAt: time.Now()}).Error)
+	require.NoError(t, db.Delete(retired).Error)
+
+	// Grants in the organization's domains, and one in the other organization's
+	grants := [][]string{
+		{"admin", "role:org_admin", casbinx.BuildDomain("org", org.ID.String())},
+		{"manager", "role:project_admin", casbinx.BuildDomain("project", project.ID.String())},
+		{"owner", casbinx.DeviceRoleName("owner"), casbinx.BuildDomain("device", device.ID.String())},
+		{"owner", casbinx.DeviceRoleName("owner"), casbinx.BuildDomain("device", retired.ID.String())},
+		{"owner", casbinx.DeviceRoleName("owner"), casbinx.BuildDomain("device", otherDevice.ID.String())},
+	}
+	for _, g := range grants {
+		_, err := enforcer.AddGroupingPolicy(g[0], g[1], g[2])
+		require.NoError(t, err)
+	}
+	require.NoError(t, enforcer.AddDeviceRolePolicies(casbinx.BuildDomain("device", device.ID.String())))
+
+	// Refused while the organization still owns projects and devices
+	err = service.DeleteOrganization(org.ID, false)
+	require.Error(t, err)
+	appErr, ok := err.(*errors.AppError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusConflict, appErr.HTTPStatus)
+	assert.Equal(t, int64(1), appErr.Details["devices"])
+	_, err = service.GetOrganization(org.ID)
+	assert.NoError(t, err)
+
+	require.NoError(t, service.DeleteOrganization(org.ID, true))
+	_, err = service.GetOrganization(org.ID)
+	assert.Error(t, err)
+	var count int64
+	require.NoError(t, db.Model(&models.Project{}).Where("id = ?", project.ID).Count(&count).Error)
+	assert.Zero(t, count)
+	require.NoError(t, db.Model(&models.Device{}).Where("id = ?", device.ID).Count(&count).Error)
+	assert.Zero(t, count)
+	require.NoError(t, db.Model(&models.DeviceShare{}).Where("device_id = ?", device.ID).Count(&count).Error)
+	assert.Zero(t, count)
+	require.NoError(t, db.Model(&models.DeviceCredential{}).Where("device_id = ?", retired.ID).Count(&count).Error)
+	assert.Zero(t, count)
+	for _, g := range grants[:4] {
+		assert.Empty(t, enforcer.GetFilteredGroupingPolicy(2, g[2]), g[2])
+	}
+	assert.Empty(t, enforcer.GetPermissionsForUser(casbinx.DeviceRoleName("owner"), casbinx.BuildDomain("device", device.ID.String())))
+
+	// The other organization is untouched
+	require.NoError(t, db.Model(&models.Project{}).Where("id = ?", otherProject.ID).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+	require.NoError(t, db.Model(&models.DeviceShare{}).Where("device_id = ?", otherDevice.ID).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+	assert.Len(t, enforcer.GetFilteredGroupingPolicy(2, grants[4][2]), 1)
+
+	// An empty organization needs no cascade
+	empty, err := service.CreateOrganization("empty", "Empty")
+	require.NoError(t, err)
+	assert.NoError(t, service.DeleteOrganization(empty.ID, false))
+}
+
+type staticOrgDirectory []casdoor.OrganizationInfo
+
+func (d staticOrgDirectory) GetOrganizations(ctx context.Context) ([]casdoor.OrganizationInfo, error) {
+	return d, nil
+}
+
+func TestOrganizationService_Import(t *testing.T) {
+	db := setupTestDB(t)
+	service := NewOrganizationService(db, setupTestEnforcer(t, db))
+	_, err := service.CreateOrganization("acme", "Acme")
+	require.NoError(t, err)
+
+	directory := staticOrgDirectory{
+		{Name: "acme", DisplayName: "Acme Renamed"},
+		{Name: "globex", DisplayName: "Globex Corp"},
+		{Name: "initech"},
+	}
+	result, err := service.ImportOrganizations(context.Background(), directory)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"acme"}, result.Existing)
+	require.Len(t, result.Created, 2)
+	assert.Equal(t, "Globex Corp", result.Created[0].Name)
+	assert.Equal(t, "initech", result.Created[1].Name)
+	assert.Empty(t, result.Failed)
+
+	acme, err := service.GetOrganizationByCasdoor("acme")
+	require.NoError(t, err)
+	assert.Equal(t, "Acme", acme.Name)
+
+	// Importing again creates nothing
+	result, err = service.ImportOrganizations(context.Background(), directory)
+	require.NoError(t, err)
+	assert.Empty(t, result.Created)
+	assert.Len(t, result.Existing, 3)
+}
+
 func TestDeviceService_Validation(t *testing.T) {
 	// Test MAC validation
 	assert.True(t, ValidateMAC("A1B2C3D4E5F6"))
@@ -100,11 +252,46 @@ func TestDeviceService_Validation(t *testing.T) {
 	assert.False(t, ValidateIMEI("1234567890123"))     // too short
 	assert.False(t, ValidateIMEI("12345678901234567")) // too long
 	assert.False(t, ValidateIMEI("1234567890123a5"))   // non-digit
+
+	// Test identifier type detection
+	assert.Equal(t, "mac", IdentifierType("a1:b2:c3:d4:e5:f6"))
+	assert.Equal(t, "mac", IdentifierType("123456789012"))
+	assert.Equal(t, "imei", IdentifierType("123456789012345"))
+	assert.Equal(t, "", IdentifierType("1234567890123"))
+}
+
+func TestDeviceService_Labels(t *testing.T) {
+	tags, err := NormalizeTags([]string{" roof ", "outdoor", "roof", ""})
+	assert.NoError(t, err)
+	assert.Equal(t, models.StringList{"roof", "outdoor"}, tags)
+	_, err = NormalizeTags([]string{strings.Repeat("x", MaxTagLength+1)})
+	assert.Error(t, err)
+
+	meta := models.JSONMap{
+		"floor": "12",
+		"site":  map[string]interface{}{"name": "HQ", "zone": "A"},
+		"temp":  21.5,
+	}
+	merged, err := MergePatchMeta(meta, map[string]interface{}{
+		"site":  map[string]interface{}{"zone": nil, "rack": "R1"},
+		"temp":  nil,
+		"solar": true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, models.JSONMap{
+		"floor": "12",
+		"site":  map[string]interface{}{"name": "HQ", "rack": "R1"},
+		"solar": true,
+	}, merged)
+	assert.Equal(t, 21.5, meta["temp"], "the original metadata is left untouched")
+
+	_, err = MergePatchMeta(nil, map[string]interface{}{"bad key": 1})
+	assert.Error(t, err)
 }
 
 func TestDeviceService_CRUD(t *testing.T) {
 	db := setupTestDB(t)
-	orgService := NewOrganizationService(db)
+	orgService := NewOrganizationService(db, setupTestEnforcer(t, db))
 	deviceService := NewDeviceService(db)
 
 	// Setup organization and project
@@ -183,3 +370,139 @@ func TestDeviceService_CRUD(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, devices, 1)
 }
+
+func TestVersionConflicts(t *testing.T) {
+	db := setupTestDB(t)
+	org, err := NewOrganizationService(db, setupTestEnforcer(t, db)).CreateOrganization("test-org", "Test Organization")
+	require.NoError(t, err)
+	projectService := NewProjectService(db)
+	project, err := projectService.CreateProject(org.ID, "Plant", "", uuid.New())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), project.Version)
+
+	preconditionFailed := func(err error) {
+		t.Helper()
+		appErr, ok := err.(*errors.AppError)
+		require.True(t, ok, "expected an AppError, got %v", err)
+		assert.Equal(t, http.StatusPreconditionFailed, appErr.HTTPStatus)
+	}
+
+	// Project edits and deletes carry the version the caller read
+	updated, err := projectService.UpdateProject(project.ID, 1, "Plant 2", "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), updated.Version)
+	_, err = projectService.UpdateProject(project.ID, 1, "Plant 3", "")
+	preconditionFailed(err)
+	preconditionFailed(projectService.DeleteProject(project.ID, 1))
+	stored, err := projectService.GetProject(project.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Plant 2", stored.Name)
+
+	// Two writers editing the same device: the second one is refused
+	deviceService := NewDeviceService(db)
+	device, err := deviceService.CreateDevice("A1B2C3D4E5F6", nil, models.DeviceTypeWiFi, project.ID, nil, "Gate")
+	require.NoError(t, err)
+	first, err := deviceService.GetDevice(device.ID)
+	require.NoError(t, err)
+	second, err := deviceService.GetDevice(device.ID)
+	require.NoError(t, err)
+
+	// Heartbeats in between do not invalidate either copy
+	require.NoError(t, deviceService.UpdateDeviceStatus(device.ID, models.DeviceStatusOnline))
+
+	first.DisplayName = "North gate"
+	require.NoError(t, deviceService.UpdateDevice(first))
+	second.Tags = models.StringList{"roof"}
+	preconditionFailed(deviceService.UpdateDevice(second))
+
+	current, err := deviceService.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "North gate", current.DisplayName)
+	assert.Empty(t, current.Tags)
+	assert.Equal(t, models.DeviceStatusOnline, current.Status)
+}
+
+func TestDeviceService_ListDevicePage(t *testing.T) {
+	db := setupTestDB(t)
+	orgService := NewOrganizationService(db, setupTestEnforcer(t, db))
+	deviceService := NewDeviceService(db)
+
+	org, err := orgService.CreateOrganization("test-org", "Test Organization")
+	require.NoError(t, err)
+	project := &models.Project{
+		BaseModel: models.BaseModel{ID: uuid.New()},
+		OrgID:     org.ID,
+		Name:      "Test Project",
+		CreatedBy: uuid.New(),
+	}
+	require.NoError(t, db.Create(project).Error)
+
+	// Seven devices; gw-0 and gw-3 have never been seen, gw-2 and gw-5 share a last seen time
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	seen := []*time.Time{nil, ptrTime(base.Add(3 * time.Hour)), ptrTime(base.Add(time.Hour)), nil,
+		ptrTime(base.Add(2 * time.Hour)), ptrTime(base.Add(time.Hour)), ptrTime(base)}
+	for i, lastSeen := range seen {
+		device, err := deviceService.CreateDevice(fmt.Sprintf("A1B2C3D4E5F%d", i), nil, models.DeviceTypeLTE, project.ID, nil, fmt.Sprintf("gw-%d", i))
+		require.NoError(t, err)
+		require.NoError(t, db.Model(device).Update("last_seen_at", lastSeen).Error)
+	}
+
+	names := func(devices []models.Device) []string {
+		out := []string{}
+		for _, d := range devices {
+			out = append(out, d.DisplayName)
+		}
+		return out
+	}
+
+	// Offset pages report the total across pages
+	page, err := deviceService.ListDevicePage(org.ID, DeviceListOptions{Sort: "-display_name", Page: 2, PageSize: 3})
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), page.Total)
+	assert.Equal(t, []string{"gw-3", "gw-2", "gw-1"}, names(page.Devices))
+
+	// Walking with cursors visits every device once, never-seen devices first
+	var walked []string
+	opts := DeviceListOptions{Sort: "last_seen_at,-display_name", PageSize: 2}
+	for {
+		page, err := deviceService.ListDevicePage(org.ID, opts)
+		require.NoError(t, err)
+		walked = append(walked, names(page.Devices)...)
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	assert.Equal(t, []string{"gw-3", "gw-0", "gw-6", "gw-5", "gw-2", "gw-4", "gw-1"}, walked)
+
+	// Search matches MAC with separators and display names, and filters narrow the total
+	page, err = deviceService.ListDevicePage(org.ID, DeviceListOptions{Search: "e5:f4", PageSize: 10})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gw-4"}, names(page.Devices))
+	page, err = deviceService.ListDevicePage(org.ID, DeviceListOptions{
+		Search:   "GW-",
+		Filters:  map[string]interface{}{"project_id": project.ID},
+		PageSize: 10,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), page.Total)
+	page, err = deviceService.ListDevicePage(org.ID, DeviceListOptions{
+		Filters:  map[string]interface{}{"project_id": uuid.New()},
+		PageSize: 10,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), page.Total)
+	assert.Empty(t, page.Devices)
+
+	// Unknown sort fields and cursors from another sort order are rejected
+	_, err = deviceService.ListDevicePage(org.ID, DeviceListOptions{Sort: "password", PageSize: 10})
+	assert.Error(t, err)
+	first, err := deviceService.ListDevicePage(org.ID, DeviceListOptions{Sort: "mac", PageSize: 2})
+	require.NoError(t, err)
+	_, err = deviceService.ListDevicePage(org.ID, DeviceListOptions{Sort: "-mac", PageSize: 2, Cursor: first.NextCursor})
+	assert.Error(t, err)
+}
+
+func ptrTime(t time.Time) *time.Time {
+	return &t
+}
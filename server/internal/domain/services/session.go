@@ -0,0 +1,75 @@
+package services
+
+import (
+	"time"
+
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// defaultOrgSessionTTL bounds a session whose token carries no expiry
+const defaultOrgSessionTTL = 24 * time.Hour
+
+// OrgSessionService remembers which organization each login session has switched to. Whether
+// the user may work in that organization is decided by the caller.
+type OrgSessionService struct {
+	orgRepo     *store.OrganizationRepository
+	sessionRepo *store.OrgSessionRepository
+}
+
+// NewOrgSessionService creates a new org session service
+func NewOrgSessionService(db *gorm.DB) *OrgSessionService {
+	return &OrgSessionService{
+		orgRepo:     store.NewOrganizationRepository(db),
+		sessionRepo: store.NewOrgSessionRepository(db),
+	}
+}
+
+// ActiveOrg returns the organization the session switched to. ok is false when the session
+// never switched, has expired, or belongs to another user.
+func (s *OrgSessionService) ActiveOrg(tokenHash string, userID uuid.UUID) (orgID uuid.UUID, ok bool) {
+	if tokenHash == "" {
+		return uuid.Nil, false
+	}
+	session, err := s.sessionRepo.Get(tokenHash, time.Now())
+	if err != nil || session.UserID != userID {
+		return uuid.Nil, false
+	}
+	return session.OrgID, true
+}
+
+// Switch makes orgID the active organization of the session until expiresAt. Sessions that
+// have expired meanwhile are cleared out on the way.
+func (s *OrgSessionService) Switch(tokenHash string, userID, orgID uuid.UUID, expiresAt time.Time) (*models.Organization, error) {
+	if tokenHash == "" {
+		return nil, errors.NewBadRequestError("Session has no token")
+	}
+	org, err := s.orgRepo.GetByID(orgID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.NewNotFoundError("Organization not found")
+		}
+		return nil, errors.NewInternalError("Failed to get organization")
+	}
+
+	now := time.Now()
+	if !expiresAt.After(now) {
+		expiresAt = now.Add(defaultOrgSessionTTL)
+	}
+	session := &models.OrgSession{
+		TokenHash: tokenHash,
+		UserID:    userID,
+		OrgID:     orgID,
+		ExpiresAt: expiresAt,
+		UpdatedAt: now,
+	}
+	if err := s.sessionRepo.Save(session); err != nil {
+		return nil, errors.NewInternalError("Failed to switch organization")
+	}
+	_, _ = s.sessionRepo.DeleteExpired(now)
+	return org, nil
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/internal/tenant"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Audit actions written by device sharing
+const (
+	AuditActionDeviceShare   = "device.share"
+	AuditActionDeviceUnshare = "device.unshare"
+)
+
+// DeviceShareService grants and revokes per-device access for users and groups. Every
+// DeviceShare row is mirrored by a (subject, role:device_<role>, device:<id>) grouping.
+type DeviceShareService struct {
+	db        *gorm.DB
+	shareRepo *store.DeviceShareRepository
+	userRepo  *store.UserRepository
+	groupRepo *store.GroupRepository
+	enforcer  *casbinx.Enforcer
+	logger    *zap.Logger
+}
+
+// NewDeviceShareService creates a new device share service
+func NewDeviceShareService(db *gorm.DB, enforcer *casbinx.Enforcer, logger *zap.Logger) *DeviceShareService {
+	return &DeviceShareService{
+		db:        db,
+		shareRepo: store.NewDeviceShareRepository(db),
+		userRepo:  store.NewUserRepository(db),
+		groupRepo: store.NewGroupRepository(db),
+		enforcer:  enforcer,
+		logger:    logger,
+	}
+}
+
+// WithContext returns the service bound to ctx, so its queries run in the tenant scope of ctx
+func (s *DeviceShareService) WithContext(ctx context.Context) *DeviceShareService {
+	return NewDeviceShareService(s.db.WithContext(ctx), s.enforcer, s.logger)
+}
+
+// ListShares lists all shares of a device
+func (s *DeviceShareService) ListShares(deviceID uuid.UUID) ([]models.DeviceShare, error) {
+	shares, err := s.shareRepo.ListByDevice(deviceID)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to list shares")
+	}
+	return shares, nil
+}
+
+// ShareDevice grants a user or group editor/viewer access to a device. Sharing again with
+// the same subject changes its role. Ownership only changes through a transfer.
+//
+// As with transfers, the grouping is written before the row and reverted if the row fails,
+// because the Casbin adapter cannot join an open SQLite write transaction.
+func (s *DeviceShareService) ShareDevice(device *models.Device, actor Actor, subjectType models.SubjectType, subjectID uuid.UUID, role models.DeviceRole) (*models.DeviceShare, error) {
+	if role != models.DeviceRoleEditor && role != models.DeviceRoleViewer {
+		return nil, errors.NewValidationError("Invalid role", map[string]interface{}{
+			"role": "role must be 'editor' or 'viewer'; ownership changes through a transfer",
+		})
+	}
+	subject, err := s.casbinSubject(subjectType, subjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := s.shareRepo.GetByDeviceAndSubject(device.ID, subjectType, subjectID)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, errors.NewInternalError("Failed to share device")
+	}
+	if existing != nil {
+		if existing.Role == models.DeviceRoleOwner {
+			return nil, errors.NewConflictError("Subject already owns the device")
+		}
+		if existing.Role == role {
+			return existing, nil
+		}
+	}
+
+	domain := casbinx.BuildDomain("device", device.ID.String())
+	newRole := casbinx.DeviceRoleName(string(role))
+	if err := s.enforcer.AddDeviceRolePolicies(domain); err != nil {
+		return nil, errors.NewInternalError("Failed to update device permissions")
+	}
+	if _, err := s.enforcer.AddGroupingPolicy(subject, newRole, domain); err != nil {
+		return nil, errors.NewInternalError("Failed to update device permissions")
+	}
+	revert := func() {
+		_, err := s.enforcer.RemoveGroupingPolicy(subject, newRole, domain)
+		logRevertFailure(s.logger, err, "remove", subject, newRole, domain)
+	}
+	if existing != nil {
+		oldRole := casbinx.DeviceRoleName(string(existing.Role))
+		if _, err := s.enforcer.RemoveGroupingPolicy(subject, oldRole, domain); err != nil {
+			revert()
+			return nil, errors.NewInternalError("Failed to update device permissions")
+		}
+		revert = func() {
+			_, err := s.enforcer.RemoveGroupingPolicy(subject, newRole, domain)
+			logRevertFailure(s.logger, err, "remove", subject, newRole, domain)
+			_, err = s.enforcer.AddGroupingPolicy(subject, oldRole, domain)
+			logRevertFailure(s.logger, err, "add", subject, oldRole, domain)
+		}
+	}
+
+	share := existing
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		detail := map[string]interface{}{
+			"subject_type": subjectType,
+			"subject_id":   subjectID,
+			"role":         role,
+		}
+		if share != nil {
+			detail["previous_role"] = share.Role
+			share.Role = role
+			share.GrantedBy = actor.UserID
+			share.GrantedAt = time.Now()
+			if err := tx.Save(share).Error; err != nil {
+				return errors.NewInternalError("Failed to share device")
+			}
+		} else {
+			share = &models.DeviceShare{
+				BaseModel:   models.BaseModel{ID: uuid.New()},
+				DeviceID:    device.ID,
+				SubjectType: subjectType,
+				SubjectID:   subjectID,
+				Role:        role,
+				GrantedBy:   actor.UserID,
+				GrantedAt:   time.Now(),
+			}
+			if err := store.NewDeviceShareRepository(tx).Create(share); err != nil {
+				return errors.NewInternalError("Failed to share device")
+			}
+		}
+		detail["share_id"] = share.ID
+		return writeDeviceAudit(tx, actor, AuditActionDeviceShare, device.ID, detail)
+	})
+	if err != nil {
+		revert()
+		return nil, err
+	}
+	return share, nil
+}
+
+// UnshareDevice revokes a share. The owner share cannot be revoked.
+func (s *DeviceShareService) UnshareDevice(device *models.Device, actor Actor, shareID uuid.UUID) error {
+	share, err := s.shareRepo.GetByID(shareID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return errors.NewNotFoundError("Share not found")
+		}
+		return errors.NewInternalError("Failed to get share")
+	}
+	if share.DeviceID != device.ID {
+		return errors.NewNotFoundError("Share not found")
+	}
+	if share.Role == models.DeviceRoleOwner {
+		return errors.NewConflictError("The owner share cannot be removed; transfer the device instead")
+	}
+	subject, err := s.casbinSubject(share.SubjectType, share.SubjectID)
+	if err != nil {
+		return err
+	}
+
+	domain := casbinx.BuildDomain("device", device.ID.String())
+	role := casbinx.DeviceRoleName(string(share.Role))
+	if _, err := s.enforcer.RemoveGroupingPolicy(subject, role, domain); err != nil {
+		return errors.NewInternalError("Failed to update device permissions")
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := store.NewDeviceShareRepository(tx).Delete(share.ID); err != nil {
+			return errors.NewInternalError("Failed to remove share")
+		}
+		return writeDeviceAudit(tx, actor, AuditActionDeviceUnshare, device.ID, map[string]interface{}{
+			"share_id":     share.ID,
+			"subject_type": share.SubjectType,
+			"subject_id":   share.SubjectID,
+			"role":         share.Role,
+		})
+	})
+	if err != nil {
+		_, rerr := s.enforcer.AddGroupingPolicy(subject, role, domain)
+		logRevertFailure(s.logger, rerr, "add", subject, role, domain)
+		return err
+	}
+	return nil
+}
+
+// casbinSubject maps a share subject to its Casbin subject: the user ID for users and
+// group:<casdoor group id> for groups, matching the groups carried in user tokens. Users
+// and groups outside the service's scope are not found.
+func (s *DeviceShareService) casbinSubject(subjectType models.SubjectType, subjectID uuid.UUID) (string, error) {
+	if subjectID == uuid.Nil {
+		return "", errors.NewValidationError("Invalid subject", map[string]interface{}{"subject_id": "required"})
+	}
+	switch subjectType {
+	case models.SubjectTypeUser:
+		user, err := s.userRepo.GetByID(subjectID)
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return "", errors.NewNotFoundError("User not found")
+			}
+			return "", errors.NewInternalError("Failed to get user")
+		}
+		return user.ID.String(), nil
+	case models.SubjectTypeGroup:
+		group, err := s.groupRepo.GetByID(subjectID)
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return "", errors.NewNotFoundError("Group not found")
+			}
+			return "", errors.NewInternalError("Failed to get group")
+		}
+		return casbinx.GroupSubject(group.CasdoorGroupID), nil
+	default:
+		return "", errors.NewValidationError("Invalid subject type", map[string]interface{}{
+			"subject_type": "subject_type must be 'user' or 'group'",
+		})
+	}
+}
+
+func writeDeviceAudit(tx *gorm.DB, actor Actor, action string, deviceID uuid.UUID, detail map[string]interface{}) error {
+	rec := newAuditLog(actor, action, "device", &deviceID, detail)
+	// The record belongs to the device's organization, which may lie outside the actor's
+	// scope, as for a factory device being claimed
+	if err := store.NewAuditLogRepository(tx).Insert(tenant.Bypass(tx.Statement.Context), rec); err != nil {
+		return errors.NewInternalError("Failed to write audit log")
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDeviceShareService_ShareAndUnshare(t *testing.T) {
+	db := setupTestDB(t)
+	enforcer, err := casbinx.New(db)
+	require.NoError(t, err)
+	service := NewDeviceShareService(db, enforcer, zap.NewNop())
+
+	project := setupTestProject(t, db)
+	device, err := NewDeviceService(db).CreateDevice("AA:BB:CC:DD:EE:10", nil, models.DeviceTypeWiFi, project.ID, nil, "Gateway")
+	require.NoError(t, err)
+	domain := casbinx.BuildDomain("device", device.ID.String())
+
+	group := &models.Group{
+		BaseModel:      models.BaseModel{ID: uuid.New()},
+		CasdoorGroupID: "acme/contractors",
+		Name:           "Contractors",
+		OrgID:          project.OrgID,
+	}
+	require.NoError(t, db.Create(group).Error)
+
+	actor := Actor{UserID: uuid.New()}
+	contractor := setupTestUser(t, db, project.OrgID).UserID
+
+	// Owner shares go through transfers, unknown users and groups are rejected
+	_, err = service.ShareDevice(device, actor, models.SubjectTypeUser, contractor, models.DeviceRoleOwner)
+	assert.Error(t, err)
+	for _, subjectType := range []models.SubjectType{models.SubjectTypeUser, models.SubjectTypeGroup} {
+		_, err = service.ShareDevice(device, actor, subjectType, uuid.New(), models.DeviceRoleViewer)
+		appErr, ok := err.(*errors.AppError)
+		require.True(t, ok)
+		assert.Equal(t, http.StatusNotFound, appErr.HTTPStatus)
+	}
+
+	userShare, err := service.ShareDevice(device, actor, models.SubjectTypeUser, contractor, models.DeviceRoleViewer)
+	require.NoError(t, err)
+	allowed, err := enforcer.Enforce(contractor.String(), domain, "devices", "read")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = enforcer.Enforce(contractor.String(), domain, "devices", "write")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	// Re-sharing changes the role of the existing share
+	updated, err := service.ShareDevice(device, actor, models.SubjectTypeUser, contractor, models.DeviceRoleEditor)
+	require.NoError(t, err)
+	assert.Equal(t, userShare.ID, updated.ID)
+	allowed, err = enforcer.Enforce(contractor.String(), domain, "devices", "write")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Empty(t, enforcer.GetUsersForRole(casbinx.DeviceRoleName("viewer"), domain))
+
+	_, err = service.ShareDevice(device, actor, models.SubjectTypeGroup, group.ID, models.DeviceRoleViewer)
+	require.NoError(t, err)
+	allowed, err = enforcer.Enforce(casbinx.GroupSubject(group.CasdoorGroupID), domain, "devices", "read")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	// Shares do not leak to other devices
+	allowed, err = enforcer.Enforce(contractor.String(), casbinx.BuildDomain("device", uuid.NewString()), "devices", "read")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	shares, err := service.ListShares(device.ID)
+	require.NoError(t, err)
+	assert.Len(t, shares, 2)
+
+	require.NoError(t, service.UnshareDevice(device, actor, userShare.ID))
+	allowed, err = enforcer.Enforce(contractor.String(), domain, "devices", "read")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	shares, err = service.ListShares(device.ID)
+	require.NoError(t, err)
+	assert.Len(t, shares, 1)
+
+	var audits int64
+	require.NoError(t, db.Model(&models.AuditLog{}).Where("target_id = ?", device.ID).Count(&audits).Error)
+	assert.Equal(t, int64(4), audits)
+}
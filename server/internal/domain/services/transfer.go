@@ -0,0 +1,310 @@
+package services
+
+import (
+	"context"
+
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/internal/tenant"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Audit actions written by the transfer workflow
+const (
+	AuditActionTransferRequest = "device.transfer.request"
+	AuditActionTransferApprove = "device.transfer.approve"
+	AuditActionTransferReject  = "device.transfer.reject"
+	AuditActionTransferCancel  = "device.transfer.cancel"
+)
+
+// DeviceTransferService handles the device ownership transfer workflow
+type DeviceTransferService struct {
+	db           *gorm.DB
+	transferRepo *store.DeviceTransferRepository
+	enforcer     *casbinx.Enforcer
+	logger       *zap.Logger
+}
+
+// NewDeviceTransferService creates a new device transfer service
+func NewDeviceTransferService(db *gorm.DB, enforcer *casbinx.Enforcer, logger *zap.Logger) *DeviceTransferService {
+	return &DeviceTransferService{
+		db:           db,
+		transferRepo: store.NewDeviceTransferRepository(db),
+		enforcer:     enforcer,
+		logger:       logger,
+	}
+}
+
+// WithContext returns the service bound to ctx, so its queries run in the tenant scope of ctx
+func (s *DeviceTransferService) WithContext(ctx context.Context) *DeviceTransferService {
+	return NewDeviceTransferService(s.db.WithContext(ctx), s.enforcer, s.logger)
+}
+
+// RequestTransfer creates a pending transfer of a device from the actor to another user. The
+// recipient may belong to any organization, as when a site is handed over to the facility
+// manager's company, but must be an existing user.
+func (s *DeviceTransferService) RequestTransfer(device *models.Device, actor Actor, toUserID uuid.UUID) (*models.DeviceTransfer, error) {
+	if toUserID == uuid.Nil {
+		return nil, errors.NewValidationError("Invalid recipient", map[string]interface{}{"to_user_id": "required"})
+	}
+	if toUserID == actor.UserID {
+		return nil, errors.NewBadRequestError("Cannot transfer a device to yourself")
+	}
+
+	var transfer *models.DeviceTransfer
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Recipients are looked up across organizations; only their ID goes into the transfer
+		users := store.NewUserRepository(tx.WithContext(tenant.Bypass(tx.Statement.Context)))
+		if _, err := users.GetByID(toUserID); err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return errors.NewNotFoundError("Recipient not found")
+			}
+			return errors.NewInternalError("Failed to get recipient")
+		}
+
+		repo := store.NewDeviceTransferRepository(tx)
+		if _, err := repo.GetPendingByDevice(device.ID); err == nil {
+			return errors.NewConflictError("Device already has a pending transfer")
+		} else if err != gorm.ErrRecordNotFound {
+			return errors.NewInternalError("Failed to create transfer")
+		}
+
+		transfer = &models.DeviceTransfer{
+			BaseModel:     models.BaseModel{ID: uuid.New()},
+			DeviceID:      device.ID,
+			FromSubjectID: actor.UserID,
+			ToSubjectID:   toUserID,
+			Status:        models.TransferStatusPending,
+		}
+		if err := repo.Create(transfer); err != nil {
+			return errors.NewInternalError("Failed to create transfer")
+		}
+		return writeTransferAudit(tx, actor, AuditActionTransferRequest, transfer, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transfer, nil
+}
+
+// GetTransfer returns a transfer by ID
+func (s *DeviceTransferService) GetTransfer(id uuid.UUID) (*models.DeviceTransfer, error) {
+	transfer, err := s.transferRepo.GetByID(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.NewNotFoundError("Transfer not found")
+		}
+		return nil, errors.NewInternalError("Failed to get transfer")
+	}
+	return transfer, nil
+}
+
+// ListTransfers lists transfers sent (outgoing) or received (incoming) by a user
+func (s *DeviceTransferService) ListTransfers(userID uuid.UUID, outgoing bool, status models.TransferStatus) ([]models.DeviceTransfer, error) {
+	transfers, err := s.transferRepo.ListBySubject(userID, outgoing, status)
+	if err != nil {
+		return nil, errors.NewInternalError("Failed to list transfers")
+	}
+	return transfers, nil
+}
+
+// ApproveTransfer completes a pending transfer on behalf of its recipient. The owner share row
+// and the device_owner grouping move to the recipient, and the device moves into projectID.
+// The editor and viewer shares the previous owner handed out end with the handover, along
+// with their groupings; the recipient shares the device anew if they want to.
+// The project is checked in the service's scope, the recipient's; the device's rows are
+// then updated across organizations, since the device still sits in the sender's. A device
+// changed while the transfer is approved is left alone with 412.
+//
+// The Casbin adapter writes through its own connection, which would block behind an open
+// SQLite write transaction, so the grouping is swapped first and restored if the rows fail.
+func (s *DeviceTransferService) ApproveTransfer(id uuid.UUID, actor Actor, projectID uuid.UUID, partitionID *uuid.UUID) (*models.DeviceTransfer, error) {
+	transfer, err := s.loadPending(s.db, id)
+	if err != nil {
+		return nil, err
+	}
+	if transfer.ToSubjectID != actor.UserID {
+		return nil, errors.NewForbiddenError("Only the recipient can approve a transfer")
+	}
+	if err := validatePlacement(s.db, projectID, partitionID); err != nil {
+		return nil, err
+	}
+
+	handover := s.db.WithContext(tenant.Bypass(s.db.Statement.Context))
+	device, err := store.NewDeviceRepository(handover).GetByID(transfer.DeviceID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.NewNotFoundError("Device not found")
+		}
+		return nil, errors.NewInternalError("Failed to get device")
+	}
+
+	domain := casbinx.BuildDomain("device", transfer.DeviceID.String())
+	owner := casbinx.DeviceRoleName(string(models.DeviceRoleOwner))
+	recipient := transfer.ToSubjectID.String()
+	previous := s.enforcer.GetFilteredGroupingPolicy(2, domain)
+	if err := s.enforcer.AddDeviceRolePolicies(domain); err != nil {
+		return nil, errors.NewInternalError("Failed to update device permissions")
+	}
+	if len(previous) > 0 {
+		if _, err := s.enforcer.RemoveFilteredGroupingPolicy(2, domain); err != nil {
+			return nil, errors.NewInternalError("Failed to update device permissions")
+		}
+	}
+	if _, err := s.enforcer.AddGroupingPolicy(recipient, owner, domain); err != nil {
+		s.restoreGroupings(domain, previous, recipient, owner)
+		return nil, errors.NewInternalError("Failed to update device permissions")
+	}
+
+	err = handover.Transaction(func(tx *gorm.DB) error {
+		ok, err := store.NewDeviceTransferRepository(tx).UpdateStatus(transfer, models.TransferStatusApproved)
+		if err != nil {
+			return errors.NewInternalError("Failed to approve transfer")
+		}
+		if !ok {
+			return errors.NewConflictError("Transfer is no longer pending")
+		}
+
+		shareRepo := store.NewDeviceShareRepository(tx)
+		if err := shareRepo.DeleteByDevice(transfer.DeviceID); err != nil {
+			return errors.NewInternalError("Failed to approve transfer")
+		}
+		share := &models.DeviceShare{
+			BaseModel:   models.BaseModel{ID: uuid.New()},
+			DeviceID:    transfer.DeviceID,
+			SubjectType: models.SubjectTypeUser,
+			SubjectID:   transfer.ToSubjectID,
+			Role:        models.DeviceRoleOwner,
+			GrantedBy:   transfer.FromSubjectID,
+			GrantedAt:   *transfer.ProcessedAt,
+		}
+		if err := shareRepo.Create(share); err != nil {
+			return errors.NewInternalError("Failed to approve transfer")
+		}
+
+		if err := store.NewDeviceRepository(tx).UpdatePlacement(device.ID, device.Version, projectID, partitionID); err != nil {
+			if err == store.ErrVersionConflict {
+				return errors.NewPreconditionFailedError("Device was modified concurrently")
+			}
+			return errors.NewInternalError("Failed to move device")
+		}
+
+		detail := map[string]interface{}{"project_id": projectID, "partition_id": partitionID}
+		return writeTransferAudit(tx, actor, AuditActionTransferApprove, transfer, detail)
+	})
+	if err != nil {
+		s.restoreGroupings(domain, previous, recipient, owner)
+		return nil, err
+	}
+	return transfer, nil
+}
+
+// validatePlacement checks that the project exists and the partition, if any, belongs to it
+func validatePlacement(db *gorm.DB, projectID uuid.UUID, partitionID *uuid.UUID) error {
+	if _, err := store.NewProjectRepository(db).GetByID(projectID); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return errors.NewNotFoundError("Project not found")
+		}
+		return errors.NewInternalError("Failed to get project")
+	}
+	if partitionID == nil {
+		return nil
+	}
+	partition, err := store.NewPartitionRepository(db).GetByID(*partitionID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return errors.NewNotFoundError("Partition not found")
+		}
+		return errors.NewInternalError("Failed to get partition")
+	}
+	if partition.ProjectID != projectID {
+		return errors.NewBadRequestError("Partition belongs to another project")
+	}
+	return nil
+}
+
+// RejectTransfer declines a pending transfer on behalf of its recipient
+func (s *DeviceTransferService) RejectTransfer(id uuid.UUID, actor Actor) (*models.DeviceTransfer, error) {
+	return s.closeTransfer(id, actor, models.TransferStatusRejected)
+}
+
+// CancelTransfer withdraws a pending transfer on behalf of its sender
+func (s *DeviceTransferService) CancelTransfer(id uuid.UUID, actor Actor) (*models.DeviceTransfer, error) {
+	return s.closeTransfer(id, actor, models.TransferStatusCancelled)
+}
+
+func (s *DeviceTransferService) closeTransfer(id uuid.UUID, actor Actor, status models.TransferStatus) (*models.DeviceTransfer, error) {
+	var transfer *models.DeviceTransfer
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		transfer, err = s.loadPending(tx, id)
+		if err != nil {
+			return err
+		}
+
+		action := AuditActionTransferReject
+		if status == models.TransferStatusCancelled {
+			action = AuditActionTransferCancel
+			if transfer.FromSubjectID != actor.UserID {
+				return errors.NewForbiddenError("Only the sender can cancel a transfer")
+			}
+		} else if transfer.ToSubjectID != actor.UserID {
+			return errors.NewForbiddenError("Only the recipient can reject a transfer")
+		}
+
+		ok, err := store.NewDeviceTransferRepository(tx).UpdateStatus(transfer, status)
+		if err != nil {
+			return errors.NewInternalError("Failed to update transfer")
+		}
+		if !ok {
+			return errors.NewConflictError("Transfer is no longer pending")
+		}
+		return writeTransferAudit(tx, actor, action, transfer, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transfer, nil
+}
+
+func (s *DeviceTransferService) loadPending(tx *gorm.DB, id uuid.UUID) (*models.DeviceTransfer, error) {
+	transfer, err := store.NewDeviceTransferRepository(tx).GetByID(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.NewNotFoundError("Transfer not found")
+		}
+		return nil, errors.NewInternalError("Failed to get transfer")
+	}
+	if transfer.Status != models.TransferStatusPending {
+		return nil, errors.NewConflictError("Transfer is no longer pending")
+	}
+	return transfer, nil
+}
+
+// restoreGroupings puts back the groupings replaced by a failed approval
+func (s *DeviceTransferService) restoreGroupings(domain string, previous [][]string, added, owner string) {
+	_, err := s.enforcer.RemoveGroupingPolicy(added, owner, domain)
+	logRevertFailure(s.logger, err, "remove", added, owner, domain)
+	for _, g := range previous {
+		_, err := s.enforcer.AddGroupingPolicy(g[0], g[1], g[2])
+		logRevertFailure(s.logger, err, "add", g[0], g[1], domain)
+	}
+}
+
+func writeTransferAudit(tx *gorm.DB, actor Actor, action string, transfer *models.DeviceTransfer, extra map[string]interface{}) error {
+	detail := map[string]interface{}{
+		"transfer_id":     transfer.ID,
+		"from_subject_id": transfer.FromSubjectID,
+		"to_subject_id":   transfer.ToSubjectID,
+		"status":          transfer.Status,
+	}
+	for k, v := range extra {
+		detail[k] = v
+	}
+	return writeDeviceAudit(tx, actor, action, transfer.DeviceID, detail)
+}
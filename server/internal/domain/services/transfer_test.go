@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"server/internal/casbinx"
+	"server/internal/domain/models"
+	"server/internal/store"
+	"server/internal/tenant"
+	"server/pkg/errors"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// setupTestUser creates a local user in orgID and returns it as an actor
+func setupTestUser(t *testing.T, db *gorm.DB, orgID uuid.UUID) Actor {
+	id := uuid.New()
+	user := &models.User{BaseModel: models.BaseModel{ID: id}, CasdoorUserID: "u-" + id.String(), Username: "user-" + id.String(), OrgID: orgID}
+	require.NoError(t, db.Create(user).Error)
+	return Actor{UserID: id}
+}
+
+func TestDeviceTransferService_Approve(t *testing.T) {
+	db := setupTestDB(t)
+	enforcer, err := casbinx.New(db)
+	require.NoError(t, err)
+	service := NewDeviceTransferService(db, enforcer, zap.NewNop())
+
+	source := setupTestProject(t, db)
+	target := setupTestProject(t, db)
+	room, err := NewPartitionService(db).CreatePartition(target.ID, nil, "Lobby")
+	require.NoError(t, err)
+
+	device, err := NewDeviceService(db).CreateDevice("AA:BB:CC:DD:EE:01", nil, models.DeviceTypeWiFi, source.ID, nil, "Lamp")
+	require.NoError(t, err)
+
+	sender := setupTestUser(t, db, source.OrgID)
+	recipient := setupTestUser(t, db, source.OrgID)
+	owner := casbinx.DeviceRoleName(string(models.DeviceRoleOwner))
+	domain := casbinx.BuildDomain("device", device.ID.String())
+	_, err = enforcer.AddGroupingPolicy(sender.UserID.String(), owner, domain)
+	require.NoError(t, err)
+
+	// Self-transfers and unknown recipients are rejected
+	_, err = service.RequestTransfer(device, sender, sender.UserID)
+	assert.Error(t, err)
+	_, err = service.RequestTransfer(device, sender, uuid.New())
+	appErr, ok := err.(*errors.AppError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, appErr.HTTPStatus)
+
+	transfer, err := service.RequestTransfer(device, sender, recipient.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, models.TransferStatusPending, transfer.Status)
+
+	// Only one pending transfer per device
+	_, err = service.RequestTransfer(device, sender, setupTestUser(t, db, source.OrgID).UserID)
+	assert.Error(t, err)
+
+	// Only the recipient may approve, and the partition must be in the chosen project
+	_, err = service.ApproveTransfer(transfer.ID, sender, target.ID, nil)
+	assert.Error(t, err)
+	_, err = service.ApproveTransfer(transfer.ID, recipient, source.ID, &room.ID)
+	assert.Error(t, err)
+
+	// The sender's contractor loses access with the handover
+	contractor := setupTestUser(t, db, source.OrgID).UserID
+	_, err = NewDeviceShareService(db, enforcer, zap.NewNop()).ShareDevice(device, sender, models.SubjectTypeUser, contractor, models.DeviceRoleEditor)
+	require.NoError(t, err)
+
+	approved, err := service.ApproveTransfer(transfer.ID, recipient, target.ID, &room.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.TransferStatusApproved, approved.Status)
+	assert.NotNil(t, approved.ProcessedAt)
+
+	var moved models.Device
+	require.NoError(t, db.First(&moved, "id = ?", device.ID).Error)
+	assert.Equal(t, target.ID, moved.ProjectID)
+	require.NotNil(t, moved.PartitionID)
+	assert.Equal(t, room.ID, *moved.PartitionID)
+
+	var shares []models.DeviceShare
+	require.NoError(t, db.Where("device_id = ?", device.ID).Find(&shares).Error)
+	require.Len(t, shares, 1)
+	assert.Equal(t, recipient.UserID, shares[0].SubjectID)
+	assert.Equal(t, models.DeviceRoleOwner, shares[0].Role)
+
+	assert.Equal(t, []string{recipient.UserID.String()}, enforcer.GetUsersForRole(owner, domain))
+	allowed, err := enforcer.Enforce(contractor.String(), domain, "devices", "write")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	var audits int64
+	require.NoError(t, db.Model(&models.AuditLog{}).Where("target_id = ?", device.ID).Count(&audits).Error)
+	assert.Equal(t, int64(3), audits)
+
+	// A processed transfer cannot be approved again
+	_, err = service.ApproveTransfer(transfer.ID, recipient, target.ID, nil)
+	assert.Error(t, err)
+}
+
+func TestDeviceTransferService_AcrossOrganizations(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, store.RegisterTenantScope(db))
+	enforcer, err := casbinx.New(db)
+	require.NoError(t, err)
+	system := db.WithContext(tenant.Bypass(context.Background()))
+
+	// An installer hands a site over to the facility manager's own organization
+	installer := setupTestProject(t, system)
+	facility := setupTestProject(t, system)
+	device, err := NewDeviceService(system).CreateDevice("AA:BB:CC:DD:EE:03", nil, models.DeviceTypeWiFi, installer.ID, nil, "Boiler")
+	require.NoError(t, err)
+	sender := setupTestUser(t, system, installer.OrgID)
+	recipient := setupTestUser(t, system, facility.OrgID)
+
+	service := NewDeviceTransferService(db, enforcer, zap.NewNop())
+	transfer, err := service.WithContext(tenant.WithOrg(context.Background(), installer.OrgID)).RequestTransfer(device, sender, recipient.UserID)
+	require.NoError(t, err)
+
+	// The recipient places the device in a project of their own organization only
+	incoming := service.WithContext(tenant.WithOrg(context.Background(), facility.OrgID))
+	_, err = incoming.ApproveTransfer(transfer.ID, recipient, installer.ID, nil)
+	appErr, ok := err.(*errors.AppError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, appErr.HTTPStatus)
+
+	_, err = incoming.ApproveTransfer(transfer.ID, recipient, facility.ID, nil)
+	require.NoError(t, err)
+
+	var moved models.Device
+	require.NoError(t, system.First(&moved, "id = ?", device.ID).Error)
+	assert.Equal(t, facility.ID, moved.ProjectID)
+	var shares []models.DeviceShare
+	require.NoError(t, db.WithContext(tenant.WithOrg(context.Background(), facility.OrgID)).Where("device_id = ?", device.ID).Find(&shares).Error)
+	require.Len(t, shares, 1)
+	assert.Equal(t, recipient.UserID, shares[0].SubjectID)
+}
+
+func TestDeviceTransferService_RejectCancel(t *testing.T) {
+	db := setupTestDB(t)
+	enforcer, err := casbinx.New(db)
+	require.NoError(t, err)
+	service := NewDeviceTransferService(db, enforcer, zap.NewNop())
+
+	project := setupTestProject(t, db)
+	device, err := NewDeviceService(db).CreateDevice("AA:BB:CC:DD:EE:02", nil, models.DeviceTypeWiFi, project.ID, nil, "Lamp")
+	require.NoError(t, err)
+
+	sender := setupTestUser(t, db, project.OrgID)
+	recipient := setupTestUser(t, db, project.OrgID)
+
+	transfer, err := service.RequestTransfer(device, sender, recipient.UserID)
+	require.NoError(t, err)
+
+	// The sender cannot reject and the recipient cannot cancel
+	_, err = service.RejectTransfer(transfer.ID, sender)
+	assert.Error(t, err)
+	_, err = service.CancelTransfer(transfer.ID, recipient)
+	assert.Error(t, err)
+
+	rejected, err := service.RejectTransfer(transfer.ID, recipient)
+	require.NoError(t, err)
+	assert.Equal(t, models.TransferStatusRejected, rejected.Status)
+
+	// A new request is allowed once the previous one is closed
+	transfer, err = service.RequestTransfer(device, sender, recipient.UserID)
+	require.NoError(t, err)
+	cancelled, err := service.CancelTransfer(transfer.ID, sender)
+	require.NoError(t, err)
+	assert.Equal(t, models.TransferStatusCancelled, cancelled.Status)
+
+	incoming, err := service.ListTransfers(recipient.UserID, false, "")
+	require.NoError(t, err)
+	assert.Len(t, incoming, 2)
+	outgoing, err := service.ListTransfers(sender.UserID, true, models.TransferStatusCancelled)
+	require.NoError(t, err)
+	assert.Len(t, outgoing, 1)
+}
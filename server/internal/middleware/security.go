@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -31,6 +33,56 @@ func RateLimitMiddleware() gin.HandlerFunc {
 	}
 }
 
+// KeyedRateLimitMiddleware limits each key, such as a user or client IP, to burst requests
+// and one more every interval after that. Keys idle long enough to have a full burst again
+// are forgotten.
+func KeyedRateLimitMiddleware(interval time.Duration, burst int, key func(c *gin.Context) string) gin.HandlerFunc {
+	type entry struct {
+		limiter  *rate.Limiter
+		lastSeen time.Time
+	}
+	var mu sync.Mutex
+	entries := make(map[string]*entry)
+	idle := interval * time.Duration(burst)
+	lastSweep := time.Now()
+
+	return func(c *gin.Context) {
+		k := key(c)
+		now := time.Now()
+		mu.Lock()
+		if now.Sub(lastSweep) > idle {
+			for id, e := range entries {
+				if now.Sub(e.lastSeen) > idle {
+					delete(entries, id)
+				}
+			}
+			lastSweep = now
+		}
+		e, ok := entries[k]
+		if !ok {
+			e = &entry{limiter: rate.NewLimiter(rate.Every(interval), burst)}
+			entries[k] = e
+		}
+		e.lastSeen = now
+		allowed := e.limiter.AllowN(now, 1)
+		mu.Unlock()
+
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(interval.Round(time.Second)/time.Second)))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error": gin.H{
+					"code":        "RATE_LIMIT_EXCEEDED",
+					"message":     "Too many requests",
+					"retry_after": interval.Round(time.Second).String(),
+				},
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
 // SecurityHeadersMiddleware adds security headers
 func SecurityHeadersMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
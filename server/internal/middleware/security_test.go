@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -54,3 +55,35 @@ func TestRateLimitMiddleware(t *testing.T) {
 		t.Fatalf("expected 200, got %d", w.Code)
 	}
 }
+
+func TestKeyedRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(KeyedRateLimitMiddleware(time.Hour, 2, func(c *gin.Context) string { return c.GetHeader("X-User") }))
+	r.POST("/claim", func(c *gin.Context) { c.String(200, "ok") })
+
+	do := func(user string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/claim", nil)
+		req.Header.Set("X-User", user)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := do("alice"); w.Code != 200 {
+			t.Fatalf("request %d: expected 200, got %d", i, w.Code)
+		}
+	}
+	w := do("alice")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 after the burst, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "3600" {
+		t.Fatalf("expected Retry-After 3600, got %q", w.Header().Get("Retry-After"))
+	}
+
+	// Other keys have their own budget
+	if w := do("bob"); w.Code != 200 {
+		t.Fatalf("expected 200 for another key, got %d", w.Code)
+	}
+}
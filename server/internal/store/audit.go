@@ -0,0 +1,195 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// AuditLogRepository handles audit log records
+type AuditLogRepository struct{ db *gorm.DB }
+
+func NewAuditLogRepository(db *gorm.DB) *AuditLogRepository { return &AuditLogRepository{db: db} }
+
+// AuditLogQuery filters audit log records. Action matches exactly, or as a prefix when it
+// ends in "*". From is inclusive and To exclusive.
+type AuditLogQuery struct {
+	OrgID      *uuid.UUID
+	Actor      *uuid.UUID
+	Action     string
+	TargetType string
+	TargetID   *uuid.UUID
+	From       *time.Time
+	To         *time.Time
+	Limit      int
+	Offset     int
+}
+
+// PurgeBatch permanently deletes up to limit records created before cutoff, oldest first, and
+// returns how many were deleted. Small batches keep each statement's locks short.
+func (r *AuditLogRepository) PurgeBatch(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	batch := r.db.Unscoped().Model(&models.AuditLog{}).Select("id").
+		Where("created_at < ?", cutoff).Order("created_at").Limit(limit)
+	res := r.db.WithContext(ctx).Unscoped().Where("id IN (?)", batch).Delete(&models.AuditLog{})
+	return res.RowsAffected, res.Error
+}
+
+// Insert writes a record, scoping it to the organization owning its target, or to the
+// actor's organization when the target has none, unless OrgID is already set
+func (r *AuditLogRepository) Insert(ctx context.Context, rec *models.AuditLog) error {
+	db := r.db.WithContext(ctx)
+	if rec.OrgID == nil {
+		orgID, err := auditOrgID(db, rec)
+		if err != nil {
+			return err
+		}
+		rec.OrgID = orgID
+	}
+	return db.Create(rec).Error
+}
+
+// List returns one page of matching records, newest first, and the total number of matches
+func (r *AuditLogRepository) List(ctx context.Context, q AuditLogQuery) ([]models.AuditLog, int64, error) {
+	query := applyAuditFilters(r.db.WithContext(ctx).Model(&models.AuditLog{}), q)
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var logs []models.AuditLog
+	err := query.Order("created_at DESC").Order("id DESC").
+		Offset(q.Offset).Limit(q.Limit).Find(&logs).Error
+	return logs, total, err
+}
+
+// Each calls fn for every matching record, oldest first, reading rows as they are needed
+// so exports do not hold the whole result in memory. Limit and Offset are ignored.
+func (r *AuditLogRepository) Each(ctx context.Context, q AuditLogQuery, fn func(*models.AuditLog) error) error {
+	db := r.db.WithContext(ctx)
+	rows, err := applyAuditFilters(db.Model(&models.AuditLog{}), q).
+		Order("created_at ASC").Order("id ASC").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec models.AuditLog
+		if err := db.ScanRows(rows, &rec); err != nil {
+			return err
+		}
+		if err := fn(&rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func applyAuditFilters(query *gorm.DB, q AuditLogQuery) *gorm.DB {
+	if q.OrgID != nil {
+		query = query.Where("org_id = ?", *q.OrgID)
+	}
+	if q.Actor != nil {
+		query = query.Where("actor = ?", *q.Actor)
+	}
+	if prefix, ok := strings.CutSuffix(q.Action, "*"); ok {
+		query = query.Where(`action LIKE ? ESCAPE '\'`, likeEscaper.Replace(prefix)+"%")
+	} else if q.Action != "" {
+		query = query.Where("action = ?", q.Action)
+	}
+	if q.TargetType != "" {
+		query = query.Where("target_type = ?", q.TargetType)
+	}
+	if q.TargetID != nil {
+		query = query.Where("target_id = ?", *q.TargetID)
+	}
+	if q.From != nil {
+		query = query.Where("created_at >= ?", *q.From)
+	}
+	if q.To != nil {
+		query = query.Where("created_at < ?", *q.To)
+	}
+	return query
+}
+
+// auditOrgID resolves the organization owning an audit record's target, falling back to the
+// actor's organization. Soft-deleted rows still count, so deletions are scoped too.
+func auditOrgID(db *gorm.DB, rec *models.AuditLog) (*uuid.UUID, error) {
+	var ids []uuid.UUID
+	if rec.TargetID != nil {
+		var query *gorm.DB
+		switch rec.TargetType {
+		case "organization":
+			id := *rec.TargetID
+			return &id, nil
+		case "project":
+			query = db.Table("projects").Select("org_id").Where("id = ?", *rec.TargetID)
+		case "partition":
+			query = db.Table("partitions").Select("projects.org_id").
+				Joins("JOIN projects ON projects.id = partitions.project_id").
+				Where("partitions.id = ?", *rec.TargetID)
+		case "device":
+			query = db.Table("devices").Select("projects.org_id").
+				Joins("JOIN projects ON projects.id = devices.project_id").
+				Where("devices.id = ?", *rec.TargetID)
+		case "user":
+			query = db.Table("users").Select("org_id").Where("id = ?", *rec.TargetID)
+		case "group":
+			query = db.Table("groups").Select("org_id").Where("id = ?", *rec.TargetID)
+		}
+		if query != nil {
+			if err := query.Limit(1).Pluck("org_id", &ids).Error; err != nil {
+				return nil, err
+			}
+			if len(ids) > 0 {
+				return &ids[0], nil
+			}
+		}
+	}
+
+	if rec.Actor == uuid.Nil {
+		return nil, nil
+	}
+	if err := db.Table("users").Select("org_id").Where("id = ?", rec.Actor).Limit(1).Pluck("org_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		return &ids[0], nil
+	}
+	return nil, nil
+}
+
+// AuditPurgeRunRepository handles audit retention run records
+type AuditPurgeRunRepository struct{ db *gorm.DB }
+
+func NewAuditPurgeRunRepository(db *gorm.DB) *AuditPurgeRunRepository {
+	return &AuditPurgeRunRepository{db: db}
+}
+
+// Save creates or updates a run
+func (r *AuditPurgeRunRepository) Save(run *models.AuditPurgeRun) error {
+	return r.db.Save(run).Error
+}
+
+// ListRecent lists the most recent runs
+func (r *AuditPurgeRunRepository) ListRecent(limit int) ([]models.AuditPurgeRun, error) {
+	var runs []models.AuditPurgeRun
+	err := r.db.Order("started_at DESC").Limit(limit).Find(&runs).Error
+	return runs, err
+}
+
+// Latest returns the most recent run with the given trigger
+func (r *AuditPurgeRunRepository) Latest(trigger string) (*models.AuditPurgeRun, error) {
+	var run models.AuditPurgeRun
+	err := r.db.Where(&models.AuditPurgeRun{Trigger: trigger}).Order("started_at DESC").First(&run).Error
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DeviceBindingRepository handles device binding data operations
+type DeviceBindingRepository struct {
+	db *gorm.DB
+}
+
+// NewDeviceBindingRepository creates a new device binding repository
+func NewDeviceBindingRepository(db *gorm.DB) *DeviceBindingRepository {
+	return &DeviceBindingRepository{db: db}
+}
+
+// Create creates a new device binding
+func (r *DeviceBindingRepository) Create(binding *models.DeviceBinding) error {
+	return r.db.Create(binding).Error
+}
+
+// GetByDevice gets the current binding of a device
+func (r *DeviceBindingRepository) GetByDevice(deviceID uuid.UUID) (*models.DeviceBinding, error) {
+	var binding models.DeviceBinding
+	err := r.db.Where("device_id = ?", deviceID).Order("bound_at DESC").First(&binding).Error
+	if err != nil {
+		return nil, err
+	}
+	return &binding, nil
+}
+
+// ListByDevices lists the current bindings of the devices
+func (r *DeviceBindingRepository) ListByDevices(deviceIDs []uuid.UUID) ([]models.DeviceBinding, error) {
+	var bindings []models.DeviceBinding
+	if len(deviceIDs) == 0 {
+		return bindings, nil
+	}
+	err := r.db.Where("device_id IN ?", deviceIDs).Order("bound_at").Find(&bindings).Error
+	return bindings, err
+}
+
+// DeleteByDevice ends all bindings of a device; rows are soft-deleted and kept for history
+func (r *DeviceBindingRepository) DeleteByDevice(deviceID uuid.UUID) error {
+	return r.db.Where("device_id = ?", deviceID).Delete(&models.DeviceBinding{}).Error
+}
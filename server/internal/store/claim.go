@@ -0,0 +1,97 @@
+package store
+
+import (
+	"time"
+
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DeviceClaimCodeRepository handles the claim codes of devices
+type DeviceClaimCodeRepository struct {
+	db *gorm.DB
+}
+
+// NewDeviceClaimCodeRepository creates a new device claim code repository
+func NewDeviceClaimCodeRepository(db *gorm.DB) *DeviceClaimCodeRepository {
+	return &DeviceClaimCodeRepository{db: db}
+}
+
+// GetByDevice gets the claim code of a device
+func (r *DeviceClaimCodeRepository) GetByDevice(deviceID uuid.UUID) (*models.DeviceClaimCode, error) {
+	var code models.DeviceClaimCode
+	if err := r.db.First(&code, "device_id = ?", deviceID).Error; err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+// Save sets the claim code of a device, replacing any previous one together with its use
+func (r *DeviceClaimCodeRepository) Save(code *models.DeviceClaimCode) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"code_hash", "source", "expires_at", "used_at", "used_by", "updated_at",
+		}),
+	}).Create(code).Error
+}
+
+// CreateBatch creates claim codes for newly created devices
+func (r *DeviceClaimCodeRepository) CreateBatch(codes []models.DeviceClaimCode) error {
+	if len(codes) == 0 {
+		return nil
+	}
+	return r.db.CreateInBatches(codes, 200).Error
+}
+
+// Use marks the claim code of a device used by userID if codeHash matches and the code is
+// still unused and unexpired at now; returns false otherwise
+func (r *DeviceClaimCodeRepository) Use(deviceID uuid.UUID, codeHash string, userID uuid.UUID, now time.Time) (bool, error) {
+	res := r.db.Model(&models.DeviceClaimCode{}).
+		Where("device_id = ? AND code_hash = ? AND used_at IS NULL", deviceID, codeHash).
+		Where("expires_at IS NULL OR expires_at > ?", now).
+		Updates(map[string]interface{}{"used_at": now, "used_by": userID})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// GetAttempt gets the failed claim attempts of a user at a device
+func (r *DeviceClaimCodeRepository) GetAttempt(deviceID, userID uuid.UUID) (*models.DeviceClaimAttempt, error) {
+	var attempt models.DeviceClaimAttempt
+	if err := r.db.First(&attempt, "device_id = ? AND user_id = ?", deviceID, userID).Error; err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// RecordFailure counts a wrong guess by a user at the claim code of a device. The
+// maxAttempts-th failure locks the user out of the device until now+lockFor and starts the
+// count again.
+func (r *DeviceClaimCodeRepository) RecordFailure(deviceID, userID uuid.UUID, maxAttempts int, now time.Time, lockFor time.Duration) error {
+	attempt := &models.DeviceClaimAttempt{DeviceID: deviceID, UserID: userID, FailedAttempts: 1}
+	if maxAttempts <= 1 {
+		lockedUntil := now.Add(lockFor)
+		attempt.FailedAttempts, attempt.LockedUntil = 0, &lockedUntil
+	}
+	return r.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "device_id"}, {Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"failed_attempts": gorm.Expr("CASE WHEN device_claim_attempts.failed_attempts + 1 >= ? THEN 0 ELSE device_claim_attempts.failed_attempts + 1 END", maxAttempts),
+			"locked_until":    gorm.Expr("CASE WHEN device_claim_attempts.failed_attempts + 1 >= ? THEN ? ELSE device_claim_attempts.locked_until END", maxAttempts, now.Add(lockFor)),
+			"updated_at":      now,
+		}),
+	}).Create(attempt).Error
+}
+
+// DeleteByDevice removes the claim code of a device and the failed attempts at it
+func (r *DeviceClaimCodeRepository) DeleteByDevice(deviceID uuid.UUID) error {
+	if err := r.db.Where("device_id = ?", deviceID).Delete(&models.DeviceClaimAttempt{}).Error; err != nil {
+		return err
+	}
+	return r.db.Where("device_id = ?", deviceID).Delete(&models.DeviceClaimCode{}).Error
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DeviceCredentialRepository handles the MQTT credentials of devices
+type DeviceCredentialRepository struct {
+	db *gorm.DB
+}
+
+// NewDeviceCredentialRepository creates a new device credential repository
+func NewDeviceCredentialRepository(db *gorm.DB) *DeviceCredentialRepository {
+	return &DeviceCredentialRepository{db: db}
+}
+
+// GetByDevice gets the credential of a device
+func (r *DeviceCredentialRepository) GetByDevice(deviceID uuid.UUID) (*models.DeviceCredential, error) {
+	var cred models.DeviceCredential
+	if err := r.db.First(&cred, "device_id = ?", deviceID).Error; err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+// Save sets the credential of a device, replacing any previous one
+func (r *DeviceCredentialRepository) Save(cred *models.DeviceCredential) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"secret_hash", "previous_hash", "previous_expires_at", "rotated_at", "updated_at",
+		}),
+	}).Create(cred).Error
+}
+
+// CreateBatch creates the credentials of newly created devices
+func (r *DeviceCredentialRepository) CreateBatch(creds []models.DeviceCredential) error {
+	if len(creds) == 0 {
+		return nil
+	}
+	return r.db.CreateInBatches(creds, 200).Error
+}
+
+// DeleteByDevice removes the credential of a device
+func (r *DeviceCredentialRepository) DeleteByDevice(deviceID uuid.UUID) error {
+	return r.db.Where("device_id = ?", deviceID).Delete(&models.DeviceCredential{}).Error
+}
@@ -1,6 +1,11 @@
 package store
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
 	"server/internal/domain/models"
 
 	"github.com/google/uuid"
@@ -22,6 +27,35 @@ func (r *DeviceRepository) Create(device *models.Device) error {
 	return r.db.Create(device).Error
 }
 
+// CreateBatch creates devices in batches; call it inside a transaction to make it atomic
+func (r *DeviceRepository) CreateBatch(devices []models.Device) error {
+	if len(devices) == 0 {
+		return nil
+	}
+	return r.db.CreateInBatches(devices, 200).Error
+}
+
+// ListByIdentifiers lists the devices, soft-deleted ones included, that hold any of the
+// MACs or IMEIs. Both columns are unique over every row, so these are the registrations
+// new devices would collide with.
+func (r *DeviceRepository) ListByIdentifiers(macs, imeis []string) ([]models.Device, error) {
+	var devices []models.Device
+	if len(macs) == 0 && len(imeis) == 0 {
+		return devices, nil
+	}
+	query := r.db.Unscoped().Select("id", "mac", "imei", "project_id", "deleted_at")
+	switch {
+	case len(imeis) == 0:
+		query = query.Where("mac IN ?", macs)
+	case len(macs) == 0:
+		query = query.Where("imei IN ?", imeis)
+	default:
+		query = query.Where("mac IN ? OR imei IN ?", macs, imeis)
+	}
+	err := query.Find(&devices).Error
+	return devices, err
+}
+
 // GetByID gets a device by ID
 func (r *DeviceRepository) GetByID(id uuid.UUID) (*models.Device, error) {
 	var device models.Device
@@ -56,35 +90,428 @@ func (r *DeviceRepository) GetByIMEI(imei string) (*models.Device, error) {
 func (r *DeviceRepository) ListByProject(projectID uuid.UUID, filters map[string]interface{}) ([]models.Device, error) {
 	var devices []models.Device
 	query := r.db.Preload("Project").Preload("Partition").Where("project_id = ?", projectID)
-
-	for key, value := range filters {
-		query = query.Where(key+" = ?", value)
-	}
+	query = r.applyFilters(query, filters)
 
 	err := query.Find(&devices).Error
 	return devices, err
 }
 
+// Filter keys understood by ListByOrg and ListByProject in addition to plain device columns
+const (
+	FilterTagsAny = "tags_any" // []string: device has at least one of the tags
+	FilterTagsAll = "tags_all" // []string: device has every tag
+	FilterMeta    = "meta"     // map[string]string: top-level meta keys equal to the values, compared as text
+	// uuid.UUID: device is attached to the partition or to any partition below it
+	FilterPartitionTree = "partition_tree"
+)
+
 // ListByOrg lists devices by organization ID (through project relationship)
 func (r *DeviceRepository) ListByOrg(orgID uuid.UUID, filters map[string]interface{}) ([]models.Device, error) {
 	var devices []models.Device
 	query := r.db.Preload("Project").Preload("Partition").
 		Joins("JOIN projects ON devices.project_id = projects.id").
 		Where("projects.org_id = ?", orgID)
+	query = r.applyFilters(query, filters)
 
+	err := query.Find(&devices).Error
+	return devices, err
+}
+
+// DeviceSort is one ORDER BY term of a device page
+type DeviceSort struct {
+	Field string
+	Desc  bool
+}
+
+// DeviceListQuery selects one page of devices
+type DeviceListQuery struct {
+	Filters map[string]interface{} // as for ListByOrg
+	Search  string                 // substring of MAC, IMEI or display name
+	Sort    []DeviceSort           // devices.id is always appended as the final tie-breaker
+	Limit   int
+	Offset  int
+	After   *DeviceCursor // keyset position; when set Offset is ignored
+}
+
+// DeviceCursor is the position after the last device of a page: its sort values and ID
+type DeviceCursor struct {
+	Values []interface{}
+	ID     uuid.UUID
+}
+
+// Device fields that can be sorted on
+var deviceSortFields = map[string]bool{
+	"display_name": true,
+	"mac":          true,
+	"status":       true,
+	"device_type":  true,
+	"created_at":   true,
+	"updated_at":   true,
+	"last_seen_at": true,
+}
+
+// ParseDeviceSort parses a comma-separated sort spec such as "last_seen_at,-display_name";
+// a leading '-' sorts that field descending
+func ParseDeviceSort(spec string) ([]DeviceSort, error) {
+	var sort []DeviceSort
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		term := DeviceSort{Field: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+		if !deviceSortFields[term.Field] {
+			return nil, fmt.Errorf("cannot sort by %q", term.Field)
+		}
+		if seen[term.Field] {
+			return nil, fmt.Errorf("%q appears more than once", term.Field)
+		}
+		seen[term.Field] = true
+		sort = append(sort, term)
+	}
+	return sort, nil
+}
+
+// ListPage returns one page of an organization's devices in a stable order, and the number
+// of devices matching the filters and search across all pages
+func (r *DeviceRepository) ListPage(orgID uuid.UUID, q DeviceListQuery) ([]models.Device, int64, error) {
+	query := r.listQuery(orgID, q)
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	devices, err := r.findPage(query, q)
+	return devices, total, err
+}
+
+// EachBatch calls fn with successive pages of up to batchSize devices matching the filters
+// and search of q, in its sort order, until all have been passed. Pages are read with keyset
+// conditions, so each query is cheap however deep the export goes. Limit, Offset and After
+// are ignored.
+func (r *DeviceRepository) EachBatch(orgID uuid.UUID, q DeviceListQuery, batchSize int, fn func([]models.Device) error) error {
+	q.Limit, q.Offset, q.After = batchSize, 0, nil
+	for {
+		devices, err := r.findPage(r.listQuery(orgID, q), q)
+		if err != nil {
+			return err
+		}
+		if len(devices) > 0 {
+			if err := fn(devices); err != nil {
+				return err
+			}
+		}
+		if len(devices) < batchSize {
+			return nil
+		}
+		q.After = r.CursorFor(&devices[len(devices)-1], q.Sort)
+	}
+}
+
+// listQuery selects an organization's devices matching the filters and search of q
+func (r *DeviceRepository) listQuery(orgID uuid.UUID, q DeviceListQuery) *gorm.DB {
+	query := r.db.Model(&models.Device{}).
+		Joins("JOIN projects ON devices.project_id = projects.id").
+		Where("projects.org_id = ?", orgID)
+	query = r.applyFilters(query, q.Filters)
+	if q.Search != "" {
+		query = query.Where(r.searchCondition(q.Search))
+	}
+	return query
+}
+
+// findPage reads the page of query that q positions, with project and partition loaded
+func (r *DeviceRepository) findPage(query *gorm.DB, q DeviceListQuery) ([]models.Device, error) {
+	if q.After != nil {
+		if len(q.After.Values) != len(q.Sort) {
+			return nil, fmt.Errorf("cursor does not match the sort order")
+		}
+		cond, args := r.keysetCondition(q.Sort, q.After)
+		query = query.Where(cond, args...)
+	} else if q.Offset > 0 {
+		query = query.Offset(q.Offset)
+	}
+	for _, term := range q.Sort {
+		order := r.sortExpr(term.Field)
+		if term.Desc {
+			order += " DESC"
+		}
+		query = query.Order(order)
+	}
+	query = query.Order("devices.id")
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+
+	var devices []models.Device
+	err := query.Preload("Project").Preload("Partition").Find(&devices).Error
+	return devices, err
+}
+
+// CursorFor returns the keyset position just after device for the given sort
+func (r *DeviceRepository) CursorFor(device *models.Device, sort []DeviceSort) *DeviceCursor {
+	cursor := &DeviceCursor{ID: device.ID}
+	for _, term := range sort {
+		var value interface{}
+		switch term.Field {
+		case "display_name":
+			value = device.DisplayName
+		case "mac":
+			value = device.MAC
+		case "status":
+			value = string(device.Status)
+		case "device_type":
+			value = string(device.DeviceType)
+		case "created_at":
+			value = device.CreatedAt
+		case "updated_at":
+			value = device.UpdatedAt
+		case "last_seen_at":
+			if device.LastSeenAt != nil {
+				value = *device.LastSeenAt
+			}
+		}
+		cursor.Values = append(cursor.Values, value)
+	}
+	return cursor
+}
+
+// sortExpr is the SQL expression a field is sorted on. A missing last_seen_at sorts as the
+// earliest time on both databases, so keyset comparisons never meet NULL.
+func (r *DeviceRepository) sortExpr(field string) string {
+	if field == "last_seen_at" {
+		if r.isPostgres() {
+			return "COALESCE(devices.last_seen_at, '-infinity'::timestamptz)"
+		}
+		return "COALESCE(devices.last_seen_at, '')"
+	}
+	return "devices." + field
+}
+
+// keysetCondition matches rows that sort after the cursor:
+// (a > x) OR (a = x AND b < y) OR (a = x AND b = y AND id > z), per sort direction
+func (r *DeviceRepository) keysetCondition(sort []DeviceSort, after *DeviceCursor) (string, []interface{}) {
+	values := make([]interface{}, 0, len(sort)+1)
+	for i, term := range sort {
+		value := after.Values[i]
+		if value == nil && term.Field == "last_seen_at" {
+			value = r.missingTime()
+		}
+		values = append(values, value)
+	}
+	values = append(values, after.ID)
+	exprs := make([]string, 0, len(sort)+1)
+	for _, term := range sort {
+		exprs = append(exprs, r.sortExpr(term.Field))
+	}
+	exprs = append(exprs, "devices.id")
+
+	var ors []string
+	var args []interface{}
+	for i := range exprs {
+		var ands []string
+		for j := 0; j < i; j++ {
+			ands = append(ands, exprs[j]+" = ?")
+			args = append(args, values[j])
+		}
+		op := " > ?"
+		if i < len(sort) && sort[i].Desc {
+			op = " < ?"
+		}
+		ands = append(ands, exprs[i]+op)
+		args = append(args, values[i])
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	return "(" + strings.Join(ors, " OR ") + ")", args
+}
+
+// missingTime is the value a missing last_seen_at sorts as, see sortExpr
+func (r *DeviceRepository) missingTime() interface{} {
+	if r.isPostgres() {
+		return gorm.Expr("'-infinity'::timestamptz")
+	}
+	return ""
+}
+
+// searchCondition matches a case-insensitive substring of the MAC, IMEI or display name.
+// The MAC is also matched with separators stripped, so "a1:b2" finds A1B2C3D4E5F6.
+func (r *DeviceRepository) searchCondition(search string) *gorm.DB {
+	pattern := containsPattern(strings.ToLower(search))
+	mac := strings.NewReplacer(":", "", "-", "", ".", "", " ", "").Replace(strings.ToUpper(search))
+	group := r.db.Where(`LOWER(devices.display_name) LIKE ? ESCAPE '\'`, pattern).
+		Or(`devices.imei LIKE ? ESCAPE '\'`, pattern)
+	if mac != "" {
+		group = group.Or(`devices.mac LIKE ? ESCAPE '\'`, containsPattern(mac))
+	}
+	return group
+}
+
+// applyFilters adds the supported device filters to query; unknown keys are ignored
+func (r *DeviceRepository) applyFilters(query *gorm.DB, filters map[string]interface{}) *gorm.DB {
 	for key, value := range filters {
-		if key == "status" || key == "device_type" {
+		switch key {
+		case "status", "device_type", "project_id", "partition_id":
 			query = query.Where("devices."+key+" = ?", value)
+		case FilterTagsAny:
+			if tags, ok := value.([]string); ok && len(tags) > 0 {
+				query = query.Where(r.tagsAny(tags))
+			}
+		case FilterTagsAll:
+			if tags, ok := value.([]string); ok {
+				query = r.tagsAll(query, tags)
+			}
+		case FilterMeta:
+			if meta, ok := value.(map[string]string); ok {
+				query = r.metaEquals(query, meta)
+			}
+		case FilterPartitionTree:
+			if id, ok := value.(uuid.UUID); ok {
+				query = r.partitionTree(query, id)
+			}
 		}
 	}
+	return query
+}
 
-	err := query.Find(&devices).Error
-	return devices, err
+// partitionTree restricts query to devices anywhere under the partition; an unknown
+// partition matches no device
+func (r *DeviceRepository) partitionTree(query *gorm.DB, id uuid.UUID) *gorm.DB {
+	var paths []string
+	if err := r.db.Model(&models.Partition{}).Where("id = ?", id).Pluck("path", &paths).Error; err != nil || len(paths) == 0 {
+		return query.Where("1 = 0")
+	}
+	return query.Where("devices.partition_id IN (?)", subtreeIDs(r.db, paths[0]))
+}
+
+// Tag and meta filters use jsonb containment and ->> on Postgres and the JSON1 functions on SQLite
+
+func (r *DeviceRepository) isPostgres() bool {
+	return r.db.Dialector.Name() == "postgres"
+}
+
+func (r *DeviceRepository) tagCondition(tag string) (string, interface{}) {
+	if r.isPostgres() {
+		b, _ := json.Marshal([]string{tag})
+		return "devices.tags @> ?::jsonb", string(b)
+	}
+	return "EXISTS (SELECT 1 FROM json_each(devices.tags) WHERE json_each.value = ?)", tag
+}
+
+func (r *DeviceRepository) tagsAny(tags []string) *gorm.DB {
+	cond, arg := r.tagCondition(tags[0])
+	group := r.db.Where(cond, arg)
+	for _, tag := range tags[1:] {
+		cond, arg = r.tagCondition(tag)
+		group = group.Or(cond, arg)
+	}
+	return group
 }
 
-// Update updates a device
+func (r *DeviceRepository) tagsAll(query *gorm.DB, tags []string) *gorm.DB {
+	if r.isPostgres() && len(tags) > 0 {
+		b, _ := json.Marshal(tags)
+		return query.Where("devices.tags @> ?::jsonb", string(b))
+	}
+	for _, tag := range tags {
+		cond, arg := r.tagCondition(tag)
+		query = query.Where(cond, arg)
+	}
+	return query
+}
+
+func (r *DeviceRepository) metaEquals(query *gorm.DB, meta map[string]string) *gorm.DB {
+	for key, value := range meta {
+		if r.isPostgres() {
+			query = query.Where("devices.meta->>? = ?", key, value)
+			continue
+		}
+		// json_extract returns 1/0 for booleans; render them like Postgres does
+		path := `$."` + key + `"`
+		query = query.Where(`(CASE json_type(devices.meta, ?) WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' `+
+			`ELSE CAST(json_extract(devices.meta, ?) AS TEXT) END) = ?`, path, path, value)
+	}
+	return query
+}
+
+// Update writes the device if it is still at the version it was read at, and advances the
+// version; ErrVersionConflict means it changed meanwhile. Status and last_seen_at are left
+// to the targeted status and presence updates.
 func (r *DeviceRepository) Update(device *models.Device) error {
-	return r.db.Save(device).Error
+	return updateVersioned(r.db, device, &device.Version, "status", "last_seen_at")
+}
+
+// UpdatePlacement moves a device to another project and partition if it is still at
+// version, and advances the version; ErrVersionConflict means it changed meanwhile
+func (r *DeviceRepository) UpdatePlacement(id uuid.UUID, version int64, projectID uuid.UUID, partitionID *uuid.UUID) error {
+	res := r.db.Model(&models.Device{}).Where("id = ? AND version = ?", id, version).Updates(map[string]interface{}{
+		"project_id":   projectID,
+		"partition_id": partitionID,
+		"version":      bumpVersion,
+	})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrVersionConflict
+	}
+	return res.Error
+}
+
+// ClaimUnbound places an unbound device and sets its status in one conditional update;
+// returns false if the device was no longer unbound
+func (r *DeviceRepository) ClaimUnbound(id uuid.UUID, projectID uuid.UUID, partitionID *uuid.UUID, status models.DeviceStatus) (bool, error) {
+	res := r.db.Model(&models.Device{}).
+		Where("id = ? AND status = ?", id, models.DeviceStatusUnbound).
+		Updates(map[string]interface{}{
+			"project_id":   projectID,
+			"partition_id": partitionID,
+			"status":       status,
+			"version":      bumpVersion,
+		})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// UpdateStatus sets the status of the device if it is still at version, and advances the
+// version; ErrVersionConflict means it changed meanwhile
+func (r *DeviceRepository) UpdateStatus(id uuid.UUID, version int64, status models.DeviceStatus) error {
+	res := r.db.Model(&models.Device{}).Where("id = ? AND version = ?", id, version).
+		Updates(map[string]interface{}{"status": status, "version": bumpVersion})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrVersionConflict
+	}
+	return res.Error
+}
+
+// UpdatePresence sets the status and last seen time of the device. Only these two columns
+// are written and the version is left alone, so presence updates never overwrite or
+// invalidate a user's edit.
+func (r *DeviceRepository) UpdatePresence(id uuid.UUID, status models.DeviceStatus, seenAt time.Time) error {
+	return r.db.Model(&models.Device{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"last_seen_at": seenAt,
+		"status":       status,
+	}).Error
+}
+
+// ReportPresence is UpdatePresence for reports from the device itself: unbound devices keep
+// their status
+func (r *DeviceRepository) ReportPresence(id uuid.UUID, status models.DeviceStatus, seenAt time.Time) error {
+	return r.db.Model(&models.Device{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"last_seen_at": seenAt,
+		"status":       gorm.Expr("CASE WHEN status = ? THEN status ELSE ? END", models.DeviceStatusUnbound, status),
+	}).Error
+}
+
+// FillEmpty sets column of the device to value only while the column is NULL or empty, so
+// a value set meanwhile is never overwritten; it reports whether the device was changed.
+// column must be a trusted column name.
+func (r *DeviceRepository) FillEmpty(id uuid.UUID, column string, value interface{}) (bool, error) {
+	res := r.db.Model(&models.Device{}).
+		Where("id = ?", id).
+		Where(fmt.Sprintf("(%s IS NULL OR %s = '')", column, column)).
+		Updates(map[string]interface{}{column: value, "version": bumpVersion})
+	return res.RowsAffected > 0, res.Error
 }
 
 // Delete deletes a device
@@ -92,6 +519,12 @@ func (r *DeviceRepository) Delete(id uuid.UUID) error {
 	return r.db.Delete(&models.Device{}, "id = ?", id).Error
 }
 
+// DeleteVersion deletes the device if it is still at version; ErrVersionConflict means it
+// changed meanwhile
+func (r *DeviceRepository) DeleteVersion(id uuid.UUID, version int64) error {
+	return deleteVersioned(r.db, &models.Device{}, id, version)
+}
+
 // UpdateLastSeen updates the last seen timestamp for a device
 func (r *DeviceRepository) UpdateLastSeen(deviceID uuid.UUID) error {
 	return r.db.Model(&models.Device{}).Where("id = ?", deviceID).Update("last_seen_at", gorm.Expr("NOW()")).Error
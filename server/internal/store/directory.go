@@ -0,0 +1,34 @@
+package store
+
+import (
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DirectorySyncRunRepository handles directory sync run records
+type DirectorySyncRunRepository struct {
+	db *gorm.DB
+}
+
+// NewDirectorySyncRunRepository creates a new directory sync run repository
+func NewDirectorySyncRunRepository(db *gorm.DB) *DirectorySyncRunRepository {
+	return &DirectorySyncRunRepository{db: db}
+}
+
+// Save creates or updates a sync run
+func (r *DirectorySyncRunRepository) Save(run *models.DirectorySyncRun) error {
+	return r.db.Save(run).Error
+}
+
+// ListRecent lists the most recent sync runs, optionally for one organization
+func (r *DirectorySyncRunRepository) ListRecent(orgID *uuid.UUID, limit int) ([]models.DirectorySyncRun, error) {
+	var runs []models.DirectorySyncRun
+	query := r.db.Order("started_at DESC").Limit(limit)
+	if orgID != nil {
+		query = query.Where("org_id = ?", *orgID)
+	}
+	err := query.Find(&runs).Error
+	return runs, err
+}
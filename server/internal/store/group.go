@@ -0,0 +1,77 @@
+package store
+
+import (
+	"strings"
+
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// GroupRepository handles group data operations
+type GroupRepository struct {
+	db *gorm.DB
+}
+
+// NewGroupRepository creates a new group repository
+func NewGroupRepository(db *gorm.DB) *GroupRepository {
+	return &GroupRepository{db: db}
+}
+
+// Create creates a new group
+func (r *GroupRepository) Create(group *models.Group) error {
+	return r.db.Create(group).Error
+}
+
+// GetByID gets a group by ID
+func (r *GroupRepository) GetByID(id uuid.UUID) (*models.Group, error) {
+	var group models.Group
+	err := r.db.First(&group, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// ListByOrg lists the groups of an organization, optionally including soft-deleted ones
+func (r *GroupRepository) ListByOrg(orgID uuid.UUID, includeDeleted bool) ([]models.Group, error) {
+	var groups []models.Group
+	query := r.db
+	if includeDeleted {
+		query = query.Unscoped()
+	}
+	err := query.Where("org_id = ?", orgID).Find(&groups).Error
+	return groups, err
+}
+
+// Search pages through an organization's groups whose name or display name contains q,
+// case-insensitively, and returns the total number of matches
+func (r *GroupRepository) Search(orgID uuid.UUID, q string, offset, limit int) ([]models.Group, int64, error) {
+	query := r.db.Model(&models.Group{}).Where("org_id = ?", orgID)
+	if q != "" {
+		pattern := containsPattern(strings.ToLower(q))
+		query = query.Where(`(LOWER(name) LIKE ? ESCAPE '\' OR LOWER(display_name) LIKE ? ESCAPE '\')`, pattern, pattern)
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var groups []models.Group
+	err := query.Order("name").Order("id").Offset(offset).Limit(limit).Find(&groups).Error
+	return groups, total, err
+}
+
+// Save creates or updates a group; a soft-deleted group is restored when DeletedAt is cleared
+func (r *GroupRepository) Save(group *models.Group) error {
+	return r.db.Unscoped().Save(group).Error
+}
+
+// Delete soft-deletes a group and removes its memberships
+func (r *GroupRepository) Delete(id uuid.UUID) error {
+	if err := r.db.Where("group_id = ?", id).Delete(&models.UserGroup{}).Error; err != nil {
+		return err
+	}
+	return r.db.Delete(&models.Group{}, "id = ?", id).Error
+}
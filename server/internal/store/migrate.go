@@ -0,0 +1,347 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations live in migrations/<dialect>/ and are named like golang-migrate's:
+// <version>_<name>.up.sql and <version>_<name>.down.sql. Versions are applied in
+// order and recorded in schema_migrations, which uses golang-migrate's layout so
+// either tool can take over an existing database.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// schemaLockID is the Postgres advisory lock held while a migration runs, so
+// several instances starting at once apply each migration only once
+const schemaLockID = 7208451203
+
+var (
+	// ErrSchemaAhead means the database was migrated by a newer binary
+	ErrSchemaAhead = errors.New("database schema is newer than this binary")
+	// ErrSchemaDirty means a migration failed part way and needs fixing by hand
+	ErrSchemaDirty = errors.New("database schema is dirty")
+	// ErrNoChange means there was no migration to apply or revert
+	ErrNoChange = errors.New("no migration to apply")
+)
+
+// Migration is one versioned schema change
+type Migration struct {
+	Version uint64 `json:"version"`
+	Name    string `json:"name"`
+	up      string
+	down    string
+}
+
+// MigrationStatus reports the schema version of the database against the migrations
+// embedded in the binary
+type MigrationStatus struct {
+	Dialect string      `json:"dialect"`
+	Version uint64      `json:"version"` // 0 when no migration was applied
+	Dirty   bool        `json:"dirty"`
+	Latest  uint64      `json:"latest"`
+	Pending []Migration `json:"pending"`
+}
+
+// loadMigrations reads the embedded migrations for a dialect, ordered by version
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for dialect %s: %w", dialect, err)
+	}
+
+	byVersion := make(map[uint64]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") || !ok {
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+		prefix, label, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseUint(prefix, 10, 64)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("migration file %s has no version", name)
+		}
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, label)
+		}
+		switch direction {
+		case "up":
+			m.up = string(body)
+		case "down":
+			m.down = string(body)
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d needs both an up and a down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// dialect returns the migrations directory matching the database driver
+func (s *Store) dialect() string {
+	if s.db.Dialector.Name() == "postgres" {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// MigrationStatus reports the current schema version and the migrations not yet applied
+func (s *Store) MigrationStatus(ctx context.Context) (*MigrationStatus, error) {
+	migrations, err := loadMigrations(s.dialect())
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureSchemaTable(ctx, sqlDB); err != nil {
+		return nil, err
+	}
+	version, dirty, err := schemaVersion(ctx, sqlDB)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &MigrationStatus{Dialect: s.dialect(), Version: version, Dirty: dirty, Pending: []Migration{}}
+	for _, m := range migrations {
+		status.Latest = m.Version
+		if m.Version > version {
+			status.Pending = append(status.Pending, m)
+		}
+	}
+	return status, nil
+}
+
+// CheckSchema returns ErrSchemaAhead when the database was migrated past the newest
+// migration this binary knows, and ErrSchemaDirty when a migration was left half done
+func (s *Store) CheckSchema(ctx context.Context) (*MigrationStatus, error) {
+	status, err := s.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if status.Dirty {
+		return status, fmt.Errorf("%w at version %d", ErrSchemaDirty, status.Version)
+	}
+	if status.Version > status.Latest {
+		return status, fmt.Errorf("%w: database is at version %d, binary supports up to %d",
+			ErrSchemaAhead, status.Version, status.Latest)
+	}
+	return status, nil
+}
+
+// MigrateUp applies up to n pending migrations, or all of them when n is 0, and returns
+// the versions applied. Each migration runs in its own transaction together with the
+// version bump, so a failed migration leaves the schema at the previous version.
+func (s *Store) MigrateUp(ctx context.Context, n int) ([]uint64, error) {
+	return s.migrate(ctx, n, true)
+}
+
+// MigrateDown reverts the last n applied migrations and returns the versions reverted
+func (s *Store) MigrateDown(ctx context.Context, n int) ([]uint64, error) {
+	if n < 1 {
+		return nil, errors.New("number of migrations to revert must be at least 1")
+	}
+	return s.migrate(ctx, n, false)
+}
+
+// ForceVersion records version as the schema version and clears the dirty flag without
+// running any migration. It is the way out after fixing a failed migration by hand.
+func (s *Store) ForceVersion(ctx context.Context, version uint64) error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	if err := ensureSchemaTable(ctx, sqlDB); err != nil {
+		return err
+	}
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := setSchemaVersion(ctx, tx, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) migrate(ctx context.Context, n int, up bool) ([]uint64, error) {
+	migrations, err := loadMigrations(s.dialect())
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureSchemaTable(ctx, sqlDB); err != nil {
+		return nil, err
+	}
+
+	var done []uint64
+	for n == 0 || len(done) < n {
+		version, err := s.step(ctx, sqlDB, migrations, up)
+		if errors.Is(err, ErrNoChange) {
+			break
+		}
+		if err != nil {
+			return done, err
+		}
+		done = append(done, version)
+	}
+	if len(done) == 0 {
+		return nil, ErrNoChange
+	}
+	return done, nil
+}
+
+// step applies the next migration, or reverts the current one, in a single transaction.
+// The version is read inside the transaction, after taking the lock, so concurrent
+// runners never apply the same migration twice.
+func (s *Store) step(ctx context.Context, sqlDB *sql.DB, migrations []Migration, up bool) (uint64, error) {
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if s.dialect() == "postgres" {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", schemaLockID)); err != nil {
+			return 0, fmt.Errorf("failed to lock schema: %w", err)
+		}
+	}
+	version, dirty, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, fmt.Errorf("%w at version %d", ErrSchemaDirty, version)
+	}
+	if latest := migrations[len(migrations)-1].Version; version > latest {
+		return 0, fmt.Errorf("%w: database is at version %d, binary supports up to %d", ErrSchemaAhead, version, latest)
+	}
+
+	var (
+		body   string
+		target uint64
+		ran    uint64
+	)
+	if up {
+		for _, m := range migrations {
+			if m.Version > version {
+				body, target, ran = m.up, m.Version, m.Version
+				break
+			}
+		}
+	} else {
+		for i, m := range migrations {
+			if m.Version == version {
+				body, ran = m.down, m.Version
+				if i > 0 {
+					target = migrations[i-1].Version
+				}
+				break
+			}
+		}
+		if ran == 0 && version != 0 {
+			return 0, fmt.Errorf("no migration file for applied version %d", version)
+		}
+	}
+	if ran == 0 {
+		return 0, ErrNoChange
+	}
+
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		direction := "down"
+		if up {
+			direction = "up"
+		}
+		return 0, fmt.Errorf("migration %d %s failed: %w", ran, direction, err)
+	}
+	if err := setSchemaVersion(ctx, tx, target); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return ran, nil
+}
+
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func ensureSchemaTable(ctx context.Context, db execQuerier) error {
+	_, err := db.ExecContext(ctx,
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// schemaVersion reads the recorded version; an empty table means version 0
+func schemaVersion(ctx context.Context, db execQuerier) (uint64, bool, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+	err := db.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version < 0 {
+		// golang-migrate records -1 for "no version"
+		return 0, dirty, nil
+	}
+	return uint64(version), dirty, nil
+}
+
+// setSchemaVersion replaces the recorded version; version 0 leaves the table empty
+func setSchemaVersion(ctx context.Context, db execQuerier, version uint64) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+		return fmt.Errorf("failed to record schema version: %w", err)
+	}
+	if version == 0 {
+		return nil
+	}
+	// Literal values keep the statement the same for both drivers' placeholder styles
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO schema_migrations (version, dirty) VALUES (%d, false)", version)); err != nil {
+		return fmt.Errorf("failed to record schema version: %w", err)
+	}
+	return nil
+}
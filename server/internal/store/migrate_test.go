@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMigrations_UpDownStatus(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	store := &Store{db: db}
+	t.Cleanup(func() { _ = store.Close() })
+	ctx := context.Background()
+
+	migrations, err := loadMigrations("sqlite")
+	require.NoError(t, err)
+	pg, err := loadMigrations("postgres")
+	require.NoError(t, err)
+	require.Equal(t, len(migrations), len(pg), "every migration needs a postgres and a sqlite version")
+	latest := migrations[len(migrations)-1].Version
+
+	status, err := store.MigrationStatus(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "sqlite", status.Dialect)
+	assert.Zero(t, status.Version)
+	assert.Len(t, status.Pending, len(migrations))
+
+	applied, err := store.MigrateUp(ctx, 0)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(migrations))
+	_, err = store.MigrateUp(ctx, 0)
+	assert.ErrorIs(t, err, ErrNoChange)
+
+	status, err = store.CheckSchema(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, latest, status.Version)
+	assert.Empty(t, status.Pending)
+
+	// The migrated schema has a column for every model field
+	for _, model := range []interface{}{
+		&models.Organization{}, &models.User{}, &models.Group{}, &models.UserGroup{},
+		&models.DirectorySyncRun{}, &models.Project{}, &models.Partition{}, &models.Device{},
+		&models.DeviceBinding{}, &models.DeviceShare{}, &models.DeviceTransfer{}, &models.CasbinRule{},
+		&models.AuditLog{}, &models.AuditPurgeRun{}, &models.OrganizationSetting{}, &models.SystemSetting{},
+		&models.OrgSession{}, &models.DeviceClaimCode{}, &models.DeviceClaimAttempt{},
+		&models.DeviceCredential{},
+	} {
+		stmt := &gorm.Statement{DB: db}
+		require.NoError(t, stmt.Parse(model))
+		require.True(t, db.Migrator().HasTable(model), stmt.Schema.Table)
+		for _, column := range stmt.Schema.DBNames {
+			assert.True(t, db.Migrator().HasColumn(model, column), "%s.%s", stmt.Schema.Table, column)
+		}
+	}
+
+	// Down reverts one migration at a time, and all the way back to an empty schema
+	reverted, err := store.MigrateDown(ctx, len(migrations))
+	require.NoError(t, err)
+	assert.Equal(t, latest, reverted[0])
+	assert.False(t, db.Migrator().HasTable(&models.Device{}))
+	_, err = store.MigrateDown(ctx, 1)
+	assert.ErrorIs(t, err, ErrNoChange)
+
+	// A database migrated by a newer binary is refused, and so is a dirty one
+	require.NoError(t, store.ForceVersion(ctx, latest+1))
+	_, err = store.CheckSchema(ctx)
+	assert.ErrorIs(t, err, ErrSchemaAhead)
+	_, err = store.MigrateUp(ctx, 0)
+	assert.ErrorIs(t, err, ErrSchemaAhead)
+
+	require.NoError(t, db.Exec("UPDATE schema_migrations SET dirty = true").Error)
+	_, err = store.CheckSchema(ctx)
+	assert.ErrorIs(t, err, ErrSchemaDirty)
+	require.NoError(t, store.ForceVersion(ctx, 0))
+	_, err = store.MigrateUp(ctx, 1)
+	require.NoError(t, err)
+}
+
+func TestMigrations_AdoptAutoMigratedDatabase(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	store := &Store{db: db}
+	t.Cleanup(func() { _ = store.Close() })
+
+	// Databases created before versioned migrations only have the GORM-created tables
+	require.NoError(t, db.AutoMigrate(&models.Organization{}, &models.User{}, &models.Project{}))
+	// and no row versions
+	require.NoError(t, db.Migrator().DropColumn(&models.Project{}, "version"))
+	require.NoError(t, db.Create(&models.Organization{BaseModel: models.BaseModel{ID: uuid.New()}, CasdoorOrg: "acme", Name: "Acme"}).Error)
+
+	_, err = store.MigrateUp(context.Background(), 0)
+	require.NoError(t, err)
+	var count int64
+	require.NoError(t, db.Model(&models.Organization{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+	assert.True(t, db.Migrator().HasTable(&models.AuditLog{}))
+}
@@ -0,0 +1,265 @@
+-- Baseline schema. Tables and indexes are created only when missing, so databases
+-- created by the former GORM auto-migration are adopted as they are.
+
+CREATE TABLE IF NOT EXISTS "organizations" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "casdoor_org" text NOT NULL,
+    "name" text NOT NULL,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_organizations_casdoor_org" ON "organizations"("casdoor_org");
+CREATE INDEX IF NOT EXISTS "idx_organizations_deleted_at" ON "organizations"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "users" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "casdoor_user_id" text NOT NULL,
+    "username" text NOT NULL,
+    "org_id" uuid NOT NULL,
+    "email" text,
+    "display_name" text,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_organization" FOREIGN KEY ("org_id") REFERENCES "organizations"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_users_org_id" ON "users"("org_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_casdoor_user_id" ON "users"("casdoor_user_id");
+CREATE INDEX IF NOT EXISTS "idx_users_deleted_at" ON "users"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "groups" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "casdoor_group_id" text NOT NULL,
+    "name" text NOT NULL,
+    "display_name" text,
+    "org_id" uuid NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_groups_organization" FOREIGN KEY ("org_id") REFERENCES "organizations"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_groups_org_id" ON "groups"("org_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_groups_casdoor_group_id" ON "groups"("casdoor_group_id");
+CREATE INDEX IF NOT EXISTS "idx_groups_deleted_at" ON "groups"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "user_groups" (
+    "user_id" uuid,
+    "group_id" uuid,
+    PRIMARY KEY ("user_id", "group_id")
+);
+CREATE INDEX IF NOT EXISTS "idx_user_groups_group_id" ON "user_groups"("group_id");
+
+CREATE TABLE IF NOT EXISTS "directory_sync_runs" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "org_id" uuid NOT NULL,
+    "trigger" text NOT NULL,
+    "started_at" timestamptz NOT NULL,
+    "finished_at" timestamptz,
+    "users_created" bigint,
+    "users_updated" bigint,
+    "users_deleted" bigint,
+    "groups_created" bigint,
+    "groups_updated" bigint,
+    "groups_deleted" bigint,
+    "memberships" bigint,
+    "error" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_directory_sync_runs_org_id" ON "directory_sync_runs"("org_id");
+CREATE INDEX IF NOT EXISTS "idx_directory_sync_runs_deleted_at" ON "directory_sync_runs"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "projects" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "org_id" uuid NOT NULL,
+    "name" text NOT NULL,
+    "remark" text,
+    "created_by" uuid NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_projects_organization" FOREIGN KEY ("org_id") REFERENCES "organizations"("id"),
+    CONSTRAINT "fk_projects_creator" FOREIGN KEY ("created_by") REFERENCES "users"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_projects_org_id" ON "projects"("org_id");
+CREATE INDEX IF NOT EXISTS "idx_projects_deleted_at" ON "projects"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "partitions" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "project_id" uuid NOT NULL,
+    "parent_id" uuid,
+    "name" text NOT NULL,
+    "path" text,
+    "depth" bigint NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_partitions_children" FOREIGN KEY ("parent_id") REFERENCES "partitions"("id"),
+    CONSTRAINT "fk_projects_partitions" FOREIGN KEY ("project_id") REFERENCES "projects"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_partitions_path" ON "partitions"("path");
+CREATE INDEX IF NOT EXISTS "idx_partitions_parent_id" ON "partitions"("parent_id");
+CREATE INDEX IF NOT EXISTS "idx_partitions_project_id" ON "partitions"("project_id");
+CREATE INDEX IF NOT EXISTS "idx_partitions_deleted_at" ON "partitions"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "devices" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "mac" varchar(12) NOT NULL,
+    "imei" varchar(16),
+    "device_type" text NOT NULL,
+    "project_id" uuid NOT NULL,
+    "partition_id" uuid,
+    "display_name" text,
+    "status" text DEFAULT 'unbound',
+    "last_seen_at" timestamptz,
+    "tags" jsonb,
+    "meta" jsonb,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_partitions_devices" FOREIGN KEY ("partition_id") REFERENCES "partitions"("id"),
+    CONSTRAINT "fk_projects_devices" FOREIGN KEY ("project_id") REFERENCES "projects"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_devices_partition_id" ON "devices"("partition_id");
+CREATE INDEX IF NOT EXISTS "idx_devices_project_id" ON "devices"("project_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_devices_imei" ON "devices"("imei");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_devices_mac" ON "devices"("mac");
+CREATE INDEX IF NOT EXISTS "idx_devices_deleted_at" ON "devices"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "device_bindings" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "device_id" uuid NOT NULL,
+    "user_id" uuid NOT NULL,
+    "bound_at" timestamptz NOT NULL,
+    "bound_by" uuid NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_devices_bindings" FOREIGN KEY ("device_id") REFERENCES "devices"("id"),
+    CONSTRAINT "fk_device_bindings_user" FOREIGN KEY ("user_id") REFERENCES "users"("id"),
+    CONSTRAINT "fk_device_bindings_binder" FOREIGN KEY ("bound_by") REFERENCES "users"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_device_bindings_user_id" ON "device_bindings"("user_id");
+CREATE INDEX IF NOT EXISTS "idx_device_bindings_device_id" ON "device_bindings"("device_id");
+CREATE INDEX IF NOT EXISTS "idx_device_bindings_deleted_at" ON "device_bindings"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "device_shares" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "device_id" uuid NOT NULL,
+    "subject_type" text NOT NULL,
+    "subject_id" uuid NOT NULL,
+    "role" text NOT NULL,
+    "granted_by" uuid NOT NULL,
+    "granted_at" timestamptz NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_device_shares_granter" FOREIGN KEY ("granted_by") REFERENCES "users"("id"),
+    CONSTRAINT "fk_devices_shares" FOREIGN KEY ("device_id") REFERENCES "devices"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_device_shares_subject_id" ON "device_shares"("subject_id");
+CREATE INDEX IF NOT EXISTS "idx_device_shares_device_id" ON "device_shares"("device_id");
+CREATE INDEX IF NOT EXISTS "idx_device_shares_deleted_at" ON "device_shares"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "device_transfers" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "device_id" uuid NOT NULL,
+    "from_subject_id" uuid NOT NULL,
+    "to_subject_id" uuid NOT NULL,
+    "status" text DEFAULT 'pending',
+    "processed_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_device_transfers_to_subject" FOREIGN KEY ("to_subject_id") REFERENCES "users"("id"),
+    CONSTRAINT "fk_devices_transfers" FOREIGN KEY ("device_id") REFERENCES "devices"("id"),
+    CONSTRAINT "fk_device_transfers_from_subject" FOREIGN KEY ("from_subject_id") REFERENCES "users"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_device_transfers_device_id" ON "device_transfers"("device_id");
+CREATE INDEX IF NOT EXISTS "idx_device_transfers_deleted_at" ON "device_transfers"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "casbin_rule" (
+    "id" bigserial,
+    "ptype" varchar(512),
+    "v0" varchar(512),
+    "v1" varchar(512),
+    "v2" varchar(512),
+    "v3" varchar(512),
+    "v4" varchar(512),
+    "v5" varchar(512),
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "unique_index" ON "casbin_rule"("ptype", "v0", "v1", "v2", "v3", "v4", "v5");
+
+CREATE TABLE IF NOT EXISTS "audit_logs" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "org_id" uuid,
+    "actor" uuid NOT NULL,
+    "action" text NOT NULL,
+    "target_type" text NOT NULL,
+    "target_id" uuid,
+    "detail" jsonb,
+    "ip" text,
+    "user_agent" text,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_audit_logs_user" FOREIGN KEY ("actor") REFERENCES "users"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_target_id" ON "audit_logs"("target_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_target_type" ON "audit_logs"("target_type");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_action" ON "audit_logs"("action");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_actor" ON "audit_logs"("actor");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_org_id" ON "audit_logs"("org_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_deleted_at" ON "audit_logs"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "audit_purge_runs" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "trigger" text NOT NULL,
+    "retention_days" bigint,
+    "cutoff" timestamptz,
+    "started_at" timestamptz NOT NULL,
+    "finished_at" timestamptz,
+    "rows_purged" bigint,
+    "batches" bigint,
+    "duration_ms" bigint,
+    "error" text,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_audit_purge_runs_started_at" ON "audit_purge_runs"("started_at");
+CREATE INDEX IF NOT EXISTS "idx_audit_purge_runs_deleted_at" ON "audit_purge_runs"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "organization_settings" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "org_id" uuid,
+    "factory_allow_registration" boolean NOT NULL DEFAULT true,
+    "factory_default_project_id" uuid,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_organization_settings_org_id" ON "organization_settings"("org_id");
+CREATE INDEX IF NOT EXISTS "idx_organization_settings_deleted_at" ON "organization_settings"("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "system_settings" (
+    "key" varchar(128),
+    "value" text,
+    PRIMARY KEY ("key")
+);
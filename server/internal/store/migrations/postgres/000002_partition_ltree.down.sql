@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS "idx_devices_partition_status";
+
+DROP INDEX IF EXISTS "idx_partitions_path_gist";
+ALTER TABLE "partitions" ALTER COLUMN "path" TYPE text USING "path"::text;
+CREATE INDEX IF NOT EXISTS "idx_partitions_path" ON "partitions"("path");
@@ -0,0 +1,10 @@
+-- Partition paths become ltree so subtree and ancestor queries use a GiST index.
+-- The ltree extension ships with PostgreSQL contrib; creating it needs a role allowed to.
+CREATE EXTENSION IF NOT EXISTS ltree;
+
+DROP INDEX IF EXISTS "idx_partitions_path";
+ALTER TABLE "partitions" ALTER COLUMN "path" TYPE ltree USING "path"::ltree;
+CREATE INDEX IF NOT EXISTS "idx_partitions_path_gist" ON "partitions" USING GIST ("path");
+
+-- Subtree rollups count the devices of many partitions at once, grouped by status
+CREATE INDEX IF NOT EXISTS "idx_devices_partition_status" ON "devices"("partition_id", "status");
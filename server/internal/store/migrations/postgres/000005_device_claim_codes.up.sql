@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS "device_claim_codes" (
+    "device_id" uuid,
+    "code_hash" varchar(64) NOT NULL,
+    "source" varchar(16) NOT NULL,
+    "expires_at" timestamptz,
+    "used_at" timestamptz,
+    "used_by" uuid,
+    "failed_attempts" bigint NOT NULL DEFAULT 0,
+    "locked_until" timestamptz,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("device_id")
+);
@@ -0,0 +1,2 @@
+-- Firmware version as last reported by a device in its MQTT registration
+ALTER TABLE "devices" ADD COLUMN IF NOT EXISTS "firmware_version" text;
@@ -0,0 +1,14 @@
+-- Per-device MQTT secrets, stored as hashes, replacing the MAC as password
+CREATE TABLE IF NOT EXISTS "device_credentials" (
+    "device_id" uuid,
+    "secret_hash" varchar(64) NOT NULL,
+    "previous_hash" varchar(64),
+    "previous_expires_at" timestamptz,
+    "rotated_at" timestamptz NOT NULL,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("device_id")
+);
+
+-- Organizations keep accepting MAC/IMEI passwords until their fleet has migrated
+ALTER TABLE "organization_settings" ADD COLUMN IF NOT EXISTS "mqtt_legacy_passwords" boolean NOT NULL DEFAULT true;
@@ -0,0 +1,3 @@
+ALTER TABLE "device_claim_codes" ADD COLUMN IF NOT EXISTS "locked_until" timestamptz;
+ALTER TABLE "device_claim_codes" ADD COLUMN IF NOT EXISTS "failed_attempts" bigint NOT NULL DEFAULT 0;
+DROP TABLE IF EXISTS "device_claim_attempts";
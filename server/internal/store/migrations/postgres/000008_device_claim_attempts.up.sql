@@ -0,0 +1,14 @@
+-- Wrong claim codes are counted per device and user, so nobody can lock a device's real
+-- owner out by guessing
+CREATE TABLE IF NOT EXISTS "device_claim_attempts" (
+    "device_id" uuid,
+    "user_id" uuid,
+    "failed_attempts" bigint NOT NULL DEFAULT 0,
+    "locked_until" timestamptz,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("device_id", "user_id")
+);
+
+ALTER TABLE "device_claim_codes" DROP COLUMN IF EXISTS "failed_attempts";
+ALTER TABLE "device_claim_codes" DROP COLUMN IF EXISTS "locked_until";
@@ -0,0 +1,16 @@
+DROP TABLE IF EXISTS `system_settings`;
+DROP TABLE IF EXISTS `organization_settings`;
+DROP TABLE IF EXISTS `audit_purge_runs`;
+DROP TABLE IF EXISTS `audit_logs`;
+DROP TABLE IF EXISTS `casbin_rule`;
+DROP TABLE IF EXISTS `device_transfers`;
+DROP TABLE IF EXISTS `device_shares`;
+DROP TABLE IF EXISTS `device_bindings`;
+DROP TABLE IF EXISTS `devices`;
+DROP TABLE IF EXISTS `partitions`;
+DROP TABLE IF EXISTS `projects`;
+DROP TABLE IF EXISTS `directory_sync_runs`;
+DROP TABLE IF EXISTS `user_groups`;
+DROP TABLE IF EXISTS `groups`;
+DROP TABLE IF EXISTS `users`;
+DROP TABLE IF EXISTS `organizations`;
@@ -0,0 +1,3 @@
+-- SQLite has no ltree: paths stay text and subtrees are matched as a range on
+-- idx_partitions_path. Only the rollup index is shared with Postgres.
+CREATE INDEX IF NOT EXISTS `idx_devices_partition_status` ON `devices`(`partition_id`, `status`);
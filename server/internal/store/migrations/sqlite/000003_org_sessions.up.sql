@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS `org_sessions` (
+    `token_hash` text,
+    `user_id` uuid NOT NULL,
+    `org_id` uuid NOT NULL,
+    `expires_at` datetime NOT NULL,
+    `updated_at` datetime,
+    PRIMARY KEY (`token_hash`)
+);
+CREATE INDEX IF NOT EXISTS `idx_org_sessions_user_id` ON `org_sessions`(`user_id`);
+CREATE INDEX IF NOT EXISTS `idx_org_sessions_expires_at` ON `org_sessions`(`expires_at`);
@@ -0,0 +1,2 @@
+ALTER TABLE `projects` DROP COLUMN `version`;
+ALTER TABLE `devices` DROP COLUMN `version`;
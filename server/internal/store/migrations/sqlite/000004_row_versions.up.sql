@@ -0,0 +1,4 @@
+-- Optimistic concurrency: every edit of a device or project bumps its version, which the
+-- API exposes as the ETag and checks against If-Match
+ALTER TABLE `devices` ADD COLUMN `version` integer NOT NULL DEFAULT 1;
+ALTER TABLE `projects` ADD COLUMN `version` integer NOT NULL DEFAULT 1;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS `device_claim_codes` (
+    `device_id` uuid,
+    `code_hash` text NOT NULL,
+    `source` text NOT NULL,
+    `expires_at` datetime,
+    `used_at` datetime,
+    `used_by` uuid,
+    `failed_attempts` integer NOT NULL DEFAULT 0,
+    `locked_until` datetime,
+    `created_at` datetime,
+    `updated_at` datetime,
+    PRIMARY KEY (`device_id`)
+);
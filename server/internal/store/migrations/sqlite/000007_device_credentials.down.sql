@@ -0,0 +1,2 @@
+ALTER TABLE `organization_settings` DROP COLUMN `mqtt_legacy_passwords`;
+DROP TABLE IF EXISTS `device_credentials`;
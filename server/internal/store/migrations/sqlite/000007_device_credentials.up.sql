@@ -0,0 +1,14 @@
+-- Per-device MQTT secrets, stored as hashes, replacing the MAC as password
+CREATE TABLE IF NOT EXISTS `device_credentials` (
+    `device_id` uuid,
+    `secret_hash` text NOT NULL,
+    `previous_hash` text,
+    `previous_expires_at` datetime,
+    `rotated_at` datetime NOT NULL,
+    `created_at` datetime,
+    `updated_at` datetime,
+    PRIMARY KEY (`device_id`)
+);
+
+-- Organizations keep accepting MAC/IMEI passwords until their fleet has migrated
+ALTER TABLE `organization_settings` ADD COLUMN `mqtt_legacy_passwords` numeric NOT NULL DEFAULT true;
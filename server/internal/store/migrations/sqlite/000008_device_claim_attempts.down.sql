@@ -0,0 +1,3 @@
+ALTER TABLE `device_claim_codes` ADD COLUMN `locked_until` datetime;
+ALTER TABLE `device_claim_codes` ADD COLUMN `failed_attempts` integer NOT NULL DEFAULT 0;
+DROP TABLE IF EXISTS `device_claim_attempts`;
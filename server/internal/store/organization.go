@@ -58,3 +58,66 @@ func (r *OrganizationRepository) Update(org *models.Organization) error {
 func (r *OrganizationRepository) Delete(id uuid.UUID) error {
 	return r.db.Delete(&models.Organization{}, "id = ?", id).Error
 }
+
+// CountContents counts the projects and devices an organization still owns
+func (r *OrganizationRepository) CountContents(id uuid.UUID) (projects, devices int64, err error) {
+	if err = r.db.Model(&models.Project{}).Where("org_id = ?", id).Count(&projects).Error; err != nil {
+		return 0, 0, err
+	}
+	err = r.db.Model(&models.Device{}).
+		Where("project_id IN (?)", r.db.Model(&models.Project{}).Select("id").Where("org_id = ?", id)).
+		Count(&devices).Error
+	return projects, devices, err
+}
+
+// ContentIDs lists the projects, partitions and devices an organization owns, soft-deleted
+// ones included
+func (r *OrganizationRepository) ContentIDs(id uuid.UUID) (projects, partitions, devices []uuid.UUID, err error) {
+	projectIDs := r.db.Model(&models.Project{}).Unscoped().Select("id").Where("org_id = ?", id)
+	if err = r.db.Model(&models.Project{}).Unscoped().Where("org_id = ?", id).Pluck("id", &projects).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	if err = r.db.Model(&models.Partition{}).Unscoped().Where("project_id IN (?)", projectIDs).Pluck("id", &partitions).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	err = r.db.Model(&models.Device{}).Unscoped().Where("project_id IN (?)", projectIDs).Pluck("id", &devices).Error
+	return projects, partitions, devices, err
+}
+
+// DeleteCascade deletes an organization together with everything it owns, in one transaction:
+// its projects, partitions, devices with their bindings, shares, claim codes, credentials and
+// transfers, its users, groups and memberships, sync runs and settings. Soft-deleted devices
+// count as owned, so their rows go too. Audit logs are kept; retention purges them.
+func (r *OrganizationRepository) DeleteCascade(id uuid.UUID) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		projects := tx.Model(&models.Project{}).Unscoped().Select("id").Where("org_id = ?", id)
+		devices := tx.Model(&models.Device{}).Unscoped().Select("id").Where("project_id IN (?)", projects)
+		groups := tx.Model(&models.Group{}).Unscoped().Select("id").Where("org_id = ?", id)
+		for _, step := range []struct {
+			model interface{}
+			cond  string
+			value interface{}
+		}{
+			{&models.DeviceShare{}, "device_id IN (?)", devices},
+			{&models.DeviceClaimAttempt{}, "device_id IN (?)", devices},
+			{&models.DeviceClaimCode{}, "device_id IN (?)", devices},
+			{&models.DeviceCredential{}, "device_id IN (?)", devices},
+			{&models.DeviceBinding{}, "device_id IN (?)", devices},
+			{&models.DeviceTransfer{}, "device_id IN (?)", devices},
+			{&models.Device{}, "project_id IN (?)", projects},
+			{&models.Partition{}, "project_id IN (?)", projects},
+			{&models.Project{}, "org_id = ?", id},
+			{&models.UserGroup{}, "group_id IN (?)", groups},
+			{&models.Group{}, "org_id = ?", id},
+			{&models.User{}, "org_id = ?", id},
+			{&models.DirectorySyncRun{}, "org_id = ?", id},
+			{&models.OrganizationSetting{}, "org_id = ?", id},
+			{&models.Organization{}, "id = ?", id},
+		} {
+			if err := tx.Where(step.cond, step.value).Delete(step.model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,220 @@
+package store
+
+import (
+	"strings"
+
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PartitionRepository handles partition data operations
+type PartitionRepository struct {
+	db *gorm.DB
+}
+
+// NewPartitionRepository creates a new partition repository
+func NewPartitionRepository(db *gorm.DB) *PartitionRepository {
+	return &PartitionRepository{db: db}
+}
+
+// PartitionLabel returns the materialized path label for a partition ID.
+// Labels are the UUID hex without dashes so they stay valid ltree labels.
+func PartitionLabel(id uuid.UUID) string {
+	return strings.ReplaceAll(id.String(), "-", "")
+}
+
+// Create creates a new partition
+func (r *PartitionRepository) Create(partition *models.Partition) error {
+	return r.db.Create(partition).Error
+}
+
+// GetByID gets a partition by ID
+func (r *PartitionRepository) GetByID(id uuid.UUID) (*models.Partition, error) {
+	var partition models.Partition
+	err := r.db.First(&partition, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &partition, nil
+}
+
+// ListByProject lists all partitions of a project ordered by depth and name
+func (r *PartitionRepository) ListByProject(projectID uuid.UUID) ([]models.Partition, error) {
+	var partitions []models.Partition
+	err := r.db.Where("project_id = ?", projectID).Order("depth ASC, name ASC").Find(&partitions).Error
+	return partitions, err
+}
+
+// CountChildren counts direct children of a partition
+func (r *PartitionRepository) CountChildren(id uuid.UUID) (int64, error) {
+	var n int64
+	err := r.db.Model(&models.Partition{}).Where("parent_id = ?", id).Count(&n).Error
+	return n, err
+}
+
+// ExistsSibling reports whether a sibling with the same name exists under parentID
+func (r *PartitionRepository) ExistsSibling(projectID uuid.UUID, parentID *uuid.UUID, name string, excludeID *uuid.UUID) (bool, error) {
+	query := r.db.Model(&models.Partition{}).Where("project_id = ? AND name = ?", projectID, name)
+	if parentID != nil {
+		query = query.Where("parent_id = ?", *parentID)
+	} else {
+		query = query.Where("parent_id IS NULL")
+	}
+	if excludeID != nil {
+		query = query.Where("id <> ?", *excludeID)
+	}
+	var n int64
+	err := query.Count(&n).Error
+	return n > 0, err
+}
+
+// Update updates a partition
+func (r *PartitionRepository) Update(partition *models.Partition) error {
+	return r.db.Save(partition).Error
+}
+
+// LockProjectTree takes a row lock on the project so concurrent tree restructurings
+// of the same project are serialized. Only meaningful inside a transaction.
+func (r *PartitionRepository) LockProjectTree(projectID uuid.UUID) error {
+	var project models.Project
+	return r.db.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&project, "id = ?", projectID).Error
+}
+
+// MoveSubtree re-parents a partition by rewriting the materialized path and depth of
+// the partition and all of its descendants. Call it inside a transaction.
+func (r *PartitionRepository) MoveSubtree(partition *models.Partition, newParentID *uuid.UUID, newPath string, newDepth int) error {
+	oldPath := partition.Path
+	// Replace the old path prefix with the new one; on Postgres subpath() cannot take
+	// the whole path, so the moved partition itself gets the new path as is
+	path := gorm.Expr("? || SUBSTR(path, ?)", newPath, len(oldPath)+1)
+	if r.isPostgres() {
+		path = gorm.Expr("CASE WHEN nlevel(path) = ? THEN ?::ltree ELSE ?::ltree || subpath(path, ?) END",
+			partition.Depth, newPath, newPath, partition.Depth)
+	}
+	err := r.db.Model(&models.Partition{}).
+		Where("project_id = ?", partition.ProjectID).
+		Where(subtreeCondition(r.db, "path", oldPath)).
+		Updates(map[string]interface{}{
+			"path":       path,
+			"depth":      gorm.Expr("depth + ?", newDepth-partition.Depth),
+			"updated_at": gorm.Expr("CURRENT_TIMESTAMP"),
+		}).Error
+	if err != nil {
+		return err
+	}
+	err = r.db.Model(&models.Partition{}).Where("id = ?", partition.ID).Update("parent_id", newParentID).Error
+	if err != nil {
+		return err
+	}
+	partition.ParentID = newParentID
+	partition.Path = newPath
+	partition.Depth = newDepth
+	return nil
+}
+
+// ListDescendants lists the partitions below partition at any depth, ordered by depth and name
+func (r *PartitionRepository) ListDescendants(partition *models.Partition) ([]models.Partition, error) {
+	var partitions []models.Partition
+	err := r.db.Where(subtreeCondition(r.db, "path", partition.Path)).
+		Where("id <> ?", partition.ID).
+		Order("depth ASC, name ASC").Find(&partitions).Error
+	return partitions, err
+}
+
+// ListAncestors lists the partitions above partition, root first
+func (r *PartitionRepository) ListAncestors(partition *models.Partition) ([]models.Partition, error) {
+	var partitions []models.Partition
+	query := r.db.Where("id <> ?", partition.ID)
+	if r.isPostgres() {
+		query = query.Where("path @> ?::ltree", partition.Path)
+	} else {
+		// Every label of the path is an ancestor's ID, so SQLite looks them up by key
+		labels := strings.Split(partition.Path, ".")
+		ids := make([]uuid.UUID, 0, len(labels))
+		for _, label := range labels[:len(labels)-1] {
+			id, err := uuid.Parse(label)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			return partitions, nil
+		}
+		query = query.Where("id IN ?", ids)
+	}
+	err := query.Order("depth ASC").Find(&partitions).Error
+	return partitions, err
+}
+
+// ListSubtreeDevices lists the devices attached to partition or to any partition below it
+func (r *PartitionRepository) ListSubtreeDevices(partition *models.Partition) ([]models.Device, error) {
+	var devices []models.Device
+	err := r.db.Where("partition_id IN (?)", subtreeIDs(r.db, partition.Path)).
+		Order("display_name ASC, id ASC").Find(&devices).Error
+	return devices, err
+}
+
+// CountSubtreeDevices counts the devices in partition and all partitions below it per status
+func (r *PartitionRepository) CountSubtreeDevices(partition *models.Partition) ([]PartitionDeviceCount, error) {
+	var rows []PartitionDeviceCount
+	err := r.db.Model(&models.Device{}).
+		Select("status, COUNT(*) AS count").
+		Where("partition_id IN (?)", subtreeIDs(r.db, partition.Path)).
+		Group("status").
+		Scan(&rows).Error
+	return rows, err
+}
+
+func (r *PartitionRepository) isPostgres() bool {
+	return r.db.Dialector.Name() == "postgres"
+}
+
+// subtreeCondition matches rows whose path column lies at or below path. Postgres stores
+// paths as ltree and answers with <@ from the GiST index; SQLite keeps text paths and
+// compares a range, which its B-tree index on path serves without scanning the tree.
+// Labels are hex, and '/' sorts right after '.', so the range holds exactly the descendants.
+func subtreeCondition(db *gorm.DB, column, path string) clause.Expr {
+	if db.Dialector.Name() == "postgres" {
+		return gorm.Expr(column+" <@ ?::ltree", path)
+	}
+	return gorm.Expr("("+column+" = ? OR ("+column+" > ? AND "+column+" < ?))", path, path+".", path+"/")
+}
+
+// subtreeIDs selects the IDs of the partition at path and all partitions below it
+func subtreeIDs(db *gorm.DB, path string) *gorm.DB {
+	return db.Model(&models.Partition{}).Select("id").Where(subtreeCondition(db, "path", path))
+}
+
+// Delete deletes a partition
+func (r *PartitionRepository) Delete(id uuid.UUID) error {
+	return r.db.Delete(&models.Partition{}, "id = ?", id).Error
+}
+
+// PartitionDeviceCount holds device counts per partition and status
+type PartitionDeviceCount struct {
+	PartitionID *uuid.UUID
+	Status      models.DeviceStatus
+	Count       int64
+}
+
+// CountDevicesByPartition aggregates device counts of a project per partition and status
+func (r *PartitionRepository) CountDevicesByPartition(projectID uuid.UUID) ([]PartitionDeviceCount, error) {
+	var rows []PartitionDeviceCount
+	err := r.db.Model(&models.Device{}).
+		Select("partition_id, status, COUNT(*) AS count").
+		Where("project_id = ?", projectID).
+		Group("partition_id, status").
+		Scan(&rows).Error
+	return rows, err
+}
+
+// CountDevices counts devices directly attached to a partition
+func (r *PartitionRepository) CountDevices(id uuid.UUID) (int64, error) {
+	var n int64
+	err := r.db.Model(&models.Device{}).Where("partition_id = ?", id).Count(&n).Error
+	return n, err
+}
@@ -39,12 +39,14 @@ func (r *ProjectRepository) ListByOrg(orgID uuid.UUID) ([]models.Project, error)
 	return projects, err
 }
 
-// Update updates a project
+// Update writes the project if it is still at the version it was read at, and advances
+// the version; ErrVersionConflict means it changed meanwhile
 func (r *ProjectRepository) Update(project *models.Project) error {
-	return r.db.Save(project).Error
+	return updateVersioned(r.db, project, &project.Version)
 }
 
-// Delete deletes a project
-func (r *ProjectRepository) Delete(id uuid.UUID) error {
-	return r.db.Delete(&models.Project{}, "id = ?", id).Error
+// DeleteVersion deletes the project if it is still at version; ErrVersionConflict means it
+// changed meanwhile
+func (r *ProjectRepository) DeleteVersion(id uuid.UUID, version int64) error {
+	return deleteVersioned(r.db, &models.Project{}, id, version)
 }
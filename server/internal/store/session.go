@@ -0,0 +1,44 @@
+package store
+
+import (
+	"time"
+
+	"server/internal/domain/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OrgSessionRepository handles the active organizations of login sessions
+type OrgSessionRepository struct {
+	db *gorm.DB
+}
+
+// NewOrgSessionRepository creates a new org session repository
+func NewOrgSessionRepository(db *gorm.DB) *OrgSessionRepository {
+	return &OrgSessionRepository{db: db}
+}
+
+// Get gets the unexpired session with tokenHash
+func (r *OrgSessionRepository) Get(tokenHash string, now time.Time) (*models.OrgSession, error) {
+	var session models.OrgSession
+	err := r.db.Where("expires_at > ?", now).First(&session, "token_hash = ?", tokenHash).Error
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Save creates the session or moves it to another organization
+func (r *OrgSessionRepository) Save(session *models.OrgSession) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "token_hash"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "org_id", "expires_at", "updated_at"}),
+	}).Create(session).Error
+}
+
+// DeleteExpired deletes the sessions whose token expired before now
+func (r *OrgSessionRepository) DeleteExpired(now time.Time) (int64, error) {
+	res := r.db.Where("expires_at <= ?", now).Delete(&models.OrgSession{})
+	return res.RowsAffected, res.Error
+}
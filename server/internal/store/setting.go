@@ -34,7 +34,8 @@ func (r *OrganizationSettingRepository) Upsert(ctx context.Context, s *models.Or
 		DoUpdates: clause.Assignments(map[string]interface{}{
 			"factory_allow_registration": s.FactoryAllowRegistration,
 			"factory_default_project_id": s.FactoryDefaultProjectID,
-			"updated_at":                 gorm.Expr("NOW()"),
+			"mqtt_legacy_passwords":      s.MQTTLegacyPasswords,
+			"updated_at":                 time.Now(),
 		}),
 	}).Create(s).Error
 }
@@ -58,17 +59,3 @@ func (r *SystemSettingRepository) Set(ctx context.Context, key, value string) er
 	s := &models.SystemSetting{Key: key, Value: value}
 	return r.db.WithContext(ctx).Save(s).Error
 }
-
-// AuditLogRepository helpers for purge
-type AuditLogRepository struct{ db *gorm.DB }
-
-func NewAuditLogRepository(db *gorm.DB) *AuditLogRepository { return &AuditLogRepository{db: db} }
-
-func (r *AuditLogRepository) PurgeOlderThan(ctx context.Context, cutoff time.Time) (int64, error) {
-	res := r.db.WithContext(ctx).Where("created_at < ?", cutoff).Delete(&models.AuditLog{})
-	return res.RowsAffected, res.Error
-}
-
-func (r *AuditLogRepository) Insert(ctx context.Context, rec *models.AuditLog) error {
-	return r.db.WithContext(ctx).Create(rec).Error
-}
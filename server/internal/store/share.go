@@ -0,0 +1,82 @@
+package store
+
+import (
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DeviceShareRepository handles device share data operations
+type DeviceShareRepository struct {
+	db *gorm.DB
+}
+
+// NewDeviceShareRepository creates a new device share repository
+func NewDeviceShareRepository(db *gorm.DB) *DeviceShareRepository {
+	return &DeviceShareRepository{db: db}
+}
+
+// Create creates a new device share
+func (r *DeviceShareRepository) Create(share *models.DeviceShare) error {
+	return r.db.Create(share).Error
+}
+
+// GetByID gets a device share by ID
+func (r *DeviceShareRepository) GetByID(id uuid.UUID) (*models.DeviceShare, error) {
+	var share models.DeviceShare
+	err := r.db.First(&share, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// GetByDeviceAndSubject gets the share of a device held by a subject
+func (r *DeviceShareRepository) GetByDeviceAndSubject(deviceID uuid.UUID, subjectType models.SubjectType, subjectID uuid.UUID) (*models.DeviceShare, error) {
+	var share models.DeviceShare
+	err := r.db.First(&share, "device_id = ? AND subject_type = ? AND subject_id = ?", deviceID, subjectType, subjectID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// ListByDevice lists all shares of a device
+func (r *DeviceShareRepository) ListByDevice(deviceID uuid.UUID) ([]models.DeviceShare, error) {
+	var shares []models.DeviceShare
+	err := r.db.Where("device_id = ?", deviceID).Order("granted_at ASC").Find(&shares).Error
+	return shares, err
+}
+
+// ListByDevices lists all shares of the devices
+func (r *DeviceShareRepository) ListByDevices(deviceIDs []uuid.UUID) ([]models.DeviceShare, error) {
+	var shares []models.DeviceShare
+	if len(deviceIDs) == 0 {
+		return shares, nil
+	}
+	err := r.db.Where("device_id IN ?", deviceIDs).Order("granted_at ASC").Find(&shares).Error
+	return shares, err
+}
+
+// ListByDeviceAndRole lists shares of a device with a given role
+func (r *DeviceShareRepository) ListByDeviceAndRole(deviceID uuid.UUID, role models.DeviceRole) ([]models.DeviceShare, error) {
+	var shares []models.DeviceShare
+	err := r.db.Where("device_id = ? AND role = ?", deviceID, role).Find(&shares).Error
+	return shares, err
+}
+
+// DeleteByDeviceAndRole removes all shares of a device with a given role
+func (r *DeviceShareRepository) DeleteByDeviceAndRole(deviceID uuid.UUID, role models.DeviceRole) error {
+	return r.db.Where("device_id = ? AND role = ?", deviceID, role).Delete(&models.DeviceShare{}).Error
+}
+
+// Delete deletes a device share
+func (r *DeviceShareRepository) Delete(id uuid.UUID) error {
+	return r.db.Delete(&models.DeviceShare{}, "id = ?", id).Error
+}
+
+// DeleteByDevice removes all shares of a device
+func (r *DeviceShareRepository) DeleteByDevice(deviceID uuid.UUID) error {
+	return r.db.Where("device_id = ?", deviceID).Delete(&models.DeviceShare{}).Error
+}
@@ -5,7 +5,6 @@ import (
 	"strings"
 
 	"server/internal/config"
-	"server/internal/domain/models"
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/driver/postgres"
@@ -52,6 +51,9 @@ func New(cfg *config.Config) (*Store, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database (dsn=%s): %w", dsn, err)
 	}
+	if err := RegisterTenantScope(db); err != nil {
+		return nil, fmt.Errorf("failed to register tenant scope: %w", err)
+	}
 
 	return &Store{db: db}, nil
 }
@@ -61,25 +63,6 @@ func (s *Store) DB() *gorm.DB {
 	return s.db
 }
 
-// AutoMigrate runs database migrations
-func (s *Store) AutoMigrate() error {
-	return s.db.AutoMigrate(
-		&models.Organization{},
-		&models.User{},
-		&models.Group{},
-		&models.Project{},
-		&models.Partition{},
-		&models.Device{},
-		&models.DeviceBinding{},
-		&models.DeviceShare{},
-		&models.DeviceTransfer{},
-		&models.CasbinRule{},
-		&models.AuditLog{},
-		&models.OrganizationSetting{},
-		&models.SystemSetting{},
-	)
-}
-
 // Close closes the database connection
 func (s *Store) Close() error {
 	sqlDB, err := s.db.DB()
@@ -97,3 +80,11 @@ func (s *Store) Health() error {
 	}
 	return sqlDB.Ping()
 }
+
+// likeEscaper escapes LIKE wildcards; queries using it must declare ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// containsPattern returns a LIKE pattern matching s anywhere in the value
+func containsPattern(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
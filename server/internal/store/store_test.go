@@ -1,7 +1,9 @@
 package store
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"server/internal/domain/models"
 
@@ -20,7 +22,7 @@ func setupTestDB(t *testing.T) *Store {
 	store := &Store{db: db}
 
 	// Run migrations
-	err = store.AutoMigrate()
+	_, err = store.MigrateUp(context.Background(), 0)
 	require.NoError(t, err)
 
 	return store
@@ -145,8 +147,7 @@ func TestDeviceRepository_CRUD(t *testing.T) {
 	assert.Len(t, devices, 1)
 
 	// Update device status
-	device.Status = models.DeviceStatusOnline
-	err = deviceRepo.Update(device)
+	err = deviceRepo.UpdatePresence(device.ID, models.DeviceStatusOnline, time.Now())
 	assert.NoError(t, err)
 
 	// Verify update
@@ -162,3 +163,187 @@ func TestDeviceRepository_CRUD(t *testing.T) {
 	_, err = deviceRepo.GetByID(device.ID)
 	assert.Error(t, err)
 }
+
+func TestDeviceRepository_TagAndMetaFilters(t *testing.T) {
+	store := setupTestDB(t)
+	t.Cleanup(func() { _ = store.Close() })
+
+	deviceRepo := NewDeviceRepository(store.DB())
+
+	org := &models.Organization{
+		BaseModel:  models.BaseModel{ID: uuid.New()},
+		CasdoorOrg: "test-org",
+		Name:       "Test Organization",
+	}
+	require.NoError(t, NewOrganizationRepository(store.DB()).Create(org))
+	project := &models.Project{
+		BaseModel: models.BaseModel{ID: uuid.New()},
+		OrgID:     org.ID,
+		Name:      "Test Project",
+		CreatedBy: uuid.New(),
+	}
+	require.NoError(t, store.DB().Create(project).Error)
+
+	newDevice := func(mac string, tags []string, meta models.JSONMap) *models.Device {
+		device := &models.Device{
+			BaseModel:   models.BaseModel{ID: uuid.New()},
+			MAC:         mac,
+			DeviceType:  models.DeviceTypeLTE,
+			ProjectID:   project.ID,
+			DisplayName: mac,
+			Status:      models.DeviceStatusOffline,
+			Tags:        tags,
+			Meta:        meta,
+		}
+		require.NoError(t, deviceRepo.Create(device))
+		return device
+	}
+	roof := newDevice("A1B2C3D4E5F1", []string{"outdoor", "roof"}, models.JSONMap{"floor": "12", "solar": true})
+	lobby := newDevice("A1B2C3D4E5F2", []string{"indoor"}, models.JSONMap{"floor": "1", "solar": false})
+	newDevice("A1B2C3D4E5F3", nil, nil)
+
+	macs := func(filters map[string]interface{}) []string {
+		devices, err := deviceRepo.ListByOrg(org.ID, filters)
+		require.NoError(t, err)
+		out := []string{}
+		for _, d := range devices {
+			out = append(out, d.MAC)
+		}
+		return out
+	}
+
+	assert.ElementsMatch(t, []string{roof.MAC, lobby.MAC}, macs(map[string]interface{}{FilterTagsAny: []string{"roof", "indoor"}}))
+	assert.ElementsMatch(t, []string{roof.MAC}, macs(map[string]interface{}{FilterTagsAll: []string{"roof", "outdoor"}}))
+	assert.Empty(t, macs(map[string]interface{}{FilterTagsAll: []string{"roof", "indoor"}}))
+	assert.ElementsMatch(t, []string{lobby.MAC}, macs(map[string]interface{}{FilterMeta: map[string]string{"floor": "1"}}))
+	assert.ElementsMatch(t, []string{roof.MAC}, macs(map[string]interface{}{FilterMeta: map[string]string{"solar": "true"}}))
+	assert.ElementsMatch(t, []string{roof.MAC}, macs(map[string]interface{}{
+		FilterTagsAny: []string{"outdoor", "indoor"},
+		FilterMeta:    map[string]string{"floor": "12"},
+	}))
+
+	// Tags and meta round-trip; missing values read back as empty
+	retrieved, err := deviceRepo.GetByID(roof.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StringList{"outdoor", "roof"}, retrieved.Tags)
+	assert.Equal(t, true, retrieved.Meta["solar"])
+	retrieved, err = deviceRepo.GetByMAC("A1B2C3D4E5F3")
+	require.NoError(t, err)
+	assert.Empty(t, retrieved.Tags)
+	assert.Empty(t, retrieved.Meta)
+}
+
+func TestPartitionRepository_Subtree(t *testing.T) {
+	store := setupTestDB(t)
+	t.Cleanup(func() { _ = store.Close() })
+	repo := NewPartitionRepository(store.DB())
+
+	projectID := uuid.New()
+	newPartition := func(parent *models.Partition, name string) *models.Partition {
+		p := &models.Partition{BaseModel: models.BaseModel{ID: uuid.New()}, ProjectID: projectID, Name: name, Depth: 1}
+		p.Path = PartitionLabel(p.ID)
+		if parent != nil {
+			p.ParentID = &parent.ID
+			p.Path = parent.Path + "." + p.Path
+			p.Depth = parent.Depth + 1
+		}
+		require.NoError(t, repo.Create(p))
+		return p
+	}
+	root := newPartition(nil, "root")
+	child := newPartition(root, "child")
+	grandchild := newPartition(child, "grandchild")
+	sibling := newPartition(nil, "sibling")
+
+	descendants, err := repo.ListDescendants(root)
+	require.NoError(t, err)
+	require.Len(t, descendants, 2)
+	assert.Equal(t, child.ID, descendants[0].ID)
+	assert.Equal(t, grandchild.ID, descendants[1].ID)
+
+	ancestors, err := repo.ListAncestors(grandchild)
+	require.NoError(t, err)
+	require.Len(t, ancestors, 2)
+	assert.Equal(t, root.ID, ancestors[0].ID)
+	ancestors, err = repo.ListAncestors(root)
+	require.NoError(t, err)
+	assert.Empty(t, ancestors)
+
+	for i, p := range []*models.Partition{root, grandchild, sibling} {
+		require.NoError(t, store.DB().Create(&models.Device{
+			BaseModel:   models.BaseModel{ID: uuid.New()},
+			MAC:         "A1B2C3D4E5F" + string(rune('0'+i)),
+			DeviceType:  models.DeviceTypeWiFi,
+			ProjectID:   projectID,
+			PartitionID: &p.ID,
+			Status:      models.DeviceStatusOffline,
+		}).Error)
+	}
+	devices, err := repo.ListSubtreeDevices(child)
+	require.NoError(t, err)
+	assert.Len(t, devices, 1)
+	counts, err := repo.CountSubtreeDevices(root)
+	require.NoError(t, err)
+	require.Len(t, counts, 1)
+	assert.Equal(t, int64(2), counts[0].Count)
+}
+
+func TestVersionedWrites(t *testing.T) {
+	store := setupTestDB(t)
+	t.Cleanup(func() { _ = store.Close() })
+
+	org := &models.Organization{BaseModel: models.BaseModel{ID: uuid.New()}, CasdoorOrg: "test-org", Name: "Test Organization"}
+	require.NoError(t, NewOrganizationRepository(store.DB()).Create(org))
+	projectRepo := NewProjectRepository(store.DB())
+	project := &models.Project{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: org.ID, Name: "Test Project", CreatedBy: uuid.New()}
+	require.NoError(t, projectRepo.Create(project))
+	deviceRepo := NewDeviceRepository(store.DB())
+	device := &models.Device{BaseModel: models.BaseModel{ID: uuid.New()}, MAC: "A1B2C3D4E5F6", DeviceType: models.DeviceTypeLTE, ProjectID: project.ID, Status: models.DeviceStatusOffline}
+	require.NoError(t, deviceRepo.Create(device))
+
+	current := func() int64 {
+		stored, err := deviceRepo.GetByID(device.ID)
+		require.NoError(t, err)
+		return stored.Version
+	}
+	assert.Equal(t, int64(1), current())
+
+	// A stale copy loses against the write that got there first
+	stale := *device
+	device.DisplayName = "Gate"
+	require.NoError(t, deviceRepo.Update(device))
+	assert.Equal(t, int64(2), device.Version)
+	stale.DisplayName = "Fence"
+	assert.ErrorIs(t, deviceRepo.Update(&stale), ErrVersionConflict)
+	assert.Equal(t, int64(1), stale.Version)
+	stored, err := deviceRepo.GetByID(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Gate", stored.DisplayName)
+
+	// Presence reports do not count as edits
+	require.NoError(t, deviceRepo.UpdatePresence(device.ID, models.DeviceStatusOnline, time.Now()))
+	assert.Equal(t, int64(2), current())
+	require.NoError(t, deviceRepo.UpdateStatus(device.ID, 2, models.DeviceStatusUnbound))
+	assert.Equal(t, int64(3), current())
+
+	filled, err := deviceRepo.FillEmpty(device.ID, "imei", "123456789012345")
+	require.NoError(t, err)
+	assert.True(t, filled)
+	filled, err = deviceRepo.FillEmpty(device.ID, "imei", "999999999999999")
+	require.NoError(t, err)
+	assert.False(t, filled)
+	assert.Equal(t, int64(4), current())
+
+	assert.ErrorIs(t, deviceRepo.UpdatePlacement(device.ID, 3, project.ID, nil), ErrVersionConflict)
+	require.NoError(t, deviceRepo.UpdatePlacement(device.ID, 4, project.ID, nil))
+	assert.Equal(t, int64(5), current())
+
+	assert.ErrorIs(t, deviceRepo.DeleteVersion(device.ID, 4), ErrVersionConflict)
+	require.NoError(t, deviceRepo.DeleteVersion(device.ID, 5))
+
+	project.Name = "Renamed"
+	require.NoError(t, projectRepo.Update(project))
+	assert.Equal(t, int64(2), project.Version)
+	assert.ErrorIs(t, projectRepo.DeleteVersion(project.ID, 1), ErrVersionConflict)
+	require.NoError(t, projectRepo.DeleteVersion(project.ID, 2))
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"server/internal/tenant"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrCrossTenant is returned when a scoped request creates a row owned by another organization
+var ErrCrossTenant = errors.New("row belongs to another organization")
+
+// ErrNoTenantScope is returned for statements on organization-owned tables whose context
+// neither names an organization nor bypasses tenancy, as when a handler forgets WithContext
+var ErrNoTenantScope = errors.New("no tenant scope on a query of an organization-owned table")
+
+// tenantTable describes how an organization-owned table leads back to its organization:
+// column holds the organization ID itself, or, when parent is set, the ID of a row in
+// parent, which is owned in turn. field is the model field of column.
+type tenantTable struct {
+	column string
+	field  string
+	parent string
+}
+
+// tenantTables lists the organization-owned tables. Device transfers are left out: they are
+// addressed to a user who may sit in another organization and are checked against the
+// sender and recipient instead.
+var tenantTables = map[string]tenantTable{
+	"organizations":         {column: "id", field: "ID"},
+	"users":                 {column: "org_id", field: "OrgID"},
+	"groups":                {column: "org_id", field: "OrgID"},
+	"user_groups":           {column: "group_id", field: "GroupID", parent: "groups"},
+	"directory_sync_runs":   {column: "org_id", field: "OrgID"},
+	"projects":              {column: "org_id", field: "OrgID"},
+	"partitions":            {column: "project_id", field: "ProjectID", parent: "projects"},
+	"devices":               {column: "project_id", field: "ProjectID", parent: "projects"},
+	"device_bindings":       {column: "device_id", field: "DeviceID", parent: "devices"},
+	"device_shares":         {column: "device_id", field: "DeviceID", parent: "devices"},
+	"device_claim_codes":    {column: "device_id", field: "DeviceID", parent: "devices"},
+	"device_claim_attempts": {column: "device_id", field: "DeviceID", parent: "devices"},
+	"device_credentials":    {column: "device_id", field: "DeviceID", parent: "devices"},
+	"audit_logs":            {column: "org_id", field: "OrgID"},
+	"organization_settings": {column: "org_id", field: "OrgID"},
+}
+
+// RegisterTenantScope installs the callbacks that confine every query, update and delete
+// on an organization-owned table to the organization in the statement's context (see
+// package tenant), and refuse creating rows for another organization. Contexts with
+// tenant.Bypass are not restricted; contexts without any scope fail with ErrNoTenantScope.
+// Raw SQL is never rewritten.
+func RegisterTenantScope(db *gorm.DB) error {
+	cb := db.Callback()
+	if err := cb.Query().Before("gorm:query").Register("tenant:scope", scopeTenant); err != nil {
+		return err
+	}
+	if err := cb.Row().Before("gorm:row").Register("tenant:scope", scopeTenant); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("gorm:update").Register("tenant:scope", scopeTenant); err != nil {
+		return err
+	}
+	if err := cb.Delete().Before("gorm:delete").Register("tenant:scope", scopeTenant); err != nil {
+		return err
+	}
+	return cb.Create().Before("gorm:create").Register("tenant:check", checkTenantCreate)
+}
+
+func scopeTenant(db *gorm.DB) {
+	if db.Error != nil || db.Statement.SQL.Len() > 0 {
+		return
+	}
+	table, ok := tenantTables[db.Statement.Table]
+	if !ok {
+		return
+	}
+	orgID, ok := scopedOrg(db)
+	if !ok {
+		return
+	}
+	column := db.Statement.Quote(clause.Column{Table: db.Statement.Table, Name: table.column})
+	cond, vars := tenantCondition(column, table, orgID)
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: cond, Vars: vars}}})
+}
+
+// scopedOrg returns the organization a statement on an organization-owned table is scoped
+// to. ok is false for a bypassing context and, with ErrNoTenantScope added, for a context
+// without any scope.
+func scopedOrg(db *gorm.DB) (orgID uuid.UUID, ok bool) {
+	if orgID, ok = tenant.OrgID(db.Statement.Context); ok {
+		return orgID, true
+	}
+	if !tenant.Bypassed(db.Statement.Context) {
+		_ = db.AddError(ErrNoTenantScope)
+	}
+	return uuid.Nil, false
+}
+
+// tenantCondition restricts column, which holds table's owner key, to the organization,
+// following parent tables with subqueries: a device share's device must belong to a
+// project of the organization
+func tenantCondition(column string, table tenantTable, orgID uuid.UUID) (string, []interface{}) {
+	if table.parent == "" {
+		return column + " = ?", []interface{}{orgID}
+	}
+	parent := tenantTables[table.parent]
+	cond, vars := tenantCondition(parent.column, parent, orgID)
+	return fmt.Sprintf("%s IN (SELECT id FROM %s WHERE %s)", column, table.parent, cond), vars
+}
+
+// checkTenantCreate refuses inserts whose owner key points outside the organization
+func checkTenantCreate(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+	table, ok := tenantTables[db.Statement.Table]
+	if !ok {
+		return
+	}
+	orgID, ok := scopedOrg(db)
+	if !ok {
+		return
+	}
+	field := db.Statement.Schema.LookUpField(table.field)
+	if field == nil {
+		return
+	}
+
+	keys := make(map[uuid.UUID]bool)
+	collect := func(rv reflect.Value) {
+		value, zero := field.ValueOf(db.Statement.Context, rv)
+		if zero {
+			keys[uuid.Nil] = true
+			return
+		}
+		switch v := value.(type) {
+		case uuid.UUID:
+			keys[v] = true
+		case *uuid.UUID:
+			keys[*v] = true
+		}
+	}
+	rv := reflect.Indirect(db.Statement.ReflectValue)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			collect(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		collect(rv)
+	default:
+		return
+	}
+
+	if table.parent == "" {
+		for key := range keys {
+			if key != orgID {
+				_ = db.AddError(ErrCrossTenant)
+				return
+			}
+		}
+		return
+	}
+
+	// The owning rows are looked up in the same scope, so rows of other organizations
+	// are simply not found
+	ids := make([]uuid.UUID, 0, len(keys))
+	for key := range keys {
+		ids = append(ids, key)
+	}
+	var found int64
+	err := db.Session(&gorm.Session{NewDB: true}).Table(table.parent).Where("id IN ?", ids).Count(&found).Error
+	if err != nil {
+		_ = db.AddError(err)
+	} else if found != int64(len(ids)) {
+		_ = db.AddError(ErrCrossTenant)
+	}
+}
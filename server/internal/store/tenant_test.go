@@ -0,0 +1,174 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"server/internal/domain/models"
+	"server/internal/tenant"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+type tenantFixture struct {
+	org     *models.Organization
+	project *models.Project
+	device  *models.Device
+	share   *models.DeviceShare
+}
+
+func seedTenant(t *testing.T, db *gorm.DB, name, mac string) tenantFixture {
+	org := &models.Organization{BaseModel: models.BaseModel{ID: uuid.New()}, CasdoorOrg: name, Name: name}
+	require.NoError(t, db.Create(org).Error)
+	project := &models.Project{BaseModel: models.BaseModel{ID: uuid.New()}, OrgID: org.ID, Name: name, CreatedBy: uuid.New()}
+	require.NoError(t, db.Create(project).Error)
+	device := &models.Device{
+		BaseModel:   models.BaseModel{ID: uuid.New()},
+		MAC:         mac,
+		DeviceType:  models.DeviceTypeLTE,
+		ProjectID:   project.ID,
+		DisplayName: name,
+		Status:      models.DeviceStatusOffline,
+	}
+	require.NoError(t, db.Create(device).Error)
+	share := &models.DeviceShare{
+		BaseModel:   models.BaseModel{ID: uuid.New()},
+		DeviceID:    device.ID,
+		SubjectType: models.SubjectTypeUser,
+		SubjectID:   uuid.New(),
+		Role:        models.DeviceRoleViewer,
+		GrantedBy:   uuid.New(),
+		GrantedAt:   time.Now(),
+	}
+	require.NoError(t, db.Create(share).Error)
+	return tenantFixture{org: org, project: project, device: device, share: share}
+}
+
+func TestTenantScope(t *testing.T) {
+	store := setupTestDB(t)
+	t.Cleanup(func() { _ = store.Close() })
+	require.NoError(t, RegisterTenantScope(store.DB()))
+	system := store.DB().WithContext(tenant.Bypass(context.Background()))
+
+	a := seedTenant(t, system, "org-a", "AAAAAAAAAAAA")
+	b := seedTenant(t, system, "org-b", "BBBBBBBBBBBB")
+	scoped := store.DB().WithContext(tenant.WithOrg(context.Background(), a.org.ID))
+
+	t.Run("reads stay in the organization", func(t *testing.T) {
+		projects := NewProjectRepository(scoped)
+		_, err := projects.GetByID(a.project.ID)
+		assert.NoError(t, err)
+		_, err = projects.GetByID(b.project.ID)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+		list, err := projects.ListByOrg(b.org.ID)
+		require.NoError(t, err)
+		assert.Empty(t, list)
+
+		devices := NewDeviceRepository(scoped)
+		_, err = devices.GetByMAC(b.device.MAC)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+		_, err = devices.GetByID(b.device.ID)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+		list2, err := devices.ListByOrg(b.org.ID, nil)
+		require.NoError(t, err)
+		assert.Empty(t, list2)
+
+		// Unfiltered queries only see the caller's rows
+		var all []models.Device
+		require.NoError(t, scoped.Find(&all).Error)
+		require.Len(t, all, 1)
+		assert.Equal(t, a.device.ID, all[0].ID)
+		var count int64
+		require.NoError(t, scoped.Model(&models.Organization{}).Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+
+		shares, err := NewDeviceShareRepository(scoped).ListByDevice(b.device.ID)
+		require.NoError(t, err)
+		assert.Empty(t, shares)
+		_, err = NewDeviceShareRepository(scoped).GetByID(a.share.ID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("writes stay in the organization", func(t *testing.T) {
+		devices := NewDeviceRepository(scoped)
+		require.NoError(t, devices.UpdatePresence(b.device.ID, models.DeviceStatusOnline, time.Now()))
+		assert.ErrorIs(t, devices.UpdateStatus(b.device.ID, b.device.Version, models.DeviceStatusOnline), ErrVersionConflict)
+		require.NoError(t, devices.Delete(b.device.ID))
+		require.NoError(t, NewDeviceShareRepository(scoped).Delete(b.share.ID))
+
+		var device models.Device
+		require.NoError(t, system.First(&device, "id = ?", b.device.ID).Error)
+		assert.Equal(t, models.DeviceStatusOffline, device.Status)
+		var share models.DeviceShare
+		assert.NoError(t, system.First(&share, "id = ?", b.share.ID).Error)
+
+		// Another organization's row is not found, so a versioned update matches nothing
+		project := *b.project
+		project.Name = "taken over"
+		assert.ErrorIs(t, NewProjectRepository(scoped).Update(&project), ErrVersionConflict)
+		var stored models.Project
+		require.NoError(t, system.First(&stored, "id = ?", b.project.ID).Error)
+		assert.NotEqual(t, "taken over", stored.Name)
+	})
+
+	t.Run("creates stay in the organization", func(t *testing.T) {
+		err := NewProjectRepository(scoped).Create(&models.Project{
+			BaseModel: models.BaseModel{ID: uuid.New()},
+			OrgID:     b.org.ID,
+			Name:      "foreign",
+			CreatedBy: uuid.New(),
+		})
+		assert.ErrorIs(t, err, ErrCrossTenant)
+
+		err = NewDeviceRepository(scoped).Create(&models.Device{
+			BaseModel:   models.BaseModel{ID: uuid.New()},
+			MAC:         "CCCCCCCCCCCC",
+			DeviceType:  models.DeviceTypeLTE,
+			ProjectID:   b.project.ID,
+			DisplayName: "foreign",
+			Status:      models.DeviceStatusUnbound,
+		})
+		assert.ErrorIs(t, err, ErrCrossTenant)
+
+		err = NewDeviceRepository(scoped).Create(&models.Device{
+			BaseModel:   models.BaseModel{ID: uuid.New()},
+			MAC:         "DDDDDDDDDDDD",
+			DeviceType:  models.DeviceTypeLTE,
+			ProjectID:   a.project.ID,
+			DisplayName: "own",
+			Status:      models.DeviceStatusUnbound,
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("bypass sees every organization", func(t *testing.T) {
+		_, err := NewDeviceRepository(system).GetByMAC(b.device.MAC)
+		assert.NoError(t, err)
+		var count int64
+		require.NoError(t, system.Model(&models.Organization{}).Count(&count).Error)
+		assert.Equal(t, int64(2), count)
+	})
+
+	t.Run("unscoped contexts are refused", func(t *testing.T) {
+		unscoped := store.DB().WithContext(context.Background())
+		_, err := NewDeviceRepository(unscoped).GetByMAC(b.device.MAC)
+		assert.ErrorIs(t, err, ErrNoTenantScope)
+		var count int64
+		assert.ErrorIs(t, unscoped.Model(&models.Organization{}).Count(&count).Error, ErrNoTenantScope)
+		assert.ErrorIs(t, NewDeviceRepository(unscoped).UpdatePresence(a.device.ID, models.DeviceStatusOnline, time.Now()), ErrNoTenantScope)
+		err = NewProjectRepository(unscoped).Create(&models.Project{
+			BaseModel: models.BaseModel{ID: uuid.New()},
+			OrgID:     a.org.ID,
+			Name:      "unscoped",
+			CreatedBy: uuid.New(),
+		})
+		assert.ErrorIs(t, err, ErrNoTenantScope)
+
+		// Tables outside the organizations are not affected
+		assert.NoError(t, unscoped.Model(&models.SystemSetting{}).Count(&count).Error)
+	})
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"time"
+
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DeviceTransferRepository handles device transfer data operations
+type DeviceTransferRepository struct {
+	db *gorm.DB
+}
+
+// NewDeviceTransferRepository creates a new device transfer repository
+func NewDeviceTransferRepository(db *gorm.DB) *DeviceTransferRepository {
+	return &DeviceTransferRepository{db: db}
+}
+
+// Create creates a new device transfer
+func (r *DeviceTransferRepository) Create(transfer *models.DeviceTransfer) error {
+	return r.db.Create(transfer).Error
+}
+
+// GetByID gets a device transfer by ID
+func (r *DeviceTransferRepository) GetByID(id uuid.UUID) (*models.DeviceTransfer, error) {
+	var transfer models.DeviceTransfer
+	err := r.db.Preload("Device").First(&transfer, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// GetPendingByDevice gets the pending transfer of a device, if any
+func (r *DeviceTransferRepository) GetPendingByDevice(deviceID uuid.UUID) (*models.DeviceTransfer, error) {
+	var transfer models.DeviceTransfer
+	err := r.db.First(&transfer, "device_id = ? AND status = ?", deviceID, models.TransferStatusPending).Error
+	if err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// ListBySubject lists transfers sent (fromSide) or received by a subject, optionally filtered by status
+func (r *DeviceTransferRepository) ListBySubject(subjectID uuid.UUID, fromSide bool, status models.TransferStatus) ([]models.DeviceTransfer, error) {
+	var transfers []models.DeviceTransfer
+	query := r.db.Preload("Device")
+	if fromSide {
+		query = query.Where("from_subject_id = ?", subjectID)
+	} else {
+		query = query.Where("to_subject_id = ?", subjectID)
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	err := query.Order("created_at DESC").Find(&transfers).Error
+	return transfers, err
+}
+
+// UpdateStatus moves a transfer from pending to a final status; returns false if it was no longer pending
+func (r *DeviceTransferRepository) UpdateStatus(transfer *models.DeviceTransfer, status models.TransferStatus) (bool, error) {
+	now := time.Now()
+	res := r.db.Model(&models.DeviceTransfer{}).
+		Where("id = ? AND status = ?", transfer.ID, models.TransferStatusPending).
+		Updates(map[string]interface{}{
+			"status":       status,
+			"processed_at": now,
+		})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	transfer.Status = status
+	transfer.ProcessedAt = &now
+	return true, nil
+}
+
+// CancelPendingByDevice cancels any pending transfer of a device
+func (r *DeviceTransferRepository) CancelPendingByDevice(deviceID uuid.UUID) error {
+	return r.db.Model(&models.DeviceTransfer{}).
+		Where("device_id = ? AND status = ?", deviceID, models.TransferStatusPending).
+		Updates(map[string]interface{}{
+			"status":       models.TransferStatusCancelled,
+			"processed_at": time.Now(),
+		}).Error
+}
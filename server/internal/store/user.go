@@ -0,0 +1,105 @@
+package store
+
+import (
+	"strings"
+
+	"server/internal/domain/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// UserRepository handles user data operations
+type UserRepository struct {
+	db *gorm.DB
+}
+
+// NewUserRepository creates a new user repository
+func NewUserRepository(db *gorm.DB) *UserRepository {
+	return &UserRepository{db: db}
+}
+
+// Create creates a new user
+func (r *UserRepository) Create(user *models.User) error {
+	return r.db.Create(user).Error
+}
+
+// GetByID gets a user by ID
+func (r *UserRepository) GetByID(id uuid.UUID) (*models.User, error) {
+	var user models.User
+	err := r.db.First(&user, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetByCasdoorUserID gets a user by Casdoor user ID, including soft-deleted users
+func (r *UserRepository) GetByCasdoorUserID(casdoorUserID string) (*models.User, error) {
+	var user models.User
+	err := r.db.Unscoped().First(&user, "casdoor_user_id = ?", casdoorUserID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ListByOrg lists the users of an organization, optionally including soft-deleted ones
+func (r *UserRepository) ListByOrg(orgID uuid.UUID, includeDeleted bool) ([]models.User, error) {
+	var users []models.User
+	query := r.db
+	if includeDeleted {
+		query = query.Unscoped()
+	}
+	err := query.Where("org_id = ?", orgID).Find(&users).Error
+	return users, err
+}
+
+// Search pages through an organization's users whose username, display name or email
+// contains q, case-insensitively, and returns the total number of matches
+func (r *UserRepository) Search(orgID uuid.UUID, q string, offset, limit int) ([]models.User, int64, error) {
+	query := r.db.Model(&models.User{}).Where("org_id = ?", orgID)
+	if q != "" {
+		pattern := containsPattern(strings.ToLower(q))
+		query = query.Where(`(LOWER(username) LIKE ? ESCAPE '\' OR LOWER(display_name) LIKE ? ESCAPE '\' OR LOWER(email) LIKE ? ESCAPE '\')`,
+			pattern, pattern, pattern)
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var users []models.User
+	err := query.Order("username").Order("id").Offset(offset).Limit(limit).Find(&users).Error
+	return users, total, err
+}
+
+// Save creates or updates a user; a soft-deleted user is restored when DeletedAt is cleared
+func (r *UserRepository) Save(user *models.User) error {
+	return r.db.Unscoped().Save(user).Error
+}
+
+// Delete soft-deletes a user
+func (r *UserRepository) Delete(id uuid.UUID) error {
+	return r.db.Delete(&models.User{}, "id = ?", id).Error
+}
+
+// ReplaceOrgMemberships replaces the group memberships of every user in an organization
+func (r *UserRepository) ReplaceOrgMemberships(orgID uuid.UUID, memberships []models.UserGroup) error {
+	err := r.db.Where("user_id IN (?)", r.db.Model(&models.User{}).Unscoped().Select("id").Where("org_id = ?", orgID)).
+		Delete(&models.UserGroup{}).Error
+	if err != nil {
+		return err
+	}
+	if len(memberships) == 0 {
+		return nil
+	}
+	return r.db.CreateInBatches(memberships, 500).Error
+}
+
+// ListGroupIDs lists the groups a user is a member of
+func (r *UserRepository) ListGroupIDs(userID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := r.db.Model(&models.UserGroup{}).Where("user_id = ?", userID).Pluck("group_id", &ids).Error
+	return ids, err
+}
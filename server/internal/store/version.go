@@ -0,0 +1,42 @@
+package store
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrVersionConflict is returned by versioned writes when the row was changed or deleted
+// since the version the caller holds was read
+var ErrVersionConflict = errors.New("row was modified concurrently")
+
+// bumpVersion is the update expression that advances a row's version
+var bumpVersion = gorm.Expr("version + 1")
+
+// updateVersioned writes every column of model, which holds the row as read at *version,
+// and advances the version in the row and in *version. Associations and the omit columns
+// are not saved. On ErrVersionConflict nothing is written and *version is left as it was.
+func updateVersioned(db *gorm.DB, model interface{}, version *int64, omit ...string) error {
+	expected := *version
+	*version = expected + 1
+	res := db.Model(model).Where("version = ?", expected).
+		Select("*").Omit(append([]string{"id", "created_at", clause.Associations}, omit...)...).
+		Updates(model)
+	if res.Error == nil && res.RowsAffected == 0 {
+		res.Error = ErrVersionConflict
+	}
+	if res.Error != nil {
+		*version = expected
+	}
+	return res.Error
+}
+
+// deleteVersioned soft-deletes the row of model with id if it is still at version
+func deleteVersioned(db *gorm.DB, model interface{}, id interface{}, version int64) error {
+	res := db.Where("id = ? AND version = ?", id, version).Delete(model)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrVersionConflict
+	}
+	return res.Error
+}
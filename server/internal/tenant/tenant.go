@@ -0,0 +1,51 @@
+// Package tenant carries the organization a request is scoped to. The store reads it from
+// the context of every query and limits organization-owned tables to that organization;
+// queries on those tables from a context with neither a scope nor Bypass are refused.
+package tenant
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+type contextKey struct{}
+
+// scope is what a context says about tenancy: one organization, or every organization
+type scope struct {
+	orgID  uuid.UUID
+	bypass bool
+}
+
+// WithOrg scopes ctx to one organization
+func WithOrg(ctx context.Context, orgID uuid.UUID) context.Context {
+	return context.WithValue(ctx, contextKey{}, scope{orgID: orgID})
+}
+
+// Bypass lets ctx see every organization. Use it for super users and for internal work
+// that legitimately crosses organizations, such as claiming a factory device.
+func Bypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKey{}, scope{bypass: true})
+}
+
+// OrgID returns the organization ctx is scoped to. ok is false when ctx bypasses tenancy
+// or carries no scope at all.
+func OrgID(ctx context.Context) (orgID uuid.UUID, ok bool) {
+	if ctx == nil {
+		return uuid.Nil, false
+	}
+	s, found := ctx.Value(contextKey{}).(scope)
+	if !found || s.bypass {
+		return uuid.Nil, false
+	}
+	return s.orgID, true
+}
+
+// Bypassed reports whether ctx was made with Bypass
+func Bypassed(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	s, found := ctx.Value(contextKey{}).(scope)
+	return found && s.bypass
+}
@@ -78,7 +78,7 @@ func (h *Handler) HandleWebSocket(c *gin.Context) {
 	}
 
 	// Check if device exists and user has access
-	device, err := h.deviceService.GetDeviceByID(normalizedDeviceID, deviceBy)
+	device, err := h.deviceService.WithContext(c.Request.Context()).GetDeviceByID(normalizedDeviceID, deviceBy)
 	if err != nil {
 		if err == services.ErrDeviceNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
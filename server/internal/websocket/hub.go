@@ -162,6 +162,41 @@ func (h *Hub) GetUserConnections(userID string) []*Connection {
 	return connections
 }
 
+// CloseDeviceConnections closes every connection attached to one of the given device keys
+// (normalized MAC or IMEI) and returns how many were closed
+func (h *Hub) CloseDeviceConnections(reason string, deviceKeys ...string) int {
+	keys := make(map[string]struct{}, len(deviceKeys))
+	for _, k := range deviceKeys {
+		if k != "" {
+			keys[k] = struct{}{}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	closed := 0
+	for userID, userConns := range h.connections {
+		for connID, conn := range userConns {
+			if _, ok := keys[conn.DeviceID]; !ok {
+				continue
+			}
+			delete(userConns, connID)
+			_ = conn.SendError(reason, "DEVICE_REMOVED", "")
+			conn.Close()
+			closed++
+			h.logger.Info("Closed device connection",
+				zap.String("user_id", userID),
+				zap.String("connection_id", connID),
+				zap.String("device_id", conn.DeviceID))
+		}
+		if len(userConns) == 0 {
+			delete(h.connections, userID)
+		}
+	}
+	return closed
+}
+
 // GetStats returns current hub statistics
 func (h *Hub) GetStats() map[string]interface{} {
 	h.mu.RLock()
@@ -3,6 +3,7 @@ package errors
 import (
 	"fmt"
 	"net/http"
+	"time"
 )
 
 // AppError represents an application error
@@ -26,6 +27,8 @@ const (
 	ErrCodeForbidden    = "FORBIDDEN"
 	ErrCodeConflict     = "CONFLICT"
 	ErrCodeBadRequest   = "BAD_REQUEST"
+	ErrCodePrecondition = "PRECONDITION_FAILED"
+	ErrCodeRateLimited  = "RATE_LIMIT_EXCEEDED"
 )
 
 // Helper functions for common errors
@@ -85,3 +88,20 @@ func NewBadRequestError(message string) *AppError {
 		HTTPStatus: http.StatusBadRequest,
 	}
 }
+
+func NewPreconditionFailedError(message string) *AppError {
+	return &AppError{
+		Code:       ErrCodePrecondition,
+		Message:    message,
+		HTTPStatus: http.StatusPreconditionFailed,
+	}
+}
+
+func NewTooManyRequestsError(message string, retryAfter time.Duration) *AppError {
+	return &AppError{
+		Code:       ErrCodeRateLimited,
+		Message:    message,
+		Details:    map[string]interface{}{"retry_after": retryAfter.Round(time.Second).String()},
+		HTTPStatus: http.StatusTooManyRequests,
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"server/internal/casbinx"
 	"server/internal/domain/models"
 	"server/internal/domain/services"
 
@@ -31,6 +32,8 @@ func setupTestApp(t *testing.T) (*gin.Engine, *services.OrganizationService, *se
 		&models.Organization{},
 		&models.User{},
 		&models.Group{},
+		&models.UserGroup{},
+		&models.DirectorySyncRun{},
 		&models.Project{},
 		&models.Partition{},
 		&models.Device{},
@@ -39,11 +42,14 @@ func setupTestApp(t *testing.T) (*gin.Engine, *services.OrganizationService, *se
 		&models.DeviceTransfer{},
 		&models.CasbinRule{},
 		&models.AuditLog{},
+		&models.AuditPurgeRun{},
 	)
 	require.NoError(t, err)
 
 	// Create services
-	orgService := services.NewOrganizationService(db)
+	enforcer, err := casbinx.New(db)
+	require.NoError(t, err)
+	orgService := services.NewOrganizationService(db, enforcer)
 	deviceService := services.NewDeviceService(db)
 
 	// Create router